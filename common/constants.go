@@ -33,6 +33,10 @@ var DefaultCollapseSidebar = false // default value of collapse sidebar
 var SessionSecret = uuid.New().String()
 var CryptoSecret = uuid.New().String()
 
+// TokenHashSecret 计算令牌哈希的密钥，修改后已有的令牌全部失效。
+// 未设置 TOKEN_HASH_SECRET 时启动阶段从数据库读取，没有则随机生成并保存
+var TokenHashSecret string
+
 var OptionMap map[string]string
 var OptionMapRWMutex sync.RWMutex
 
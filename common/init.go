@@ -15,13 +15,16 @@ var (
 	PrintVersion = flag.Bool("version", false, "print version and exit")
 	PrintHelp    = flag.Bool("help", false, "print help and exit")
 	LogDir       = flag.String("log-dir", "./logs", "specify the log directory")
+
+	RotateMasterKey = flag.Bool("rotate-master-key", false, "re-encrypt stored secrets with ENCRYPTION_MASTER_KEY and exit")
+	DecryptSecrets  = flag.Bool("decrypt-secrets", false, "decrypt stored secrets to plaintext when ENCRYPTION_MASTER_KEY is not set and exit")
 )
 
 func printHelp() {
 	fmt.Println("New API " + Version + " - All in one API service for OpenAI API.")
 	fmt.Println("Copyright (C) 2023 JustSong. All rights reserved.")
 	fmt.Println("GitHub: https://github.com/songquanpeng/veloera")
-	fmt.Println("Usage: veloera [--port <port>] [--log-dir <log directory>] [--version] [--help]")
+	fmt.Println("Usage: veloera [--port <port>] [--log-dir <log directory>] [--rotate-master-key] [--decrypt-secrets] [--version] [--help]")
 }
 
 func LoadEnv() {
@@ -52,6 +55,9 @@ func LoadEnv() {
 	} else {
 		CryptoSecret = SessionSecret
 	}
+	if os.Getenv("TOKEN_HASH_SECRET") != "" {
+		TokenHashSecret = os.Getenv("TOKEN_HASH_SECRET")
+	}
 	if os.Getenv("SQLITE_PATH") != "" {
 		SQLitePath = os.Getenv("SQLITE_PATH")
 	}
@@ -0,0 +1,153 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// 数据库中的渠道 key、OAuth 密钥等敏感字段使用信封加密保存：每个值使用随机的数据密钥以 AES-GCM 加密，
+// 数据密钥再由主密钥加密，与密文一起保存为 enc:v1:{主密钥 id}:{加密的数据密钥}:{密文}。
+// 未配置主密钥时按明文保存，读取时明文和密文都可以识别
+const encryptedSecretPrefix = "enc:v1:"
+
+var (
+	currentMasterKeyId string
+	masterKeys         = make(map[string][]byte) // 主密钥 id -> 主密钥，包含轮换前的旧主密钥
+)
+
+// parseMasterKey 主密钥可以是 base64 编码的 32 字节，其他字符串使用 SHA-256 派生
+func parseMasterKey(value string) []byte {
+	if decoded, err := base64.StdEncoding.DecodeString(value); err == nil && len(decoded) == 32 {
+		return decoded
+	}
+	key := sha256.Sum256([]byte(value))
+	return key[:]
+}
+
+func masterKeyIdOf(key []byte) string {
+	sum := sha256.Sum256(append([]byte("veloera-master-key:"), key...))
+	return hex.EncodeToString(sum[:4])
+}
+
+// readSecretEnv 读取环境变量，未设置时读取 {name}_FILE 指向的文件
+func readSecretEnv(name string) (string, error) {
+	if value := os.Getenv(name); value != "" {
+		return strings.TrimSpace(value), nil
+	}
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s_FILE: %s", name, err.Error())
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", nil
+}
+
+// InitMasterKey 从 ENCRYPTION_MASTER_KEY 读取主密钥，ENCRYPTION_PREVIOUS_MASTER_KEYS 为逗号分隔的旧主密钥，只用于解密。
+// 两者都可以改为通过 _FILE 后缀的环境变量从文件读取
+func InitMasterKey() error {
+	current, err := readSecretEnv("ENCRYPTION_MASTER_KEY")
+	if err != nil {
+		return err
+	}
+	previous, err := readSecretEnv("ENCRYPTION_PREVIOUS_MASTER_KEYS")
+	if err != nil {
+		return err
+	}
+	currentMasterKeyId = ""
+	masterKeys = make(map[string][]byte)
+	for _, value := range strings.Split(previous, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			key := parseMasterKey(value)
+			masterKeys[masterKeyIdOf(key)] = key
+		}
+	}
+	if current != "" {
+		key := parseMasterKey(current)
+		currentMasterKeyId = masterKeyIdOf(key)
+		masterKeys[currentMasterKeyId] = key
+		SysLog("secret encryption enabled with master key " + currentMasterKeyId)
+	}
+	return nil
+}
+
+// SecretEncryptionEnabled 是否配置了主密钥
+func SecretEncryptionEnabled() bool {
+	return currentMasterKeyId != ""
+}
+
+func IsEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, encryptedSecretPrefix)
+}
+
+// IsSecretUpToDate 配置了主密钥时值应为当前主密钥加密的密文，未配置时应为明文
+func IsSecretUpToDate(value string) bool {
+	if value == "" {
+		return true
+	}
+	if !SecretEncryptionEnabled() {
+		return !IsEncryptedSecret(value)
+	}
+	return strings.HasPrefix(value, encryptedSecretPrefix+currentMasterKeyId+":")
+}
+
+// EncryptSecret 使用当前主密钥加密，未配置主密钥或值已经是密文时原样返回
+func EncryptSecret(plaintext string) (string, error) {
+	if plaintext == "" || !SecretEncryptionEnabled() || IsEncryptedSecret(plaintext) {
+		return plaintext, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	ciphertext, err := sealAESGCM(dataKey, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := sealAESGCM(masterKeys[currentMasterKeyId], dataKey)
+	if err != nil {
+		return "", err
+	}
+	return encryptedSecretPrefix + currentMasterKeyId + ":" +
+		base64.StdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// DecryptSecret 解密 EncryptSecret 的结果，明文原样返回
+func DecryptSecret(value string) (string, error) {
+	if !IsEncryptedSecret(value) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedSecretPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("invalid encrypted secret")
+	}
+	masterKey, ok := masterKeys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("master key %s not found, please check ENCRYPTION_MASTER_KEY and ENCRYPTION_PREVIOUS_MASTER_KEYS", parts[0])
+	}
+	wrappedKey, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := openAESGCM(masterKey, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt data key: %s", err.Error())
+	}
+	plaintext, err := openAESGCM(dataKey, ciphertext)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt secret: %s", err.Error())
+	}
+	return string(plaintext), nil
+}
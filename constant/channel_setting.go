@@ -4,4 +4,9 @@ var (
 	ForceFormat                     = "force_format"        // ForceFormat 强制格式化为OpenAI格式
 	ChanelSettingProxy              = "proxy"               // Proxy 代理
 	ChannelSettingThinkingToContent = "thinking_to_content" // ThinkingToContent
+	ChannelSettingMaxConcurrency    = "max_concurrency"     // MaxConcurrency 渠道最大并发请求数
+	ChannelSettingKeyMaxConcurrency = "key_max_concurrency" // KeyMaxConcurrency 渠道中每个 key 的最大并发请求数
+	ChannelSettingTestCases         = "test_cases"          // TestCases 渠道测试使用的自定义提示词和期望的回复内容
+	ChannelSettingModelDiscovery    = "model_discovery"     // ModelDiscovery 上游新增和下线模型的处理策略
+	ChannelSettingUpstreamCost      = "upstream_cost"       // UpstreamCost 渠道的上游成本倍率和按模型设置的上游价格
 )
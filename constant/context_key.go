@@ -7,4 +7,46 @@ const (
 	ContextKeyUserStatus       = "user_status"
 	ContextKeyUserEmail        = "user_email"
 	ContextKeyUserGroup        = "user_group"
+
+	// ContextKeyResponsesResponse holds the final *dto.OpenAIResponsesResponse relayed from the upstream
+	ContextKeyResponsesResponse = "responses_response"
+
+	// ContextKeyBatchUsage holds the *model.BatchUsage of a request executed by a batch,
+	// the request is billed with the batch discount and its consume log is aggregated into the batch
+	ContextKeyBatchUsage = "batch_usage"
+
+	// ContextKeyUpstreamCost holds the upstream cost already added up for a consume log that is not tied to
+	// a single channel, such as the summary log of a batch
+	ContextKeyUpstreamCost = "upstream_cost"
+
+	// ContextKeyVirtualModel holds the name of the requested virtual model, the request is served and
+	// billed by one of the models in its fallback chain
+	ContextKeyVirtualModel = "virtual_model"
+
+	// ContextKeyRelayInfo holds the *relaycommon.RelayInfo of the current relay attempt,
+	// its FirstResponseTime is used to track the time to first token of the channel
+	ContextKeyRelayInfo = "relay_info"
+
+	// ContextKeyChannelKeyHash holds the HMAC of the key selected from a multi-key channel,
+	// errors of the request are recorded against that key instead of the whole channel
+	ContextKeyChannelKeyHash = "channel_key_hash"
+
+	// ContextKeyPromptCacheAffinity holds the hash of the request prefix or session, a successful request
+	// binds the hash to its channel and key so that later requests with the same prefix hit the upstream prompt cache
+	ContextKeyPromptCacheAffinity = "prompt_cache_affinity"
+
+	// ContextKeyPromptCacheAffinityRouted is true when the channel was selected from the prompt cache affinity binding
+	ContextKeyPromptCacheAffinityRouted = "prompt_cache_affinity_routed"
+
+	// ContextKeyHedgeAttempt holds the *model.HedgeAttempt of a hedged relay attempt, the consumption of
+	// the losing attempt is refunded to the user and recorded as hedge cost for admins
+	ContextKeyHedgeAttempt = "hedge_attempt"
+
+	// ContextKeyStreamContinuation holds the *relaycommon.StreamContinuation of a stream that broke mid-way
+	// and is continued on another channel
+	ContextKeyStreamContinuation = "stream_continuation"
+
+	// ContextKeyExperiment holds the *model.ExperimentAssignment of a request assigned to a variant of an A/B
+	// experiment, the consumption of the request is accumulated into it
+	ContextKeyExperiment = "experiment"
 )
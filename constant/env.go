@@ -16,6 +16,8 @@ var GeminiVisionMaxImageNum int
 var NotifyLimitCount int
 var NotificationLimitDurationMinute int
 var GenerateDefaultToken bool
+var FileStorageDir string
+var FileStorageShared bool
 
 //var GeminiModelMap = map[string]string{
 //	"gemini-1.0-pro": "v1",
@@ -36,6 +38,10 @@ func InitEnv() {
 	NotificationLimitDurationMinute = common.GetEnvOrDefault("NOTIFICATION_LIMIT_DURATION_MINUTE", 10)
 	// GenerateDefaultToken 是否生成初始令牌，默认关闭。
 	GenerateDefaultToken = common.GetEnvOrDefaultBool("GENERATE_DEFAULT_TOKEN", false)
+	// FileStorageDir /v1/files 上传文件和批处理结果的保存目录
+	FileStorageDir = common.GetEnvOrDefaultString("FILE_STORAGE_DIR", "./data/files")
+	// FileStorageShared FILE_STORAGE_DIR 是否为所有节点共享的存储，未共享时文件接口只能由主节点处理，因为批处理只在主节点执行
+	FileStorageShared = common.GetEnvOrDefaultBool("FILE_STORAGE_SHARED", false)
 
 	//modelVersionMapStr := strings.TrimSpace(os.Getenv("GEMINI_MODEL_MAP"))
 	//if modelVersionMapStr == "" {
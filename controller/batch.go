@@ -0,0 +1,244 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/model"
+	"veloera/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// batchEndpoints 批处理支持的接口
+var batchEndpoints = map[string]bool{
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/embeddings":       true,
+	"/v1/responses":        true,
+}
+
+const batchCompletionWindow = 24 * time.Hour
+
+func batchError(c *gin.Context, statusCode int, param string, message string) {
+	c.JSON(statusCode, gin.H{
+		"error": dto.OpenAIError{
+			Message: message,
+			Type:    "invalid_request_error",
+			Param:   param,
+		},
+	})
+}
+
+func batchStoreError(c *gin.Context, err error) {
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": dto.OpenAIError{
+			Message: err.Error(),
+			Type:    "veloera_error",
+			Code:    "batch_store_error",
+		},
+	})
+}
+
+func batchNotFound(c *gin.Context, batchId string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": dto.OpenAIError{
+			Message: fmt.Sprintf("No batch found with id '%s'.", batchId),
+			Type:    "invalid_request_error",
+			Param:   "batch_id",
+		},
+	})
+}
+
+func optionalTimestamp(timestamp int64) *int64 {
+	if timestamp == 0 {
+		return nil
+	}
+	return &timestamp
+}
+
+func batch2Response(batch *model.Batch) *dto.BatchResponse {
+	response := &dto.BatchResponse{
+		Id:               batch.BatchId,
+		Object:           "batch",
+		Endpoint:         batch.Endpoint,
+		InputFileId:      batch.InputFileId,
+		CompletionWindow: batch.CompletionWindow,
+		Status:           batch.Status,
+		CreatedAt:        batch.CreatedAt,
+		InProgressAt:     optionalTimestamp(batch.InProgressAt),
+		ExpiresAt:        optionalTimestamp(batch.ExpiresAt),
+		FinalizingAt:     optionalTimestamp(batch.FinalizingAt),
+		CompletedAt:      optionalTimestamp(batch.CompletedAt),
+		FailedAt:         optionalTimestamp(batch.FailedAt),
+		ExpiredAt:        optionalTimestamp(batch.ExpiredAt),
+		CancellingAt:     optionalTimestamp(batch.CancellingAt),
+		CancelledAt:      optionalTimestamp(batch.CancelledAt),
+		RequestCounts: dto.BatchRequestCounts{
+			Total:     batch.Total,
+			Completed: batch.Completed,
+			Failed:    batch.Failed,
+		},
+		Metadata: batch.Metadata,
+	}
+	if len(response.Metadata) == 0 {
+		response.Metadata = json.RawMessage("null")
+	}
+	if len(batch.Errors) > 0 {
+		var errors dto.BatchErrors
+		if err := json.Unmarshal(batch.Errors, &errors); err == nil {
+			response.Errors = &errors
+		}
+	}
+	// 结果文件在批处理结束后才可用
+	if batch.IsFinished() {
+		if batch.OutputFileId != "" {
+			response.OutputFileId = &batch.OutputFileId
+		}
+		if batch.ErrorFileId != "" {
+			response.ErrorFileId = &batch.ErrorFileId
+		}
+	}
+	return response
+}
+
+// getUserBatch returns the batch of the current user, or writes the error response and returns nil
+func getUserBatch(c *gin.Context) *model.Batch {
+	batchId := c.Param("id")
+	batch, err := model.GetUserBatch(c.GetInt("id"), batchId)
+	if exist, err := model.RecordExist(err); !exist {
+		if err != nil {
+			batchStoreError(c, err)
+		} else {
+			batchNotFound(c, batchId)
+		}
+		return nil
+	}
+	return batch
+}
+
+// CreateBatch POST /v1/batches
+func CreateBatch(c *gin.Context) {
+	if !operation_setting.GetBatchSetting().Enabled {
+		RelayNotImplemented(c)
+		return
+	}
+	allowIpsMap := c.GetStringMap("allow_ips")
+	if len(allowIpsMap) != 0 {
+		if _, ok := allowIpsMap[c.ClientIP()]; !ok {
+			batchError(c, http.StatusForbidden, "", "您的 IP 不在令牌允许访问的列表中")
+			return
+		}
+	}
+	var request dto.BatchRequest
+	if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+		batchError(c, http.StatusBadRequest, "", "Invalid request, "+err.Error())
+		return
+	}
+	if !batchEndpoints[request.Endpoint] {
+		batchError(c, http.StatusBadRequest, "endpoint", fmt.Sprintf("Invalid value for 'endpoint': '%s'.", request.Endpoint))
+		return
+	}
+	if request.CompletionWindow != "24h" {
+		batchError(c, http.StatusBadRequest, "completion_window", fmt.Sprintf("Invalid value for 'completion_window': '%s'. Supported values are: '24h'.", request.CompletionWindow))
+		return
+	}
+	userId := c.GetInt("id")
+	inputFile, err := model.GetUserFile(userId, request.InputFileId)
+	if exist, err := model.RecordExist(err); !exist {
+		if err != nil {
+			fileStoreError(c, err)
+		} else {
+			batchError(c, http.StatusBadRequest, "input_file_id", fmt.Sprintf("No such File object: %s", request.InputFileId))
+		}
+		return
+	}
+	if inputFile.Purpose != model.FilePurposeBatch {
+		batchError(c, http.StatusBadRequest, "input_file_id", "The input file must be uploaded with purpose 'batch'.")
+		return
+	}
+
+	now := time.Now()
+	batch := &model.Batch{
+		BatchId:          fmt.Sprintf("batch_%s", common.GetUUID()),
+		UserId:           userId,
+		TokenId:          c.GetInt("token_id"),
+		Endpoint:         request.Endpoint,
+		InputFileId:      request.InputFileId,
+		CompletionWindow: request.CompletionWindow,
+		Status:           model.BatchStatusValidating,
+		Metadata:         request.Metadata,
+		CreatedAt:        now.Unix(),
+		ExpiresAt:        now.Add(batchCompletionWindow).Unix(),
+	}
+	if err := batch.Insert(); err != nil {
+		batchStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, batch2Response(batch))
+}
+
+// GetBatch GET /v1/batches/{id}
+func GetBatch(c *gin.Context) {
+	batch := getUserBatch(c)
+	if batch == nil {
+		return
+	}
+	c.JSON(http.StatusOK, batch2Response(batch))
+}
+
+// ListBatches GET /v1/batches
+func ListBatches(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	batches, err := model.GetUserBatches(c.GetInt("id"), c.Query("after"), limit+1)
+	if exist, err := model.RecordExist(err); !exist && err != nil {
+		batchStoreError(c, err)
+		return
+	}
+	hasMore := len(batches) > limit
+	if hasMore {
+		batches = batches[:limit]
+	}
+	data := make([]*dto.BatchResponse, 0, len(batches))
+	for _, batch := range batches {
+		data = append(data, batch2Response(batch))
+	}
+	response := gin.H{
+		"object":   "list",
+		"data":     data,
+		"first_id": nil,
+		"last_id":  nil,
+		"has_more": hasMore,
+	}
+	if len(data) > 0 {
+		response["first_id"] = data[0].Id
+		response["last_id"] = data[len(data)-1].Id
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// CancelBatch POST /v1/batches/{id}/cancel
+func CancelBatch(c *gin.Context) {
+	batchId := c.Param("id")
+	batch, err := model.CancelUserBatch(c.GetInt("id"), batchId)
+	if exist, err := model.RecordExist(err); !exist {
+		if err != nil {
+			batchStoreError(c, err)
+		} else {
+			batchNotFound(c, batchId)
+		}
+		return
+	}
+	if batch.IsFinished() && batch.Status != model.BatchStatusCancelled {
+		batchError(c, http.StatusConflict, "", fmt.Sprintf("Cannot cancel a batch with status '%s'.", batch.Status))
+		return
+	}
+	c.JSON(http.StatusOK, batch2Response(batch))
+}
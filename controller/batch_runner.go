@@ -0,0 +1,596 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime/debug"
+	"sync"
+	"time"
+	"veloera/common"
+	"veloera/constant"
+	"veloera/dto"
+	"veloera/middleware"
+	"veloera/model"
+	"veloera/service"
+	"veloera/setting/operation_setting"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/gin-gonic/gin"
+)
+
+// maxBatchValidationErrors 输入文件校验最多返回的错误数
+const maxBatchValidationErrors = 100
+
+var runningBatches sync.Map
+
+// RunBatchScheduler 定期调度未结束的批处理，只在主节点运行
+func RunBatchScheduler() {
+	for {
+		batches, err := model.GetUnfinishedBatches()
+		if err != nil {
+			common.SysError("failed to get unfinished batches: " + err.Error())
+		}
+		for _, batch := range batches {
+			if _, running := runningBatches.LoadOrStore(batch.Id, true); running {
+				continue
+			}
+			batch := batch
+			gopool.Go(func() {
+				defer runningBatches.Delete(batch.Id)
+				runBatch(batch)
+			})
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func runBatch(batch *model.Batch) {
+	defer func() {
+		if r := recover(); r != nil {
+			common.SysError(fmt.Sprintf("batch %s panic: %v", batch.BatchId, r))
+		}
+	}()
+	var err error
+	switch batch.Status {
+	case model.BatchStatusValidating:
+		var ok bool
+		ok, err = validateBatch(batch)
+		if err == nil && ok {
+			err = executeBatch(batch)
+		}
+	case model.BatchStatusInProgress:
+		err = executeBatch(batch)
+	case model.BatchStatusCancelling:
+		err = finalizeBatch(batch, model.BatchStatusCancelled)
+	case model.BatchStatusFinalizing:
+		// 结束过程中被中断
+		finalStatus := model.BatchStatusCompleted
+		if batch.CancellingAt != 0 {
+			finalStatus = model.BatchStatusCancelled
+		} else if batch.Completed+batch.Failed < batch.Total {
+			finalStatus = model.BatchStatusExpired
+		}
+		err = finalizeBatch(batch, finalStatus)
+	}
+	if err != nil {
+		common.SysError(fmt.Sprintf("batch %s error: %s", batch.BatchId, err.Error()))
+	}
+}
+
+// readBatchLines 逐行读取输入文件，跳过空行，lineNo 为文件中的行号
+func readBatchLines(fileId string, handle func(lineNo int, line []byte) bool) error {
+	file, err := service.OpenFileContent(fileId)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for lineNo := 1; ; lineNo++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if line = bytes.TrimSpace(line); len(line) > 0 {
+			if !handle(lineNo, line) {
+				return nil
+			}
+		}
+		if err != nil {
+			return nil
+		}
+	}
+}
+
+// validateBatch 校验输入文件，校验通过后批处理进入 in_progress
+func validateBatch(batch *model.Batch) (bool, error) {
+	var validationErrors []dto.BatchError
+	addError := func(lineNo int, code string, message string) {
+		if len(validationErrors) < maxBatchValidationErrors {
+			line := lineNo
+			validationErrors = append(validationErrors, dto.BatchError{Code: code, Message: message, Line: &line})
+		}
+	}
+	customIds := make(map[string]bool)
+	total := 0
+	modelName := ""
+	err := readBatchLines(batch.InputFileId, func(lineNo int, line []byte) bool {
+		total++
+		var input dto.BatchRequestInput
+		if err := json.Unmarshal(line, &input); err != nil {
+			addError(lineNo, "invalid_json_line", "This line is not parseable as valid JSON.")
+			return true
+		}
+		if input.CustomId == "" {
+			addError(lineNo, "missing_required_parameter", "The 'custom_id' parameter is required.")
+		} else if customIds[input.CustomId] {
+			addError(lineNo, "duplicate_custom_id", fmt.Sprintf("The custom_id '%s' is duplicated.", input.CustomId))
+		}
+		customIds[input.CustomId] = true
+		if input.Method != http.MethodPost {
+			addError(lineNo, "invalid_value", "Only the POST method is supported.")
+		}
+		if input.Url != batch.Endpoint {
+			addError(lineNo, "mismatched_endpoint", fmt.Sprintf("The provided url '%s' does not match the batch endpoint '%s'.", input.Url, batch.Endpoint))
+		}
+		var body struct {
+			Model  string `json:"model"`
+			Stream bool   `json:"stream"`
+		}
+		if err := json.Unmarshal(input.Body, &body); err != nil {
+			addError(lineNo, "invalid_request", "The 'body' parameter must be a JSON object.")
+			return true
+		}
+		if body.Stream {
+			addError(lineNo, "invalid_value", "Streaming is not supported in batch requests.")
+		}
+		if body.Model == "" {
+			addError(lineNo, "missing_required_parameter", "The 'model' parameter is required.")
+		} else if modelName == "" {
+			modelName = body.Model
+		} else if body.Model != modelName {
+			addError(lineNo, "mismatched_model", "All requests in a batch must use the same model.")
+		}
+		return true
+	})
+	if err != nil {
+		validationErrors = append(validationErrors, dto.BatchError{Code: "invalid_file", Message: err.Error()})
+	} else if total == 0 {
+		validationErrors = append(validationErrors, dto.BatchError{Code: "empty_file", Message: "The input file is empty."})
+	} else if maxRequests := operation_setting.GetBatchSetting().MaxRequests; maxRequests > 0 && total > maxRequests {
+		validationErrors = append(validationErrors, dto.BatchError{Code: "too_many_requests", Message: fmt.Sprintf("The input file contains %d requests, the maximum is %d.", total, maxRequests)})
+	}
+
+	now := common.GetTimestamp()
+	if len(validationErrors) > 0 {
+		errorsData, _ := json.Marshal(dto.BatchErrors{Object: "list", Data: validationErrors})
+		_, err := model.UpdateBatchIfStatus(batch.Id, []string{model.BatchStatusValidating}, map[string]any{
+			"status":    model.BatchStatusFailed,
+			"failed_at": now,
+			"errors":    json.RawMessage(errorsData),
+		})
+		return false, err
+	}
+	fields := map[string]any{
+		"status":         model.BatchStatusInProgress,
+		"in_progress_at": now,
+		"total":          total,
+		"model":          modelName,
+		"output_file_id": service.NewFileId(),
+		"error_file_id":  service.NewFileId(),
+	}
+	ok, err := model.UpdateBatchIfStatus(batch.Id, []string{model.BatchStatusValidating}, fields)
+	if err != nil || !ok {
+		// 校验期间被取消，下一轮调度处理
+		return false, err
+	}
+	batch.Status = model.BatchStatusInProgress
+	batch.InProgressAt = now
+	batch.Total = total
+	batch.Model = modelName
+	batch.OutputFileId = fields["output_file_id"].(string)
+	batch.ErrorFileId = fields["error_file_id"].(string)
+	return true, nil
+}
+
+type batchLine struct {
+	lineNo int
+	input  dto.BatchRequestInput
+}
+
+type batchResult struct {
+	output  *dto.BatchRequestOutput
+	success bool
+}
+
+// executeBatch 分组并发执行输入文件中尚未执行的请求。每组执行前记录已开始执行的请求数，执行完后将结果写入磁盘并与文件大小一起保存进度，
+// 中断后继续执行时丢弃未保存进度的结果，已开始执行但未保存进度的请求按失败处理而不重新执行，避免重复扣费和重复的结果
+func executeBatch(batch *model.Batch) error {
+	// 升级前开始执行的批处理没有记录文件大小
+	if batch.Dispatched > 0 {
+		if err := service.TruncateFileContent(batch.OutputFileId, batch.OutputBytes); err != nil {
+			return err
+		}
+		if err := service.TruncateFileContent(batch.ErrorFileId, batch.ErrorBytes); err != nil {
+			return err
+		}
+	}
+	outputFile, err := service.AppendFileContent(batch.OutputFileId)
+	if err != nil {
+		return err
+	}
+	defer outputFile.Close()
+	errorFile, err := service.AppendFileContent(batch.ErrorFileId)
+	if err != nil {
+		return err
+	}
+	defer errorFile.Close()
+
+	if interrupted := batch.Dispatched - batch.Completed - batch.Failed; interrupted > 0 {
+		err := failBatchLines(batch, outputFile, errorFile, interrupted, &dto.BatchLineError{
+			Code:    "batch_interrupted",
+			Message: "The batch was interrupted while this request was in progress, the request may have been executed but its result was lost.",
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	token, err := model.GetTokenById(batch.TokenId)
+	if err != nil {
+		token = nil
+	}
+	concurrency := operation_setting.GetBatchSetting().Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	finalStatus := model.BatchStatusCompleted
+	processed := batch.Completed + batch.Failed
+	skipped := 0
+	chunk := make([]batchLine, 0, concurrency)
+	var runErr error
+	runChunk := func() bool {
+		if runErr = model.SetBatchDispatched(batch.Id, batch.Completed+batch.Failed+len(chunk)); runErr != nil {
+			return false
+		}
+		usage := &model.BatchUsage{}
+		results := make([]batchResult, len(chunk))
+		var wg sync.WaitGroup
+		for i := range chunk {
+			wg.Add(1)
+			i := i
+			gopool.Go(func() {
+				defer wg.Done()
+				results[i] = executeBatchRequest(batch, token, chunk[i].input, usage)
+			})
+		}
+		wg.Wait()
+		chunk = chunk[:0]
+
+		completed, failed := 0, 0
+		for _, result := range results {
+			target := outputFile
+			if result.success {
+				completed++
+			} else {
+				failed++
+				target = errorFile
+			}
+			if runErr = writeBatchOutput(target, result.output); runErr != nil {
+				return false
+			}
+		}
+		if runErr = saveBatchProgress(batch, outputFile, errorFile, completed, failed, usage); runErr != nil {
+			return false
+		}
+		if batch.Status == model.BatchStatusCancelling {
+			finalStatus = model.BatchStatusCancelled
+			return false
+		}
+		if common.GetTimestamp() > batch.ExpiresAt {
+			finalStatus = model.BatchStatusExpired
+			return false
+		}
+		return true
+	}
+
+	err = readBatchLines(batch.InputFileId, func(lineNo int, line []byte) bool {
+		if skipped < processed {
+			skipped++
+			return true
+		}
+		var input dto.BatchRequestInput
+		_ = json.Unmarshal(line, &input)
+		chunk = append(chunk, batchLine{lineNo: lineNo, input: input})
+		if len(chunk) < concurrency {
+			return true
+		}
+		return runChunk()
+	})
+	if err != nil {
+		return err
+	}
+	if runErr != nil {
+		return runErr
+	}
+	if len(chunk) > 0 && finalStatus == model.BatchStatusCompleted {
+		runChunk()
+		if runErr != nil {
+			return runErr
+		}
+	}
+	if finalStatus == model.BatchStatusExpired {
+		err := failBatchLines(batch, outputFile, errorFile, batch.Total-batch.Completed-batch.Failed, &dto.BatchLineError{
+			Code:    "batch_expired",
+			Message: "This request could not be executed before the completion window expired.",
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return finalizeBatch(batch, finalStatus)
+}
+
+// saveBatchProgress 将结果写入磁盘后与结果文件的大小一起保存进度，并重新读取批处理以获取取消状态
+func saveBatchProgress(batch *model.Batch, outputFile *os.File, errorFile *os.File, completed int, failed int, usage *model.BatchUsage) error {
+	sizes := make([]int64, 2)
+	for i, file := range []*os.File{outputFile, errorFile} {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		sizes[i] = info.Size()
+	}
+	if err := model.IncreaseBatchProgress(batch.Id, completed, failed, sizes[0], sizes[1], usage); err != nil {
+		return err
+	}
+	latest, err := model.GetBatchById(batch.Id)
+	if err != nil {
+		return err
+	}
+	*batch = *latest
+	return nil
+}
+
+// failBatchLines 不执行接下来的 count 个请求，将 lineError 作为这些请求的结果写入错误文件
+func failBatchLines(batch *model.Batch, outputFile *os.File, errorFile *os.File, count int, lineError *dto.BatchLineError) error {
+	processed := batch.Completed + batch.Failed
+	if count <= 0 {
+		return nil
+	}
+	if batch.Dispatched < processed+count {
+		if err := model.SetBatchDispatched(batch.Id, processed+count); err != nil {
+			return err
+		}
+	}
+	skipped := 0
+	failed := 0
+	var writeErr error
+	err := readBatchLines(batch.InputFileId, func(lineNo int, line []byte) bool {
+		if skipped < processed {
+			skipped++
+			return true
+		}
+		var input dto.BatchRequestInput
+		_ = json.Unmarshal(line, &input)
+		writeErr = writeBatchOutput(errorFile, &dto.BatchRequestOutput{
+			Id:       fmt.Sprintf("batch_req_%s", common.GetUUID()),
+			CustomId: input.CustomId,
+			Error:    lineError,
+		})
+		failed++
+		return writeErr == nil && failed < count
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return saveBatchProgress(batch, outputFile, errorFile, 0, failed, &model.BatchUsage{})
+}
+
+func writeBatchOutput(file *os.File, output *dto.BatchRequestOutput) error {
+	data, err := json.Marshal(output)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// executeBatchRequest 模拟令牌鉴权和渠道分发，通过 Relay 执行一个批处理请求
+func executeBatchRequest(batch *model.Batch, token *model.Token, input dto.BatchRequestInput, usage *model.BatchUsage) batchResult {
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest(http.MethodPost, batch.Endpoint, bytes.NewReader(input.Body))
+	c.Request.Header.Set("Content-Type", "application/json")
+
+	requestId := common.GetTimeString() + common.GetRandomString(8)
+	c.Set(common.RequestIdKey, requestId)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), common.RequestIdKey, requestId))
+	c.Set(constant.ContextKeyBatchUsage, usage)
+
+	if err := setupBatchRequestContext(c, batch, token); err != nil {
+		abortWithBatchError(c, http.StatusUnauthorized, err.Error())
+	} else {
+		relayBatchRequest(c)
+	}
+
+	body := w.Body.Bytes()
+	if !json.Valid(body) {
+		body, _ = json.Marshal(string(body))
+	}
+	return batchResult{
+		output: &dto.BatchRequestOutput{
+			Id:       fmt.Sprintf("batch_req_%s", common.GetUUID()),
+			CustomId: input.CustomId,
+			Response: &dto.BatchResponseBody{
+				StatusCode: w.Code,
+				RequestId:  requestId,
+				Body:       body,
+			},
+		},
+		success: w.Code == http.StatusOK,
+	}
+}
+
+// relayBatchRequest 依次执行 Distribute 和 Relay，panic 的处理与 RelayPanicRecover 相同
+func relayBatchRequest(c *gin.Context) {
+	defer func() {
+		if err := recover(); err != nil {
+			common.SysError(fmt.Sprintf("panic detected: %v", err))
+			common.SysError(fmt.Sprintf("stacktrace from panic: %s", string(debug.Stack())))
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error": gin.H{
+					"message": fmt.Sprintf("Panic detected, error: %v. Please submit a issue here: https://github.com/Veloera/Veloera", err),
+					"type":    "veloera_panic",
+				},
+			})
+			c.Abort()
+		}
+	}()
+	middleware.Distribute()(c)
+	if !c.IsAborted() {
+		Relay(c)
+	}
+}
+
+// setupBatchRequestContext 写入与 TokenAuth 相同的用户和令牌上下文，令牌每次请求都重新校验
+func setupBatchRequestContext(c *gin.Context, batch *model.Batch, token *model.Token) error {
+	if token == nil {
+		return errors.New("无效的令牌")
+	}
+	token, err := model.ValidateUserTokenHash(token.KeyHash)
+	if err != nil {
+		return err
+	}
+	userCache, err := model.GetUserCache(batch.UserId)
+	if err != nil {
+		return err
+	}
+	if userCache.Status != common.UserStatusEnabled {
+		return errors.New("用户已被封禁")
+	}
+	userCache.WriteContext(c)
+	middleware.SetupContextForToken(c, token)
+	// 创建批处理时已校验过 IP
+	c.Set("allow_ips", map[string]any{})
+	return nil
+}
+
+func abortWithBatchError(c *gin.Context, statusCode int, message string) {
+	c.JSON(statusCode, gin.H{
+		"error": dto.OpenAIError{
+			Message: common.MessageWithRequestId(message, c.GetString(common.RequestIdKey)),
+			Type:    "veloera_error",
+		},
+	})
+	c.Abort()
+}
+
+// finalizeBatch 创建结果文件记录，记录批处理的汇总消费日志并结束批处理
+func finalizeBatch(batch *model.Batch, finalStatus string) error {
+	now := common.GetTimestamp()
+	ok, err := model.UpdateBatchIfStatus(batch.Id, []string{model.BatchStatusValidating, model.BatchStatusInProgress, model.BatchStatusCancelling, model.BatchStatusFinalizing}, map[string]any{
+		"status":        model.BatchStatusFinalizing,
+		"finalizing_at": now,
+	})
+	if err != nil || !ok {
+		return err
+	}
+	batch, err = model.GetBatchById(batch.Id)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]any{
+		"status":         finalStatus,
+		"output_file_id": createBatchResultFile(batch, batch.OutputFileId, "output"),
+		"error_file_id":  createBatchResultFile(batch, batch.ErrorFileId, "error"),
+	}
+	switch finalStatus {
+	case model.BatchStatusCancelled:
+		fields["cancelled_at"] = now
+	case model.BatchStatusExpired:
+		fields["expired_at"] = now
+	default:
+		fields["completed_at"] = now
+	}
+	recordBatchConsumeLog(batch)
+	return batch.Update(fields)
+}
+
+// createBatchResultFile 为非空的结果文件创建文件记录，返回文件 id，没有结果时删除空文件并返回空字符串
+func createBatchResultFile(batch *model.Batch, fileId string, kind string) string {
+	if fileId == "" {
+		return ""
+	}
+	info, err := os.Stat(service.FileStoragePath(fileId))
+	if err != nil || info.Size() == 0 {
+		_ = service.DeleteFileContent(fileId)
+		return ""
+	}
+	if _, err := model.GetUserFile(batch.UserId, fileId); err == nil {
+		return fileId
+	}
+	file := &model.File{
+		FileId:   fileId,
+		UserId:   batch.UserId,
+		Filename: fmt.Sprintf("%s_%s.jsonl", batch.BatchId, kind),
+		Purpose:  model.FilePurposeBatchOutput,
+		Bytes:    info.Size(),
+	}
+	if err := file.Insert(); err != nil {
+		common.SysError(fmt.Sprintf("failed to create batch %s file: %s", kind, err.Error()))
+		return ""
+	}
+	return fileId
+}
+
+// recordBatchConsumeLog 批处理中的请求不单独记录消费日志，结束时记录一条汇总日志
+func recordBatchConsumeLog(batch *model.Batch) {
+	if batch.Completed+batch.Failed == 0 {
+		return
+	}
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	if userCache, err := model.GetUserCache(batch.UserId); err == nil {
+		userCache.WriteContext(c)
+	}
+	tokenName := ""
+	group := c.GetString(constant.ContextKeyUserGroup)
+	if token, err := model.GetTokenById(batch.TokenId); err == nil {
+		tokenName = token.Name
+		if token.Group != "" {
+			group = token.Group
+		}
+	}
+	userQuota, _ := model.GetUserQuota(batch.UserId, false)
+	// 汇总日志不对应单个渠道，上游成本使用各请求按实际渠道计算后的合计
+	c.Set(constant.ContextKeyUpstreamCost, batch.UpstreamCost)
+	useTimeSeconds := 0
+	if batch.InProgressAt != 0 {
+		useTimeSeconds = int(common.GetTimestamp() - batch.InProgressAt)
+	}
+	discountRatio := operation_setting.GetBatchSetting().DiscountRatio
+	logContent := fmt.Sprintf("批处理 %s，请求 %d 个，成功 %d 个，失败 %d 个，批处理折扣 %.2f", batch.BatchId, batch.Total, batch.Completed, batch.Failed, discountRatio)
+	other := map[string]interface{}{
+		"batch_id":       batch.BatchId,
+		"batch_discount": discountRatio,
+		"batch_requests": batch.Total,
+	}
+	model.RecordConsumeLog(c, batch.UserId, 0, batch.PromptTokens, batch.CompletionTokens, batch.Model, tokenName,
+		batch.Quota, logContent, batch.TokenId, userQuota, useTimeSeconds, false, group, other)
+}
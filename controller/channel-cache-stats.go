@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"veloera/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ChannelCacheStats struct {
+	Id   int    `json:"id"`
+	Name string `json:"name"`
+	model.ChannelCacheStats
+}
+
+// GetChannelCacheStats 返回各渠道的提示词缓存命中率，只包含有请求记录的渠道
+func GetChannelCacheStats(c *gin.Context) {
+	channels, err := model.GetAllChannels(0, 0, true, true)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	items := make([]ChannelCacheStats, 0)
+	for _, channel := range channels {
+		stats := model.GetChannelCacheStats(channel.Id)
+		if stats.Requests == 0 {
+			continue
+		}
+		items = append(items, ChannelCacheStats{
+			Id:                channel.Id,
+			Name:              channel.Name,
+			ChannelCacheStats: stats,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    items,
+	})
+}
+
+// ResetChannelCacheStats 清空渠道的提示词缓存命中统计
+func ResetChannelCacheStats(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	model.ResetChannelCacheStats(id)
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+}
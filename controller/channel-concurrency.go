@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"net/http"
+	"veloera/middleware"
+	"veloera/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ChannelConcurrency struct {
+	Id                int    `json:"id"`
+	Name              string `json:"name"`
+	MaxConcurrency    int    `json:"max_concurrency"`
+	InFlight          int    `json:"in_flight"`
+	KeyMaxConcurrency int    `json:"key_max_concurrency"`
+	KeyInFlight       []int  `json:"key_in_flight,omitempty"`
+}
+
+// GetChannelConcurrency 返回限制了并发的渠道当前的并发数，以及本节点等待队列的统计
+func GetChannelConcurrency(c *gin.Context) {
+	channels, err := model.GetAllChannels(0, 0, true, true)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	items := make([]ChannelConcurrency, 0)
+	for _, channel := range channels {
+		maxConcurrency := channel.GetMaxConcurrency()
+		keyMaxConcurrency := channel.GetKeyMaxConcurrency()
+		if maxConcurrency <= 0 && keyMaxConcurrency <= 0 {
+			continue
+		}
+		item := ChannelConcurrency{
+			Id:                channel.Id,
+			Name:              channel.Name,
+			MaxConcurrency:    maxConcurrency,
+			InFlight:          model.GetChannelConcurrency(channel.Id, ""),
+			KeyMaxConcurrency: keyMaxConcurrency,
+		}
+		if keyMaxConcurrency > 0 {
+			for _, key := range channel.GetKeys() {
+				item.KeyInFlight = append(item.KeyInFlight, model.GetChannelConcurrency(channel.Id, model.HashChannelKey(key)))
+			}
+		}
+		items = append(items, item)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data": gin.H{
+			"channels": items,
+			"queue":    middleware.GetChannelQueueStats(),
+		},
+	})
+}
@@ -0,0 +1,121 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"veloera/common"
+	"veloera/model"
+	"veloera/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// modelStatusCacheDuration 公开的模型状态缓存时间，避免故障期间大量查询压垮数据库
+const modelStatusCacheDuration = time.Minute
+
+var (
+	modelStatusCacheLock sync.Mutex
+	modelStatusCache     []*model.ModelStatus
+	modelStatusCachedAt  time.Time
+)
+
+// GetChannelHealthSamples 分页返回渠道健康记录
+func GetChannelHealthSamples(c *gin.Context) {
+	p, _ := strconv.Atoi(c.Query("p"))
+	pageSize, _ := strconv.Atoi(c.Query("page_size"))
+	if p < 1 {
+		p = 1
+	}
+	if pageSize <= 0 {
+		pageSize = common.ItemsPerPage
+	}
+	if pageSize > 100 {
+		pageSize = 100
+	}
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	channel, _ := strconv.Atoi(c.Query("channel"))
+	samples, total, err := model.GetChannelHealthSamples(startTimestamp, endTimestamp, channel, c.Query("model"), c.Query("source"), (p-1)*pageSize, pageSize)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data": map[string]any{
+			"items":     samples,
+			"total":     total,
+			"page":      p,
+			"page_size": pageSize,
+		},
+	})
+}
+
+// GetChannelHealthStats 按天、渠道和模型返回可用率和延迟分位数，默认统计最近 7 天
+func GetChannelHealthStats(c *gin.Context) {
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	if startTimestamp == 0 {
+		startTimestamp = time.Now().AddDate(0, 0, -7).Unix()
+	}
+	channel, _ := strconv.Atoi(c.Query("channel"))
+	stats, err := model.GetChannelHealthDailyStats(startTimestamp, endTimestamp, channel, c.Query("model"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    stats,
+	})
+}
+
+// GetModelStatus 公开的模型状态，按模型汇总所有渠道的可用率，不包含渠道信息
+func GetModelStatus(c *gin.Context) {
+	setting := operation_setting.GetChannelHealthSetting()
+	if !setting.StatusPageEnabled {
+		c.JSON(http.StatusNotFound, gin.H{
+			"success": false,
+			"message": "模型状态页未开启",
+		})
+		return
+	}
+	modelStatusCacheLock.Lock()
+	defer modelStatusCacheLock.Unlock()
+	if modelStatusCache == nil || time.Since(modelStatusCachedAt) >= modelStatusCacheDuration {
+		hours := setting.StatusPageHours
+		if hours <= 0 {
+			hours = 24
+		}
+		since := time.Now().Add(-time.Duration(hours) * time.Hour).Unix()
+		statuses, err := model.GetModelStatuses(setting.StatusPageModels, since)
+		if err != nil {
+			common.SysError("failed to get model statuses: " + err.Error())
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": "获取模型状态失败",
+			})
+			return
+		}
+		modelStatusCache = statuses
+		modelStatusCachedAt = time.Now()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data": gin.H{
+			"updated_at": modelStatusCachedAt.Unix(),
+			"models":     modelStatusCache,
+		},
+	})
+}
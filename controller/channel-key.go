@@ -0,0 +1,104 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"veloera/model"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ChannelKeyStatusRequest struct {
+	KeyHash string `json:"key_hash"`
+}
+
+// GetChannelKeys 列出多 key 渠道中每个 key 的状态和使用次数
+func GetChannelKeys(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	channel, err := model.GetChannelById(id, true)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    model.GetChannelKeyStates(channel),
+	})
+}
+
+func EnableChannelKey(c *gin.Context) {
+	updateChannelKeyStatus(c, model.ChannelKeyStatusEnabled)
+}
+
+func DisableChannelKey(c *gin.Context) {
+	updateChannelKeyStatus(c, model.ChannelKeyStatusDisabled)
+}
+
+func updateChannelKeyStatus(c *gin.Context, status int) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	req := ChannelKeyStatusRequest{}
+	err = c.ShouldBindJSON(&req)
+	if err == nil && req.KeyHash == "" {
+		err = errors.New("key_hash 不能为空")
+	}
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	channel, err := model.GetChannelById(id, true)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	found := false
+	for _, key := range channel.GetKeys() {
+		if model.HashChannelKey(key) == req.KeyHash {
+			found = true
+			break
+		}
+	}
+	if !found {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": "渠道中不存在该 key",
+		})
+		return
+	}
+	err = model.UpdateChannelKeyStatus(channel.Id, req.KeyHash, status, 0, "")
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+	})
+}
@@ -0,0 +1,282 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/model"
+	"veloera/service"
+	"veloera/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// modelDiscoveryUnsupportedTypes 上游没有 OpenAI 格式模型列表的渠道类型，不检查这些渠道的上游模型
+var modelDiscoveryUnsupportedTypes = map[int]bool{
+	common.ChannelTypeMidjourney:     true,
+	common.ChannelTypeMidjourneyPlus: true,
+	common.ChannelTypeAzure:          true,
+	common.ChannelTypePaLM:           true,
+	common.ChannelTypeAnthropic:      true,
+	common.ChannelTypeBaidu:          true,
+	common.ChannelTypeBaiduV2:        true,
+	common.ChannelTypeZhipu:          true,
+	common.ChannelTypeAli:            true,
+	common.ChannelTypeXunfei:         true,
+	common.ChannelTypeTencent:        true,
+	common.ChannelTypeAws:            true,
+	common.ChannelTypeCohere:         true,
+	common.ChannelTypeSunoAPI:        true,
+	common.ChannelTypeDify:           true,
+	common.ChannelTypeJina:           true,
+	common.ChannelCloudflare:         true,
+	common.ChannelTypeVertexAi:       true,
+	common.ChannelTypeMokaAI:         true,
+}
+
+// diffChannelModels 比较渠道的模型列表和上游的模型列表，模型重定向的目标在上游存在时视为该模型仍然可用
+func diffChannelModels(channel *model.Channel, upstream []string) (added []string, removed []string) {
+	mapping := make(map[string]string)
+	if modelMapping := channel.GetModelMapping(); modelMapping != "" && modelMapping != "{}" {
+		if err := json.Unmarshal([]byte(modelMapping), &mapping); err != nil {
+			common.SysError(fmt.Sprintf("failed to unmarshal model mapping of channel #%d: %s", channel.Id, err.Error()))
+		}
+	}
+	upstreamSet := make(map[string]bool, len(upstream))
+	for _, name := range upstream {
+		upstreamSet[name] = true
+	}
+	known := make(map[string]bool)
+	for _, name := range channel.GetModels() {
+		if name == "" {
+			continue
+		}
+		known[name] = true
+		target, mapped := mapping[name]
+		if mapped {
+			known[target] = true
+		}
+		if !upstreamSet[name] && !(mapped && upstreamSet[target]) {
+			removed = append(removed, name)
+		}
+	}
+	for _, name := range upstream {
+		if name != "" && !known[name] {
+			known[name] = true
+			added = append(added, name)
+		}
+	}
+	return added, removed
+}
+
+// discoverChannelModels 获取渠道上游的模型列表，按渠道的策略自动更新或提交审核，返回是否产生了新的记录
+func discoverChannelModels(channel *model.Channel) (*model.ModelDiscoveryDiff, bool, error) {
+	if modelDiscoveryUnsupportedTypes[channel.Type] {
+		return nil, false, errors.New("该渠道类型的上游不支持获取模型列表")
+	}
+	upstream, err := fetchChannelUpstreamModels(channel)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(upstream) == 0 {
+		// 上游异常时可能返回空列表，不能据此移除所有模型
+		return nil, false, errors.New("上游返回的模型列表为空")
+	}
+	added, removed := diffChannelModels(channel, upstream)
+	policy := channel.GetModelDiscoveryPolicy()
+	var pendingAdded, pendingRemoved, autoAdded, autoRemoved []string
+	switch policy.Add {
+	case operation_setting.ModelDiscoveryPolicyAuto:
+		autoAdded = added
+	case operation_setting.ModelDiscoveryPolicyApprove:
+		pendingAdded = added
+	}
+	switch policy.Remove {
+	case operation_setting.ModelDiscoveryPolicyAuto:
+		autoRemoved = removed
+	case operation_setting.ModelDiscoveryPolicyApprove:
+		pendingRemoved = removed
+	}
+	diff := &model.ModelDiscoveryDiff{
+		ChannelId:   channel.Id,
+		ChannelName: channel.Name,
+	}
+	diff.SetChanges(pendingAdded, pendingRemoved, autoAdded, autoRemoved)
+	saved, err := model.SaveModelDiscoveryDiff(diff)
+	if err != nil {
+		return nil, false, err
+	}
+	return diff, saved, nil
+}
+
+func notifyModelDiscoveryDiff(diff *model.ModelDiscoveryDiff) {
+	var lines []string
+	if diff.AutoAdded != "" {
+		lines = append(lines, "已自动添加："+diff.AutoAdded)
+	}
+	if diff.AutoRemoved != "" {
+		lines = append(lines, "已自动移除："+diff.AutoRemoved)
+	}
+	if diff.Added != "" {
+		lines = append(lines, "等待审核的新增模型："+diff.Added)
+	}
+	if diff.Removed != "" {
+		lines = append(lines, "等待审核的下线模型："+diff.Removed)
+	}
+	subject := fmt.Sprintf("通道「%s」（#%d）的上游模型发生变化", diff.ChannelName, diff.ChannelId)
+	content := subject + "\n" + strings.Join(lines, "\n")
+	notifyType := fmt.Sprintf("%s_model_discovery_%d", dto.NotifyTypeChannelUpdate, diff.ChannelId)
+	service.NotifyRootUser(notifyType, subject, content)
+}
+
+func discoverAllChannelModels() {
+	channels, err := model.GetAllChannels(0, 0, true, false)
+	if err != nil {
+		common.SysError("failed to get channels for model discovery: " + err.Error())
+		return
+	}
+	for _, channel := range channels {
+		if channel.Status != common.ChannelStatusEnabled || modelDiscoveryUnsupportedTypes[channel.Type] {
+			continue
+		}
+		policy := channel.GetModelDiscoveryPolicy()
+		if policy.Add == operation_setting.ModelDiscoveryPolicyIgnore && policy.Remove == operation_setting.ModelDiscoveryPolicyIgnore {
+			continue
+		}
+		diff, saved, err := discoverChannelModels(channel)
+		if err != nil {
+			common.SysError(fmt.Sprintf("failed to discover models of channel #%d: %s", channel.Id, err.Error()))
+		} else if saved {
+			common.SysLog(fmt.Sprintf("channel #%d upstream models changed, status %s", channel.Id, diff.Status))
+			notifyModelDiscoveryDiff(diff)
+		}
+		time.Sleep(common.RequestInterval)
+	}
+}
+
+// RunModelDiscovery 按配置的间隔检查所有启用渠道的上游模型列表，只在主节点运行
+func RunModelDiscovery() {
+	lastRun := time.Now()
+	for {
+		time.Sleep(time.Minute)
+		setting := operation_setting.GetModelDiscoverySetting()
+		interval := setting.IntervalMinutes
+		if interval <= 0 {
+			interval = 360
+		}
+		if !setting.Enabled || time.Since(lastRun) < time.Duration(interval)*time.Minute {
+			continue
+		}
+		lastRun = time.Now()
+		common.SysLog("discovering upstream models of all channels")
+		discoverAllChannelModels()
+		common.SysLog("upstream model discovery finished")
+	}
+}
+
+// GetModelDiscoveryDiffs 分页返回上游模型变化记录，可按状态和渠道筛选
+func GetModelDiscoveryDiffs(c *gin.Context) {
+	p, _ := strconv.Atoi(c.Query("p"))
+	pageSize, _ := strconv.Atoi(c.Query("page_size"))
+	if p < 1 {
+		p = 1
+	}
+	if pageSize <= 0 {
+		pageSize = common.ItemsPerPage
+	}
+	channelId, _ := strconv.Atoi(c.Query("channel"))
+	diffs, total, err := model.GetModelDiscoveryDiffs(c.Query("status"), channelId, (p-1)*pageSize, pageSize)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data": map[string]any{
+			"items":     diffs,
+			"total":     total,
+			"page":      p,
+			"page_size": pageSize,
+		},
+	})
+}
+
+// DiscoverChannelModels 立即检查一个渠道的上游模型列表
+func DiscoverChannelModels(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	channel, err := model.GetChannelById(id, true)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	diff, saved, err := discoverChannelModels(channel)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if !saved {
+		diff = nil
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    diff,
+	})
+}
+
+func reviewModelDiscoveryDiff(c *gin.Context, approve bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	diff, err := model.ReviewModelDiscoveryDiff(id, approve)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    diff,
+	})
+}
+
+// ApproveModelDiscoveryDiff 通过等待审核的记录，更新渠道的模型列表
+func ApproveModelDiscoveryDiff(c *gin.Context) {
+	reviewModelDiscoveryDiff(c, true)
+}
+
+// RejectModelDiscoveryDiff 拒绝等待审核的记录，上游再次出现相同的变化时不再提交审核
+func RejectModelDiscoveryDiff(c *gin.Context) {
+	reviewModelDiscoveryDiff(c, false)
+}
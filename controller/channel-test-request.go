@@ -0,0 +1,313 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"strings"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/model"
+	"veloera/relay/channel"
+	relaycommon "veloera/relay/common"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 渠道测试按测试模型的端点选择的请求类型
+const (
+	channelTestChat          = "chat"
+	channelTestClaude        = "claude"
+	channelTestEmbedding     = "embedding"
+	channelTestImage         = "image"
+	channelTestSpeech        = "speech"
+	channelTestTranscription = "transcription"
+	channelTestRerank        = "rerank"
+)
+
+var channelTestPaths = map[string]string{
+	channelTestChat:          "/v1/chat/completions",
+	channelTestClaude:        "/v1/messages",
+	channelTestEmbedding:     "/v1/embeddings",
+	channelTestImage:         "/v1/images/generations",
+	channelTestSpeech:        "/v1/audio/speech",
+	channelTestTranscription: "/v1/audio/transcriptions",
+	channelTestRerank:        "/v1/rerank",
+}
+
+// getChannelTestType 根据测试模型的名称和渠道类型判断测试使用的端点
+func getChannelTestType(channel *model.Channel, modelName string) string {
+	name := strings.ToLower(modelName)
+	switch {
+	case strings.Contains(name, "rerank"):
+		return channelTestRerank
+	case strings.Contains(name, "embed") ||
+		strings.HasPrefix(name, "m3e") || // m3e 系列模型
+		strings.Contains(name, "bge-") || // bge 系列模型
+		channel.Type == common.ChannelTypeMokaAI:
+		return channelTestEmbedding
+	case strings.Contains(name, "whisper") || strings.Contains(name, "transcribe"):
+		return channelTestTranscription
+	case strings.HasPrefix(name, "tts-") || strings.Contains(name, "-tts"):
+		return channelTestSpeech
+	case strings.HasPrefix(name, "dall-e") ||
+		strings.HasPrefix(name, "gpt-image") ||
+		strings.HasPrefix(name, "imagen") ||
+		strings.Contains(name, "flux") ||
+		strings.Contains(name, "stable-diffusion") ||
+		strings.Contains(name, "cogview") ||
+		strings.Contains(name, "kolors"):
+		return channelTestImage
+	case channel.Type == common.ChannelTypeAnthropic:
+		return channelTestClaude
+	}
+	return channelTestChat
+}
+
+// genChannelTestRelayInfo 按测试类型生成 RelayInfo，与对应端点的转发逻辑一致
+func genChannelTestRelayInfo(c *gin.Context, testType string) *relaycommon.RelayInfo {
+	switch testType {
+	case channelTestClaude:
+		return relaycommon.GenRelayInfoClaude(c)
+	case channelTestRerank:
+		return relaycommon.GenRelayInfoRerank(c, buildTestRerankRequest(""))
+	}
+	return relaycommon.GenRelayInfo(c)
+}
+
+// buildChannelTestBody 按测试类型构造请求并由适配器转换为上游的请求体，返回请求体和预估的输出 token 数
+func buildChannelTestBody(c *gin.Context, info *relaycommon.RelayInfo, adaptor channel.Adaptor, testType string, testModel string, testCase *model.ChannelTestCase) (io.Reader, int, error) {
+	var convertedRequest any
+	var err error
+	maxTokens := 0
+	switch testType {
+	case channelTestClaude:
+		request := buildTestClaudeRequest(testModel, testCase)
+		maxTokens = int(request.MaxTokens)
+		convertedRequest, err = adaptor.ConvertClaudeRequest(c, info, request)
+	case channelTestEmbedding:
+		convertedRequest, err = adaptor.ConvertEmbeddingRequest(c, info, dto.EmbeddingRequest{
+			Model: testModel,
+			Input: []string{"hello world"},
+		})
+	case channelTestImage:
+		convertedRequest, err = adaptor.ConvertImageRequest(c, info, buildTestImageRequest(testModel))
+	case channelTestSpeech:
+		return convertTestAudioRequest(c, info, adaptor, dto.AudioRequest{
+			Model: testModel,
+			Input: "hi",
+			Voice: "alloy",
+		})
+	case channelTestTranscription:
+		if err := setTestTranscriptionForm(c, testModel); err != nil {
+			return nil, 0, err
+		}
+		return convertTestAudioRequest(c, info, adaptor, dto.AudioRequest{
+			Model:          testModel,
+			ResponseFormat: "json",
+		})
+	case channelTestRerank:
+		convertedRequest, err = adaptor.ConvertRerankRequest(c, info.RelayMode, *buildTestRerankRequest(testModel))
+	default:
+		request := buildTestRequest(testModel)
+		if testCase != nil {
+			content, _ := json.Marshal(testCase.Prompt)
+			request.Messages[0].Content = content
+			// 自定义提示词需要完整的回复才能判断是否包含期望的内容
+			request.MaxTokens = 0
+			request.MaxCompletionTokens = 0
+		}
+		maxTokens = int(request.MaxTokens)
+		convertedRequest, err = adaptor.ConvertOpenAIRequest(c, info, request)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if reader, ok := convertedRequest.(io.Reader); ok {
+		// multipart 表单请求
+		return reader, maxTokens, nil
+	}
+	jsonData, err := json.Marshal(convertedRequest)
+	if err != nil {
+		return nil, 0, err
+	}
+	return bytes.NewBuffer(jsonData), maxTokens, nil
+}
+
+func convertTestAudioRequest(c *gin.Context, info *relaycommon.RelayInfo, adaptor channel.Adaptor, request dto.AudioRequest) (io.Reader, int, error) {
+	reader, err := adaptor.ConvertAudioRequest(c, info, request)
+	if err != nil {
+		return nil, 0, err
+	}
+	return reader, 0, nil
+}
+
+func buildTestClaudeRequest(modelName string, testCase *model.ChannelTestCase) *dto.ClaudeRequest {
+	request := &dto.ClaudeRequest{
+		Model:     modelName,
+		MaxTokens: 10,
+		Messages: []dto.ClaudeMessage{
+			{Role: "user", Content: "hi"},
+		},
+	}
+	if testCase != nil {
+		request.Messages[0].Content = testCase.Prompt
+		request.MaxTokens = 1024
+	}
+	return request
+}
+
+// buildTestImageRequest 使用模型支持的最小尺寸和最低质量生成一张图片
+func buildTestImageRequest(model string) dto.ImageRequest {
+	request := dto.ImageRequest{
+		Model:  model,
+		Prompt: "a red circle",
+		N:      1,
+	}
+	switch {
+	case strings.HasPrefix(model, "dall-e-2"):
+		request.Size = "256x256"
+	case strings.HasPrefix(model, "dall-e-3"):
+		request.Size = "1024x1024"
+		request.Quality = "standard"
+	case strings.HasPrefix(model, "gpt-image"):
+		request.Size = "1024x1024"
+		request.Quality = "low"
+	}
+	return request
+}
+
+func buildTestRerankRequest(model string) *dto.RerankRequest {
+	return &dto.RerankRequest{
+		Model: model,
+		Query: "What is the capital of France?",
+		Documents: []any{
+			"Paris is the capital of France.",
+			"Berlin is the capital of Germany.",
+		},
+		TopN: 2,
+	}
+}
+
+// setTestTranscriptionForm 把内置的音频片段作为 multipart 表单写入测试请求，供适配器读取
+func setTestTranscriptionForm(c *gin.Context, model string) error {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("model", model)
+	writer.WriteField("response_format", "json")
+	part, err := writer.CreateFormFile("file", "test.wav")
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(testAudioClip()); err != nil {
+		return err
+	}
+	writer.Close()
+	c.Request.Header.Set("Content-Type", writer.FormDataContentType())
+	c.Request.Body = io.NopCloser(&body)
+	return c.Request.ParseMultipartForm(1 << 20)
+}
+
+// testAudioClip 生成半秒 16kHz 单声道的 440Hz 正弦波 WAV，用于测试转录模型
+func testAudioClip() []byte {
+	const sampleRate = 16000
+	const samples = sampleRate / 2
+	var buf bytes.Buffer
+	buf.WriteString("RIFF")
+	binary.Write(&buf, binary.LittleEndian, uint32(36+samples*2))
+	buf.WriteString("WAVEfmt ")
+	binary.Write(&buf, binary.LittleEndian, uint32(16))           // fmt 块大小
+	binary.Write(&buf, binary.LittleEndian, uint16(1))            // PCM
+	binary.Write(&buf, binary.LittleEndian, uint16(1))            // 声道数
+	binary.Write(&buf, binary.LittleEndian, uint32(sampleRate))   // 采样率
+	binary.Write(&buf, binary.LittleEndian, uint32(sampleRate*2)) // 字节率
+	binary.Write(&buf, binary.LittleEndian, uint16(2))            // 块对齐
+	binary.Write(&buf, binary.LittleEndian, uint16(16))           // 位深
+	buf.WriteString("data")
+	binary.Write(&buf, binary.LittleEndian, uint32(samples*2))
+	for i := 0; i < samples; i++ {
+		sample := int16(math.Sin(2*math.Pi*440*float64(i)/sampleRate) * 8000)
+		binary.Write(&buf, binary.LittleEndian, sample)
+	}
+	return buf.Bytes()
+}
+
+// checkChannelTestResponse 按测试类型检查返回给客户端的响应，自定义测试用例的回复需要包含期望的内容
+func checkChannelTestResponse(testType string, body []byte, testCase *model.ChannelTestCase) error {
+	var text string
+	switch testType {
+	case channelTestClaude:
+		var response dto.ClaudeResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			return fmt.Errorf("invalid messages response: %s", err.Error())
+		}
+		for _, content := range response.Content {
+			if content.Text != nil {
+				text += *content.Text
+			}
+		}
+		if len(response.Content) == 0 && response.Completion == "" {
+			return errors.New("messages response has no content")
+		}
+		text += response.Completion
+	case channelTestEmbedding:
+		var response dto.OpenAIEmbeddingResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			return fmt.Errorf("invalid embedding response: %s", err.Error())
+		}
+		if len(response.Data) == 0 || len(response.Data[0].Embedding) == 0 {
+			return errors.New("embedding response has no vectors")
+		}
+		return nil
+	case channelTestImage:
+		var response dto.ImageResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			return fmt.Errorf("invalid image response: %s", err.Error())
+		}
+		for _, data := range response.Data {
+			if data.Url != "" || data.B64Json != "" {
+				return nil
+			}
+		}
+		return errors.New("image response has no images")
+	case channelTestSpeech:
+		if len(body) == 0 {
+			return errors.New("speech response has no audio")
+		}
+		return nil
+	case channelTestTranscription:
+		var response map[string]json.RawMessage
+		if err := json.Unmarshal(body, &response); err != nil {
+			return fmt.Errorf("invalid transcription response: %s", err.Error())
+		}
+		if _, ok := response["text"]; !ok {
+			return errors.New("transcription response has no text")
+		}
+		return nil
+	case channelTestRerank:
+		var response dto.RerankResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			return fmt.Errorf("invalid rerank response: %s", err.Error())
+		}
+		if len(response.Results) == 0 {
+			return errors.New("rerank response has no results")
+		}
+		return nil
+	default:
+		text, _ = parseShadowResponse(body)
+	}
+	if testCase == nil {
+		return nil
+	}
+	for _, expect := range testCase.Expect {
+		if !strings.Contains(text, expect) {
+			return fmt.Errorf("response does not contain %q: %s", expect, text)
+		}
+	}
+	return nil
+}
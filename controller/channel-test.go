@@ -1,7 +1,6 @@
 package controller
 
 import (
-	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,10 +18,10 @@ import (
 	"veloera/middleware"
 	"veloera/model"
 	"veloera/relay"
-	relaycommon "veloera/relay/common"
 	"veloera/relay/constant"
 	"veloera/relay/helper"
 	"veloera/service"
+	"veloera/setting/operation_setting"
 
 	"github.com/bytedance/gopkg/util/gopool"
 
@@ -30,7 +29,6 @@ import (
 )
 
 func testChannel(channel *model.Channel, testModel string) (err error, openAIErrorWithStatusCode *dto.OpenAIErrorWithStatusCode) {
-	tik := time.Now()
 	if channel.Type == common.ChannelTypeMidjourney {
 		return errors.New("midjourney channel test is not supported"), nil
 	}
@@ -40,26 +38,6 @@ func testChannel(channel *model.Channel, testModel string) (err error, openAIErr
 	if channel.Type == common.ChannelTypeSunoAPI {
 		return errors.New("suno channel test is not supported"), nil
 	}
-	w := httptest.NewRecorder()
-	c, _ := gin.CreateTestContext(w)
-
-	requestPath := "/v1/chat/completions"
-
-	// 先判断是否为 Embedding 模型
-	if strings.Contains(strings.ToLower(testModel), "embedding") ||
-		strings.HasPrefix(testModel, "m3e") || // m3e 系列模型
-		strings.Contains(testModel, "bge-") || // bge 系列模型
-		strings.Contains(testModel, "embed") ||
-		channel.Type == common.ChannelTypeMokaAI { // 其他 embedding 模型
-		requestPath = "/v1/embeddings" // 修改请求路径
-	}
-
-	c.Request = &http.Request{
-		Method: "POST",
-		URL:    &url.URL{Path: requestPath}, // 使用动态路径
-		Body:   nil,
-		Header: make(http.Header),
-	}
 
 	if testModel == "" {
 		if channel.TestModel != nil && *channel.TestModel != "" {
@@ -73,6 +51,54 @@ func testChannel(channel *model.Channel, testModel string) (err error, openAIErr
 		}
 	}
 
+	tik := time.Now()
+	defer func() {
+		// 记录渠道健康记录
+		errorClass := ""
+		if openAIErrorWithStatusCode != nil {
+			errorClass = channelErrorClass(openAIErrorWithStatusCode)
+		} else if err != nil {
+			errorClass = "test_failed"
+		}
+		model.RecordChannelHealthSample(&model.ChannelHealthSample{
+			ChannelId:  channel.Id,
+			ModelName:  testModel,
+			Source:     model.ChannelHealthSourceTest,
+			Success:    err == nil,
+			Latency:    time.Since(tik).Milliseconds(),
+			ErrorClass: errorClass,
+		})
+	}()
+
+	// 根据测试模型的端点选择请求类型，对话模型配置了自定义测试用例时逐个执行
+	testType := getChannelTestType(channel, testModel)
+	if testType == channelTestChat || testType == channelTestClaude {
+		testCases := channel.GetTestCases(testModel)
+		for i := range testCases {
+			err, openAIErrorWithStatusCode = runChannelTest(channel, testModel, testType, &testCases[i])
+			if err != nil {
+				return err, openAIErrorWithStatusCode
+			}
+		}
+		if len(testCases) > 0 {
+			return nil, nil
+		}
+	}
+	return runChannelTest(channel, testModel, testType, nil)
+}
+
+func runChannelTest(channel *model.Channel, testModel string, testType string, testCase *model.ChannelTestCase) (err error, openAIErrorWithStatusCode *dto.OpenAIErrorWithStatusCode) {
+	tik := time.Now()
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+
+	c.Request = &http.Request{
+		Method: "POST",
+		URL:    &url.URL{Path: channelTestPaths[testType]}, // 使用测试类型对应的路径
+		Body:   nil,
+		Header: make(http.Header),
+	}
+
 	cache, err := model.GetUserCache(1)
 	if err != nil {
 		return err, nil
@@ -86,9 +112,11 @@ func testChannel(channel *model.Channel, testModel string) (err error, openAIErr
 	group, _ := model.GetUserGroup(1, false)
 	c.Set("group", group)
 
-	middleware.SetupContextForSelectedChannel(c, channel, testModel)
+	if err := middleware.SetupContextForSelectedChannel(c, channel, testModel); err != nil {
+		return err, nil
+	}
 
-	info := relaycommon.GenRelayInfo(c)
+	info := genChannelTestRelayInfo(c, testType)
 
 	err = helper.ModelMappedHelper(c, info)
 	if err != nil {
@@ -102,25 +130,20 @@ func testChannel(channel *model.Channel, testModel string) (err error, openAIErr
 		return fmt.Errorf("invalid api type: %d, adaptor is nil", apiType), nil
 	}
 
-	request := buildTestRequest(testModel)
-	common.SysLog(fmt.Sprintf("testing channel %d with model %s , info %v ", channel.Id, testModel, info))
-
-	priceData, err := helper.ModelPriceHelper(c, info, 0, int(request.MaxTokens))
-	if err != nil {
-		return err, nil
-	}
+	common.SysLog(fmt.Sprintf("testing channel %d with model %s (%s), info %v ", channel.Id, testModel, testType, info))
 
 	adaptor.Init(info)
 
-	convertedRequest, err := adaptor.ConvertOpenAIRequest(c, info, request)
+	requestBody, maxTokens, err := buildChannelTestBody(c, info, adaptor, testType, testModel, testCase)
 	if err != nil {
 		return err, nil
 	}
-	jsonData, err := json.Marshal(convertedRequest)
+
+	priceData, err := helper.ModelPriceHelper(c, info, 0, maxTokens)
 	if err != nil {
 		return err, nil
 	}
-	requestBody := bytes.NewBuffer(jsonData)
+
 	c.Request.Body = io.NopCloser(requestBody)
 	resp, err := adaptor.DoRequest(c, info, requestBody)
 	if err != nil {
@@ -138,15 +161,22 @@ func testChannel(channel *model.Channel, testModel string) (err error, openAIErr
 	if respErr != nil {
 		return fmt.Errorf("%s", respErr.Error.Message), respErr
 	}
-	if usageA == nil {
-		return errors.New("usage is nil"), nil
+	usage, _ := usageA.(*dto.Usage)
+	if usage == nil {
+		if testType == channelTestChat || testType == channelTestClaude {
+			return errors.New("usage is nil"), nil
+		}
+		// 图片、语音等接口的响应可能没有用量
+		usage = &dto.Usage{}
 	}
-	usage := usageA.(*dto.Usage)
 	result := w.Result()
 	respBody, err := io.ReadAll(result.Body)
 	if err != nil {
 		return err, nil
 	}
+	if err := checkChannelTestResponse(testType, respBody, testCase); err != nil {
+		return err, nil
+	}
 	info.PromptTokens = usage.PromptTokens
 
 	quota := 0
@@ -166,7 +196,11 @@ func testChannel(channel *model.Channel, testModel string) (err error, openAIErr
 		usage.PromptTokensDetails.CachedTokens, priceData.CacheRatio, priceData.ModelPrice)
 	model.RecordConsumeLog(c, 1, channel.Id, usage.PromptTokens, usage.CompletionTokens, info.OriginModelName, "模型测试",
 		quota, "模型测试", 0, quota, int(consumedTime), false, info.Group, other)
-	common.SysLog(fmt.Sprintf("testing channel #%d, response: \n%s", channel.Id, string(respBody)))
+	if testType == channelTestSpeech {
+		common.SysLog(fmt.Sprintf("testing channel #%d, response: %d bytes of audio", channel.Id, len(respBody)))
+	} else {
+		common.SysLog(fmt.Sprintf("testing channel #%d, response: \n%s", channel.Id, string(respBody)))
+	}
 	return nil, nil
 }
 
@@ -176,16 +210,6 @@ func buildTestRequest(model string) *dto.GeneralOpenAIRequest {
 		Stream: false,
 	}
 
-	// 先判断是否为 Embedding 模型
-	if strings.Contains(strings.ToLower(model), "embedding") || // 其他 embedding 模型
-		strings.HasPrefix(model, "m3e") || // m3e 系列模型
-		strings.Contains(model, "bge-") {
-		testRequest.Model = model
-		// Embedding 请求
-		testRequest.Input = []string{"hello world"}
-		return testRequest
-	}
-	// 并非Embedding 模型
 	if strings.HasPrefix(model, "o1") || strings.HasPrefix(model, "o3") {
 		testRequest.MaxCompletionTokens = 10
 	} else if strings.Contains(model, "thinking") {
@@ -286,7 +310,8 @@ func testAllChannels(notify bool) error {
 
 			if milliseconds > disableThreshold {
 				err = errors.New(fmt.Sprintf("响应时间 %.2fs 超过阈值 %.2fs", float64(milliseconds)/1000.0, float64(disableThreshold)/1000.0))
-				shouldBanChannel = true
+				// 响应慢不是永久错误，启用熔断时交给熔断器处理，不禁用渠道
+				shouldBanChannel = shouldBanChannel || !operation_setting.GetCircuitBreakerSetting().Enabled
 			}
 
 			// disable channel
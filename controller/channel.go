@@ -2,6 +2,7 @@ package controller
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -107,13 +108,24 @@ func FetchUpstreamModels(c *gin.Context) {
 		return
 	}
 
-	//if channel.Type != common.ChannelTypeOpenAI {
-	//	c.JSON(http.StatusOK, gin.H{
-	//		"success": false,
-	//		"message": "仅支持 OpenAI 类型渠道",
-	//	})
-	//	return
-	//}
+	ids, err := fetchChannelUpstreamModels(channel)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    ids,
+	})
+}
+
+// fetchChannelUpstreamModels 获取渠道上游 /v1/models 返回的模型列表
+func fetchChannelUpstreamModels(channel *model.Channel) ([]string, error) {
 	baseURL := common.ChannelBaseURLs[channel.Type]
 	if channel.GetBaseURL() != "" {
 		baseURL = channel.GetBaseURL()
@@ -127,23 +139,18 @@ func FetchUpstreamModels(c *gin.Context) {
 	if channel.Type == common.ChannelTypeGemini {
 		url = fmt.Sprintf("%s/v1beta/openai/models", baseURL)
 	}
-	key := strings.Split(channel.Key, ",")[0]
-	body, err := GetResponseBody("GET", url, channel, GetAuthHeader(key))
+	keys := channel.GetKeys()
+	if len(keys) == 0 {
+		return nil, errors.New("渠道没有可用的 key")
+	}
+	body, err := GetResponseBody("GET", url, channel, GetAuthHeader(keys[0]))
 	if err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"success": false,
-			"message": err.Error(),
-		})
-		return
+		return nil, err
 	}
 
 	var result OpenAIModelsResponse
 	if err = json.Unmarshal(body, &result); err != nil {
-		c.JSON(http.StatusOK, gin.H{
-			"success": false,
-			"message": fmt.Sprintf("解析响应失败: %s", err.Error()),
-		})
-		return
+		return nil, fmt.Errorf("解析响应失败: %s", err.Error())
 	}
 
 	var ids []string
@@ -154,12 +161,7 @@ func FetchUpstreamModels(c *gin.Context) {
 		}
 		ids = append(ids, id)
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"message": "",
-		"data":    ids,
-	})
+	return ids, nil
 }
 
 func FixChannelsAbilities(c *gin.Context) {
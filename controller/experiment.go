@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/model"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+type experimentFeedbackRequest struct {
+	RequestId string   `json:"request_id"`
+	Score     *float64 `json:"score"`
+}
+
+// SubmitExperimentFeedback 客户端对实验中的请求提交反馈评分，请求 id 取自响应头 X-Oneapi-Request-Id
+func SubmitExperimentFeedback(c *gin.Context) {
+	var request experimentFeedbackRequest
+	if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+		experimentFeedbackError(c, http.StatusBadRequest, "", "invalid request body: "+err.Error())
+		return
+	}
+	if request.RequestId == "" {
+		experimentFeedbackError(c, http.StatusBadRequest, "request_id", "request_id is required")
+		return
+	}
+	if request.Score == nil || math.IsNaN(*request.Score) || math.IsInf(*request.Score, 0) {
+		experimentFeedbackError(c, http.StatusBadRequest, "score", "score must be a number")
+		return
+	}
+	err := model.UpdateExperimentFeedback(c.GetInt("id"), request.RequestId, *request.Score)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		experimentFeedbackError(c, http.StatusNotFound, "request_id", "no experiment request found with id "+request.RequestId)
+		return
+	}
+	if err != nil {
+		experimentFeedbackError(c, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"request_id": request.RequestId,
+		"score":      *request.Score,
+	})
+}
+
+func experimentFeedbackError(c *gin.Context, statusCode int, param string, message string) {
+	c.JSON(statusCode, gin.H{
+		"error": dto.OpenAIError{
+			Message: message,
+			Type:    "invalid_request_error",
+			Param:   param,
+		},
+	})
+}
+
+// GetExperimentStats 按变体比较实验请求的消耗、延迟、错误率和反馈评分
+func GetExperimentStats(c *gin.Context) {
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	stats, err := model.GetExperimentVariantStats(c.Query("experiment"), startTimestamp, endTimestamp)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    stats,
+	})
+}
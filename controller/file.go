@@ -0,0 +1,233 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/model"
+	"veloera/service"
+	"veloera/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+var filePurposes = map[string]bool{
+	"assistants": true,
+	"batch":      true,
+	"fine-tune":  true,
+	"vision":     true,
+	"user_data":  true,
+	"evals":      true,
+}
+
+func fileError(c *gin.Context, statusCode int, param string, message string) {
+	c.JSON(statusCode, gin.H{
+		"error": dto.OpenAIError{
+			Message: message,
+			Type:    "invalid_request_error",
+			Param:   param,
+		},
+	})
+}
+
+func fileNotFound(c *gin.Context, fileId string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": dto.OpenAIError{
+			Message: fmt.Sprintf("No such File object: %s", fileId),
+			Type:    "invalid_request_error",
+			Param:   "id",
+		},
+	})
+}
+
+func fileStoreError(c *gin.Context, err error) {
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": dto.OpenAIError{
+			Message: err.Error(),
+			Type:    "veloera_error",
+			Code:    "file_store_error",
+		},
+	})
+}
+
+// checkFileStorage 当前节点无法访问文件存储时写入错误响应并返回 false
+func checkFileStorage(c *gin.Context) bool {
+	if service.FileStorageAvailable() {
+		return true
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": dto.OpenAIError{
+			Message: "File storage is only available on the master node, set FILE_STORAGE_SHARED when FILE_STORAGE_DIR is shared by all nodes.",
+			Type:    "veloera_error",
+			Code:    "file_storage_unavailable",
+		},
+	})
+	return false
+}
+
+func file2Object(file *model.File) *dto.FileObject {
+	return &dto.FileObject{
+		Id:        file.FileId,
+		Object:    "file",
+		Bytes:     file.Bytes,
+		CreatedAt: file.CreatedAt,
+		Filename:  file.Filename,
+		Purpose:   file.Purpose,
+		Status:    "processed",
+	}
+}
+
+// getUserFile returns the file of the current user, or writes the error response and returns nil
+func getUserFile(c *gin.Context) *model.File {
+	fileId := c.Param("id")
+	file, err := model.GetUserFile(c.GetInt("id"), fileId)
+	if exist, err := model.RecordExist(err); !exist {
+		if err != nil {
+			fileStoreError(c, err)
+		} else {
+			fileNotFound(c, fileId)
+		}
+		return nil
+	}
+	return file
+}
+
+// UploadFile POST /v1/files
+func UploadFile(c *gin.Context) {
+	if !checkFileStorage(c) {
+		return
+	}
+	purpose := c.PostForm("purpose")
+	if !filePurposes[purpose] {
+		fileError(c, http.StatusBadRequest, "purpose", fmt.Sprintf("Invalid value for 'purpose': '%s'.", purpose))
+		return
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		fileError(c, http.StatusBadRequest, "file", "'file' is a required property")
+		return
+	}
+	if purpose == model.FilePurposeBatch && filepath.Ext(header.Filename) != ".jsonl" {
+		fileError(c, http.StatusBadRequest, "file", "Invalid file format for Batch API. Must be .jsonl")
+		return
+	}
+	maxBytes := int64(operation_setting.GetBatchSetting().MaxFileSizeMB) << 20
+	if header.Size > maxBytes {
+		fileError(c, http.StatusBadRequest, "file", fmt.Sprintf("File is too large, the maximum size is %d MB", maxBytes>>20))
+		return
+	}
+	src, err := header.Open()
+	if err != nil {
+		fileStoreError(c, err)
+		return
+	}
+	defer src.Close()
+
+	file := &model.File{
+		FileId:   service.NewFileId(),
+		UserId:   c.GetInt("id"),
+		Filename: header.Filename,
+		Purpose:  purpose,
+	}
+	file.Bytes, err = service.SaveFileContent(file.FileId, src, maxBytes)
+	if err != nil {
+		fileError(c, http.StatusBadRequest, "file", err.Error())
+		return
+	}
+	if err := file.Insert(); err != nil {
+		_ = service.DeleteFileContent(file.FileId)
+		fileStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, file2Object(file))
+}
+
+// ListFiles GET /v1/files
+func ListFiles(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10000"))
+	if limit < 1 || limit > 10000 {
+		limit = 10000
+	}
+	files, err := model.GetUserFiles(c.GetInt("id"), c.Query("purpose"), c.Query("after"), limit+1, c.DefaultQuery("order", "desc") == "desc")
+	if exist, err := model.RecordExist(err); !exist && err != nil {
+		fileStoreError(c, err)
+		return
+	}
+	hasMore := len(files) > limit
+	if hasMore {
+		files = files[:limit]
+	}
+	data := make([]*dto.FileObject, 0, len(files))
+	for _, file := range files {
+		data = append(data, file2Object(file))
+	}
+	response := gin.H{
+		"object":   "list",
+		"data":     data,
+		"first_id": nil,
+		"last_id":  nil,
+		"has_more": hasMore,
+	}
+	if len(data) > 0 {
+		response["first_id"] = data[0].Id
+		response["last_id"] = data[len(data)-1].Id
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// GetFile GET /v1/files/{id}
+func GetFile(c *gin.Context) {
+	file := getUserFile(c)
+	if file == nil {
+		return
+	}
+	c.JSON(http.StatusOK, file2Object(file))
+}
+
+// DeleteFile DELETE /v1/files/{id}
+func DeleteFile(c *gin.Context) {
+	if !checkFileStorage(c) {
+		return
+	}
+	fileId := c.Param("id")
+	err := model.DeleteUserFile(c.GetInt("id"), fileId)
+	if exist, err := model.RecordExist(err); !exist {
+		if err != nil {
+			fileStoreError(c, err)
+		} else {
+			fileNotFound(c, fileId)
+		}
+		return
+	}
+	if err := service.DeleteFileContent(fileId); err != nil {
+		common.SysError(fmt.Sprintf("failed to delete file content %s: %s", fileId, err.Error()))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":      fileId,
+		"object":  "file",
+		"deleted": true,
+	})
+}
+
+// GetFileContent GET /v1/files/{id}/content
+func GetFileContent(c *gin.Context) {
+	if !checkFileStorage(c) {
+		return
+	}
+	file := getUserFile(c)
+	if file == nil {
+		return
+	}
+	content, err := service.OpenFileContent(file.FileId)
+	if err != nil {
+		fileStoreError(c, err)
+		return
+	}
+	defer content.Close()
+	c.DataFromReader(http.StatusOK, file.Bytes, "application/octet-stream", content, map[string]string{
+		"Content-Disposition": fmt.Sprintf(`attachment; filename="%s"`, file.Filename),
+	})
+}
@@ -0,0 +1,451 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+	"veloera/common"
+	"veloera/constant"
+	"veloera/dto"
+	"veloera/model"
+	"veloera/service"
+	"veloera/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fineTuningChannelTypes 支持微调的渠道类型
+var fineTuningChannelTypes = []int{common.ChannelTypeOpenAI, common.ChannelTypeAzure}
+
+func fineTuningJobNotFound(c *gin.Context, jobId string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": dto.OpenAIError{
+			Message: fmt.Sprintf("Could not find fine tune job: %s", jobId),
+			Type:    "invalid_request_error",
+			Param:   "fine_tuning_job_id",
+		},
+	})
+}
+
+func fineTuningStoreError(c *gin.Context, err error) {
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": dto.OpenAIError{
+			Message: err.Error(),
+			Type:    "veloera_error",
+			Code:    "fine_tuning_store_error",
+		},
+	})
+}
+
+func fineTuningUpstreamError(c *gin.Context, err error) {
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": dto.OpenAIError{
+			Message: err.Error(),
+			Type:    "veloera_error",
+			Code:    "do_request_failed",
+		},
+	})
+}
+
+// fineTuningJobObject 返回上游任务对象，文件 id 替换为本地文件 id
+func fineTuningJobObject(job *model.FineTuningJob) map[string]any {
+	object := make(map[string]any)
+	if len(job.Data) > 0 {
+		_ = json.Unmarshal(job.Data, &object)
+	}
+	object["id"] = job.JobId
+	object["object"] = "fine_tuning.job"
+	object["model"] = job.Model
+	object["status"] = job.Status
+	object["training_file"] = job.TrainingFile
+	if job.ValidationFile != "" {
+		object["validation_file"] = job.ValidationFile
+	} else {
+		object["validation_file"] = nil
+	}
+	if job.FineTunedModel != "" {
+		object["fine_tuned_model"] = job.FineTunedModel
+	} else {
+		object["fine_tuned_model"] = nil
+	}
+	return object
+}
+
+// getUserFineTuningJob returns the fine-tuning job of the current user, or writes the error response and returns nil
+func getUserFineTuningJob(c *gin.Context) *model.FineTuningJob {
+	jobId := c.Param("id")
+	job, err := model.GetUserFineTuningJob(c.GetInt("id"), jobId)
+	if exist, err := model.RecordExist(err); !exist {
+		if err != nil {
+			fineTuningStoreError(c, err)
+		} else {
+			fineTuningJobNotFound(c, jobId)
+		}
+		return nil
+	}
+	return job
+}
+
+// getFineTuningJobUpstream 返回任务所属的渠道和 key
+func getFineTuningJobUpstream(job *model.FineTuningJob) (*service.FineTuningUpstream, error) {
+	channel, err := model.GetChannelById(job.ChannelId, true)
+	if err != nil {
+		return nil, fmt.Errorf("the channel #%d that owns this fine-tuning job is no longer available", job.ChannelId)
+	}
+	return service.NewFineTuningUpstream(channel, job.KeyHash)
+}
+
+// getFineTuningFile returns the local file used as training or validation file, or writes the error response and returns nil
+func getFineTuningFile(c *gin.Context, param string, fileId string) *model.File {
+	file, err := model.GetUserFile(c.GetInt("id"), fileId)
+	if exist, err := model.RecordExist(err); !exist {
+		if err != nil {
+			fileStoreError(c, err)
+		} else {
+			fileError(c, http.StatusBadRequest, param, fmt.Sprintf("invalid file id: %s", fileId))
+		}
+		return nil
+	}
+	if file.Purpose != "fine-tune" {
+		fileError(c, http.StatusBadRequest, param, fmt.Sprintf("File %s has purpose '%s', expected 'fine-tune'", fileId, file.Purpose))
+		return nil
+	}
+	return file
+}
+
+// writeUpstreamResponse 原样返回上游响应
+func writeUpstreamResponse(c *gin.Context, statusCode int, body []byte) {
+	c.Data(statusCode, "application/json", body)
+}
+
+// updateFineTuningJob 根据上游返回的任务对象更新本地任务，任务成功时将微调模型加入渠道
+func updateFineTuningJob(job *model.FineTuningJob, body []byte) error {
+	var upstreamJob struct {
+		Status         string  `json:"status"`
+		FineTunedModel *string `json:"fine_tuned_model"`
+	}
+	if err := json.Unmarshal(body, &upstreamJob); err != nil {
+		return fmt.Errorf("unmarshal fine-tuning job failed: %w", err)
+	}
+	previousStatus := job.Status
+	fields := map[string]any{
+		"data": json.RawMessage(body),
+	}
+	if upstreamJob.Status != "" {
+		fields["status"] = upstreamJob.Status
+		job.Status = upstreamJob.Status
+	}
+	if upstreamJob.FineTunedModel != nil && *upstreamJob.FineTunedModel != "" {
+		fields["fine_tuned_model"] = *upstreamJob.FineTunedModel
+		job.FineTunedModel = *upstreamJob.FineTunedModel
+	}
+	job.Data = body
+	if err := job.Update(fields); err != nil {
+		return err
+	}
+	if job.Status == model.FineTuningStatusSucceeded && previousStatus != model.FineTuningStatusSucceeded && job.FineTunedModel != "" {
+		if err := model.AddChannelModel(job.ChannelId, job.FineTunedModel); err != nil {
+			return fmt.Errorf("add fine-tuned model %s to channel #%d failed: %w", job.FineTunedModel, job.ChannelId, err)
+		}
+		common.SysLog(fmt.Sprintf("fine-tuned model %s added to channel #%d", job.FineTunedModel, job.ChannelId))
+	}
+	return nil
+}
+
+// refreshFineTuningJob 从上游获取任务的最新状态，返回上游的状态码和响应
+func refreshFineTuningJob(job *model.FineTuningJob) (int, []byte, error) {
+	upstream, err := getFineTuningJobUpstream(job)
+	if err != nil {
+		return 0, nil, err
+	}
+	resp, err := upstream.Do(http.MethodGet, "/fine_tuning/jobs/"+url.PathEscape(job.JobId), nil, nil, "")
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		if err := updateFineTuningJob(job, body); err != nil {
+			return 0, nil, err
+		}
+	}
+	return resp.StatusCode, body, nil
+}
+
+// RunFineTuningJobPoller 定期刷新未结束的微调任务，只在主节点运行
+func RunFineTuningJobPoller() {
+	for {
+		interval := operation_setting.GetFineTuningSetting().PollIntervalSeconds
+		if interval <= 0 {
+			interval = 60
+		}
+		time.Sleep(time.Duration(interval) * time.Second)
+		jobs, err := model.GetUnfinishedFineTuningJobs()
+		if err != nil {
+			common.SysError("failed to get unfinished fine-tuning jobs: " + err.Error())
+			continue
+		}
+		for _, job := range jobs {
+			statusCode, _, err := refreshFineTuningJob(job)
+			if err != nil {
+				common.SysError(fmt.Sprintf("failed to refresh fine-tuning job %s: %s", job.JobId, err.Error()))
+			} else if statusCode != http.StatusOK {
+				common.SysError(fmt.Sprintf("failed to refresh fine-tuning job %s: status code %d", job.JobId, statusCode))
+			}
+		}
+	}
+}
+
+// CreateFineTuningJob POST /v1/fine_tuning/jobs
+func CreateFineTuningJob(c *gin.Context) {
+	if !operation_setting.GetFineTuningSetting().Enabled {
+		RelayNotImplemented(c)
+		return
+	}
+	// 训练文件需要从本地存储上传到渠道
+	if !checkFileStorage(c) {
+		return
+	}
+	allowIpsMap := c.GetStringMap("allow_ips")
+	if len(allowIpsMap) != 0 {
+		if _, ok := allowIpsMap[c.ClientIP()]; !ok {
+			fileError(c, http.StatusForbidden, "", "您的 IP 不在令牌允许访问的列表中")
+			return
+		}
+	}
+	var request map[string]any
+	if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+		fileError(c, http.StatusBadRequest, "", "Invalid request, "+err.Error())
+		return
+	}
+	modelName, _ := request["model"].(string)
+	if modelName == "" {
+		fileError(c, http.StatusBadRequest, "model", "Missing required parameter: 'model'.")
+		return
+	}
+	trainingFileId, _ := request["training_file"].(string)
+	if trainingFileId == "" {
+		fileError(c, http.StatusBadRequest, "training_file", "Missing required parameter: 'training_file'.")
+		return
+	}
+	validationFileId, _ := request["validation_file"].(string)
+	if c.GetBool("token_model_limit_enabled") {
+		tokenModelLimit, _ := c.Get("token_model_limit")
+		if limit, ok := tokenModelLimit.(map[string]bool); !ok || !limit[modelName] {
+			fileError(c, http.StatusForbidden, "model", "该令牌无权访问模型 "+modelName)
+			return
+		}
+	}
+
+	trainingFile := getFineTuningFile(c, "training_file", trainingFileId)
+	if trainingFile == nil {
+		return
+	}
+	var validationFile *model.File
+	if validationFileId != "" {
+		validationFile = getFineTuningFile(c, "validation_file", validationFileId)
+		if validationFile == nil {
+			return
+		}
+	}
+
+	group := c.GetString(constant.ContextKeyUserGroup)
+	if tokenGroup := c.GetString("token_group"); tokenGroup != "" {
+		group = tokenGroup
+	}
+	channel, err := model.GetFineTuningChannel(group, modelName, fineTuningChannelTypes)
+	if err != nil {
+		fileError(c, http.StatusServiceUnavailable, "model", fmt.Sprintf("当前分组 %s 下对于模型 %s 无可用的微调渠道", group, modelName))
+		return
+	}
+	upstream, err := service.NewFineTuningUpstream(channel, "")
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+
+	// 训练文件保存在本地，先上传到选中的渠道
+	request["training_file"], err = upstream.GetUpstreamFileId(trainingFile)
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+	if validationFile != nil {
+		request["validation_file"], err = upstream.GetUpstreamFileId(validationFile)
+		if err != nil {
+			fineTuningUpstreamError(c, err)
+			return
+		}
+	}
+	requestBody, err := json.Marshal(request)
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+	resp, err := upstream.Do(http.MethodPost, "/fine_tuning/jobs", nil, bytes.NewReader(requestBody), "application/json")
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		writeUpstreamResponse(c, resp.StatusCode, body)
+		return
+	}
+	var upstreamJob struct {
+		Id     string `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(body, &upstreamJob); err != nil || upstreamJob.Id == "" {
+		fineTuningUpstreamError(c, fmt.Errorf("invalid fine-tuning job response: %s", string(body)))
+		return
+	}
+	job := &model.FineTuningJob{
+		JobId:          upstreamJob.Id,
+		UserId:         c.GetInt("id"),
+		TokenId:        c.GetInt("token_id"),
+		ChannelId:      channel.Id,
+		KeyHash:        upstream.KeyHash(),
+		Model:          modelName,
+		TrainingFile:   trainingFileId,
+		ValidationFile: validationFileId,
+		Status:         upstreamJob.Status,
+		Data:           body,
+	}
+	if err := job.Insert(); err != nil {
+		fineTuningStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, fineTuningJobObject(job))
+}
+
+// ListFineTuningJobs GET /v1/fine_tuning/jobs
+func ListFineTuningJobs(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.Query("limit"))
+	if limit <= 0 || limit > 100 {
+		limit = 20
+	}
+	jobs, err := model.GetUserFineTuningJobs(c.GetInt("id"), c.Query("after"), limit+1)
+	if exist, err := model.RecordExist(err); !exist && err != nil {
+		fineTuningStoreError(c, err)
+		return
+	}
+	hasMore := len(jobs) > limit
+	if hasMore {
+		jobs = jobs[:limit]
+	}
+	data := make([]map[string]any, 0, len(jobs))
+	for _, job := range jobs {
+		data = append(data, fineTuningJobObject(job))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"object":   "list",
+		"data":     data,
+		"has_more": hasMore,
+	})
+}
+
+// GetFineTuningJob GET /v1/fine_tuning/jobs/:id
+func GetFineTuningJob(c *gin.Context) {
+	job := getUserFineTuningJob(c)
+	if job == nil {
+		return
+	}
+	statusCode, body, err := refreshFineTuningJob(job)
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+	if statusCode != http.StatusOK {
+		writeUpstreamResponse(c, statusCode, body)
+		return
+	}
+	c.JSON(http.StatusOK, fineTuningJobObject(job))
+}
+
+// CancelFineTuningJob POST /v1/fine_tuning/jobs/:id/cancel
+func CancelFineTuningJob(c *gin.Context) {
+	job := getUserFineTuningJob(c)
+	if job == nil {
+		return
+	}
+	upstream, err := getFineTuningJobUpstream(job)
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+	resp, err := upstream.Do(http.MethodPost, "/fine_tuning/jobs/"+url.PathEscape(job.JobId)+"/cancel", nil, nil, "")
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		writeUpstreamResponse(c, resp.StatusCode, body)
+		return
+	}
+	if err := updateFineTuningJob(job, body); err != nil {
+		fineTuningStoreError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, fineTuningJobObject(job))
+}
+
+// ListFineTuningJobEvents GET /v1/fine_tuning/jobs/:id/events
+func ListFineTuningJobEvents(c *gin.Context) {
+	relayFineTuningJobList(c, "events")
+}
+
+// ListFineTuningJobCheckpoints GET /v1/fine_tuning/jobs/:id/checkpoints
+func ListFineTuningJobCheckpoints(c *gin.Context) {
+	relayFineTuningJobList(c, "checkpoints")
+}
+
+// relayFineTuningJobList 将任务的事件和检查点列表请求透传到任务所属的渠道
+func relayFineTuningJobList(c *gin.Context, resource string) {
+	job := getUserFineTuningJob(c)
+	if job == nil {
+		return
+	}
+	upstream, err := getFineTuningJobUpstream(job)
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+	query := url.Values{}
+	for _, key := range []string{"after", "limit"} {
+		if value := c.Query(key); value != "" {
+			query.Set(key, value)
+		}
+	}
+	resp, err := upstream.Do(http.MethodGet, "/fine_tuning/jobs/"+url.PathEscape(job.JobId)+"/"+resource, query, nil, "")
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		fineTuningUpstreamError(c, err)
+		return
+	}
+	writeUpstreamResponse(c, resp.StatusCode, body)
+}
@@ -0,0 +1,82 @@
+package controller
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"veloera/common"
+	"veloera/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ExportGatewayConfig 导出渠道和选项为 YAML，keys=encrypt 时导出加密的渠道 key，默认不导出
+func ExportGatewayConfig(c *gin.Context) {
+	cfg, err := service.ExportGatewayConfig(c.Query("keys"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	data, err := service.MarshalGatewayConfig(cfg)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.Header("Content-Disposition", "attachment; filename=veloera-config.yaml")
+	c.Data(http.StatusOK, "application/yaml; charset=utf-8", data)
+}
+
+// ImportGatewayConfig 导入 YAML 或 JSON 格式的配置并返回差异，dry_run=true 时只返回差异，
+// prune=true 时删除配置中没有的渠道
+func ImportGatewayConfig(c *gin.Context) {
+	dryRun, _ := strconv.ParseBool(c.Query("dry_run"))
+	prune, _ := strconv.ParseBool(c.Query("prune"))
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	cfg, err := service.ParseGatewayConfig(data)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	plan, err := service.PlanGatewayConfig(cfg, prune)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	if !dryRun {
+		if err := service.ApplyGatewayConfigPlan(plan); err != nil {
+			c.JSON(http.StatusOK, gin.H{
+				"success": false,
+				"message": err.Error(),
+			})
+			return
+		}
+		common.SysLog("gateway config imported by user " + strconv.Itoa(c.GetInt("id")))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data": gin.H{
+			"dry_run": dryRun,
+			"changes": plan.Changes,
+		},
+	})
+}
@@ -212,3 +212,45 @@ func DeleteHistoryLogs(c *gin.Context) {
 	})
 	return
 }
+
+// GetHedgeCosts 返回对冲请求中落败一方的上游消耗，以及按渠道的汇总
+func GetHedgeCosts(c *gin.Context) {
+	p, _ := strconv.Atoi(c.Query("p"))
+	pageSize, _ := strconv.Atoi(c.Query("page_size"))
+	if p < 1 {
+		p = 1
+	}
+	if pageSize <= 0 {
+		pageSize = common.ItemsPerPage
+	}
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	channel, _ := strconv.Atoi(c.Query("channel"))
+	costs, total, err := model.GetHedgeCosts(startTimestamp, endTimestamp, channel, (p-1)*pageSize, pageSize)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	stats, err := model.GetHedgeCostStats(startTimestamp, endTimestamp)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data": map[string]any{
+			"items":     costs,
+			"total":     total,
+			"page":      p,
+			"page_size": pageSize,
+			"channels":  stats,
+		},
+	})
+}
@@ -0,0 +1,361 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+	"veloera/common"
+	constant2 "veloera/constant"
+	"veloera/dto"
+	"veloera/middleware"
+	"veloera/model"
+	relaycommon "veloera/relay/common"
+	relayconstant "veloera/relay/constant"
+	"veloera/service"
+	"veloera/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+var errHedgeLost = errors.New("hedged request lost to another channel")
+
+// hedgeRace 同一个请求的多个对冲尝试，最先写出响应的尝试获胜，其响应直接写给客户端，其余尝试被取消
+type hedgeRace struct {
+	mu      sync.Mutex
+	writer  gin.ResponseWriter
+	winner  *hedgeRun
+	runs    []*hedgeRun
+	claimed chan struct{}
+}
+
+// hedgeRun 一次对冲尝试，使用独立的 gin.Context 和可取消的上游请求
+type hedgeRun struct {
+	c        *gin.Context
+	channel  *model.Channel
+	cancel   context.CancelFunc
+	attempt  *model.HedgeAttempt
+	lost     chan bool
+	loseOnce sync.Once
+	done     chan struct{}
+	err      *dto.OpenAIErrorWithStatusCode
+	failed   bool // 尝试本身失败，而不是落败后被取消
+}
+
+func (r *hedgeRun) lose() {
+	r.loseOnce.Do(func() {
+		r.attempt.Lose()
+		r.cancel()
+		close(r.lost)
+	})
+}
+
+// claim 尝试成为获胜者，获胜时把缓存的响应头写给客户端并取消其他尝试
+func (race *hedgeRace) claim(run *hedgeRun, header http.Header, status int) bool {
+	race.mu.Lock()
+	defer race.mu.Unlock()
+	if race.winner != nil {
+		return race.winner == run
+	}
+	race.winner = run
+	for key, values := range header {
+		race.writer.Header()[key] = values
+	}
+	if status != 0 {
+		race.writer.WriteHeader(status)
+	}
+	for _, other := range race.runs {
+		if other != run {
+			other.lose()
+		}
+	}
+	close(race.claimed)
+	return true
+}
+
+func (race *hedgeRace) getWinner() *hedgeRun {
+	race.mu.Lock()
+	defer race.mu.Unlock()
+	return race.winner
+}
+
+// start 在新的 goroutine 中发起一次尝试，已有获胜者或 setup 失败时不再发起并返回 nil
+func (race *hedgeRace) start(c *gin.Context, relayMode int, channel *model.Channel, setup func(ac *gin.Context) error) *hedgeRun {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	ac := c.Copy()
+	ac.Request = c.Request.Clone(ctx)
+	run := &hedgeRun{
+		c:       ac,
+		channel: channel,
+		cancel:  cancel,
+		attempt: &model.HedgeAttempt{},
+		lost:    make(chan bool),
+		done:    make(chan struct{}),
+	}
+	writer := &hedgeWriter{ResponseWriter: race.writer, race: race, run: run, header: make(http.Header)}
+	ac.Writer = writer
+	ac.Set(constant2.ContextKeyHedgeAttempt, run.attempt)
+	if setup != nil {
+		if err := setup(ac); err != nil {
+			cancel()
+			return nil
+		}
+	}
+
+	race.mu.Lock()
+	if race.winner != nil {
+		race.mu.Unlock()
+		cancel()
+		return nil
+	}
+	race.runs = append(race.runs, run)
+	race.mu.Unlock()
+
+	go func() {
+		defer close(run.done)
+		defer cancel()
+		defer func() {
+			if err := recover(); err != nil {
+				common.SysError(fmt.Sprintf("panic detected: %v", err))
+				common.SysError(fmt.Sprintf("stacktrace from panic: %s", string(debug.Stack())))
+				run.err = service.OpenAIErrorWrapperLocal(fmt.Errorf("panic detected: %v", err), "veloera_panic", http.StatusInternalServerError)
+				run.failed = true
+			}
+		}()
+		run.err = relayRequest(ac, relayMode, channel)
+		if run.err == nil {
+			// 成功但没有写出任何内容时，以完成的时间决定胜负
+			writer.claim()
+		}
+		run.failed = run.err != nil && !run.attempt.Lost()
+		if run.attempt.Lost() {
+			settleHedgeLoser(run, race.getWinner())
+		}
+	}()
+	return run
+}
+
+// finish 把返回结果的尝试的上下文写回原请求，处理其他失败的尝试的渠道错误
+func (race *hedgeRace) finish(c *gin.Context, result *hedgeRun) *dto.OpenAIErrorWithStatusCode {
+	for key, value := range result.c.Keys {
+		if key != constant2.ContextKeyHedgeAttempt {
+			c.Set(key, value)
+		}
+	}
+	race.mu.Lock()
+	runs := race.runs
+	race.mu.Unlock()
+	for _, run := range runs {
+		if run == result {
+			continue
+		}
+		select {
+		case <-run.done:
+			if run.failed {
+				go processChannelError(run.c, run.channel.Id, run.channel.Type, run.channel.Name,
+					run.c.GetString(constant2.ContextKeyChannelKeyHash), run.channel.GetAutoBan(), run.err)
+			}
+		default:
+		}
+	}
+	return result.err
+}
+
+// settleHedgeLoser 退还落败尝试已扣除的额度，并将其上游消耗记录为对冲成本
+func settleHedgeLoser(run *hedgeRun, winner *hedgeRun) {
+	c := run.c
+	var relayInfo *relaycommon.RelayInfo
+	if info, ok := c.Get(constant2.ContextKeyRelayInfo); ok {
+		relayInfo, _ = info.(*relaycommon.RelayInfo)
+	}
+	promptTokens, completionTokens, quota, billed := run.attempt.Usage()
+	if billed {
+		refundToken := relayInfo == nil || !relayInfo.IsPlayground
+		err := model.RefundHedgeQuota(c.GetInt("id"), c.GetInt("token_id"), c.GetString("token_key_hash"), quota, refundToken)
+		if err != nil {
+			common.LogError(c, "failed to refund hedged request: "+err.Error())
+		}
+	} else if relayInfo != nil {
+		// 计费前被取消，按预估的输入 token 数记录
+		promptTokens = relayInfo.PromptTokens
+	}
+	cost := &model.HedgeCost{
+		RequestId:        c.GetString(common.RequestIdKey),
+		UserId:           c.GetInt("id"),
+		TokenId:          c.GetInt("token_id"),
+		ChannelId:        run.channel.Id,
+		ModelName:        c.GetString("original_model"),
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		Quota:            quota,
+		Cancelled:        !billed,
+	}
+	if winner != nil {
+		cost.WinnerChannelId = winner.channel.Id
+	}
+	model.RecordHedgeCost(cost)
+}
+
+// hedgingDelay 返回请求的对冲阈值，令牌或分组未启用对冲时返回 false
+func hedgingDelay(c *gin.Context, relayMode int) (time.Duration, bool) {
+	switch relayMode {
+	case relayconstant.RelayModeChatCompletions, relayconstant.RelayModeCompletions, relayconstant.RelayModeResponses:
+	default:
+		return 0, false
+	}
+	if _, ok := c.Get("specific_channel_id"); ok {
+		return 0, false
+	}
+	if middleware.GetVirtualModelFallback(c) != nil {
+		return 0, false
+	}
+	if !c.GetBool("token_hedging_enabled") && !operation_setting.IsHedgingGroup(c.GetString("group")) {
+		return 0, false
+	}
+	delay := time.Duration(operation_setting.GetHedgingSetting().DelayMs) * time.Millisecond
+	return delay, delay > 0
+}
+
+// hedgedRelayRequest 首个渠道超过阈值仍未写出响应时，在另一个渠道上发起对冲请求，
+// 先写出响应的一方获胜，另一方被取消且不向用户计费
+func hedgedRelayRequest(c *gin.Context, relayMode int, channel *model.Channel, delay time.Duration) *dto.OpenAIErrorWithStatusCode {
+	race := &hedgeRace{writer: c.Writer, claimed: make(chan struct{})}
+	primary := race.start(c, relayMode, channel, nil)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-primary.done:
+		return race.finish(c, primary)
+	case <-race.claimed:
+		<-primary.done
+		return race.finish(c, primary)
+	case <-timer.C:
+	}
+
+	originalModel := c.GetString("original_model")
+	hedgeChannel := middleware.SelectAlternateChannel(c, c.GetString("group"), originalModel, channel.Id, nil)
+	var hedge *hedgeRun
+	if hedgeChannel != nil {
+		hedge = race.start(c, relayMode, hedgeChannel, func(ac *gin.Context) error {
+			return middleware.SetupContextForSelectedChannel(ac, hedgeChannel, originalModel)
+		})
+	}
+	if hedge == nil {
+		<-primary.done
+		return race.finish(c, primary)
+	}
+	common.LogInfo(c, fmt.Sprintf("channel #%d has not responded in %d ms, hedging on channel #%d", channel.Id, delay.Milliseconds(), hedgeChannel.Id))
+
+	allDone := make(chan struct{})
+	go func() {
+		<-primary.done
+		<-hedge.done
+		close(allDone)
+	}()
+	select {
+	case <-race.claimed:
+	case <-allDone:
+	}
+	if winner := race.getWinner(); winner != nil {
+		<-winner.done
+		if winner == hedge {
+			common.LogInfo(c, fmt.Sprintf("hedged request on channel #%d won", hedgeChannel.Id))
+		}
+		return race.finish(c, winner)
+	}
+	// 两个尝试都失败，按首个渠道的错误处理
+	return race.finish(c, primary)
+}
+
+// hedgeWriter 在获胜前缓存响应头并丢弃输出，获胜后直接写给客户端
+type hedgeWriter struct {
+	gin.ResponseWriter
+	race   *hedgeRace
+	run    *hedgeRun
+	header http.Header
+	status int
+	won    atomic.Bool // 流式响应的保活也会在其他 goroutine 中写入
+}
+
+func (w *hedgeWriter) claim() bool {
+	if !w.won.Load() && w.race.claim(w.run, w.header, w.status) {
+		w.won.Store(true)
+	}
+	return w.won.Load()
+}
+
+func (w *hedgeWriter) Header() http.Header {
+	if w.won.Load() {
+		return w.ResponseWriter.Header()
+	}
+	return w.header
+}
+
+func (w *hedgeWriter) WriteHeader(code int) {
+	if w.won.Load() {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+}
+
+func (w *hedgeWriter) WriteHeaderNow() {
+	if w.won.Load() {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *hedgeWriter) Write(data []byte) (int, error) {
+	if !w.claim() {
+		return 0, errHedgeLost
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *hedgeWriter) WriteString(s string) (int, error) {
+	if !w.claim() {
+		return 0, errHedgeLost
+	}
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *hedgeWriter) Flush() {
+	if w.won.Load() {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *hedgeWriter) Status() int {
+	if w.won.Load() {
+		return w.ResponseWriter.Status()
+	}
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *hedgeWriter) Size() int {
+	if w.won.Load() {
+		return w.ResponseWriter.Size()
+	}
+	return -1
+}
+
+func (w *hedgeWriter) Written() bool {
+	if w.won.Load() {
+		return w.ResponseWriter.Written()
+	}
+	return false
+}
+
+func (w *hedgeWriter) CloseNotify() <-chan bool {
+	if w.won.Load() {
+		return w.ResponseWriter.CloseNotify()
+	}
+	return w.run.lost
+}
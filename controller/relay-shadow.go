@@ -0,0 +1,290 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"strings"
+	"sync/atomic"
+	"time"
+	"veloera/common"
+	constant2 "veloera/constant"
+	"veloera/dto"
+	"veloera/middleware"
+	"veloera/model"
+	"veloera/relay"
+	relaycommon "veloera/relay/common"
+	relayconstant "veloera/relay/constant"
+	"veloera/relay/helper"
+	"veloera/service"
+	"veloera/setting/operation_setting"
+
+	"github.com/bytedance/gopkg/util/gopool"
+	"github.com/gin-gonic/gin"
+)
+
+// maxShadowCaptureSize 记录原请求响应的上限，超出的部分不参与比较
+const maxShadowCaptureSize = 1 << 20
+
+var shadowTrafficRunning atomic.Int64
+
+// shadowCaptureWriter 记录原请求写给客户端的响应，用于与影子响应比较
+type shadowCaptureWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *shadowCaptureWriter) capture(data []byte) {
+	if remaining := maxShadowCaptureSize - w.body.Len(); remaining > 0 {
+		if len(data) > remaining {
+			data = data[:remaining]
+		}
+		w.body.Write(data)
+	}
+}
+
+func (w *shadowCaptureWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *shadowCaptureWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+// shadowTraffic 被抽中复制的请求，原请求结束后按规则向影子渠道发起请求
+type shadowTraffic struct {
+	rules     []operation_setting.ShadowTrafficRule
+	body      []byte
+	group     string
+	modelName string
+	writer    *shadowCaptureWriter
+	start     time.Time
+}
+
+// startShadowTraffic 按规则的比例抽样，被抽中时记录原请求的请求体和写给客户端的响应，没有抽中时返回 nil
+func startShadowTraffic(c *gin.Context, relayMode int) *shadowTraffic {
+	if relayMode != relayconstant.RelayModeChatCompletions {
+		return nil
+	}
+	group := c.GetString("group")
+	modelName := c.GetString("original_model")
+	var rules []operation_setting.ShadowTrafficRule
+	for _, rule := range operation_setting.MatchShadowTrafficRules(group, modelName) {
+		if rand.Float64()*100 < rule.Percentage {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	body, err := common.GetRequestBody(c)
+	if err != nil {
+		return nil
+	}
+	writer := &shadowCaptureWriter{ResponseWriter: c.Writer}
+	c.Writer = writer
+	return &shadowTraffic{
+		rules:     rules,
+		body:      body,
+		group:     group,
+		modelName: modelName,
+		writer:    writer,
+		start:     time.Now(),
+	}
+}
+
+// mirror 在原请求结束后异步发起影子请求并记录对比结果，影子请求不影响客户端也不向用户计费
+func (s *shadowTraffic) mirror(c *gin.Context, openaiErr *dto.OpenAIErrorWithStatusCode) {
+	primaryLatency := time.Since(s.start).Milliseconds()
+	primaryText, primaryUsage := parseShadowResponse(s.writer.body.Bytes())
+	promptTokens := 0
+	if info, ok := c.Get(constant2.ContextKeyRelayInfo); ok {
+		if relayInfo, ok := info.(*relaycommon.RelayInfo); ok {
+			promptTokens = relayInfo.PromptTokens
+		}
+	}
+	if primaryUsage == nil {
+		// 响应中没有用量时按输出内容估算
+		primaryUsage, _ = service.ResponseText2Usage(primaryText, s.modelName, promptTokens)
+	}
+	base := model.ShadowComparison{
+		RequestId:               c.GetString(common.RequestIdKey),
+		UserId:                  c.GetInt("id"),
+		Group:                   s.group,
+		ModelName:               s.modelName,
+		PrimaryChannelId:        c.GetInt("channel_id"),
+		PrimaryLatency:          primaryLatency,
+		PrimaryPromptTokens:     primaryUsage.PromptTokens,
+		PrimaryCompletionTokens: primaryUsage.CompletionTokens,
+		PrimaryError:            openaiErr != nil,
+	}
+	maxConcurrency := int64(operation_setting.GetShadowTrafficSetting().MaxConcurrency)
+	for _, rule := range s.rules {
+		if shadowTrafficRunning.Add(1) > maxConcurrency {
+			shadowTrafficRunning.Add(-1)
+			common.LogWarn(c, fmt.Sprintf("too many shadow requests in flight, skipping shadow traffic rule %s", rule.Name))
+			continue
+		}
+		rule := rule
+		comparison := base
+		comparison.RuleName = rule.Name
+		comparison.ShadowChannelId = rule.ChannelId
+		gopool.Go(func() {
+			defer shadowTrafficRunning.Add(-1)
+			defer func() {
+				if err := recover(); err != nil {
+					common.SysError(fmt.Sprintf("shadow request panic: %v", err))
+					common.SysError(fmt.Sprintf("stacktrace from panic: %s", string(debug.Stack())))
+				}
+			}()
+			start := time.Now()
+			shadowText, shadowUsage, err := doShadowRequest(&comparison, rule, s.body, promptTokens)
+			comparison.ShadowLatency = time.Since(start).Milliseconds()
+			if err != nil {
+				comparison.ShadowError = true
+				comparison.ShadowErrorMessage = err.Error()
+			}
+			if shadowUsage != nil {
+				comparison.ShadowPromptTokens = shadowUsage.PromptTokens
+				comparison.ShadowCompletionTokens = shadowUsage.CompletionTokens
+			}
+			if rule.CompareResponse && !comparison.PrimaryError && !comparison.ShadowError {
+				similarity := service.TextSimilarity(primaryText, shadowText)
+				comparison.Similarity = &similarity
+			}
+			model.RecordShadowComparison(&comparison)
+		})
+	}
+}
+
+// doShadowRequest 与渠道测试相同，直接通过适配器向影子渠道发起请求，不经过计费，返回回复内容和用量
+func doShadowRequest(comparison *model.ShadowComparison, rule operation_setting.ShadowTrafficRule, body []byte, promptTokens int) (string, *dto.Usage, error) {
+	channel, err := model.GetChannelById(rule.ChannelId, true)
+	if err != nil {
+		return "", nil, err
+	}
+	var request dto.GeneralOpenAIRequest
+	if err := json.Unmarshal(body, &request); err != nil {
+		return "", nil, err
+	}
+	modelName := comparison.ModelName
+	if rule.Model != "" {
+		modelName = rule.Model
+	}
+	comparison.ShadowModel = modelName
+	comparison.IsStream = request.Stream
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request, _ = http.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Set(common.RequestIdKey, comparison.RequestId)
+	c.Set(constant2.ContextKeyRequestStartTime, time.Now())
+	if userCache, err := model.GetUserCache(comparison.UserId); err == nil {
+		userCache.WriteContext(c)
+	}
+	c.Set("group", comparison.Group)
+	defer middleware.ReleaseChannelSlots(c)
+	if err := middleware.SetupContextForSelectedChannel(c, channel, modelName); err != nil {
+		return "", nil, err
+	}
+
+	info := relaycommon.GenRelayInfo(c)
+	info.SetIsStream(request.Stream)
+	info.PromptTokens = promptTokens
+	if err := helper.ModelMappedHelper(c, info); err != nil {
+		return "", nil, err
+	}
+	request.Model = info.UpstreamModelName
+	if request.Stream && info.SupportStreamOptions {
+		request.StreamOptions = &dto.StreamOptions{IncludeUsage: true}
+	} else {
+		request.StreamOptions = nil
+	}
+
+	adaptor := relay.GetAdaptor(info.ApiType)
+	if adaptor == nil {
+		return "", nil, fmt.Errorf("invalid api type: %d, adaptor is nil", info.ApiType)
+	}
+	adaptor.Init(info)
+	convertedRequest, err := adaptor.ConvertOpenAIRequest(c, info, &request)
+	if err != nil {
+		return "", nil, err
+	}
+	jsonData, err := json.Marshal(convertedRequest)
+	if err != nil {
+		return "", nil, err
+	}
+	requestBody := bytes.NewBuffer(jsonData)
+	c.Request.Body = io.NopCloser(requestBody)
+	resp, err := adaptor.DoRequest(c, info, requestBody)
+	if err != nil {
+		return "", nil, err
+	}
+	httpResp, _ := resp.(*http.Response)
+	if httpResp == nil {
+		return "", nil, errors.New("empty response")
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		openaiErr := service.RelayErrorHandler(httpResp, true)
+		return "", nil, fmt.Errorf("status code %d: %s", httpResp.StatusCode, openaiErr.Error.Message)
+	}
+	usage, openaiErr := adaptor.DoResponse(c, httpResp, info)
+	if openaiErr != nil {
+		return "", nil, errors.New(openaiErr.Error.Message)
+	}
+	text, responseUsage := parseShadowResponse(w.Body.Bytes())
+	if u, ok := usage.(*dto.Usage); ok && u != nil {
+		responseUsage = u
+	}
+	return text, responseUsage, nil
+}
+
+// parseShadowResponse 从 OpenAI 格式的响应中提取回复内容和用量，流式响应拼接各数据块的内容，没有用量时返回 nil
+func parseShadowResponse(body []byte) (string, *dto.Usage) {
+	var builder strings.Builder
+	var usage *dto.Usage
+	trimmed := bytes.TrimSpace(body)
+	if !bytes.HasPrefix(trimmed, []byte("data:")) {
+		var response dto.OpenAITextResponse
+		if err := json.Unmarshal(trimmed, &response); err != nil {
+			return "", nil
+		}
+		for _, choice := range response.Choices {
+			builder.WriteString(choice.Message.StringContent())
+		}
+		if service.ValidUsage(&response.Usage) {
+			usage = &response.Usage
+		}
+		return builder.String(), usage
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 64*1024), maxShadowCaptureSize)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		data = strings.TrimSpace(data)
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var streamResponse dto.ChatCompletionsStreamResponse
+		if err := common.DecodeJsonStr(data, &streamResponse); err != nil {
+			continue
+		}
+		for _, choice := range streamResponse.Choices {
+			builder.WriteString(choice.Delta.GetContentString())
+		}
+		if service.ValidUsage(streamResponse.Usage) {
+			usage = streamResponse.Usage
+		}
+	}
+	return builder.String(), usage
+}
@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"veloera/common"
+	constant2 "veloera/constant"
+	"veloera/dto"
+	"veloera/middleware"
+	"veloera/model"
+	"veloera/relay"
+	relaycommon "veloera/relay/common"
+	"veloera/relay/helper"
+	"veloera/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// buildContinuationRequest 在原请求的消息之后附加已输出的内容和续写指令
+func buildContinuationRequest(requestBody []byte, text string, prompt string) ([]byte, error) {
+	var request map[string]json.RawMessage
+	if err := json.Unmarshal(requestBody, &request); err != nil {
+		return nil, err
+	}
+	var messages []any
+	if err := json.Unmarshal(request["messages"], &messages); err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, errors.New("request has no messages")
+	}
+	if text != "" {
+		messages = append(messages, map[string]any{"role": "assistant", "content": text})
+	}
+	if prompt != "" {
+		messages = append(messages, map[string]any{"role": "user", "content": prompt})
+	}
+	encoded, err := json.Marshal(messages)
+	if err != nil {
+		return nil, err
+	}
+	request["messages"] = encoded
+	return json.Marshal(request)
+}
+
+// continueInterruptedStream 流式响应中途中断时，把原请求和已输出的内容发给其他渠道续写，新的内容接在同一个流中，
+// 每一段按各自渠道的用量计费。没有可用的渠道时结束客户端的流
+func continueInterruptedStream(c *gin.Context, relayMode int, group string, originalModel string) {
+	continuation := relaycommon.GetStreamContinuation(c)
+	if continuation == nil || !continuation.Interrupted {
+		return
+	}
+	requestBody, err := common.GetRequestBody(c)
+	if err != nil {
+		finishInterruptedStream(c, continuation, nil)
+		return
+	}
+	failures := 0
+	for continuation.Interrupted && c.Request.Context().Err() == nil {
+		interruptedChannelId := c.GetInt("channel_id")
+		body, err := buildContinuationRequest(requestBody, continuation.Text, operation_setting.GetStreamFailoverSetting().ContinuationPrompt)
+		if err != nil {
+			common.LogError(c, "failed to build continuation request: "+err.Error())
+			break
+		}
+		middleware.ReleaseChannelSlots(c)
+		channel := middleware.SelectAlternateChannel(c, group, originalModel, interruptedChannelId, func(channel *model.Channel) bool {
+			return relay.SupportsStreamContinuation(channel.Type)
+		})
+		if channel == nil {
+			common.LogError(c, fmt.Sprintf("stream from channel #%d was interrupted and no other channel is available to continue it", interruptedChannelId))
+			break
+		}
+		if err := middleware.SetupContextForSelectedChannel(c, channel, originalModel); err != nil {
+			common.LogError(c, fmt.Sprintf("stream from channel #%d was interrupted and channel #%d is saturated", interruptedChannelId, channel.Id))
+			break
+		}
+		common.LogWarn(c, fmt.Sprintf("stream from channel #%d was interrupted, continuing on channel #%d", interruptedChannelId, channel.Id))
+		c.Set(constant2.ContextKeyPromptCacheAffinityRouted, false)
+		c.Set(common.KeyRequestBody, body)
+		continuation.Interrupted = false
+		openaiErr := relayRequest(c, relayMode, channel)
+		if openaiErr != nil {
+			go processChannelError(c, channel.Id, channel.Type, channel.Name, c.GetString(constant2.ContextKeyChannelKeyHash), channel.GetAutoBan(), openaiErr)
+			continuation.Interrupted = true
+			failures++
+			if failures > common.RetryTimes {
+				break
+			}
+		}
+	}
+	c.Set(common.KeyRequestBody, requestBody)
+	if continuation.Interrupted {
+		finishInterruptedStream(c, continuation, requestBody)
+	}
+}
+
+// finishInterruptedStream 无法续写时以 length 结束原因结束客户端的流，客户端要求返回用量时附上之前各段的用量
+func finishInterruptedStream(c *gin.Context, continuation *relaycommon.StreamContinuation, requestBody []byte) {
+	stop := helper.GenerateStopResponse(continuation.Id, continuation.Created, continuation.Model, "length")
+	if err := helper.ObjectData(c, stop); err != nil {
+		common.LogError(c, "failed to send stop response: "+err.Error())
+	}
+	var request dto.GeneralOpenAIRequest
+	if requestBody != nil && json.Unmarshal(requestBody, &request) == nil &&
+		request.StreamOptions != nil && request.StreamOptions.IncludeUsage {
+		usage := helper.GenerateFinalUsageResponse(continuation.Id, continuation.Created, continuation.Model, continuation.Usage)
+		if err := helper.ObjectData(c, usage); err != nil {
+			common.LogError(c, "failed to send usage response: "+err.Error())
+		}
+	}
+	helper.Done(c)
+}
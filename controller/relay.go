@@ -10,21 +10,25 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 	"veloera/common"
+	constant2 "veloera/constant"
 	"veloera/dto"
 	"veloera/middleware"
 	"veloera/model"
 	"veloera/relay"
+	relaycommon "veloera/relay/common"
 	"veloera/relay/constant"
 	relayconstant "veloera/relay/constant"
 	"veloera/relay/helper"
 	"veloera/service"
+	"veloera/setting/operation_setting"
 )
 
 func relayHandler(c *gin.Context, relayMode int) *dto.OpenAIErrorWithStatusCode {
 	var err *dto.OpenAIErrorWithStatusCode
 	switch relayMode {
-	case relayconstant.RelayModeImagesGenerations:
+	case relayconstant.RelayModeImagesGenerations, relayconstant.RelayModeImagesEdits, relayconstant.RelayModeImagesVariations:
 		err = relay.ImageHelper(c)
 	case relayconstant.RelayModeAudioSpeech:
 		fallthrough
@@ -51,7 +55,13 @@ func Relay(c *gin.Context) {
 	originalModel := c.GetString("original_model")
 	var openaiErr *dto.OpenAIErrorWithStatusCode
 
-	for i := 0; i <= common.RetryTimes; i++ {
+	if shadow := startShadowTraffic(c, relayMode); shadow != nil {
+		defer func() {
+			shadow.mirror(c, openaiErr)
+		}()
+	}
+
+	for i := 0; i <= getRetryTimes(c); i++ {
 		channel, err := getChannel(c, group, originalModel, i)
 		if err != nil {
 			common.LogError(c, err.Error())
@@ -59,15 +69,21 @@ func Relay(c *gin.Context) {
 			break
 		}
 
-		openaiErr = relayRequest(c, relayMode, channel)
+		if delay, ok := hedgingDelay(c, relayMode); ok {
+			openaiErr = hedgedRelayRequest(c, relayMode, channel, delay)
+		} else {
+			openaiErr = relayRequest(c, relayMode, channel)
+		}
 
 		if openaiErr == nil {
+			continueInterruptedStream(c, relayMode, group, originalModel)
+			middleware.RecordPromptCacheAffinity(c)
 			return // 成功处理请求，直接返回
 		}
 
-		go processChannelError(c, channel.Id, channel.Type, channel.Name, channel.GetAutoBan(), openaiErr)
+		go processChannelError(c, channel.Id, channel.Type, channel.Name, c.GetString(constant2.ContextKeyChannelKeyHash), channel.GetAutoBan(), openaiErr)
 
-		if !shouldRetry(c, openaiErr, common.RetryTimes-i) {
+		if !shouldRetry(c, openaiErr, getRemainingRetryTimes(c, i)) {
 			break
 		}
 	}
@@ -115,7 +131,7 @@ func WssRelay(c *gin.Context) {
 	originalModel := c.GetString("original_model")
 	var openaiErr *dto.OpenAIErrorWithStatusCode
 
-	for i := 0; i <= common.RetryTimes; i++ {
+	for i := 0; i <= getRetryTimes(c); i++ {
 		channel, err := getChannel(c, group, originalModel, i)
 		if err != nil {
 			common.LogError(c, err.Error())
@@ -126,12 +142,13 @@ func WssRelay(c *gin.Context) {
 		openaiErr = wssRequest(c, ws, relayMode, channel)
 
 		if openaiErr == nil {
+			middleware.RecordPromptCacheAffinity(c)
 			return // 成功处理请求，直接返回
 		}
 
-		go processChannelError(c, channel.Id, channel.Type, channel.Name, channel.GetAutoBan(), openaiErr)
+		go processChannelError(c, channel.Id, channel.Type, channel.Name, c.GetString(constant2.ContextKeyChannelKeyHash), channel.GetAutoBan(), openaiErr)
 
-		if !shouldRetry(c, openaiErr, common.RetryTimes-i) {
+		if !shouldRetry(c, openaiErr, getRemainingRetryTimes(c, i)) {
 			break
 		}
 	}
@@ -157,7 +174,7 @@ func RelayClaude(c *gin.Context) {
 	originalModel := c.GetString("original_model")
 	var claudeErr *dto.ClaudeErrorWithStatusCode
 
-	for i := 0; i <= common.RetryTimes; i++ {
+	for i := 0; i <= getRetryTimes(c); i++ {
 		channel, err := getChannel(c, group, originalModel, i)
 		if err != nil {
 			common.LogError(c, err.Error())
@@ -173,9 +190,9 @@ func RelayClaude(c *gin.Context) {
 
 		openaiErr := service.ClaudeErrorToOpenAIError(claudeErr)
 
-		go processChannelError(c, channel.Id, channel.Type, channel.Name, channel.GetAutoBan(), openaiErr)
+		go processChannelError(c, channel.Id, channel.Type, channel.Name, c.GetString(constant2.ContextKeyChannelKeyHash), channel.GetAutoBan(), openaiErr)
 
-		if !shouldRetry(c, openaiErr, common.RetryTimes-i) {
+		if !shouldRetry(c, openaiErr, getRemainingRetryTimes(c, i)) {
 			break
 		}
 	}
@@ -194,11 +211,86 @@ func RelayClaude(c *gin.Context) {
 	}
 }
 
+func RelayGemini(c *gin.Context) {
+	requestId := c.GetString(common.RequestIdKey)
+	group := c.GetString("group")
+	originalModel := c.GetString("original_model")
+	var openaiErr *dto.OpenAIErrorWithStatusCode
+
+	for i := 0; i <= getRetryTimes(c); i++ {
+		channel, err := getChannel(c, group, originalModel, i)
+		if err != nil {
+			common.LogError(c, err.Error())
+			openaiErr = service.OpenAIErrorWrapperLocal(err, "get_channel_failed", http.StatusInternalServerError)
+			break
+		}
+
+		openaiErr = geminiRequest(c, channel)
+
+		if openaiErr == nil {
+			middleware.RecordPromptCacheAffinity(c)
+			return // 成功处理请求，直接返回
+		}
+
+		go processChannelError(c, channel.Id, channel.Type, channel.Name, c.GetString(constant2.ContextKeyChannelKeyHash), channel.GetAutoBan(), openaiErr)
+
+		if !shouldRetry(c, openaiErr, getRemainingRetryTimes(c, i)) {
+			break
+		}
+	}
+	useChannel := c.GetStringSlice("use_channel")
+	if len(useChannel) > 1 {
+		retryLogStr := fmt.Sprintf("重试：%s", strings.Trim(strings.Join(strings.Fields(fmt.Sprint(useChannel)), "->"), "[]"))
+		common.LogInfo(c, retryLogStr)
+	}
+
+	if openaiErr != nil {
+		if openaiErr.StatusCode == http.StatusTooManyRequests {
+			common.LogError(c, fmt.Sprintf("origin 429 error: %s", openaiErr.Error.Message))
+			openaiErr.Error.Message = "当前分组上游负载已饱和，请稍后再试"
+		}
+		openaiErr.Error.Message = common.MessageWithRequestId(openaiErr.Error.Message, requestId)
+		// gemini 格式的错误
+		c.JSON(openaiErr.StatusCode, gin.H{
+			"error": gin.H{
+				"code":    openaiErr.StatusCode,
+				"message": openaiErr.Error.Message,
+				"status":  geminiErrorStatus(openaiErr.StatusCode),
+			},
+		})
+	}
+}
+
+func geminiErrorStatus(statusCode int) string {
+	switch statusCode {
+	case http.StatusBadRequest:
+		return "INVALID_ARGUMENT"
+	case http.StatusUnauthorized:
+		return "UNAUTHENTICATED"
+	case http.StatusForbidden:
+		return "PERMISSION_DENIED"
+	case http.StatusNotFound:
+		return "NOT_FOUND"
+	case http.StatusTooManyRequests:
+		return "RESOURCE_EXHAUSTED"
+	case http.StatusNotImplemented:
+		return "UNIMPLEMENTED"
+	case http.StatusServiceUnavailable:
+		return "UNAVAILABLE"
+	case http.StatusGatewayTimeout:
+		return "DEADLINE_EXCEEDED"
+	}
+	return "INTERNAL"
+}
+
 func relayRequest(c *gin.Context, relayMode int, channel *model.Channel) *dto.OpenAIErrorWithStatusCode {
 	addUsedChannel(c, channel.Id)
 	requestBody, _ := common.GetRequestBody(c)
 	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
-	return relayHandler(c, relayMode)
+	finish := startChannelAttempt(c, channel.Id)
+	openaiErr := relayHandler(c, relayMode)
+	finish(openaiErr)
+	return openaiErr
 }
 
 func wssRequest(c *gin.Context, ws *websocket.Conn, relayMode int, channel *model.Channel) *dto.OpenAIErrorWithStatusCode {
@@ -212,7 +304,102 @@ func claudeRequest(c *gin.Context, channel *model.Channel) *dto.ClaudeErrorWithS
 	addUsedChannel(c, channel.Id)
 	requestBody, _ := common.GetRequestBody(c)
 	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
-	return relay.ClaudeHelper(c)
+	finish := startChannelAttempt(c, channel.Id)
+	claudeErr := relay.ClaudeHelper(c)
+	if claudeErr != nil {
+		finish(service.ClaudeErrorToOpenAIError(claudeErr))
+	} else {
+		finish(nil)
+	}
+	return claudeErr
+}
+
+func geminiRequest(c *gin.Context, channel *model.Channel) *dto.OpenAIErrorWithStatusCode {
+	addUsedChannel(c, channel.Id)
+	requestBody, _ := common.GetRequestBody(c)
+	c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
+	finish := startChannelAttempt(c, channel.Id)
+	openaiErr := relay.GeminiHelper(c)
+	finish(openaiErr)
+	return openaiErr
+}
+
+// startChannelAttempt 记录渠道正在处理的请求，返回的函数在请求结束后记录首字时间和成败，用于渠道选择
+func startChannelAttempt(c *gin.Context, channelId int) func(openaiErr *dto.OpenAIErrorWithStatusCode) {
+	modelName := c.GetString("original_model")
+	keyHash := c.GetString(constant2.ContextKeyChannelKeyHash)
+	attemptStart := time.Now()
+	c.Set(constant2.ContextKeyRelayInfo, nil)
+	inFlightMember := model.ChannelRequestStarted(channelId, modelName)
+	circuitBreakerProbes := model.CircuitBreakerRequestStarted(channelId, modelName)
+	return func(openaiErr *dto.OpenAIErrorWithStatusCode) {
+		ttft := time.Since(attemptStart)
+		if info, ok := c.Get(constant2.ContextKeyRelayInfo); ok {
+			if relayInfo, ok := info.(*relaycommon.RelayInfo); ok && relayInfo.HasSendResponse() && relayInfo.FirstResponseTime.After(attemptStart) {
+				ttft = relayInfo.FirstResponseTime.Sub(attemptStart)
+			}
+		}
+		success, counted := channelAttemptResult(openaiErr)
+		if hedgeAttempt, ok := c.Get(constant2.ContextKeyHedgeAttempt); ok && hedgeAttempt.(*model.HedgeAttempt).Lost() {
+			// 落败后被取消的对冲请求不计入渠道的成功率
+			success, counted = false, false
+		}
+		model.ChannelRequestFinished(channelId, modelName, inFlightMember, ttft, success, counted)
+		model.CircuitBreakerRequestFinished(channelId, modelName, circuitBreakerProbes, success, counted)
+		if keyHash != "" {
+			model.RecordChannelKeyUsage(channelId, keyHash, counted && !success)
+		}
+		if counted && operation_setting.GetChannelHealthSetting().RecordLiveSamples {
+			model.RecordChannelHealthSample(&model.ChannelHealthSample{
+				ChannelId:  channelId,
+				ModelName:  modelName,
+				Source:     model.ChannelHealthSourceLive,
+				Success:    success,
+				Latency:    ttft.Milliseconds(),
+				ErrorClass: channelErrorClass(openaiErr),
+			})
+		}
+	}
+}
+
+// channelAttemptResult 判断请求是否计入渠道成功率，请求本身的错误不计入
+func channelAttemptResult(openaiErr *dto.OpenAIErrorWithStatusCode) (success bool, counted bool) {
+	if openaiErr == nil {
+		return true, true
+	}
+	if openaiErr.LocalError {
+		return false, false
+	}
+	switch openaiErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false, true
+	}
+	if openaiErr.StatusCode/100 == 4 {
+		return false, false
+	}
+	return false, true
+}
+
+// channelErrorClass 按状态码归类渠道错误，用于渠道健康记录
+func channelErrorClass(openaiErr *dto.OpenAIErrorWithStatusCode) string {
+	if openaiErr == nil {
+		return ""
+	}
+	if openaiErr.LocalError {
+		return "local_error"
+	}
+	switch openaiErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "auth_error"
+	case http.StatusTooManyRequests:
+		return "rate_limited"
+	case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+		return "timeout"
+	}
+	if openaiErr.StatusCode/100 == 4 {
+		return "bad_request"
+	}
+	return "upstream_error"
 }
 
 func addUsedChannel(c *gin.Context, channelId int) {
@@ -235,14 +422,46 @@ func getChannel(c *gin.Context, group, originalModel string, retryCount int) (*m
 			AutoBan: &autoBanInt,
 		}, nil
 	}
-	channel, err := model.CacheGetRandomSatisfiedChannel(group, originalModel, retryCount)
+	// 释放上一个渠道占用的并发名额
+	middleware.ReleaseChannelSlots(c)
+	// 重试的渠道不是按提示词缓存绑定选择的
+	c.Set(constant2.ContextKeyPromptCacheAffinityRouted, false)
+	if fallback := middleware.GetVirtualModelFallback(c); fallback != nil {
+		channel, err := fallback.NextChannel(c, group)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("获取重试渠道失败: %s", err.Error()))
+		}
+		return channel, nil
+	}
+	channel, err := middleware.SelectChannelWithConcurrency(c, func() (*model.Channel, string, error) {
+		channel, err := model.CacheGetRandomSatisfiedChannel(group, originalModel, retryCount)
+		return channel, originalModel, err
+	})
 	if err != nil {
 		return nil, errors.New(fmt.Sprintf("获取重试渠道失败: %s", err.Error()))
 	}
-	middleware.SetupContextForSelectedChannel(c, channel, originalModel)
+	if err := middleware.SetupContextForSelectedChannel(c, channel, originalModel); err != nil {
+		return nil, errors.New(fmt.Sprintf("获取重试渠道失败: %s", err.Error()))
+	}
 	return channel, nil
 }
 
+// getRetryTimes 请求的最大重试次数，虚拟模型链上的每个模型都可以重试
+func getRetryTimes(c *gin.Context) int {
+	if fallback := middleware.GetVirtualModelFallback(c); fallback != nil {
+		return fallback.RetryTimes()
+	}
+	return common.RetryTimes
+}
+
+// getRemainingRetryTimes 第 i 次请求失败后剩余的重试次数
+func getRemainingRetryTimes(c *gin.Context, i int) int {
+	if fallback := middleware.GetVirtualModelFallback(c); fallback != nil {
+		return fallback.RemainingRetryTimes()
+	}
+	return common.RetryTimes - i
+}
+
 func shouldRetry(c *gin.Context, openaiErr *dto.OpenAIErrorWithStatusCode, retryTimes int) bool {
 	if openaiErr == nil {
 		return false
@@ -286,10 +505,20 @@ func shouldRetry(c *gin.Context, openaiErr *dto.OpenAIErrorWithStatusCode, retry
 	return true
 }
 
-func processChannelError(c *gin.Context, channelId int, channelType int, channelName string, autoBan bool, err *dto.OpenAIErrorWithStatusCode) {
+func processChannelError(c *gin.Context, channelId int, channelType int, channelName string, keyHash string, autoBan bool, err *dto.OpenAIErrorWithStatusCode) {
 	// 不要使用context获取渠道信息，异步处理时可能会出现渠道信息不一致的情况
 	// do not use context to get channel info, there may be inconsistent channel info when processing asynchronously
 	common.LogError(c, fmt.Sprintf("relay error (channel #%d, status code: %d): %s", channelId, err.StatusCode, err.Error.Message))
+	// 多 key 渠道先处理出错的 key，还有可用的 key 时不禁用渠道
+	if keyHash != "" && !err.LocalError && service.ProcessChannelKeyError(channelId, channelType, keyHash, autoBan, err) {
+		return
+	}
+	// 被上游限流的渠道或 key 已按 retry-after 暂停使用，不需要禁用
+	if err.StatusCode == http.StatusTooManyRequests && model.IsChannelRateLimited(channelId, keyHash) {
+		common.LogWarn(c, fmt.Sprintf("channel #%d is rate limited by upstream, cooling down", channelId))
+		return
+	}
+	// 密钥无效、余额不足等永久错误直接禁用渠道，其他错误由熔断器处理
 	if service.ShouldDisableChannel(channelType, err) && autoBan {
 		service.DisableChannel(channelId, channelName, err.Error.Message)
 	}
@@ -374,7 +603,10 @@ func RelayTask(c *gin.Context) {
 		useChannel = append(useChannel, fmt.Sprintf("%d", channelId))
 		c.Set("use_channel", useChannel)
 		common.LogInfo(c, fmt.Sprintf("using channel #%d to retry (remain times %d)", channel.Id, i))
-		middleware.SetupContextForSelectedChannel(c, channel, originalModel)
+		if err := middleware.SetupContextForSelectedChannel(c, channel, originalModel); err != nil {
+			common.LogError(c, fmt.Sprintf("setup channel #%d failed: %s", channel.Id, err.Error()))
+			break
+		}
 
 		requestBody, err := common.GetRequestBody(c)
 		c.Request.Body = io.NopCloser(bytes.NewBuffer(requestBody))
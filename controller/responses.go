@@ -0,0 +1,125 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"veloera/dto"
+	"veloera/model"
+	"veloera/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+func responseNotFound(c *gin.Context, responseId string) {
+	c.JSON(http.StatusNotFound, gin.H{
+		"error": dto.OpenAIError{
+			Message: fmt.Sprintf("Response with id '%s' not found.", responseId),
+			Type:    "invalid_request_error",
+			Param:   "response_id",
+			Code:    "response_not_found",
+		},
+	})
+}
+
+func responseStoreError(c *gin.Context, err error) {
+	c.JSON(http.StatusInternalServerError, gin.H{
+		"error": dto.OpenAIError{
+			Message: err.Error(),
+			Type:    "veloera_error",
+			Code:    "response_store_error",
+		},
+	})
+}
+
+// getStoredResponse returns the stored response of the current user, or writes the error response and returns nil
+func getStoredResponse(c *gin.Context) *model.StoredResponse {
+	responseId := c.Param("id")
+	stored, err := model.GetStoredResponse(c.GetInt("id"), c.GetInt("token_id"), responseId)
+	if exist, err := model.RecordExist(err); !exist {
+		if err != nil {
+			responseStoreError(c, err)
+		} else {
+			responseNotFound(c, responseId)
+		}
+		return nil
+	}
+	return stored
+}
+
+// GetResponse GET /v1/responses/{id}
+func GetResponse(c *gin.Context) {
+	stored := getStoredResponse(c)
+	if stored == nil {
+		return
+	}
+	c.Data(http.StatusOK, "application/json", stored.Response)
+}
+
+// DeleteResponse DELETE /v1/responses/{id}
+func DeleteResponse(c *gin.Context) {
+	responseId := c.Param("id")
+	err := model.DeleteStoredResponse(c.GetInt("id"), c.GetInt("token_id"), responseId)
+	if exist, err := model.RecordExist(err); !exist {
+		if err != nil {
+			responseStoreError(c, err)
+		} else {
+			responseNotFound(c, responseId)
+		}
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":      responseId,
+		"object":  "response",
+		"deleted": true,
+	})
+}
+
+// ListResponseInputItems GET /v1/responses/{id}/input_items
+func ListResponseInputItems(c *gin.Context) {
+	stored := getStoredResponse(c)
+	if stored == nil {
+		return
+	}
+	items, err := service.ResponsesInputItems(stored)
+	if err != nil {
+		responseStoreError(c, err)
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	// 默认按时间倒序
+	if c.DefaultQuery("order", "desc") == "desc" {
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+	}
+	if after := c.Query("after"); after != "" {
+		for i, item := range items {
+			if item["id"] == after {
+				items = items[i+1:]
+				break
+			}
+		}
+	}
+	hasMore := len(items) > limit
+	if hasMore {
+		items = items[:limit]
+	}
+
+	response := gin.H{
+		"object":   "list",
+		"data":     items,
+		"first_id": nil,
+		"last_id":  nil,
+		"has_more": hasMore,
+	}
+	if len(items) > 0 {
+		response["first_id"] = items[0]["id"]
+		response["last_id"] = items[len(items)-1]["id"]
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -145,6 +145,7 @@ func AddToken(c *gin.Context) {
 		ModelLimits:        token.ModelLimits,
 		AllowIps:           token.AllowIps,
 		Group:              token.Group,
+		HedgingEnabled:     token.HedgingEnabled,
 	}
 	err = cleanToken.Insert()
 	if err != nil {
@@ -154,9 +155,11 @@ func AddToken(c *gin.Context) {
 		})
 		return
 	}
+	// 数据库只保存令牌的哈希，完整的令牌只在创建时返回一次
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
+		"data":    cleanToken,
 	})
 	return
 }
@@ -234,6 +237,7 @@ func UpdateToken(c *gin.Context) {
 		cleanToken.ModelLimits = token.ModelLimits
 		cleanToken.AllowIps = token.AllowIps
 		cleanToken.Group = token.Group
+		cleanToken.HedgingEnabled = token.HedgingEnabled
 	}
 	err = cleanToken.Update()
 	if err != nil {
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/model"
+	"veloera/service"
+	"veloera/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// GetMarginStats 按渠道、模型、分组或天返回收入、上游成本和毛利，默认统计最近 7 天
+func GetMarginStats(c *gin.Context) {
+	startTimestamp, _ := strconv.ParseInt(c.Query("start_timestamp"), 10, 64)
+	endTimestamp, _ := strconv.ParseInt(c.Query("end_timestamp"), 10, 64)
+	if startTimestamp == 0 {
+		startTimestamp = time.Now().AddDate(0, 0, -7).Unix()
+	}
+	groupBy := c.DefaultQuery("group_by", model.MarginGroupByChannel)
+	channel, _ := strconv.Atoi(c.Query("channel"))
+	stats, err := model.GetMarginStats(startTimestamp, endTimestamp, groupBy, channel, c.Query("model"), c.Query("group"))
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{
+			"success": false,
+			"message": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"message": "",
+		"data":    stats,
+	})
+}
+
+// checkNegativeMargins 统计最近一段时间各模型的毛利，模型的毛利变为负数时通知管理员，alerted 记录已通知且仍为负数的模型
+func checkNegativeMargins(alerted map[string]bool, windowHours int) {
+	since := time.Now().Add(-time.Duration(windowHours) * time.Hour).Unix()
+	stats, err := model.GetMarginStats(since, 0, model.MarginGroupByModel, 0, "", "")
+	if err != nil {
+		common.SysError("failed to get margin stats: " + err.Error())
+		return
+	}
+	negative := make(map[string]bool)
+	for _, stat := range stats {
+		if stat.Margin >= 0 {
+			continue
+		}
+		negative[stat.ModelName] = true
+		if alerted[stat.ModelName] {
+			continue
+		}
+		subject := fmt.Sprintf("模型「%s」最近 %d 小时的毛利为负", stat.ModelName, windowHours)
+		content := fmt.Sprintf("%s\n收入：%s\n上游成本：%s\n毛利：%s\n请求数：%d", subject,
+			common.FormatQuota(stat.Revenue), common.FormatQuota(stat.Cost), common.FormatQuota(stat.Margin), stat.Count)
+		common.SysLog(fmt.Sprintf("model %s margin is negative: revenue %d, cost %d", stat.ModelName, stat.Revenue, stat.Cost))
+		service.NotifyRootUser(fmt.Sprintf("%s_%s", dto.NotifyTypeMarginAlert, stat.ModelName), subject, content)
+	}
+	// 毛利恢复的模型再次变为负数时重新通知
+	for name := range alerted {
+		if !negative[name] {
+			delete(alerted, name)
+		}
+	}
+	for name := range negative {
+		alerted[name] = true
+	}
+}
+
+// RunMarginAlert 按配置的间隔检查各模型的毛利，只在主节点运行
+func RunMarginAlert() {
+	alerted := make(map[string]bool)
+	lastRun := time.Now()
+	for {
+		time.Sleep(time.Minute)
+		setting := operation_setting.GetUpstreamCostSetting()
+		interval := setting.MarginAlertIntervalMinutes
+		if interval <= 0 {
+			interval = 60
+		}
+		if !setting.MarginAlertEnabled || time.Since(lastRun) < time.Duration(interval)*time.Minute {
+			continue
+		}
+		lastRun = time.Now()
+		windowHours := setting.MarginAlertWindowHours
+		if windowHours <= 0 {
+			windowHours = 24
+		}
+		checkNegativeMargins(alerted, windowHours)
+	}
+}
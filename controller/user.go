@@ -221,7 +221,8 @@ func Register(c *gin.Context) {
 		})
 		return
 	}
-	// 生成默认令牌
+	// 生成默认令牌，令牌只在注册时返回一次
+	var defaultToken *model.Token
 	if constant.GenerateDefaultToken {
 		key, err := common.GenerateKey()
 		if err != nil {
@@ -251,11 +252,15 @@ func Register(c *gin.Context) {
 			})
 			return
 		}
+		defaultToken = &token
 	}
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
 		"message": "",
+		"data": gin.H{
+			"default_token": defaultToken,
+		},
 	})
 	return
 }
@@ -1064,7 +1069,15 @@ func UpdateUserSetting(c *gin.Context) {
 	if req.QuotaWarningType == constant.NotifyTypeWebhook {
 		settings[constant.UserSettingWebhookUrl] = req.WebhookUrl
 		if req.WebhookSecret != "" {
-			settings[constant.UserSettingWebhookSecret] = req.WebhookSecret
+			webhookSecret, err := common.EncryptSecret(req.WebhookSecret)
+			if err != nil {
+				c.JSON(http.StatusOK, gin.H{
+					"success": false,
+					"message": err.Error(),
+				})
+				return
+			}
+			settings[constant.UserSettingWebhookSecret] = webhookSecret
 		}
 	}
 
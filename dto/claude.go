@@ -72,6 +72,7 @@ type ClaudeMessageSource struct {
 	Type      string `json:"type"`
 	MediaType string `json:"media_type"`
 	Data      any    `json:"data"`
+	Url       string `json:"url,omitempty"`
 }
 
 type ClaudeMessage struct {
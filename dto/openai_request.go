@@ -365,7 +365,7 @@ type OpenAIResponsesRequest struct {
 	PreviousResponseID string               `json:"previous_response_id,omitempty"`
 	Reasoning          *Reasoning           `json:"reasoning,omitempty"`
 	ServiceTier        string               `json:"service_tier,omitempty"`
-	Store              bool                 `json:"store,omitempty"`
+	Store              *bool                `json:"store,omitempty"`
 	Stream             bool                 `json:"stream,omitempty"`
 	Temperature        float64              `json:"temperature,omitempty"`
 	Text               json.RawMessage      `json:"text,omitempty"`
@@ -376,6 +376,11 @@ type OpenAIResponsesRequest struct {
 	User               string               `json:"user,omitempty"`
 }
 
+// ShouldStore reports whether the response should be stored, store defaults to true
+func (r *OpenAIResponsesRequest) ShouldStore() bool {
+	return r.Store == nil || *r.Store
+}
+
 type Reasoning struct {
 	Effort  string `json:"effort,omitempty"`
 	Summary string `json:"summary,omitempty"`
@@ -399,3 +404,67 @@ type ResponsesToolsCall struct {
 	Description string          `json:"description,omitempty"`
 	Parameters  json.RawMessage `json:"parameters,omitempty"`
 }
+
+// ResponsesInputItem is one item of the /v1/responses input array,
+// either a message or a function call / function call output
+type ResponsesInputItem struct {
+	Type    string          `json:"type,omitempty"`
+	ID      string          `json:"id,omitempty"`
+	Role    string          `json:"role,omitempty"`
+	Content json.RawMessage `json:"content,omitempty"`
+	// Function call
+	CallId    string          `json:"call_id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Arguments string          `json:"arguments,omitempty"`
+	Output    json.RawMessage `json:"output,omitempty"`
+}
+
+type ResponsesInputContent struct {
+	Type     string `json:"type"`
+	Text     string `json:"text,omitempty"`
+	ImageUrl string `json:"image_url,omitempty"`
+	Detail   string `json:"detail,omitempty"`
+	FileId   string `json:"file_id,omitempty"`
+	FileData string `json:"file_data,omitempty"`
+	FileName string `json:"filename,omitempty"`
+}
+
+// ParseInput returns the input as a list of items, a plain string input becomes one user message
+func (r *OpenAIResponsesRequest) ParseInput() ([]ResponsesInputItem, error) {
+	if len(r.Input) == 0 {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(r.Input, &text); err == nil {
+		content, _ := json.Marshal(text)
+		return []ResponsesInputItem{{Type: "message", Role: "user", Content: content}}, nil
+	}
+	var items []ResponsesInputItem
+	if err := json.Unmarshal(r.Input, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// GetInstructions returns the instructions when they are a plain string
+func (r *OpenAIResponsesRequest) GetInstructions() string {
+	var instructions string
+	if len(r.Instructions) > 0 {
+		_ = json.Unmarshal(r.Instructions, &instructions)
+	}
+	return instructions
+}
+
+// ParseContent returns the content of a message item, a plain string content becomes one input_text part
+func (i *ResponsesInputItem) ParseContent() []ResponsesInputContent {
+	if len(i.Content) == 0 {
+		return nil
+	}
+	var text string
+	if err := json.Unmarshal(i.Content, &text); err == nil {
+		return []ResponsesInputContent{{Type: "input_text", Text: text}}
+	}
+	var contents []ResponsesInputContent
+	_ = json.Unmarshal(i.Content, &contents)
+	return contents
+}
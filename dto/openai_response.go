@@ -198,21 +198,43 @@ type OpenAIResponsesResponse struct {
 	Tools              []interface{}      `json:"tools"`
 	TopP               float64            `json:"top_p"`
 	Truncation         string             `json:"truncation"`
-	Usage              *Usage             `json:"usage"`
+	Usage              *ResponsesUsage    `json:"usage"`
 	User               json.RawMessage    `json:"user"`
 	Metadata           json.RawMessage    `json:"metadata"`
 }
 
 type IncompleteDetails struct {
-	Reasoning string `json:"reasoning"`
+	Reason string `json:"reason"`
+}
+
+type ResponsesUsage struct {
+	InputTokens         int                           `json:"input_tokens"`
+	InputTokensDetails  *ResponsesInputTokensDetails  `json:"input_tokens_details,omitempty"`
+	OutputTokens        int                           `json:"output_tokens"`
+	OutputTokensDetails *ResponsesOutputTokensDetails `json:"output_tokens_details,omitempty"`
+	TotalTokens         int                           `json:"total_tokens"`
+}
+
+type ResponsesInputTokensDetails struct {
+	CachedTokens int `json:"cached_tokens"`
+}
+
+type ResponsesOutputTokensDetails struct {
+	ReasoningTokens int `json:"reasoning_tokens"`
 }
 
 type ResponsesOutput struct {
 	Type    string                   `json:"type"`
 	ID      string                   `json:"id"`
-	Status  string                   `json:"status"`
-	Role    string                   `json:"role"`
-	Content []ResponsesOutputContent `json:"content"`
+	Status  string                   `json:"status,omitempty"`
+	Role    string                   `json:"role,omitempty"`
+	Content []ResponsesOutputContent `json:"content,omitempty"`
+	// Function call
+	CallId    string  `json:"call_id,omitempty"`
+	Name      string  `json:"name,omitempty"`
+	Arguments *string `json:"arguments,omitempty"`
+	// Reasoning
+	Summary []ResponsesOutputContent `json:"summary,omitempty"`
 }
 
 type ResponsesOutputContent struct {
@@ -231,11 +253,37 @@ const (
 	ResponsesOutputTypeItemDone  = "response.output_item.done"
 )
 
+const (
+	ResponsesStreamTypeCreated                  = "response.created"
+	ResponsesStreamTypeInProgress               = "response.in_progress"
+	ResponsesStreamTypeCompleted                = "response.completed"
+	ResponsesStreamTypeIncomplete               = "response.incomplete"
+	ResponsesStreamTypeContentPartAdded         = "response.content_part.added"
+	ResponsesStreamTypeContentPartDone          = "response.content_part.done"
+	ResponsesStreamTypeOutputTextDelta          = "response.output_text.delta"
+	ResponsesStreamTypeOutputTextDone           = "response.output_text.done"
+	ResponsesStreamTypeFunctionCallArgsDelta    = "response.function_call_arguments.delta"
+	ResponsesStreamTypeFunctionCallArgsDone     = "response.function_call_arguments.done"
+	ResponsesStreamTypeReasoningSummaryAdded    = "response.reasoning_summary_part.added"
+	ResponsesStreamTypeReasoningSummaryDone     = "response.reasoning_summary_part.done"
+	ResponsesStreamTypeReasoningSummaryDelta    = "response.reasoning_summary_text.delta"
+	ResponsesStreamTypeReasoningSummaryTextDone = "response.reasoning_summary_text.done"
+)
+
 // ResponsesStreamResponse 用于处理 /v1/responses 流式响应
 type ResponsesStreamResponse struct {
-	Type     string                   `json:"type"`
-	Response *OpenAIResponsesResponse `json:"response"`
-	Delta    string                   `json:"delta,omitempty"`
+	Type           string                   `json:"type"`
+	SequenceNumber int                      `json:"sequence_number"`
+	Response       *OpenAIResponsesResponse `json:"response,omitempty"`
+	OutputIndex    *int                     `json:"output_index,omitempty"`
+	ContentIndex   *int                     `json:"content_index,omitempty"`
+	SummaryIndex   *int                     `json:"summary_index,omitempty"`
+	ItemId         string                   `json:"item_id,omitempty"`
+	Item           *ResponsesOutput         `json:"item,omitempty"`
+	Part           *ResponsesOutputContent  `json:"part,omitempty"`
+	Delta          string                   `json:"delta,omitempty"`
+	Text           *string                  `json:"text,omitempty"`
+	Arguments      *string                  `json:"arguments,omitempty"`
 }
 
 type InputTokenDetails struct {
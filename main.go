@@ -47,12 +47,32 @@ func main() {
 	if common.DebugEnabled {
 		common.SysLog("running in debug mode")
 	}
+	// 敏感字段加密使用的主密钥
+	err = common.InitMasterKey()
+	if err != nil {
+		common.FatalLog("failed to initialize master key: " + err.Error())
+	}
+
 	// Initialize SQL Database
 	err = model.InitDB()
 	if err != nil {
 		common.FatalLog("failed to initialize database: " + err.Error())
 	}
 
+	// 按当前主密钥加密或重新加密数据库中的敏感字段，--rotate-master-key 或 --decrypt-secrets 时执行后退出
+	if common.IsMasterNode || *common.RotateMasterKey || *common.DecryptSecrets {
+		count, err := model.MigrateSecrets(*common.DecryptSecrets)
+		if err != nil {
+			common.FatalLog("failed to migrate secrets: " + err.Error())
+		}
+		if count > 0 {
+			common.SysLog(fmt.Sprintf("re-encrypted %d stored secrets", count))
+		}
+		if *common.RotateMasterKey || *common.DecryptSecrets {
+			os.Exit(0)
+		}
+	}
+
 	model.CheckSetup()
 
 	// Initialize SQL Database
@@ -80,6 +100,15 @@ func main() {
 	// Initialize options
 	model.InitOptionMap()
 
+	// 声明式配置：比较挂载的配置文件与数据库并输出差异，GATEWAY_CONFIG_APPLY=true 时同步到数据库
+	if configFile := os.Getenv("GATEWAY_CONFIG_FILE"); configFile != "" && common.IsMasterNode {
+		apply := common.GetEnvOrDefaultBool("GATEWAY_CONFIG_APPLY", false)
+		prune := common.GetEnvOrDefaultBool("GATEWAY_CONFIG_PRUNE", false)
+		if err := service.ReconcileGatewayConfigFile(configFile, apply, prune); err != nil {
+			common.FatalLog("failed to reconcile gateway config: " + err.Error())
+		}
+	}
+
 	if common.RedisEnabled {
 		// for compatibility with old versions
 		common.MemoryCacheEnabled = true
@@ -93,10 +122,23 @@ func main() {
 		go model.SyncOptions(common.SyncFrequency)
 		go model.SyncChannelCache(common.SyncFrequency)
 	}
+	model.InitChannelKeyCache()
+	go model.SyncChannelKeys(common.SyncFrequency)
 
 	// 数据看板
 	go model.UpdateQuotaData()
 
+	// 渠道健康记录
+	go model.SyncChannelHealthSamples()
+
+	if common.IsMasterNode {
+		go model.CleanupStoredResponses()
+		go controller.RunBatchScheduler()
+		go controller.RunFineTuningJobPoller()
+		go controller.RunModelDiscovery()
+		go controller.RunMarginAlert()
+	}
+
 	if os.Getenv("CHANNEL_UPDATE_FREQUENCY") != "" {
 		frequency, err := strconv.Atoi(os.Getenv("CHANNEL_UPDATE_FREQUENCY"))
 		if err != nil {
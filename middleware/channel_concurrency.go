@@ -0,0 +1,233 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"veloera/common"
+	"veloera/model"
+	"veloera/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	contextKeyChannelSlots          = "channel_slots"
+	contextKeyChannelKeyReservation = "channel_key_reservation"
+)
+
+// 渠道释放名额后等待队列最迟在该间隔后重新尝试，用于感知其他节点释放的名额
+const channelQueuePollInterval = 100 * time.Millisecond
+
+var (
+	ErrChannelQueueFull    = errors.New("channel wait queue is full")
+	ErrChannelQueueTimeout = errors.New("timed out waiting for an available channel")
+)
+
+// ChannelQueueStats 本节点渠道等待队列的统计
+type ChannelQueueStats struct {
+	Depth       int64 `json:"depth"`         // 当前排队的请求数
+	Queued      int64 `json:"queued"`        // 累计排队的请求数
+	Timeouts    int64 `json:"timeouts"`      // 累计等待超时的请求数
+	Rejected    int64 `json:"rejected"`      // 累计因队列已满被拒绝的请求数
+	TotalWaitMs int64 `json:"total_wait_ms"` // 累计等待时间
+	MaxWaitMs   int64 `json:"max_wait_ms"`   // 最长等待时间
+}
+
+type channelSlots struct {
+	slots []*model.ChannelSlot
+}
+
+// channelKeyReservation 选择渠道时已占用并发名额的 key，设置渠道上下文时直接使用
+type channelKeyReservation struct {
+	channelId int
+	key       string
+	keyHash   string
+}
+
+var (
+	channelQueueLock  sync.Mutex
+	channelQueueStats ChannelQueueStats
+
+	channelReleaseLock   sync.Mutex
+	channelReleaseSignal = make(chan struct{})
+)
+
+func GetChannelQueueStats() ChannelQueueStats {
+	channelQueueLock.Lock()
+	defer channelQueueLock.Unlock()
+	return channelQueueStats
+}
+
+// channelReleased 返回在下一次释放名额时关闭的 channel
+func channelReleased() <-chan struct{} {
+	channelReleaseLock.Lock()
+	defer channelReleaseLock.Unlock()
+	return channelReleaseSignal
+}
+
+func notifyChannelReleased() {
+	channelReleaseLock.Lock()
+	defer channelReleaseLock.Unlock()
+	close(channelReleaseSignal)
+	channelReleaseSignal = make(chan struct{})
+}
+
+// getChannelSlots 返回请求持有的并发名额，不经过 Distribute 的请求（如渠道测试）返回 nil，不受并发限制
+func getChannelSlots(c *gin.Context) *channelSlots {
+	slots, ok := c.Get(contextKeyChannelSlots)
+	if !ok {
+		return nil
+	}
+	return slots.(*channelSlots)
+}
+
+func holdChannelSlot(c *gin.Context, slot *model.ChannelSlot) {
+	if slot == nil {
+		return
+	}
+	if slots := getChannelSlots(c); slots != nil {
+		slots.slots = append(slots.slots, slot)
+	}
+}
+
+// ReleaseChannelSlots 释放请求持有的并发名额，切换渠道重试前和请求结束时调用
+func ReleaseChannelSlots(c *gin.Context) {
+	slots := getChannelSlots(c)
+	if slots == nil || len(slots.slots) == 0 {
+		return
+	}
+	for _, slot := range slots.slots {
+		slot.Release()
+	}
+	slots.slots = nil
+	c.Set(contextKeyChannelKeyReservation, (*channelKeyReservation)(nil))
+	notifyChannelReleased()
+}
+
+// takeChannelKeyReservation 取出为渠道预留的 key，没有预留或预留的不是该渠道时返回 false
+func takeChannelKeyReservation(c *gin.Context, channel *model.Channel) (string, string, bool) {
+	value, ok := c.Get(contextKeyChannelKeyReservation)
+	if !ok {
+		return "", "", false
+	}
+	reservation := value.(*channelKeyReservation)
+	if reservation == nil || reservation.channelId != channel.Id {
+		return "", "", false
+	}
+	c.Set(contextKeyChannelKeyReservation, (*channelKeyReservation)(nil))
+	return reservation.key, reservation.keyHash, true
+}
+
+// SelectChannelWithConcurrency 选择渠道并占用渠道和 key 的并发名额，selectChannel 返回选中的渠道和渠道上使用的模型。
+// key 的名额被占满时释放渠道名额并重新选择，所有渠道都已满时在有界队列中等待，
+// 队列已满或等待超时时返回 ErrChannelQueueFull 或 ErrChannelQueueTimeout
+func SelectChannelWithConcurrency(c *gin.Context, selectChannel func() (*model.Channel, string, error)) (*model.Channel, error) {
+	if getChannelSlots(c) == nil {
+		channel, _, err := selectChannel()
+		return channel, err
+	}
+	setting := operation_setting.GetChannelConcurrencySetting()
+	var waitStart time.Time
+	var deadline <-chan time.Time
+	queued := false
+	defer func() {
+		if queued {
+			waited := time.Since(waitStart).Milliseconds()
+			channelQueueLock.Lock()
+			channelQueueStats.Depth--
+			channelQueueStats.TotalWaitMs += waited
+			if waited > channelQueueStats.MaxWaitMs {
+				channelQueueStats.MaxWaitMs = waited
+			}
+			channelQueueLock.Unlock()
+		}
+	}()
+
+	for {
+		released := channelReleased()
+		channel, modelName, err := selectChannel()
+		if err == nil {
+			if channel == nil {
+				return nil, nil
+			}
+			if slot, ok := model.TryAcquireChannelSlot(channel); ok {
+				key, keyHash, keyErr := selectKeyForChannel(c, channel, modelName)
+				if keyErr == nil {
+					holdChannelSlot(c, slot)
+					c.Set(contextKeyChannelKeyReservation, &channelKeyReservation{channelId: channel.Id, key: key, keyHash: keyHash})
+					if queued {
+						common.LogInfo(c, fmt.Sprintf("waited %d ms in channel queue for channel #%d", time.Since(waitStart).Milliseconds(), channel.Id))
+					}
+					return channel, nil
+				}
+				// key 的名额都已满，释放渠道名额后重新选择
+				if slot != nil {
+					slot.Release()
+				}
+			}
+			// 名额被其他请求抢占，等待后重新选择
+			err = model.ErrChannelSaturated
+		}
+		if !errors.Is(err, model.ErrChannelSaturated) {
+			return nil, err
+		}
+
+		if !queued {
+			channelQueueLock.Lock()
+			if channelQueueStats.Depth >= int64(setting.QueueSize) {
+				channelQueueStats.Rejected++
+				channelQueueLock.Unlock()
+				common.LogWarn(c, fmt.Sprintf("channel queue is full, depth: %d", setting.QueueSize))
+				return nil, ErrChannelQueueFull
+			}
+			channelQueueStats.Depth++
+			channelQueueStats.Queued++
+			channelQueueLock.Unlock()
+			queued = true
+			waitStart = time.Now()
+			deadline = time.After(time.Duration(setting.QueueTimeoutSeconds) * time.Second)
+		}
+
+		select {
+		case <-released:
+		case <-time.After(channelQueuePollInterval):
+		case <-deadline:
+			channelQueueLock.Lock()
+			channelQueueStats.Timeouts++
+			channelQueueLock.Unlock()
+			common.LogWarn(c, fmt.Sprintf("timed out after waiting %d ms in channel queue", time.Since(waitStart).Milliseconds()))
+			return nil, ErrChannelQueueTimeout
+		case <-c.Request.Context().Done():
+			return nil, c.Request.Context().Err()
+		}
+	}
+}
+
+// acquireChannelKeySlot 占用 key 的并发名额，不经过 Distribute 的请求不受限制
+func acquireChannelKeySlot(c *gin.Context, channel *model.Channel, keyHash string) bool {
+	if getChannelSlots(c) == nil {
+		return true
+	}
+	slot, ok := model.TryAcquireChannelKeySlot(channel, keyHash)
+	if ok {
+		holdChannelSlot(c, slot)
+	}
+	return ok
+}
+
+// SelectAlternateChannel 为对冲或续写请求选择另一个渠道并占用并发名额，不排队等待，没有可用渠道时返回 nil。
+// accept 不为空时只选择它接受的渠道
+func SelectAlternateChannel(c *gin.Context, group string, modelName string, excludeChannelId int, accept func(channel *model.Channel) bool) *model.Channel {
+	channel, err := model.CacheGetAlternateChannel(group, modelName, excludeChannelId, accept)
+	if err != nil || channel == nil {
+		return nil
+	}
+	slot, ok := model.TryAcquireChannelSlot(channel)
+	if !ok {
+		return nil
+	}
+	holdChannelSlot(c, slot)
+	return channel
+}
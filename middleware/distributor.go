@@ -21,6 +21,7 @@ import (
 
 type ModelRequest struct {
 	Model string `json:"model"`
+	User  string `json:"user"`
 }
 
 // Cache for storing channels by prefix
@@ -141,6 +142,18 @@ func selectChannelByPrefix(group, prefix, originalModel string) (*model.Channel,
 		return nil, fmt.Errorf("no channels supporting model %s found for prefix %s", originalModel, prefix)
 	}
 
+	// Skip channels that have reached their concurrency limit
+	var unsaturatedChannels []*model.Channel
+	for _, channel := range compatibleChannels {
+		if !model.IsChannelSaturated(channel) {
+			unsaturatedChannels = append(unsaturatedChannels, channel)
+		}
+	}
+	if len(unsaturatedChannels) == 0 {
+		return nil, model.ErrChannelSaturated
+	}
+	compatibleChannels = unsaturatedChannels
+
 	// Select a random channel based on weight
 	totalWeight := 0
 	for _, channel := range compatibleChannels {
@@ -169,6 +182,9 @@ func selectChannelByPrefix(group, prefix, originalModel string) (*model.Channel,
 
 func Distribute() func(c *gin.Context) {
 	return func(c *gin.Context) {
+		// 请求结束时释放占用的渠道并发名额
+		c.Set(contextKeyChannelSlots, &channelSlots{})
+		defer ReleaseChannelSlots(c)
 		allowIpsMap := c.GetStringMap("allow_ips")
 		if len(allowIpsMap) != 0 {
 			clientIp := c.ClientIP()
@@ -259,14 +275,45 @@ func Distribute() func(c *gin.Context) {
 				}
 			}
 
+			// 通过微调任务创建的模型只有创建者可以调用
+			if owner, err := model.IsFineTunedModelOwner(c.GetInt("id"), modelRequest.Model); err != nil {
+				abortWithOpenAiMessage(c, http.StatusInternalServerError, "查询微调模型失败："+err.Error())
+				return
+			} else if !owner {
+				abortWithOpenAiMessage(c, http.StatusNotFound, fmt.Sprintf("模型 %s 不存在", originalModel))
+				return
+			}
+
 			if shouldSelectChannel {
-				// If we have a model prefix, use it to select among specific channels
-				if modelPrefix != "" {
-					channel, err = selectChannelByPrefix(userGroup, modelPrefix, modelRequest.Model)
+				// 实验模型按分配的变体选择渠道，变体的模型也可以是虚拟模型
+				selectModel := originalModel
+				variantModel, inExperiment := assignExperimentVariant(c, originalModel, modelRequest.User)
+				if inExperiment {
+					defer recordExperimentRequest(c)
+					selectModel = variantModel
+					modelRequest.Model = variantModel
+					modelPrefix = ""
+				}
+				// 虚拟模型按顺序选择第一个有可用渠道的模型
+				var isVirtualModel bool
+				var servedModel string
+				channel, servedModel, isVirtualModel, err = selectVirtualModelChannel(c, userGroup, selectModel)
+				if isVirtualModel {
+					modelRequest.Model = servedModel
+				} else if modelPrefix != "" {
+					// If we have a model prefix, use it to select among specific channels
+					channel, err = SelectChannelWithConcurrency(c, func() (*model.Channel, string, error) {
+						channel, err := selectChannelByPrefix(userGroup, modelPrefix, modelRequest.Model)
+						return channel, modelRequest.Model, err
+					})
 				} else {
-					channel, err = model.CacheGetRandomSatisfiedChannel(userGroup, modelRequest.Model, 0)
+					channel, err = selectChannelWithAffinity(c, userGroup, modelRequest.Model)
 				}
 
+				if errors.Is(err, ErrChannelQueueFull) || errors.Is(err, ErrChannelQueueTimeout) {
+					abortWithOpenAiMessage(c, http.StatusTooManyRequests, fmt.Sprintf("当前分组 %s 下模型 %s 的渠道负载已饱和，请稍后再试", userGroup, originalModel))
+					return
+				}
 				if err != nil {
 					message := fmt.Sprintf("当前分组 %s 下对于模型 %s 无可用渠道", userGroup, originalModel)
 					// 如果错误，但是渠道不为空，说明是数据库一致性问题
@@ -282,10 +329,18 @@ func Distribute() func(c *gin.Context) {
 					abortWithOpenAiMessage(c, http.StatusServiceUnavailable, fmt.Sprintf("当前分组 %s 下对于模型 %s 无可用渠道（数据库一致性已被破坏）", userGroup, originalModel))
 					return
 				}
+				if inExperiment {
+					// 日志记录请求的模型名，实际使用的模型记录在 other 中
+					c.Set(constant.ContextKeyVirtualModel, originalModel)
+					c.Set("prefixed_model", modelRequest.Model)
+				}
 			}
 		}
 		c.Set(constant.ContextKeyRequestStartTime, time.Now())
-		SetupContextForSelectedChannel(c, channel, modelRequest.Model)
+		if err := SetupContextForSelectedChannel(c, channel, modelRequest.Model); err != nil {
+			abortWithOpenAiMessage(c, http.StatusTooManyRequests, fmt.Sprintf("当前分组 %s 下模型 %s 的渠道负载已饱和，请稍后再试", userGroup, originalModel))
+			return
+		}
 		c.Next()
 	}
 }
@@ -353,9 +408,18 @@ func getModelRequest(c *gin.Context) (*ModelRequest, bool, error) {
 			modelRequest.Model = c.Param("model")
 		}
 	}
+	if strings.HasPrefix(c.Request.URL.Path, "/v1beta/models/") {
+		// gemini 原生接口，模型名称在路径中 /v1beta/models/{model}:{action}
+		modelRequest.Model, _ = relayconstant.ParseGeminiModelAction(c.Request.URL.Path)
+	}
 	if strings.HasPrefix(c.Request.URL.Path, "/v1/images/generations") {
 		modelRequest.Model = common.GetStringIfEmpty(modelRequest.Model, "dall-e")
 	}
+	if strings.HasPrefix(c.Request.URL.Path, "/v1/images/edits") || strings.HasPrefix(c.Request.URL.Path, "/v1/images/variations") {
+		// multipart 表单请求
+		modelRequest.Model = common.GetStringIfEmpty(modelRequest.Model, c.PostForm("model"))
+		modelRequest.Model = common.GetStringIfEmpty(modelRequest.Model, "dall-e-2")
+	}
 	if strings.HasPrefix(c.Request.URL.Path, "/v1/audio") {
 		relayMode := relayconstant.RelayModeAudioSpeech
 		if strings.HasPrefix(c.Request.URL.Path, "/v1/audio/speech") {
@@ -381,10 +445,121 @@ func getModelRequest(c *gin.Context) (*ModelRequest, bool, error) {
 	return &modelRequest, shouldSelectChannel, nil
 }
 
-func SetupContextForSelectedChannel(c *gin.Context, channel *model.Channel, modelName string) {
+// getFineTunedModelKey 返回多 key 渠道中微调模型所属的 key 及其哈希
+func getFineTunedModelKey(channel *model.Channel, modelName string) (string, string, bool) {
+	if !strings.HasPrefix(modelName, "ft:") {
+		return "", "", false
+	}
+	keys := channel.GetKeys()
+	if len(keys) <= 1 {
+		return "", "", false
+	}
+	keyHash := model.GetFineTunedModelKeyHash(channel.Id, modelName)
+	if keyHash == "" {
+		return "", "", false
+	}
+	for _, key := range keys {
+		if model.HashChannelKey(key) == keyHash {
+			return key, keyHash, true
+		}
+	}
+	return "", "", false
+}
+
+// selectKeyForChannel 选择渠道本次请求使用的 key 并占用 key 的并发名额，单 key 渠道返回的哈希为空。
+// Vertex 渠道的多个服务账号以 JSON 数组配置，key 的名额都已满时返回 model.ErrChannelSaturated
+func selectKeyForChannel(c *gin.Context, channel *model.Channel, modelName string) (string, string, error) {
+	if key, keyHash, ok := getFineTunedModelKey(channel, modelName); ok {
+		// 微调模型只能使用创建微调任务的 key
+		if !acquireChannelKeySlot(c, channel, keyHash) {
+			return "", "", model.ErrChannelSaturated
+		}
+		return key, keyHash, nil
+	}
+	keys := channel.GetKeys()
+	if len(keys) > 1 {
+		return selectChannelKey(c, channel, keys)
+	}
+	if len(keys) == 1 {
+		return keys[0], "", nil
+	}
+	return channel.Key, "", nil
+}
+
+// channelKeyIndex 返回渠道当前的轮询位置，渠道的 key 变化后从头开始
+func channelKeyIndex(channel *model.Channel, count int) int {
+	channelKeysMutex.Lock()
+	defer channelKeysMutex.Unlock()
+
+	// Check if keys have changed by comparing with stored hash
+	currentHash := common.GetMD5Hash(channel.Key)
+	storedHash, hashExists := channelKeysHash[channel.Id]
+
+	// Reset index if keys have changed or index doesn't exist
+	if hashExists && storedHash == currentHash {
+		storedIndex, exists := channelKeysIndex[channel.Id]
+		if exists && storedIndex < count {
+			return storedIndex
+		}
+		return 0
+	}
+	channelKeysHash[channel.Id] = currentHash
+	return 0
+}
+
+func setChannelKeyIndex(channelId int, index int) {
+	channelKeysMutex.Lock()
+	defer channelKeysMutex.Unlock()
+	channelKeysIndex[channelId] = index
+}
+
+// selectChannelKey 从当前位置开始轮询，跳过冷却中、已禁用和并发已满的 key，并优先使用未被上游限流的 key，
+// 只在读取和更新轮询位置时持有锁，占用并发名额时不持有锁。所有 key 都不可用时按原顺序轮询，
+// 可用的 key 并发都已满时返回 model.ErrChannelSaturated
+func selectChannelKey(c *gin.Context, channel *model.Channel, keys []string) (string, string, error) {
+	keyHashes := make([]string, len(keys))
+	for i, key := range keys {
+		keyHashes[i] = model.HashChannelKey(key)
+	}
+	// 提示词缓存绑定的 key 可用时直接使用，不推进轮询位置
+	if candidate, ok := selectPromptCacheAffinityKey(c, channel, keyHashes); ok {
+		return keys[candidate], keyHashes[candidate], nil
+	}
+	index := channelKeyIndex(channel, len(keys))
+	// 未被上游限流的 key 排在前面，被限流或额度将要用完的 key 排在后面
+	candidates := make([]int, 0, len(keys))
+	var rateLimited []int
+	for i := 0; i < len(keys); i++ {
+		candidate := (index + i) % len(keys)
+		keyHash := keyHashes[candidate]
+		if !model.IsChannelKeyAvailable(channel.Id, keyHash) {
+			continue
+		}
+		if model.IsChannelRateLimited(channel.Id, keyHash) || model.IsChannelNearRateLimit(channel.Id, keyHash) {
+			rateLimited = append(rateLimited, candidate)
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+	candidates = append(candidates, rateLimited...)
+	for _, candidate := range candidates {
+		if acquireChannelKeySlot(c, channel, keyHashes[candidate]) {
+			setChannelKeyIndex(channel.Id, (candidate+1)%len(keys))
+			return keys[candidate], keyHashes[candidate], nil
+		}
+	}
+	if len(candidates) > 0 {
+		return "", "", model.ErrChannelSaturated
+	}
+	setChannelKeyIndex(channel.Id, (index+1)%len(keys))
+	return keys[index], keyHashes[index], nil
+}
+
+// SetupContextForSelectedChannel 设置选中渠道的上下文，多 key 渠道中可用的 key 并发都已满时返回 model.ErrChannelSaturated
+func SetupContextForSelectedChannel(c *gin.Context, channel *model.Channel, modelName string) error {
 	c.Set("original_model", modelName) // for retry
 	if channel == nil {
-		return
+		return nil
 	}
 	c.Set("channel_id", channel.Id)
 	c.Set("channel_name", channel.Name)
@@ -405,44 +580,17 @@ c.Set("channel_create_time", channel.CreatedTime)
 	c.Set("model_mapping", channel.GetModelMapping())
 	c.Set("status_code_mapping", channel.GetStatusCodeMapping())
 
-	// 如果key包含逗号，使用轮询方式选择一个key
-	// 对于渠道类型41，不处理逗号分隔的多key机制
-	if channel.Type == 41 {
-		c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", channel.Key))
-	} else if strings.Contains(channel.Key, ",") {
-		keys := strings.Split(channel.Key, ",")
-
-		// Get current index for this channel using round-robin
-		channelKeysMutex.Lock()
-
-		// Check if keys have changed by comparing with stored hash
-		currentHash := common.GetMD5Hash(channel.Key)
-		storedHash, hashExists := channelKeysHash[channel.Id]
-
-		// Reset index if keys have changed or index doesn't exist
-		index := 0
-		if hashExists && storedHash == currentHash {
-			// Keys haven't changed, use stored index
-			storedIndex, exists := channelKeysIndex[channel.Id]
-			if exists && storedIndex < len(keys) {
-				index = storedIndex
-			}
-		} else {
-			// Keys have changed or this is first use, update hash and reset index
-			channelKeysHash[channel.Id] = currentHash
+	// 选择渠道时已占用名额的 key 直接使用，否则轮询选择一个可用的 key
+	key, keyHash, ok := takeChannelKeyReservation(c, channel)
+	if !ok {
+		var err error
+		key, keyHash, err = selectKeyForChannel(c, channel, modelName)
+		if err != nil {
+			return err
 		}
-
-		// Select key at current index
-		selectedKey := keys[index]
-
-		// Update index for next use
-		channelKeysIndex[channel.Id] = (index + 1) % len(keys)
-		channelKeysMutex.Unlock()
-
-		c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", strings.TrimSpace(selectedKey)))
-	} else {
-		c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", channel.Key))
 	}
+	c.Set(constant.ContextKeyChannelKeyHash, keyHash)
+	c.Request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", key))
 
 	c.Set("base_url", channel.GetBaseURL())
 	// TODO: api_version统一
@@ -462,4 +610,5 @@ c.Set("channel_create_time", channel.CreatedTime)
 	case common.ChannelTypeMokaAI:
 		c.Set("api_version", channel.Other)
 	}
+	return nil
 }
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"time"
+	"veloera/common"
+	"veloera/constant"
+	"veloera/model"
+	"veloera/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+// assignExperimentVariant 请求的模型有进行中的实验时，按令牌或请求的 user 字段稳定地分配变体，
+// 返回变体使用的模型，没有实验时返回 false
+func assignExperimentVariant(c *gin.Context, modelName string, user string) (string, bool) {
+	experiment := model_setting.GetActiveExperiment(modelName, common.GetTimestamp())
+	if experiment == nil {
+		return "", false
+	}
+	subject := "token:" + strconv.Itoa(c.GetInt("token_id"))
+	if experiment.StickyBy == model_setting.ExperimentStickyByUser && user != "" {
+		subject = "user:" + user
+	}
+	h := fnv.New32a()
+	h.Write([]byte(experiment.Name))
+	h.Write([]byte{0})
+	h.Write([]byte(subject))
+	variant := experiment.PickVariant(int(h.Sum32() % uint32(experiment.TotalWeight())))
+	if variant == nil {
+		return "", false
+	}
+	c.Set(constant.ContextKeyExperiment, &model.ExperimentAssignment{
+		Experiment: experiment.Name,
+		Variant:    variant.Name,
+		Model:      variant.Model,
+		StartTime:  time.Now(),
+	})
+	return variant.Model, true
+}
+
+// recordExperimentRequest 请求结束后记录实验请求的结果，用于按变体比较，没有可用渠道的请求也记为失败
+func recordExperimentRequest(c *gin.Context) {
+	value, ok := c.Get(constant.ContextKeyExperiment)
+	if !ok {
+		return
+	}
+	assignment := value.(*model.ExperimentAssignment)
+	promptTokens, completionTokens, quota := assignment.Usage()
+	model.RecordExperimentRequest(&model.ExperimentRequest{
+		Experiment:       assignment.Experiment,
+		Variant:          assignment.Variant,
+		Model:            assignment.Model,
+		RequestId:        c.GetString(common.RequestIdKey),
+		UserId:           c.GetInt("id"),
+		TokenId:          c.GetInt("token_id"),
+		Success:          c.Writer.Status() < http.StatusBadRequest,
+		Latency:          time.Since(assignment.StartTime).Milliseconds(),
+		Quota:            quota,
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+	})
+}
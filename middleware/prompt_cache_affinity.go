@@ -0,0 +1,197 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+	"veloera/common"
+	"veloera/constant"
+	"veloera/model"
+	"veloera/setting/operation_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+const contextKeyPromptCacheAffinityTarget = "prompt_cache_affinity_target"
+
+// promptCacheRequest 计算前缀时用到的字段，兼容 OpenAI、Claude、Gemini 和 Responses 格式
+type promptCacheRequest struct {
+	User     string `json:"user"`
+	Metadata *struct {
+		UserId string `json:"user_id"`
+	} `json:"metadata"`
+	System                 json.RawMessage   `json:"system"`
+	Instructions           json.RawMessage   `json:"instructions"`
+	SystemInstruction      json.RawMessage   `json:"systemInstruction"`
+	SystemInstructionSnake json.RawMessage   `json:"system_instruction"`
+	Messages               []json.RawMessage `json:"messages"`
+	Contents               []json.RawMessage `json:"contents"`
+	Input                  json.RawMessage   `json:"input"`
+}
+
+// writeCompactJSON 去掉空白后写入，避免格式差异导致前缀不同
+func writeCompactJSON(h hash.Hash, raw json.RawMessage) {
+	var buf bytes.Buffer
+	if json.Compact(&buf, raw) == nil {
+		h.Write(buf.Bytes())
+	} else {
+		h.Write(raw)
+	}
+	h.Write([]byte{'\n'})
+}
+
+// writePromptPrefix 写入系统消息和之后的前 n 条消息，返回是否写入了内容
+func writePromptPrefix(h hash.Hash, messages []json.RawMessage, n int) bool {
+	written := false
+	for _, message := range messages {
+		var role struct {
+			Role string `json:"role"`
+		}
+		_ = json.Unmarshal(message, &role)
+		if role.Role != "system" && role.Role != "developer" {
+			if n <= 0 {
+				continue
+			}
+			n--
+		}
+		writeCompactJSON(h, message)
+		written = true
+	}
+	return written
+}
+
+// promptCacheAffinityHash 计算请求的绑定哈希，优先使用客户端指定的会话，否则使用系统提示词和前几条消息，
+// 无法确定前缀时返回空字符串
+func promptCacheAffinityHash(c *gin.Context, group string, modelName string) string {
+	setting := operation_setting.GetPromptCacheAffinitySetting()
+	h := sha256.New()
+	h.Write([]byte(fmt.Sprintf("%s\n%s\n", group, modelName)))
+
+	session := ""
+	if setting.SessionHeader != "" {
+		session = strings.TrimSpace(c.GetHeader(setting.SessionHeader))
+	}
+	var request promptCacheRequest
+	if strings.HasPrefix(c.Request.Header.Get("Content-Type"), "application/json") {
+		if err := common.UnmarshalBodyReusable(c, &request); err != nil {
+			return ""
+		}
+	}
+	if session == "" && setting.UseUserField {
+		session = request.User
+		if session == "" && request.Metadata != nil {
+			session = request.Metadata.UserId
+		}
+	}
+	if session != "" {
+		h.Write([]byte("session:" + session))
+		return hex.EncodeToString(h.Sum(nil))
+	}
+
+	written := false
+	for _, system := range []json.RawMessage{request.System, request.Instructions, request.SystemInstruction, request.SystemInstructionSnake} {
+		if len(system) > 0 && string(system) != "null" {
+			writeCompactJSON(h, system)
+			written = true
+		}
+	}
+	messages := request.Messages
+	if len(messages) == 0 {
+		messages = request.Contents
+	}
+	if len(messages) == 0 && len(request.Input) > 0 {
+		// Responses 格式的 input 可以是字符串或消息数组
+		if json.Unmarshal(request.Input, &messages) != nil {
+			messages = []json.RawMessage{request.Input}
+		}
+	}
+	if writePromptPrefix(h, messages, setting.PrefixMessages) {
+		written = true
+	}
+	if !written {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// getPromptCacheAffinity 计算请求的绑定哈希并查询绑定的渠道和 key，未启用或没有绑定时返回 nil
+func getPromptCacheAffinity(c *gin.Context, group string, modelName string) *model.PromptCacheAffinity {
+	if !operation_setting.GetPromptCacheAffinitySetting().Enabled {
+		return nil
+	}
+	affinityHash := promptCacheAffinityHash(c, group, modelName)
+	if affinityHash == "" {
+		return nil
+	}
+	c.Set(constant.ContextKeyPromptCacheAffinity, affinityHash)
+	affinity, ok := model.GetPromptCacheAffinity(affinityHash)
+	if !ok {
+		return nil
+	}
+	return &affinity
+}
+
+// selectChannelWithAffinity 绑定的渠道健康时使用绑定的渠道，否则按正常策略选择
+func selectChannelWithAffinity(c *gin.Context, group string, modelName string) (*model.Channel, error) {
+	affinity := getPromptCacheAffinity(c, group, modelName)
+	if affinity != nil {
+		// 选择渠道时会同时选择 key，绑定的渠道被选中时优先使用绑定的 key
+		c.Set(contextKeyPromptCacheAffinityTarget, affinity)
+	}
+	routed := false
+	channel, err := SelectChannelWithConcurrency(c, func() (*model.Channel, string, error) {
+		routed = false
+		if affinity != nil {
+			if channel, ok := model.GetPromptCacheAffinityChannel(group, modelName, affinity.ChannelId); ok {
+				routed = true
+				return channel, modelName, nil
+			}
+		}
+		channel, err := model.CacheGetRandomSatisfiedChannel(group, modelName, 0)
+		return channel, modelName, err
+	})
+	if err == nil && routed {
+		c.Set(constant.ContextKeyPromptCacheAffinityRouted, true)
+	}
+	return channel, err
+}
+
+// selectPromptCacheAffinityKey 多 key 渠道优先使用绑定的 key，key 不可用或被限流时返回 false
+func selectPromptCacheAffinityKey(c *gin.Context, channel *model.Channel, keyHashes []string) (int, bool) {
+	value, ok := c.Get(contextKeyPromptCacheAffinityTarget)
+	if !ok {
+		return 0, false
+	}
+	affinity := value.(*model.PromptCacheAffinity)
+	if affinity.ChannelId != channel.Id || affinity.KeyHash == "" {
+		return 0, false
+	}
+	for i, keyHash := range keyHashes {
+		if keyHash != affinity.KeyHash {
+			continue
+		}
+		if !model.IsChannelKeyAvailable(channel.Id, keyHash) || model.IsChannelRateLimited(channel.Id, keyHash) {
+			return 0, false
+		}
+		return i, acquireChannelKeySlot(c, channel, keyHash)
+	}
+	return 0, false
+}
+
+// RecordPromptCacheAffinity 请求成功后将绑定哈希指向实际使用的渠道和 key，重试切换渠道后绑定随之迁移
+func RecordPromptCacheAffinity(c *gin.Context) {
+	affinityHash := c.GetString(constant.ContextKeyPromptCacheAffinity)
+	if affinityHash == "" {
+		return
+	}
+	ttl := time.Duration(operation_setting.GetPromptCacheAffinitySetting().TTLSeconds) * time.Second
+	if ttl <= 0 {
+		return
+	}
+	model.SetPromptCacheAffinity(affinityHash, c.GetInt("channel_id"), c.GetString(constant.ContextKeyChannelKeyHash), ttl)
+}
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"veloera/common"
+	"veloera/constant"
+	"veloera/model"
+	"veloera/setting/model_setting"
+
+	"github.com/gin-gonic/gin"
+)
+
+const contextKeyVirtualModelFallback = "virtual_model_fallback"
+
+// VirtualModelFallback 记录虚拟模型当前使用的模型，每个模型最多重试 RetryTimes 次，
+// 渠道用尽后按顺序切换到下一个模型
+type VirtualModelFallback struct {
+	Name   string
+	Models []string
+	index  int
+	retry  int
+}
+
+// GetVirtualModelFallback 返回当前请求的虚拟模型，请求的不是虚拟模型时返回 nil
+func GetVirtualModelFallback(c *gin.Context) *VirtualModelFallback {
+	fallback, ok := c.Get(contextKeyVirtualModelFallback)
+	if !ok {
+		return nil
+	}
+	return fallback.(*VirtualModelFallback)
+}
+
+// RetryTimes 虚拟模型的最大重试次数，链上每个模型都有 RetryTimes 次重试
+func (f *VirtualModelFallback) RetryTimes() int {
+	return (common.RetryTimes+1)*len(f.Models) - 1
+}
+
+// RemainingRetryTimes 当前模型和后续模型剩余的重试次数
+func (f *VirtualModelFallback) RemainingRetryTimes() int {
+	if f.index >= len(f.Models) {
+		return 0
+	}
+	return common.RetryTimes - f.retry + (common.RetryTimes+1)*(len(f.Models)-f.index-1)
+}
+
+// selectChannel 从当前模型开始选择渠道，当前模型无可用渠道时切换到下一个模型，
+// 剩余模型的渠道并发都已满时返回 model.ErrChannelSaturated
+func (f *VirtualModelFallback) selectChannel(group string) (*model.Channel, string, error) {
+	saturated := false
+	for index, retry := f.index, f.retry; index < len(f.Models); index, retry = index+1, 0 {
+		modelName := f.Models[index]
+		if retry <= common.RetryTimes {
+			channel, err := model.CacheGetRandomSatisfiedChannel(group, modelName, retry)
+			if err == nil && channel != nil {
+				f.index, f.retry = index, retry
+				return channel, modelName, nil
+			}
+			if errors.Is(err, model.ErrChannelSaturated) {
+				saturated = true
+			}
+		}
+	}
+	f.index = len(f.Models)
+	if saturated {
+		return nil, "", model.ErrChannelSaturated
+	}
+	return nil, "", fmt.Errorf("虚拟模型 %s 下的模型均无可用渠道", f.Name)
+}
+
+// selectChannelWithConcurrency 选择渠道并占用并发名额，所有模型的渠道都已满时排队等待
+func (f *VirtualModelFallback) selectChannelWithConcurrency(c *gin.Context, group string) (*model.Channel, string, error) {
+	index, retry := f.index, f.retry
+	var modelName string
+	channel, err := SelectChannelWithConcurrency(c, func() (*model.Channel, string, error) {
+		f.index, f.retry = index, retry
+		var channel *model.Channel
+		var err error
+		channel, modelName, err = f.selectChannel(group)
+		return channel, modelName, err
+	})
+	return channel, modelName, err
+}
+
+// NextChannel 选择重试使用的渠道，并按选中的模型设置上下文
+func (f *VirtualModelFallback) NextChannel(c *gin.Context, group string) (*model.Channel, error) {
+	f.retry++
+	channel, modelName, err := f.selectChannelWithConcurrency(c, group)
+	if err != nil {
+		return nil, err
+	}
+	c.Set("prefixed_model", modelName)
+	if err := SetupContextForSelectedChannel(c, channel, modelName); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// selectVirtualModelChannel 请求的是虚拟模型时选择链上第一个有可用渠道的模型，返回选中的渠道和模型
+func selectVirtualModelChannel(c *gin.Context, group string, modelName string) (*model.Channel, string, bool, error) {
+	models, ok := model_setting.GetVirtualModelChain(modelName)
+	if !ok {
+		return nil, "", false, nil
+	}
+	fallback := &VirtualModelFallback{
+		Name:   modelName,
+		Models: models,
+	}
+	channel, servedModel, err := fallback.selectChannelWithConcurrency(c, group)
+	if err != nil {
+		return nil, "", true, err
+	}
+	c.Set(contextKeyVirtualModelFallback, fallback)
+	c.Set(constant.ContextKeyVirtualModel, modelName)
+	c.Set("prefixed_model", servedModel)
+	return channel, servedModel, true, nil
+}
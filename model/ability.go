@@ -3,8 +3,10 @@ package model
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 	"veloera/common"
+	"veloera/setting/model_setting"
 
 	"github.com/samber/lo"
 	"gorm.io/gorm"
@@ -24,14 +26,36 @@ func GetGroupModels(group string) []string {
 	var models []string
 	// Find distinct models
 	DB.Table("abilities").Where(groupCol+" = ? and enabled = ?", group, true).Distinct("model").Pluck("model", &models)
-	return models
+	return appendVirtualModels(models)
 }
 
 func GetEnabledModels() []string {
 	var models []string
 	// Find distinct models
 	DB.Table("abilities").Where("enabled = ?", true).Distinct("model").Pluck("model", &models)
-	return models
+	return appendVirtualModels(models)
+}
+
+// appendVirtualModels 加入链上至少有一个模型可用的虚拟模型和实验模型
+func appendVirtualModels(models []string) []string {
+	available := make(map[string]bool, len(models))
+	for _, model := range models {
+		available[model] = true
+	}
+	virtualModels := make([]string, 0)
+	for name, chain := range model_setting.GetVirtualModelChains(common.GetTimestamp()) {
+		if available[name] {
+			continue
+		}
+		for _, model := range chain {
+			if available[model] {
+				virtualModels = append(virtualModels, name)
+				break
+			}
+		}
+	}
+	sort.Strings(virtualModels)
+	return append(models, virtualModels...)
 }
 
 func GetAllEnableAbilities() []Ability {
@@ -106,8 +130,27 @@ func GetRandomSatisfiedChannel(group string, model string, retry int) (*Channel,
 	if err != nil {
 		return nil, err
 	}
+	abilities = filterCircuitAvailableAbilities(abilities, model)
+	abilities, err = filterAbilities(abilities, func(channels []*Channel) ([]*Channel, error) {
+		channels, err := filterUnsaturatedChannels(channels)
+		if err != nil {
+			return nil, err
+		}
+		return preferRateLimitAvailableChannels(channels), nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	channel := Channel{}
-	if len(abilities) > 0 {
+	channelIds := make([]int, len(abilities))
+	weights := make([]int, len(abilities))
+	for i, ability_ := range abilities {
+		channelIds[i] = ability_.ChannelId
+		weights[i] = int(ability_.Weight)
+	}
+	if index, ok := selectChannelByStrategy(group, model, channelIds, weights); ok {
+		channel.Id = abilities[index].ChannelId
+	} else if len(abilities) > 0 {
 		// Randomly choose one
 		weightSum := uint(0)
 		for _, ability_ := range abilities {
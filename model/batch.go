@@ -0,0 +1,183 @@
+package model
+
+import (
+	"encoding/json"
+	"sync"
+	"veloera/common"
+
+	"gorm.io/gorm"
+)
+
+const (
+	BatchStatusValidating = "validating"
+	BatchStatusFailed     = "failed"
+	BatchStatusInProgress = "in_progress"
+	BatchStatusFinalizing = "finalizing"
+	BatchStatusCompleted  = "completed"
+	BatchStatusExpired    = "expired"
+	BatchStatusCancelling = "cancelling"
+	BatchStatusCancelled  = "cancelled"
+)
+
+// Batch /v1/batches 创建的批处理，由主节点逐行执行输入文件中的请求
+type Batch struct {
+	Id               int             `json:"id"`
+	BatchId          string          `json:"batch_id" gorm:"type:varchar(64);uniqueIndex"`
+	UserId           int             `json:"user_id" gorm:"index"`
+	TokenId          int             `json:"token_id" gorm:"index"`
+	Endpoint         string          `json:"endpoint" gorm:"type:varchar(64)"`
+	Model            string          `json:"model" gorm:"type:varchar(255)"`
+	InputFileId      string          `json:"input_file_id" gorm:"type:varchar(64)"`
+	OutputFileId     string          `json:"output_file_id" gorm:"type:varchar(64)"` // 执行时预先分配，完成后才创建文件记录
+	ErrorFileId      string          `json:"error_file_id" gorm:"type:varchar(64)"`
+	CompletionWindow string          `json:"completion_window" gorm:"type:varchar(16)"`
+	Status           string          `json:"status" gorm:"type:varchar(16);index"`
+	Metadata         json.RawMessage `json:"metadata" gorm:"type:json"`
+	Errors           json.RawMessage `json:"errors" gorm:"type:json"` // 输入文件校验失败的原因
+	Total            int             `json:"total"`
+	Completed        int             `json:"completed"`
+	Failed           int             `json:"failed"`
+	Dispatched       int             `json:"dispatched"`   // 已开始执行的请求数，大于 Completed+Failed 说明执行被中断，这部分请求不再重新执行
+	OutputBytes      int64           `json:"output_bytes"` // 与进度一起记录的结果文件大小，继续执行时截断到该大小
+	ErrorBytes       int64           `json:"error_bytes"`
+	Quota            int             `json:"quota"`
+	PromptTokens     int             `json:"prompt_tokens"`
+	CompletionTokens int             `json:"completion_tokens"`
+	UpstreamCost     int             `json:"-"` // 各请求按实际使用的渠道计算的上游成本之和
+	CreatedAt        int64           `json:"created_at" gorm:"bigint;index"`
+	InProgressAt     int64           `json:"in_progress_at" gorm:"bigint"`
+	ExpiresAt        int64           `json:"expires_at" gorm:"bigint"`
+	FinalizingAt     int64           `json:"finalizing_at" gorm:"bigint"`
+	CompletedAt      int64           `json:"completed_at" gorm:"bigint"`
+	FailedAt         int64           `json:"failed_at" gorm:"bigint"`
+	ExpiredAt        int64           `json:"expired_at" gorm:"bigint"`
+	CancellingAt     int64           `json:"cancelling_at" gorm:"bigint"`
+	CancelledAt      int64           `json:"cancelled_at" gorm:"bigint"`
+}
+
+func (b *Batch) Insert() error {
+	if b.CreatedAt == 0 {
+		b.CreatedAt = common.GetTimestamp()
+	}
+	return DB.Create(b).Error
+}
+
+// Update 只更新指定的字段
+func (b *Batch) Update(fields map[string]any) error {
+	return DB.Model(b).Updates(fields).Error
+}
+
+// IsFinished 批处理已结束，不会再执行请求
+func (b *Batch) IsFinished() bool {
+	switch b.Status {
+	case BatchStatusFailed, BatchStatusCompleted, BatchStatusExpired, BatchStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// GetUserBatch 获取用户的批处理，不存在时返回 gorm.ErrRecordNotFound
+func GetUserBatch(userId int, batchId string) (*Batch, error) {
+	if batchId == "" {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var b Batch
+	err := DB.Where("batch_id = ? AND user_id = ?", batchId, userId).First(&b).Error
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func GetBatchById(id int) (*Batch, error) {
+	var b Batch
+	err := DB.First(&b, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// GetUserBatches 按创建时间倒序列出用户的批处理，after 为上一页最后一个批处理的 id
+func GetUserBatches(userId int, after string, limit int) ([]*Batch, error) {
+	tx := DB.Where("user_id = ?", userId)
+	if after != "" {
+		afterBatch, err := GetUserBatch(userId, after)
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where("id < ?", afterBatch.Id)
+	}
+	var batches []*Batch
+	err := tx.Order("id desc").Limit(limit).Find(&batches).Error
+	return batches, err
+}
+
+// GetUnfinishedBatches 获取需要调度执行的批处理
+func GetUnfinishedBatches() ([]*Batch, error) {
+	var batches []*Batch
+	err := DB.Where("status IN ?", []string{BatchStatusValidating, BatchStatusInProgress, BatchStatusFinalizing, BatchStatusCancelling}).
+		Order("id asc").Find(&batches).Error
+	return batches, err
+}
+
+// CancelUserBatch 将未结束的批处理标记为取消中，由调度器停止执行并生成结果文件
+func CancelUserBatch(userId int, batchId string) (*Batch, error) {
+	b, err := GetUserBatch(userId, batchId)
+	if err != nil {
+		return nil, err
+	}
+	if b.IsFinished() || b.Status == BatchStatusCancelling {
+		return b, nil
+	}
+	now := common.GetTimestamp()
+	result := DB.Model(&Batch{}).Where("id = ? AND status IN ?", b.Id, []string{BatchStatusValidating, BatchStatusInProgress}).
+		Updates(map[string]any{"status": BatchStatusCancelling, "cancelling_at": now})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	return GetUserBatch(userId, batchId)
+}
+
+// UpdateBatchIfStatus 仅在批处理处于 statuses 之一时更新，返回是否更新成功，避免覆盖并发的取消操作
+func UpdateBatchIfStatus(id int, statuses []string, fields map[string]any) (bool, error) {
+	result := DB.Model(&Batch{}).Where("id = ? AND status IN ?", id, statuses).Updates(fields)
+	return result.RowsAffected > 0, result.Error
+}
+
+// SetBatchDispatched 在执行一组请求前记录已开始执行的请求数
+func SetBatchDispatched(id int, dispatched int) error {
+	return DB.Model(&Batch{}).Where("id = ?", id).Update("dispatched", dispatched).Error
+}
+
+// IncreaseBatchProgress 累加一组请求的执行结果和消耗，并记录写入结果后的文件大小
+func IncreaseBatchProgress(id int, completed int, failed int, outputBytes int64, errorBytes int64, usage *BatchUsage) error {
+	return DB.Model(&Batch{}).Where("id = ?", id).Updates(map[string]any{
+		"completed":         gorm.Expr("completed + ?", completed),
+		"failed":            gorm.Expr("failed + ?", failed),
+		"output_bytes":      outputBytes,
+		"error_bytes":       errorBytes,
+		"quota":             gorm.Expr("quota + ?", usage.Quota),
+		"prompt_tokens":     gorm.Expr("prompt_tokens + ?", usage.PromptTokens),
+		"completion_tokens": gorm.Expr("completion_tokens + ?", usage.CompletionTokens),
+		"upstream_cost":     gorm.Expr("upstream_cost + ?", usage.UpstreamCost),
+	}).Error
+}
+
+// BatchUsage 汇总批处理请求的消耗，请求的消费日志不单独记录，批处理结束时记录一条汇总日志
+type BatchUsage struct {
+	mu               sync.Mutex
+	Quota            int
+	PromptTokens     int
+	CompletionTokens int
+	UpstreamCost     int
+}
+
+func (u *BatchUsage) add(promptTokens int, completionTokens int, quota int, upstreamCost int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.Quota += quota
+	u.PromptTokens += promptTokens
+	u.CompletionTokens += completionTokens
+	u.UpstreamCost += upstreamCost
+}
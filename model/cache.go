@@ -90,6 +90,12 @@ func CacheGetRandomSatisfiedChannel(group string, model string, retry int) (*Cha
 	if len(channels) == 0 {
 		return nil, errors.New("channel not found")
 	}
+	channels = filterCircuitAvailableChannels(channels, model)
+	channels, err := filterUnsaturatedChannels(channels)
+	if err != nil {
+		return nil, err
+	}
+	channels = preferRateLimitAvailableChannels(channels)
 
 	uniquePriorities := make(map[int]bool)
 	for _, channel := range channels {
@@ -114,6 +120,16 @@ func CacheGetRandomSatisfiedChannel(group string, model string, retry int) (*Cha
 		}
 	}
 
+	channelIds := make([]int, len(targetChannels))
+	weights := make([]int, len(targetChannels))
+	for i, channel := range targetChannels {
+		channelIds[i] = channel.Id
+		weights[i] = channel.GetWeight()
+	}
+	if index, ok := selectChannelByStrategy(group, model, channelIds, weights); ok {
+		return targetChannels[index], nil
+	}
+
 	// 平滑系数
 	smoothingFactor := 10
 	// Calculate the total weight of all channels up to endIdx
@@ -159,3 +175,79 @@ func CacheUpdateChannelStatus(id int, status int) {
 		channel.Status = status
 	}
 }
+
+// CacheGetAlternateChannel 为对冲或续写请求选择一个与 excludeChannelId 不同的渠道，在可用渠道的最高优先级中按分组的策略选择。
+// accept 不为空时只在它接受的渠道中选择
+func CacheGetAlternateChannel(group string, model string, excludeChannelId int, accept func(channel *Channel) bool) (*Channel, error) {
+	if strings.HasPrefix(model, "gpt-4-gizmo") {
+		model = "gpt-4-gizmo-*"
+	}
+	if strings.HasPrefix(model, "gpt-4o-gizmo") {
+		model = "gpt-4o-gizmo-*"
+	}
+
+	var channels []*Channel
+	if common.MemoryCacheEnabled {
+		channelSyncLock.RLock()
+		for _, channel := range group2model2channels[group][model] {
+			if channel.Id != excludeChannelId {
+				channels = append(channels, channel)
+			}
+		}
+		channelSyncLock.RUnlock()
+	} else {
+		trueVal := "1"
+		if common.UsingPostgreSQL {
+			trueVal = "true"
+		}
+		var channelIds []int
+		err := DB.Model(&Ability{}).Where(groupCol+" = ? and model = ? and enabled = "+trueVal+" and channel_id <> ?", group, model, excludeChannelId).
+			Pluck("channel_id", &channelIds).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(channelIds) > 0 {
+			if err = DB.Where("id IN ?", channelIds).Find(&channels).Error; err != nil {
+				return nil, err
+			}
+		}
+	}
+	if accept != nil {
+		acceptedChannels := make([]*Channel, 0, len(channels))
+		for _, channel := range channels {
+			if accept(channel) {
+				acceptedChannels = append(acceptedChannels, channel)
+			}
+		}
+		channels = acceptedChannels
+	}
+	channels = filterCircuitAvailableChannels(channels, model)
+	channels, err := filterUnsaturatedChannels(channels)
+	if err != nil {
+		return nil, err
+	}
+	channels = preferRateLimitAvailableChannels(channels)
+	if len(channels) == 0 {
+		return nil, errors.New("channel not found")
+	}
+
+	maxPriority := channels[0].GetPriority()
+	for _, channel := range channels {
+		if channel.GetPriority() > maxPriority {
+			maxPriority = channel.GetPriority()
+		}
+	}
+	var targetChannels []*Channel
+	var channelIds, weights []int
+	for _, channel := range channels {
+		if channel.GetPriority() == maxPriority {
+			targetChannels = append(targetChannels, channel)
+			channelIds = append(channelIds, channel.Id)
+			weights = append(weights, channel.GetWeight())
+		}
+	}
+	if index, ok := selectChannelByStrategy(group, model, channelIds, weights); ok {
+		return targetChannels[index], nil
+	}
+	return targetChannels[pickChannelByWeight(weights, -1)], nil
+}
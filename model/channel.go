@@ -5,6 +5,7 @@ import (
 	"strings"
 	"sync"
 	"veloera/common"
+	"veloera/constant"
 
 	"gorm.io/gorm"
 )
@@ -12,7 +13,7 @@ import (
 type Channel struct {
 	Id                 int     `json:"id"`
 	Type               int     `json:"type" gorm:"default:0"`
-	Key                string  `json:"key" gorm:"not null"`
+	Key                string  `json:"key" gorm:"not null;serializer:encrypted"` // 配置了主密钥时加密保存
 	OpenAIOrganization *string `json:"openai_organization"`
 	TestModel          *string `json:"test_model"`
 	Status             int     `json:"status" gorm:"default:1"`
@@ -38,6 +39,7 @@ type Channel struct {
 	Setting           *string `json:"setting" gorm:"type:text"`
 	ParamOverride     *string `json:"param_override" gorm:"type:text"`
 	ModelPrefix       *string `json:"model_prefix" gorm:"type:varchar(64);default:''"`
+	KeyHash           string  `json:"-" gorm:"type:varchar(64);index"` // key 的哈希，用于按 key 搜索
 
 	// 转录服务相关字段
 	EngineType         int    `json:"engine_type" gorm:"default:0"`
@@ -162,11 +164,11 @@ func SearchChannels(keyword string, group string, model string, idSort bool) ([]
 			// sqlite, PostgreSQL
 			groupCondition = `(',' || ` + groupCol + ` || ',') LIKE ?`
 		}
-		whereClause = "(id = ? OR name LIKE ? OR " + keyCol + " = ?) AND " + modelsCol + ` LIKE ? AND ` + groupCondition
-		args = append(args, common.String2Int(keyword), "%"+keyword+"%", keyword, "%"+model+"%", "%,"+group+",%")
+		whereClause = "(id = ? OR name LIKE ? OR key_hash = ?) AND " + modelsCol + ` LIKE ? AND ` + groupCondition
+		args = append(args, common.String2Int(keyword), "%"+keyword+"%", HashChannelKey(keyword), "%"+model+"%", "%,"+group+",%")
 	} else {
-		whereClause = "(id = ? OR name LIKE ? OR " + keyCol + " = ?) AND " + modelsCol + " LIKE ?"
-		args = append(args, common.String2Int(keyword), "%"+keyword+"%", keyword, "%"+model+"%")
+		whereClause = "(id = ? OR name LIKE ? OR key_hash = ?) AND " + modelsCol + " LIKE ?"
+		args = append(args, common.String2Int(keyword), "%"+keyword+"%", HashChannelKey(keyword), "%"+model+"%")
 	}
 
 	// 执行查询
@@ -190,6 +192,9 @@ func GetChannelById(id int, selectAll bool) (*Channel, error) {
 
 func BatchInsertChannels(channels []Channel) error {
 	var err error
+	for i := range channels {
+		channels[i].syncKeyHash()
+	}
 	err = DB.Create(&channels).Error
 	if err != nil {
 		return err
@@ -223,6 +228,43 @@ func BatchDeleteChannels(ids []int) error {
 	return err
 }
 
+// ChannelRuntimeColumns 渠道运行时的状态，不属于渠道的配置
+var ChannelRuntimeColumns = []string{"created_time", "test_time", "response_time", "balance", "balance_updated_time", "used_quota"}
+
+// ReconcileChannels 在一个事务中新建、更新和删除渠道，并同步更新 abilities，更新时保留运行时的状态
+func ReconcileChannels(creates []*Channel, updates []*Channel, deleteIds []int) error {
+	return DB.Transaction(func(tx *gorm.DB) error {
+		for _, channel := range creates {
+			channel.syncKeyHash()
+			if err := tx.Create(channel).Error; err != nil {
+				return err
+			}
+			if err := channel.UpdateAbilities(tx); err != nil {
+				return err
+			}
+		}
+		for _, channel := range updates {
+			channel.syncKeyHash()
+			err := tx.Model(channel).Select("*").Omit(ChannelRuntimeColumns...).Updates(channel).Error
+			if err != nil {
+				return err
+			}
+			if err := channel.UpdateAbilities(tx); err != nil {
+				return err
+			}
+		}
+		if len(deleteIds) > 0 {
+			if err := tx.Where("id in (?)", deleteIds).Delete(&Channel{}).Error; err != nil {
+				return err
+			}
+			if err := tx.Where("channel_id in (?)", deleteIds).Delete(&Ability{}).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 func (channel *Channel) GetPriority() int64 {
 	if channel.Priority == nil {
 		return 0
@@ -260,6 +302,7 @@ func (channel *Channel) GetStatusCodeMapping() string {
 
 func (channel *Channel) Insert() error {
 	var err error
+	channel.syncKeyHash()
 	err = DB.Create(channel).Error
 	if err != nil {
 		return err
@@ -270,6 +313,7 @@ func (channel *Channel) Insert() error {
 
 func (channel *Channel) Update() error {
 	var err error
+	channel.syncKeyHash()
 	err = DB.Model(channel).Updates(channel).Error
 	if err != nil {
 		return err
@@ -489,11 +533,11 @@ func SearchTags(keyword string, group string, model string, idSort bool) ([]*str
 			// sqlite, PostgreSQL
 			groupCondition = `(',' || ` + groupCol + ` || ',') LIKE ?`
 		}
-		whereClause = "(id = ? OR name LIKE ? OR " + keyCol + " = ?) AND " + modelsCol + ` LIKE ? AND ` + groupCondition
-		args = append(args, common.String2Int(keyword), "%"+keyword+"%", keyword, "%"+model+"%", "%,"+group+",%")
+		whereClause = "(id = ? OR name LIKE ? OR key_hash = ?) AND " + modelsCol + ` LIKE ? AND ` + groupCondition
+		args = append(args, common.String2Int(keyword), "%"+keyword+"%", HashChannelKey(keyword), "%"+model+"%", "%,"+group+",%")
 	} else {
-		whereClause = "(id = ? OR name LIKE ? OR " + keyCol + " = ?) AND " + modelsCol + " LIKE ?"
-		args = append(args, common.String2Int(keyword), "%"+keyword+"%", keyword, "%"+model+"%")
+		whereClause = "(id = ? OR name LIKE ? OR key_hash = ?) AND " + modelsCol + " LIKE ?"
+		args = append(args, common.String2Int(keyword), "%"+keyword+"%", HashChannelKey(keyword), "%"+model+"%")
 	}
 
 	subQuery := baseQuery.Where(whereClause, args...).
@@ -531,6 +575,37 @@ func (channel *Channel) GetSetting() map[string]interface{} {
 	return setting
 }
 
+// ChannelTestCase 渠道测试的自定义提示词，回复需要包含 Expect 中的所有内容
+type ChannelTestCase struct {
+	Model  string   `json:"model"` // 适用的测试模型，为空时适用于所有对话模型
+	Prompt string   `json:"prompt"`
+	Expect []string `json:"expect"`
+}
+
+// GetTestCases 返回适用于测试模型的自定义测试用例
+func (channel *Channel) GetTestCases(modelName string) []ChannelTestCase {
+	value, ok := channel.GetSetting()[constant.ChannelSettingTestCases]
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var testCases []ChannelTestCase
+	if err := json.Unmarshal(data, &testCases); err != nil {
+		common.SysError("failed to unmarshal channel test cases: " + err.Error())
+		return nil
+	}
+	cases := make([]ChannelTestCase, 0, len(testCases))
+	for _, testCase := range testCases {
+		if testCase.Prompt != "" && (testCase.Model == "" || testCase.Model == modelName) {
+			cases = append(cases, testCase)
+		}
+	}
+	return cases
+}
+
 func (channel *Channel) SetSetting(setting map[string]interface{}) {
 	settingBytes, err := json.Marshal(setting)
 	if err != nil {
@@ -0,0 +1,210 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"veloera/common"
+	"veloera/constant"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// ErrChannelSaturated 所有可用渠道的并发都已达到上限
+var ErrChannelSaturated = errors.New("all channels are saturated")
+
+// 请求异常退出未释放的并发名额在租期后自动回收
+const channelConcurrencyLease = 10 * time.Minute
+
+var (
+	channelConcurrencyLock  sync.Mutex
+	channelConcurrencyCount = make(map[string]int)
+)
+
+// redis 中以有序集合实现信号量，成员为持有者，分数为获取时间。
+// KEYS[1] 信号量键，ARGV: 上限, 持有者, 当前时间（毫秒）, 租期（毫秒）
+var channelConcurrencyAcquireScript = redis.NewScript(`
+local limit = tonumber(ARGV[1])
+local now = tonumber(ARGV[3])
+local lease = tonumber(ARGV[4])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - lease)
+if redis.call('ZCARD', KEYS[1]) >= limit then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now, ARGV[2])
+redis.call('PEXPIRE', KEYS[1], lease)
+return 1
+`)
+
+// ChannelSlot 占用的一个并发名额
+type ChannelSlot struct {
+	key    string
+	member string
+}
+
+// Release 释放并发名额
+func (s *ChannelSlot) Release() {
+	if common.RedisEnabled {
+		if err := common.RDB.ZRem(context.Background(), s.redisKey(), s.member).Err(); err != nil {
+			common.SysError("failed to release channel concurrency: " + err.Error())
+		}
+		return
+	}
+	channelConcurrencyLock.Lock()
+	defer channelConcurrencyLock.Unlock()
+	if channelConcurrencyCount[s.key] > 0 {
+		channelConcurrencyCount[s.key]--
+	}
+}
+
+func (s *ChannelSlot) redisKey() string {
+	return "channel_concurrency:" + s.key
+}
+
+func channelConcurrencyKey(channelId int, keyHash string) string {
+	if keyHash == "" {
+		return fmt.Sprintf("%d", channelId)
+	}
+	return fmt.Sprintf("%d:%s", channelId, keyHash)
+}
+
+func getIntSetting(setting map[string]interface{}, name string) int {
+	value, ok := setting[name].(float64)
+	if !ok || value <= 0 {
+		return 0
+	}
+	return int(value)
+}
+
+// GetMaxConcurrency 渠道最大并发请求数，0 表示不限制
+func (channel *Channel) GetMaxConcurrency() int {
+	return getIntSetting(channel.GetSetting(), constant.ChannelSettingMaxConcurrency)
+}
+
+// GetKeyMaxConcurrency 渠道中每个 key 的最大并发请求数，0 表示不限制
+func (channel *Channel) GetKeyMaxConcurrency() int {
+	return getIntSetting(channel.GetSetting(), constant.ChannelSettingKeyMaxConcurrency)
+}
+
+func tryAcquireChannelSlot(key string, limit int) (*ChannelSlot, bool) {
+	slot := &ChannelSlot{key: key, member: common.GetUUID()}
+	if common.RedisEnabled {
+		now := time.Now().UnixMilli()
+		acquired, err := channelConcurrencyAcquireScript.Run(context.Background(), common.RDB, []string{slot.redisKey()},
+			limit, slot.member, now, channelConcurrencyLease.Milliseconds()).Int()
+		if err != nil {
+			// redis 不可用时不限制并发，避免请求全部失败
+			common.SysError("failed to acquire channel concurrency: " + err.Error())
+			return nil, true
+		}
+		return slot, acquired == 1
+	}
+	channelConcurrencyLock.Lock()
+	defer channelConcurrencyLock.Unlock()
+	if channelConcurrencyCount[key] >= limit {
+		return nil, false
+	}
+	channelConcurrencyCount[key]++
+	return slot, true
+}
+
+// GetChannelConcurrency 返回渠道（keyHash 为空）或渠道中某个 key 正在处理的请求数
+func GetChannelConcurrency(channelId int, keyHash string) int {
+	key := channelConcurrencyKey(channelId, keyHash)
+	if common.RedisEnabled {
+		slot := ChannelSlot{key: key}
+		ctx := context.Background()
+		minScore := fmt.Sprintf("%d", time.Now().Add(-channelConcurrencyLease).UnixMilli())
+		count, err := common.RDB.ZCount(ctx, slot.redisKey(), minScore, "+inf").Result()
+		if err != nil {
+			common.SysError("failed to get channel concurrency: " + err.Error())
+			return 0
+		}
+		return int(count)
+	}
+	channelConcurrencyLock.Lock()
+	defer channelConcurrencyLock.Unlock()
+	return channelConcurrencyCount[key]
+}
+
+// TryAcquireChannelSlot 占用渠道的一个并发名额，渠道未限制并发时返回 nil, true
+func TryAcquireChannelSlot(channel *Channel) (*ChannelSlot, bool) {
+	limit := channel.GetMaxConcurrency()
+	if limit <= 0 {
+		return nil, true
+	}
+	return tryAcquireChannelSlot(channelConcurrencyKey(channel.Id, ""), limit)
+}
+
+// TryAcquireChannelKeySlot 占用渠道中某个 key 的一个并发名额，未限制 key 并发时返回 nil, true
+func TryAcquireChannelKeySlot(channel *Channel, keyHash string) (*ChannelSlot, bool) {
+	limit := channel.GetKeyMaxConcurrency()
+	if limit <= 0 || keyHash == "" {
+		return nil, true
+	}
+	return tryAcquireChannelSlot(channelConcurrencyKey(channel.Id, keyHash), limit)
+}
+
+// IsChannelSaturated 渠道的并发已满，或者渠道中所有 key 的并发都已满
+func IsChannelSaturated(channel *Channel) bool {
+	if limit := channel.GetMaxConcurrency(); limit > 0 && GetChannelConcurrency(channel.Id, "") >= limit {
+		return true
+	}
+	keyLimit := channel.GetKeyMaxConcurrency()
+	if keyLimit <= 0 {
+		return false
+	}
+	for _, key := range channel.GetKeys() {
+		if GetChannelConcurrency(channel.Id, HashChannelKey(key)) < keyLimit {
+			return false
+		}
+	}
+	return true
+}
+
+// filterUnsaturatedChannels 过滤掉并发已满的渠道，所有渠道都已满时返回 ErrChannelSaturated
+func filterUnsaturatedChannels(channels []*Channel) ([]*Channel, error) {
+	available := make([]*Channel, 0, len(channels))
+	for _, channel := range channels {
+		if !IsChannelSaturated(channel) {
+			available = append(available, channel)
+		}
+	}
+	if len(available) == 0 && len(channels) > 0 {
+		return nil, ErrChannelSaturated
+	}
+	return available, nil
+}
+
+// filterAbilities 按渠道过滤 abilities，用于未启用内存缓存时
+func filterAbilities(abilities []Ability, filter func(channels []*Channel) ([]*Channel, error)) ([]Ability, error) {
+	if len(abilities) == 0 {
+		return abilities, nil
+	}
+	channelIds := make([]int, 0, len(abilities))
+	for _, ability := range abilities {
+		channelIds = append(channelIds, ability.ChannelId)
+	}
+	var channels []*Channel
+	err := DB.Select("id, type, "+keyCol+", setting").Where("id IN ?", channelIds).Find(&channels).Error
+	if err != nil {
+		return nil, err
+	}
+	channels, err = filter(channels)
+	if err != nil {
+		return nil, err
+	}
+	kept := make(map[int]bool, len(channels))
+	for _, channel := range channels {
+		kept[channel.Id] = true
+	}
+	filtered := make([]Ability, 0, len(abilities))
+	for _, ability := range abilities {
+		if kept[ability.ChannelId] {
+			filtered = append(filtered, ability)
+		}
+	}
+	return filtered, nil
+}
@@ -0,0 +1,341 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"veloera/common"
+	"veloera/setting/operation_setting"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ChannelHealthSourceTest = "test" // 渠道测试
+	ChannelHealthSourceLive = "live" // 实际请求
+
+	ModelStatusOperational = "operational"
+	ModelStatusDegraded    = "degraded"
+	ModelStatusDown        = "down"
+	ModelStatusUnknown     = "unknown"
+)
+
+// channelHealthFlushInterval 健康记录先缓存在内存中，按该间隔批量写入
+const channelHealthFlushInterval = 10 * time.Second
+
+// maxPendingChannelHealthSamples 内存中等待写入的记录上限，写入失败堆积时丢弃新的记录
+const maxPendingChannelHealthSamples = 10000
+
+// ChannelHealthSample 渠道在某个模型上的一次健康记录，来自渠道测试或实际请求
+type ChannelHealthSample struct {
+	Id         int    `json:"id"`
+	CreatedAt  int64  `json:"created_at" gorm:"bigint;index"`
+	ChannelId  int    `json:"channel_id" gorm:"index"`
+	ModelName  string `json:"model_name" gorm:"type:varchar(128);index"`
+	Source     string `json:"source" gorm:"type:varchar(16)"`
+	Success    bool   `json:"success"`
+	Latency    int64  `json:"latency"`                             // 毫秒，渠道测试为完整的请求时间，实际请求为首字时间
+	ErrorClass string `json:"error_class" gorm:"type:varchar(32)"` // 失败的类型，成功时为空
+}
+
+// ChannelHealthDailyStat 渠道在某个模型上每天的可用率和延迟分位数
+type ChannelHealthDailyStat struct {
+	Day        int64          `json:"day"` // 当天 0 点（UTC）的时间戳
+	ChannelId  int            `json:"channel_id"`
+	ModelName  string         `json:"model_name"`
+	Samples    int            `json:"samples"`
+	Successes  int            `json:"successes"`
+	Uptime     float64        `json:"uptime"`
+	LatencyP50 int64          `json:"latency_p50"` // 延迟分位数按区间统计，为分位数所在区间内的最大延迟
+	LatencyP90 int64          `json:"latency_p90"`
+	LatencyP99 int64          `json:"latency_p99"`
+	Errors     map[string]int `json:"errors"` // 按失败类型统计的次数
+	latencies  []channelHealthLatencyBucket
+}
+
+// channelHealthLatencyBucket 一个延迟区间内成功请求的数量和最大延迟
+type channelHealthLatencyBucket struct {
+	Bucket     int
+	Count      int
+	MaxLatency int64
+}
+
+// channelHealthLatencyBounds 统计延迟分位数的区间上界，毫秒，超过最后一个上界的延迟在同一个区间
+var channelHealthLatencyBounds = []int64{100, 200, 300, 500, 750, 1000, 1500, 2000, 3000, 5000, 7500, 10000, 15000, 20000, 30000, 60000}
+
+// ModelStatusBucket 模型每小时的可用率
+type ModelStatusBucket struct {
+	Time         int64   `json:"time"`
+	Samples      int     `json:"samples"`
+	Availability float64 `json:"availability"`
+}
+
+// ModelStatus 模型在所有渠道上汇总的可用状态，不包含渠道信息
+type ModelStatus struct {
+	Model        string              `json:"model"`
+	Status       string              `json:"status"`
+	Availability float64             `json:"availability"`
+	Samples      int                 `json:"samples"`
+	LastSampleAt int64               `json:"last_sample_at"`
+	Hourly       []ModelStatusBucket `json:"hourly"`
+}
+
+var (
+	pendingChannelHealthSamples     []*ChannelHealthSample
+	pendingChannelHealthSamplesLock sync.Mutex
+)
+
+// RecordChannelHealthSample 记录一次健康记录，记录由 SyncChannelHealthSamples 批量写入
+func RecordChannelHealthSample(sample *ChannelHealthSample) {
+	if sample.CreatedAt == 0 {
+		sample.CreatedAt = common.GetTimestamp()
+	}
+	pendingChannelHealthSamplesLock.Lock()
+	defer pendingChannelHealthSamplesLock.Unlock()
+	if len(pendingChannelHealthSamples) >= maxPendingChannelHealthSamples {
+		return
+	}
+	pendingChannelHealthSamples = append(pendingChannelHealthSamples, sample)
+}
+
+// SaveChannelHealthSamples 把内存中的健康记录写入数据库
+func SaveChannelHealthSamples() {
+	pendingChannelHealthSamplesLock.Lock()
+	samples := pendingChannelHealthSamples
+	pendingChannelHealthSamples = nil
+	pendingChannelHealthSamplesLock.Unlock()
+	if len(samples) == 0 {
+		return
+	}
+	if err := LOG_DB.CreateInBatches(samples, 100).Error; err != nil {
+		common.SysError("failed to save channel health samples: " + err.Error())
+	}
+}
+
+// SyncChannelHealthSamples 定期写入健康记录，主节点同时删除超过保存天数的记录
+func SyncChannelHealthSamples() {
+	defer func() {
+		if r := recover(); r != nil {
+			common.SysLog(fmt.Sprintf("SyncChannelHealthSamples panic: %s", r))
+		}
+	}()
+	lastCleanup := time.Time{}
+	for {
+		time.Sleep(channelHealthFlushInterval)
+		SaveChannelHealthSamples()
+		retentionDays := operation_setting.GetChannelHealthSetting().RetentionDays
+		if common.IsMasterNode && retentionDays > 0 && time.Since(lastCleanup) >= time.Hour {
+			lastCleanup = time.Now()
+			result := LOG_DB.Where("created_at < ?", time.Now().AddDate(0, 0, -retentionDays).Unix()).Delete(&ChannelHealthSample{})
+			if result.Error != nil {
+				common.SysError("failed to cleanup channel health samples: " + result.Error.Error())
+			} else if result.RowsAffected > 0 {
+				common.SysLog(fmt.Sprintf("deleted %d expired channel health samples", result.RowsAffected))
+			}
+		}
+	}
+}
+
+func channelHealthQuery(startTimestamp int64, endTimestamp int64, channelId int, modelName string) *gorm.DB {
+	tx := LOG_DB.Model(&ChannelHealthSample{})
+	if startTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", startTimestamp)
+	}
+	if endTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", endTimestamp)
+	}
+	if channelId != 0 {
+		tx = tx.Where("channel_id = ?", channelId)
+	}
+	if modelName != "" {
+		tx = tx.Where("model_name = ?", modelName)
+	}
+	return tx
+}
+
+func GetChannelHealthSamples(startTimestamp int64, endTimestamp int64, channelId int, modelName string, source string, startIdx int, num int) (samples []*ChannelHealthSample, total int64, err error) {
+	tx := channelHealthQuery(startTimestamp, endTimestamp, channelId, modelName)
+	if source != "" {
+		tx = tx.Where("source = ?", source)
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&samples).Error
+	return samples, total, err
+}
+
+// latencyBucketExpr 延迟所在区间的 SQL 表达式
+func latencyBucketExpr() string {
+	var builder strings.Builder
+	builder.WriteString("CASE")
+	for i, bound := range channelHealthLatencyBounds {
+		builder.WriteString(fmt.Sprintf(" WHEN latency <= %d THEN %d", bound, i))
+	}
+	builder.WriteString(fmt.Sprintf(" ELSE %d END", len(channelHealthLatencyBounds)))
+	return builder.String()
+}
+
+// latencyPercentile 按区间计算分位数，返回分位数所在区间内的最大延迟，buckets 按区间从小到大排序
+func latencyPercentile(buckets []channelHealthLatencyBucket, total int, percentile float64) int64 {
+	if total == 0 {
+		return 0
+	}
+	index := int(float64(total-1) * percentile)
+	count := 0
+	for _, bucket := range buckets {
+		count += bucket.Count
+		if count > index {
+			return bucket.MaxLatency
+		}
+	}
+	return buckets[len(buckets)-1].MaxLatency
+}
+
+// GetChannelHealthDailyStats 按天、渠道和模型统计可用率和成功请求的延迟分位数，
+// 失败次数按失败类型、成功请求按延迟区间在数据库中汇总，不读取每条记录
+func GetChannelHealthDailyStats(startTimestamp int64, endTimestamp int64, channelId int, modelName string) ([]*ChannelHealthDailyStat, error) {
+	dayExpr := "(created_at - created_at % 86400)"
+	bucketExpr := latencyBucketExpr()
+	var latencyRows []struct {
+		Day        int64
+		ChannelId  int
+		ModelName  string
+		Bucket     int
+		Count      int
+		MaxLatency int64
+	}
+	err := channelHealthQuery(startTimestamp, endTimestamp, channelId, modelName).Where("success = ?", true).
+		Select(dayExpr + " as day, channel_id, model_name, " + bucketExpr + " as bucket, count(*) as count, max(latency) as max_latency").
+		Group(dayExpr + ", channel_id, model_name, " + bucketExpr).Scan(&latencyRows).Error
+	if err != nil {
+		return nil, err
+	}
+	var errorRows []struct {
+		Day        int64
+		ChannelId  int
+		ModelName  string
+		ErrorClass string
+		Count      int
+	}
+	err = channelHealthQuery(startTimestamp, endTimestamp, channelId, modelName).Where("success = ?", false).
+		Select(dayExpr + " as day, channel_id, model_name, error_class, count(*) as count").
+		Group(dayExpr + ", channel_id, model_name, error_class").Scan(&errorRows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	statsMap := make(map[string]*ChannelHealthDailyStat)
+	getStat := func(day int64, channelId int, modelName string) *ChannelHealthDailyStat {
+		key := fmt.Sprintf("%d-%d-%s", day, channelId, modelName)
+		stat, ok := statsMap[key]
+		if !ok {
+			stat = &ChannelHealthDailyStat{
+				Day:       day,
+				ChannelId: channelId,
+				ModelName: modelName,
+				Errors:    make(map[string]int),
+			}
+			statsMap[key] = stat
+		}
+		return stat
+	}
+	for _, row := range latencyRows {
+		stat := getStat(row.Day, row.ChannelId, row.ModelName)
+		stat.Samples += row.Count
+		stat.Successes += row.Count
+		stat.latencies = append(stat.latencies, channelHealthLatencyBucket{Bucket: row.Bucket, Count: row.Count, MaxLatency: row.MaxLatency})
+	}
+	for _, row := range errorRows {
+		stat := getStat(row.Day, row.ChannelId, row.ModelName)
+		stat.Samples += row.Count
+		stat.Errors[row.ErrorClass] += row.Count
+	}
+	stats := make([]*ChannelHealthDailyStat, 0, len(statsMap))
+	for _, stat := range statsMap {
+		stat.Uptime = float64(stat.Successes) / float64(stat.Samples)
+		sort.Slice(stat.latencies, func(i, j int) bool { return stat.latencies[i].Bucket < stat.latencies[j].Bucket })
+		stat.LatencyP50 = latencyPercentile(stat.latencies, stat.Successes, 0.5)
+		stat.LatencyP90 = latencyPercentile(stat.latencies, stat.Successes, 0.9)
+		stat.LatencyP99 = latencyPercentile(stat.latencies, stat.Successes, 0.99)
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Day != stats[j].Day {
+			return stats[i].Day > stats[j].Day
+		}
+		if stats[i].ChannelId != stats[j].ChannelId {
+			return stats[i].ChannelId < stats[j].ChannelId
+		}
+		return stats[i].ModelName < stats[j].ModelName
+	})
+	return stats, nil
+}
+
+func modelStatusOf(availability float64, samples int) string {
+	setting := operation_setting.GetChannelHealthSetting()
+	switch {
+	case samples == 0:
+		return ModelStatusUnknown
+	case availability < setting.DownThreshold:
+		return ModelStatusDown
+	case availability < setting.DegradedThreshold:
+		return ModelStatusDegraded
+	}
+	return ModelStatusOperational
+}
+
+// GetModelStatuses 按模型汇总所有渠道最近的健康记录，models 为空时返回所有有记录的模型
+func GetModelStatuses(models []string, since int64) ([]*ModelStatus, error) {
+	var buckets []struct {
+		ModelName    string
+		Bucket       int64
+		Samples      int
+		Successes    int
+		LastSampleAt int64
+	}
+	tx := channelHealthQuery(since, 0, 0, "")
+	if len(models) > 0 {
+		tx = tx.Where("model_name in ?", models)
+	}
+	err := tx.Select("model_name, created_at - created_at % 3600 as bucket, count(*) as samples, " +
+		"sum(case when success then 1 else 0 end) as successes, max(created_at) as last_sample_at").
+		Group("model_name, bucket").Order("bucket").Scan(&buckets).Error
+	if err != nil {
+		return nil, err
+	}
+	statusMap := make(map[string]*ModelStatus)
+	successes := make(map[string]int)
+	for _, model := range models {
+		statusMap[model] = &ModelStatus{Model: model, Hourly: []ModelStatusBucket{}}
+	}
+	for _, bucket := range buckets {
+		status, ok := statusMap[bucket.ModelName]
+		if !ok {
+			status = &ModelStatus{Model: bucket.ModelName, Hourly: []ModelStatusBucket{}}
+			statusMap[bucket.ModelName] = status
+		}
+		status.Samples += bucket.Samples
+		successes[bucket.ModelName] += bucket.Successes
+		if bucket.LastSampleAt > status.LastSampleAt {
+			status.LastSampleAt = bucket.LastSampleAt
+		}
+		status.Hourly = append(status.Hourly, ModelStatusBucket{
+			Time:         bucket.Bucket,
+			Samples:      bucket.Samples,
+			Availability: float64(bucket.Successes) / float64(bucket.Samples),
+		})
+	}
+	statuses := make([]*ModelStatus, 0, len(statusMap))
+	for name, status := range statusMap {
+		if status.Samples > 0 {
+			status.Availability = float64(successes[name]) / float64(status.Samples)
+		}
+		status.Status = modelStatusOf(status.Availability, status.Samples)
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Model < statuses[j].Model })
+	return statuses, nil
+}
@@ -0,0 +1,270 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	"veloera/common"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ChannelKeyStatusEnabled     = 1
+	ChannelKeyStatusCoolingDown = 2 // 被限流，冷却结束后自动恢复
+	ChannelKeyStatusDisabled    = 3 // key 无效或余额不足，需要手动启用
+)
+
+// ChannelKey 多 key 渠道中单个 key 的状态，key 以 HashChannelKey 标识，没有记录的 key 视为可用
+type ChannelKey struct {
+	Id            int    `json:"id"`
+	ChannelId     int    `json:"channel_id" gorm:"uniqueIndex:idx_channel_key_hash"`
+	KeyHash       string `json:"key_hash" gorm:"type:varchar(64);uniqueIndex:idx_channel_key_hash"`
+	Status        int    `json:"status" gorm:"default:1"`
+	CooldownUntil int64  `json:"cooldown_until" gorm:"bigint"`
+	LastError     string `json:"last_error" gorm:"type:text"`
+	LastErrorTime int64  `json:"last_error_time" gorm:"bigint"`
+	RequestCount  int64  `json:"request_count" gorm:"bigint;default:0"`
+	FailureCount  int64  `json:"failure_count" gorm:"bigint;default:0"`
+	UpdatedTime   int64  `json:"updated_time" gorm:"bigint"`
+}
+
+// ChannelKeyState 管理接口中展示的 key 状态
+type ChannelKeyState struct {
+	Index   int    `json:"index"`
+	Preview string `json:"preview"`
+	ChannelKey
+}
+
+type channelKeyUsage struct {
+	requests int64
+	failures int64
+}
+
+var (
+	channelKeyLock     sync.RWMutex
+	channelKeyStateMap = make(map[int]map[string]*ChannelKey) // channel_id -> key_hash -> state
+
+	channelKeyUsageLock sync.Mutex
+	channelKeyUsageMap  = make(map[int]map[string]*channelKeyUsage)
+)
+
+// GetKeys 返回渠道的所有 key，普通渠道按逗号分隔，Vertex 渠道支持服务账号 JSON 数组
+func (channel *Channel) GetKeys() []string {
+	keys := make([]string, 0)
+	if channel.Type == common.ChannelTypeVertexAi {
+		trimmed := strings.TrimSpace(channel.Key)
+		var accounts []json.RawMessage
+		if strings.HasPrefix(trimmed, "[") && json.Unmarshal([]byte(trimmed), &accounts) == nil {
+			for _, account := range accounts {
+				keys = append(keys, string(account))
+			}
+			return keys
+		}
+		if trimmed != "" {
+			keys = append(keys, trimmed)
+		}
+		return keys
+	}
+	for _, key := range strings.Split(channel.Key, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// ChannelKeyPreview 返回用于展示的 key，Vertex 服务账号展示邮箱，其他 key 只保留首尾
+func ChannelKeyPreview(channelType int, key string) string {
+	if channelType == common.ChannelTypeVertexAi {
+		var account struct {
+			ClientEmail string `json:"client_email"`
+		}
+		if json.Unmarshal([]byte(key), &account) == nil && account.ClientEmail != "" {
+			return account.ClientEmail
+		}
+	}
+	if len(key) <= 12 {
+		return strings.Repeat("*", len(key))
+	}
+	return key[:6] + "..." + key[len(key)-4:]
+}
+
+// InitChannelKeyCache 从数据库加载 key 状态
+func InitChannelKeyCache() {
+	var keys []*ChannelKey
+	if err := DB.Find(&keys).Error; err != nil {
+		common.SysError("failed to load channel keys: " + err.Error())
+		return
+	}
+	newStateMap := make(map[int]map[string]*ChannelKey)
+	for _, key := range keys {
+		if _, ok := newStateMap[key.ChannelId]; !ok {
+			newStateMap[key.ChannelId] = make(map[string]*ChannelKey)
+		}
+		newStateMap[key.ChannelId][key.KeyHash] = key
+	}
+	channelKeyLock.Lock()
+	channelKeyStateMap = newStateMap
+	channelKeyLock.Unlock()
+}
+
+// SyncChannelKeys 定期写入 key 的使用次数，并同步其他节点修改的 key 状态
+func SyncChannelKeys(frequency int) {
+	for {
+		time.Sleep(time.Duration(frequency) * time.Second)
+		flushChannelKeyUsage()
+		InitChannelKeyCache()
+	}
+}
+
+// GetChannelKeyByHash 获取 key 的状态，没有记录时返回 false
+func GetChannelKeyByHash(channelId int, keyHash string) (ChannelKey, bool) {
+	channelKeyLock.RLock()
+	defer channelKeyLock.RUnlock()
+	key, ok := channelKeyStateMap[channelId][keyHash]
+	if !ok {
+		return ChannelKey{}, false
+	}
+	return *key, true
+}
+
+// IsChannelKeyAvailable key 是否可用，冷却中和已禁用的 key 不可用
+func IsChannelKeyAvailable(channelId int, keyHash string) bool {
+	key, ok := GetChannelKeyByHash(channelId, keyHash)
+	if !ok {
+		return true
+	}
+	switch key.Status {
+	case ChannelKeyStatusDisabled:
+		return false
+	case ChannelKeyStatusCoolingDown:
+		return common.GetTimestamp() >= key.CooldownUntil
+	}
+	return true
+}
+
+// ChannelHasAvailableKey 渠道中是否还有可用的 key
+func ChannelHasAvailableKey(channel *Channel) bool {
+	for _, key := range channel.GetKeys() {
+		if IsChannelKeyAvailable(channel.Id, HashChannelKey(key)) {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateChannelKeyStatus 修改 key 的状态，lastError 为空时不修改最近一次错误
+func UpdateChannelKeyStatus(channelId int, keyHash string, status int, cooldownUntil int64, lastError string) error {
+	key := ChannelKey{ChannelId: channelId, KeyHash: keyHash}
+	err := DB.Where(&key).FirstOrCreate(&key).Error
+	if err != nil {
+		return err
+	}
+	now := common.GetTimestamp()
+	fields := map[string]interface{}{
+		"status":         status,
+		"cooldown_until": cooldownUntil,
+		"updated_time":   now,
+	}
+	if lastError != "" {
+		fields["last_error"] = lastError
+		fields["last_error_time"] = now
+	}
+	err = DB.Model(&key).Updates(fields).Error
+	if err != nil {
+		return err
+	}
+
+	channelKeyLock.Lock()
+	defer channelKeyLock.Unlock()
+	if _, ok := channelKeyStateMap[channelId]; !ok {
+		channelKeyStateMap[channelId] = make(map[string]*ChannelKey)
+	}
+	key.Status = status
+	key.CooldownUntil = cooldownUntil
+	key.UpdatedTime = now
+	if lastError != "" {
+		key.LastError = lastError
+		key.LastErrorTime = now
+	}
+	channelKeyStateMap[channelId][keyHash] = &key
+	return nil
+}
+
+// RecordChannelKeyUsage 记录 key 的使用次数，定期批量写入数据库
+func RecordChannelKeyUsage(channelId int, keyHash string, failed bool) {
+	channelKeyUsageLock.Lock()
+	defer channelKeyUsageLock.Unlock()
+	if _, ok := channelKeyUsageMap[channelId]; !ok {
+		channelKeyUsageMap[channelId] = make(map[string]*channelKeyUsage)
+	}
+	usage, ok := channelKeyUsageMap[channelId][keyHash]
+	if !ok {
+		usage = &channelKeyUsage{}
+		channelKeyUsageMap[channelId][keyHash] = usage
+	}
+	usage.requests++
+	if failed {
+		usage.failures++
+	}
+}
+
+func flushChannelKeyUsage() {
+	channelKeyUsageLock.Lock()
+	usageMap := channelKeyUsageMap
+	channelKeyUsageMap = make(map[int]map[string]*channelKeyUsage)
+	channelKeyUsageLock.Unlock()
+
+	for channelId, keys := range usageMap {
+		for keyHash, usage := range keys {
+			key := ChannelKey{ChannelId: channelId, KeyHash: keyHash}
+			err := DB.Where(&key).FirstOrCreate(&key).Error
+			if err == nil {
+				err = DB.Model(&key).Updates(map[string]interface{}{
+					"request_count": gorm.Expr("request_count + ?", usage.requests),
+					"failure_count": gorm.Expr("failure_count + ?", usage.failures),
+				}).Error
+			}
+			if err != nil {
+				common.SysError(fmt.Sprintf("failed to update usage of channel #%d key: %s", channelId, err.Error()))
+			}
+		}
+	}
+}
+
+// GetChannelKeyStates 返回渠道中每个 key 的状态，使用次数包含尚未写入数据库的部分
+func GetChannelKeyStates(channel *Channel) []ChannelKeyState {
+	var rows []ChannelKey
+	DB.Where("channel_id = ?", channel.Id).Find(&rows)
+	rowMap := make(map[string]ChannelKey, len(rows))
+	for _, row := range rows {
+		rowMap[row.KeyHash] = row
+	}
+
+	channelKeyUsageLock.Lock()
+	defer channelKeyUsageLock.Unlock()
+	states := make([]ChannelKeyState, 0)
+	for i, key := range channel.GetKeys() {
+		keyHash := HashChannelKey(key)
+		row, ok := rowMap[keyHash]
+		if !ok {
+			row = ChannelKey{ChannelId: channel.Id, KeyHash: keyHash, Status: ChannelKeyStatusEnabled}
+		}
+		if usage, ok := channelKeyUsageMap[channel.Id][keyHash]; ok {
+			row.RequestCount += usage.requests
+			row.FailureCount += usage.failures
+		}
+		if row.Status == ChannelKeyStatusCoolingDown && common.GetTimestamp() >= row.CooldownUntil {
+			row.Status = ChannelKeyStatusEnabled
+		}
+		states = append(states, ChannelKeyState{
+			Index:      i,
+			Preview:    ChannelKeyPreview(channel.Type, key),
+			ChannelKey: row,
+		})
+	}
+	return states
+}
@@ -0,0 +1,215 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+	"veloera/common"
+	"veloera/setting/operation_setting"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	channelRateLimitMinRedisTTL   = time.Minute
+	channelRateLimitRedisSyncTime = 2 * time.Second
+)
+
+// ChannelRateLimit 上游通过响应头告知的限流额度，时间均为毫秒级时间戳，上限为 0 表示上游未返回
+type ChannelRateLimit struct {
+	LimitRequests     int64 `json:"limit_requests"`
+	RemainingRequests int64 `json:"remaining_requests"`
+	ResetRequestsAt   int64 `json:"reset_requests_at"`
+	LimitTokens       int64 `json:"limit_tokens"`
+	RemainingTokens   int64 `json:"remaining_tokens"`
+	ResetTokensAt     int64 `json:"reset_tokens_at"`
+	CooldownUntil     int64 `json:"cooldown_until"` // 429 后在该时间前不再使用
+}
+
+type channelRateLimitEntry struct {
+	rateLimit ChannelRateLimit
+	syncedAt  time.Time
+}
+
+var (
+	channelRateLimitLock sync.Mutex
+	channelRateLimitMap  = make(map[string]*channelRateLimitEntry)
+)
+
+// channelRateLimitKey 单 key 渠道的 keyHash 为空
+func channelRateLimitKey(channelId int, keyHash string) string {
+	if keyHash == "" {
+		return fmt.Sprintf("%d", channelId)
+	}
+	return fmt.Sprintf("%d:%s", channelId, keyHash)
+}
+
+func channelRateLimitRedisKey(key string) string {
+	return "channel_rate_limit:" + key
+}
+
+func getChannelRateLimitEntry(key string) *channelRateLimitEntry {
+	entry, ok := channelRateLimitMap[key]
+	if !ok {
+		entry = &channelRateLimitEntry{}
+		channelRateLimitMap[key] = entry
+	}
+	return entry
+}
+
+// merge 合并新返回的额度，未返回的部分保留原值，冷却时间取较晚的一个
+func (r *ChannelRateLimit) merge(update ChannelRateLimit) {
+	if update.LimitRequests > 0 {
+		r.LimitRequests = update.LimitRequests
+		r.RemainingRequests = update.RemainingRequests
+		r.ResetRequestsAt = update.ResetRequestsAt
+	}
+	if update.LimitTokens > 0 {
+		r.LimitTokens = update.LimitTokens
+		r.RemainingTokens = update.RemainingTokens
+		r.ResetTokensAt = update.ResetTokensAt
+	}
+	if update.CooldownUntil > r.CooldownUntil {
+		r.CooldownUntil = update.CooldownUntil
+	}
+}
+
+// expiresAt 额度全部恢复的时间，之后不再需要保存
+func (r *ChannelRateLimit) expiresAt() int64 {
+	expiresAt := r.CooldownUntil
+	if r.ResetRequestsAt > expiresAt {
+		expiresAt = r.ResetRequestsAt
+	}
+	if r.ResetTokensAt > expiresAt {
+		expiresAt = r.ResetTokensAt
+	}
+	return expiresAt
+}
+
+// UpdateChannelRateLimit 记录上游返回的限流额度，启用 redis 时同步给其他节点
+func UpdateChannelRateLimit(channelId int, keyHash string, update ChannelRateLimit) {
+	key := channelRateLimitKey(channelId, keyHash)
+	channelRateLimitLock.Lock()
+	entry := getChannelRateLimitEntry(key)
+	entry.rateLimit.merge(update)
+	rateLimit := entry.rateLimit
+	channelRateLimitLock.Unlock()
+
+	if !common.RedisEnabled {
+		return
+	}
+	ttl := time.Until(time.UnixMilli(rateLimit.expiresAt()))
+	if ttl < channelRateLimitMinRedisTTL {
+		ttl = channelRateLimitMinRedisTTL
+	}
+	data, err := json.Marshal(rateLimit)
+	if err == nil {
+		err = common.RDB.Set(context.Background(), channelRateLimitRedisKey(key), data, ttl).Err()
+	}
+	if err != nil {
+		common.SysError("failed to update channel rate limit: " + err.Error())
+	}
+}
+
+// GetChannelRateLimit 获取渠道或 key 的限流额度，启用 redis 时定期从 redis 同步其他节点的记录
+func GetChannelRateLimit(channelId int, keyHash string) ChannelRateLimit {
+	key := channelRateLimitKey(channelId, keyHash)
+	channelRateLimitLock.Lock()
+	entry := getChannelRateLimitEntry(key)
+	rateLimit := entry.rateLimit
+	shouldSync := common.RedisEnabled && time.Since(entry.syncedAt) > channelRateLimitRedisSyncTime
+	if shouldSync {
+		entry.syncedAt = time.Now()
+	}
+	channelRateLimitLock.Unlock()
+	if !shouldSync {
+		return rateLimit
+	}
+
+	data, err := common.RDB.Get(context.Background(), channelRateLimitRedisKey(key)).Bytes()
+	if err != nil {
+		if err != redis.Nil {
+			common.SysError("failed to get channel rate limit: " + err.Error())
+		}
+		return rateLimit
+	}
+	var synced ChannelRateLimit
+	if err := json.Unmarshal(data, &synced); err != nil {
+		return rateLimit
+	}
+	channelRateLimitLock.Lock()
+	entry.rateLimit = synced
+	channelRateLimitLock.Unlock()
+	return synced
+}
+
+// IsChannelRateLimited 渠道或 key 是否在 429 后的冷却中
+func IsChannelRateLimited(channelId int, keyHash string) bool {
+	if !operation_setting.GetUpstreamRateLimitSetting().Enabled {
+		return false
+	}
+	rateLimit := GetChannelRateLimit(channelId, keyHash)
+	return rateLimit.CooldownUntil > time.Now().UnixMilli()
+}
+
+func isBudgetLow(limit int64, remaining int64, resetAt int64, now int64, ratio float64) bool {
+	if limit <= 0 || (resetAt > 0 && now >= resetAt) {
+		return false
+	}
+	return float64(remaining) <= float64(limit)*ratio
+}
+
+// IsChannelNearRateLimit 渠道或 key 的剩余请求数或 token 数是否接近上限
+func IsChannelNearRateLimit(channelId int, keyHash string) bool {
+	setting := operation_setting.GetUpstreamRateLimitSetting()
+	if !setting.Enabled {
+		return false
+	}
+	rateLimit := GetChannelRateLimit(channelId, keyHash)
+	now := time.Now().UnixMilli()
+	return isBudgetLow(rateLimit.LimitRequests, rateLimit.RemainingRequests, rateLimit.ResetRequestsAt, now, setting.LowRemainingRatio) ||
+		isBudgetLow(rateLimit.LimitTokens, rateLimit.RemainingTokens, rateLimit.ResetTokensAt, now, setting.LowRemainingRatio)
+}
+
+// channelRateLimitState 渠道的限流状态，多 key 渠道只有所有 key 都受限时才算受限
+func channelRateLimitState(channel *Channel) (limited bool, nearLimit bool) {
+	keys := channel.GetKeys()
+	if len(keys) <= 1 {
+		limited = IsChannelRateLimited(channel.Id, "")
+		return limited, limited || IsChannelNearRateLimit(channel.Id, "")
+	}
+	limited, nearLimit = true, true
+	for _, key := range keys {
+		keyHash := HashChannelKey(key)
+		keyLimited := IsChannelRateLimited(channel.Id, keyHash)
+		limited = limited && keyLimited
+		nearLimit = nearLimit && (keyLimited || IsChannelNearRateLimit(channel.Id, keyHash))
+	}
+	return limited, nearLimit
+}
+
+// preferRateLimitAvailableChannels 优先使用未被限流、额度充足的渠道，没有这样的渠道时不做过滤
+func preferRateLimitAvailableChannels(channels []*Channel) []*Channel {
+	if !operation_setting.GetUpstreamRateLimitSetting().Enabled || len(channels) <= 1 {
+		return channels
+	}
+	var notLimited, sufficient []*Channel
+	for _, channel := range channels {
+		limited, nearLimit := channelRateLimitState(channel)
+		if !limited {
+			notLimited = append(notLimited, channel)
+		}
+		if !nearLimit {
+			sufficient = append(sufficient, channel)
+		}
+	}
+	if len(sufficient) > 0 {
+		return sufficient
+	}
+	if len(notLimited) > 0 {
+		return notLimited
+	}
+	return channels
+}
@@ -0,0 +1,272 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+	"veloera/common"
+	"veloera/setting/operation_setting"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	channelStatsRedisTTL      = 30 * time.Minute
+	channelStatsRedisSyncTime = 5 * time.Second
+	channelStatsDefaultTTFT   = 10000.0 // 毫秒
+)
+
+// ChannelStats 渠道在某个模型上的实时统计，用于渠道选择
+type ChannelStats struct {
+	TTFT        float64 `json:"ttft"`         // 首字时间的指数加权平均，毫秒
+	SuccessRate float64 `json:"success_rate"` // 成功率的指数加权平均
+	InFlight    int64   `json:"in_flight"`    // 正在处理的请求数
+	Samples     int64   `json:"samples"`
+}
+
+type channelStatsEntry struct {
+	stats    ChannelStats
+	syncedAt time.Time
+}
+
+var (
+	channelStatsLock sync.Mutex
+	channelStatsMap  = make(map[string]*channelStatsEntry)
+)
+
+// 在 redis 中原子地更新指数加权平均，KEYS[1] 统计键，ARGV: alpha, success(0/1), ttft(毫秒，<0 表示不更新), ttl(秒)
+var channelStatsUpdateScript = redis.NewScript(`
+local alpha = tonumber(ARGV[1])
+local success = tonumber(ARGV[2])
+local ttft = tonumber(ARGV[3])
+redis.call('HINCRBY', KEYS[1], 'samples', 1)
+local rate = tonumber(redis.call('HGET', KEYS[1], 'success_rate'))
+if rate == nil then rate = success else rate = rate + alpha * (success - rate) end
+redis.call('HSET', KEYS[1], 'success_rate', tostring(rate))
+if ttft >= 0 then
+	local current = tonumber(redis.call('HGET', KEYS[1], 'ttft'))
+	if current == nil or current == 0 then current = ttft else current = current + alpha * (ttft - current) end
+	redis.call('HSET', KEYS[1], 'ttft', tostring(current))
+end
+redis.call('EXPIRE', KEYS[1], ARGV[4])
+return 1
+`)
+
+func channelStatsKey(channelId int, modelName string) string {
+	return fmt.Sprintf("%d:%s", channelId, modelName)
+}
+
+func channelStatsRedisKey(channelId int, modelName string) string {
+	return "channel_stats:" + channelStatsKey(channelId, modelName)
+}
+
+func getChannelStatsEntry(key string) *channelStatsEntry {
+	entry, ok := channelStatsMap[key]
+	if !ok {
+		entry = &channelStatsEntry{}
+		channelStatsMap[key] = entry
+	}
+	return entry
+}
+
+func channelInFlightRedisKey(channelId int, modelName string) string {
+	return "channel_in_flight:" + channelStatsKey(channelId, modelName)
+}
+
+// ChannelRequestStarted 渠道开始处理请求，返回请求在 redis 中的成员，结束时传给 ChannelRequestFinished。
+// redis 中正在处理的请求与并发名额一样以有序集合记录，节点异常退出未结束的请求在租期后不再计入
+func ChannelRequestStarted(channelId int, modelName string) string {
+	channelStatsLock.Lock()
+	getChannelStatsEntry(channelStatsKey(channelId, modelName)).stats.InFlight++
+	channelStatsLock.Unlock()
+	if !common.RedisEnabled {
+		return ""
+	}
+	member := common.GetUUID()
+	key := channelInFlightRedisKey(channelId, modelName)
+	ctx := context.Background()
+	pipe := common.RDB.TxPipeline()
+	pipe.ZAdd(ctx, key, &redis.Z{Score: float64(time.Now().UnixMilli()), Member: member})
+	pipe.PExpire(ctx, key, channelConcurrencyLease)
+	if _, err := pipe.Exec(ctx); err != nil {
+		common.SysError("failed to update channel stats: " + err.Error())
+	}
+	return member
+}
+
+// ChannelRequestFinished 渠道处理完请求，counted 为 false 时只减少正在处理的请求数，不计入成功率
+func ChannelRequestFinished(channelId int, modelName string, member string, ttft time.Duration, success bool, counted bool) {
+	alpha := operation_setting.GetChannelSelectSetting().EwmaAlpha
+	if alpha <= 0 || alpha > 1 {
+		alpha = 0.2
+	}
+	successValue := 0.0
+	if success {
+		successValue = 1
+	}
+	ttftMs := float64(ttft.Milliseconds())
+
+	channelStatsLock.Lock()
+	entry := getChannelStatsEntry(channelStatsKey(channelId, modelName))
+	if entry.stats.InFlight > 0 {
+		entry.stats.InFlight--
+	}
+	if counted {
+		if entry.stats.Samples == 0 {
+			entry.stats.SuccessRate = successValue
+		} else {
+			entry.stats.SuccessRate += alpha * (successValue - entry.stats.SuccessRate)
+		}
+		if success {
+			if entry.stats.TTFT == 0 {
+				entry.stats.TTFT = ttftMs
+			} else {
+				entry.stats.TTFT += alpha * (ttftMs - entry.stats.TTFT)
+			}
+		}
+		entry.stats.Samples++
+	}
+	channelStatsLock.Unlock()
+
+	if common.RedisEnabled {
+		ctx := context.Background()
+		var err error
+		if member != "" {
+			err = common.RDB.ZRem(ctx, channelInFlightRedisKey(channelId, modelName), member).Err()
+		}
+		if err == nil && counted {
+			redisTTFT := -1.0
+			if success {
+				redisTTFT = ttftMs
+			}
+			err = channelStatsUpdateScript.Run(ctx, common.RDB, []string{channelStatsRedisKey(channelId, modelName)}, alpha, successValue, redisTTFT, int(channelStatsRedisTTL.Seconds())).Err()
+		}
+		if err != nil {
+			common.SysError("failed to update channel stats: " + err.Error())
+		}
+	}
+}
+
+// GetChannelStats 获取渠道在模型上的统计，启用 redis 时定期从 redis 同步其他节点的统计
+func GetChannelStats(channelId int, modelName string) ChannelStats {
+	key := channelStatsKey(channelId, modelName)
+	channelStatsLock.Lock()
+	entry := getChannelStatsEntry(key)
+	stats := entry.stats
+	shouldSync := common.RedisEnabled && time.Since(entry.syncedAt) > channelStatsRedisSyncTime
+	if shouldSync {
+		entry.syncedAt = time.Now()
+	}
+	channelStatsLock.Unlock()
+	if !shouldSync {
+		return stats
+	}
+
+	ctx := context.Background()
+	pipe := common.RDB.Pipeline()
+	valuesCmd := pipe.HGetAll(ctx, channelStatsRedisKey(channelId, modelName))
+	minScore := strconv.FormatInt(time.Now().Add(-channelConcurrencyLease).UnixMilli(), 10)
+	inFlightCmd := pipe.ZCount(ctx, channelInFlightRedisKey(channelId, modelName), minScore, "+inf")
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		common.SysError("failed to get channel stats: " + err.Error())
+		return stats
+	}
+	values := valuesCmd.Val()
+	stats.InFlight = inFlightCmd.Val()
+	if len(values) != 0 {
+		stats.TTFT, _ = strconv.ParseFloat(values["ttft"], 64)
+		stats.SuccessRate, _ = strconv.ParseFloat(values["success_rate"], 64)
+		stats.Samples, _ = strconv.ParseInt(values["samples"], 10, 64)
+	}
+	channelStatsLock.Lock()
+	entry.stats = stats
+	channelStatsLock.Unlock()
+	return stats
+}
+
+// channelStatsScore 渠道的综合得分，越小越好
+func channelStatsScore(stats ChannelStats) float64 {
+	ttft := stats.TTFT
+	if ttft <= 0 {
+		// 还没有成功过的渠道按较慢的渠道计算
+		ttft = channelStatsDefaultTTFT
+	}
+	successRate := math.Max(stats.SuccessRate, 0.01)
+	return ttft * float64(stats.InFlight+1) / successRate
+}
+
+// pickChannelByWeight 按权重随机选择，与加权随机策略使用相同的平滑系数
+func pickChannelByWeight(weights []int, exclude int) int {
+	totalWeight := 0
+	for i, weight := range weights {
+		if i != exclude {
+			totalWeight += weight + 10
+		}
+	}
+	randomWeight := rand.Intn(totalWeight)
+	for i, weight := range weights {
+		if i == exclude {
+			continue
+		}
+		randomWeight -= weight + 10
+		if randomWeight < 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// selectChannelByStrategy 按分组配置的策略在同一优先级的渠道中选择，返回选中渠道的下标，
+// 加权随机策略返回 false，由调用方使用原有的加权随机逻辑
+func selectChannelByStrategy(group string, modelName string, channelIds []int, weights []int) (int, bool) {
+	strategy := operation_setting.GetGroupChannelSelectStrategy(group)
+	if strategy == operation_setting.ChannelSelectWeighted || len(channelIds) == 0 {
+		return 0, false
+	}
+	if len(channelIds) == 1 {
+		return 0, true
+	}
+	setting := operation_setting.GetChannelSelectSetting()
+	stats := make([]ChannelStats, len(channelIds))
+	for i, channelId := range channelIds {
+		stats[i] = GetChannelStats(channelId, modelName)
+	}
+
+	switch strategy {
+	case operation_setting.ChannelSelectPowerOfTwo:
+		first := pickChannelByWeight(weights, -1)
+		second := pickChannelByWeight(weights, first)
+		if stats[first].Samples < int64(setting.MinSamples) {
+			return first, true
+		}
+		if stats[second].Samples < int64(setting.MinSamples) {
+			return second, true
+		}
+		if channelStatsScore(stats[second]) < channelStatsScore(stats[first]) {
+			return second, true
+		}
+		return first, true
+	default:
+		if rand.Float64() < setting.ExploreRatio {
+			return pickChannelByWeight(weights, -1), true
+		}
+		best := -1
+		bestScore := 0.0
+		for _, i := range rand.Perm(len(channelIds)) {
+			if stats[i].Samples < int64(setting.MinSamples) {
+				return i, true
+			}
+			score := channelStatsScore(stats[i])
+			if best == -1 || score < bestScore {
+				best = i
+				bestScore = score
+			}
+		}
+		return best, true
+	}
+}
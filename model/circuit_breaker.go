@@ -0,0 +1,387 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+	"veloera/common"
+	"veloera/setting/operation_setting"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	CircuitBreakerClosed   = "closed"
+	CircuitBreakerOpen     = "open"
+	CircuitBreakerHalfOpen = "half_open"
+)
+
+const (
+	circuitBreakerRedisTTL      = 24 * time.Hour
+	circuitBreakerRedisSyncTime = 2 * time.Second
+)
+
+// CircuitBreakerState 熔断器状态，时间均为秒级时间戳
+type CircuitBreakerState struct {
+	State       string `json:"state"`
+	Failures    int    `json:"failures"`     // 当前统计窗口内的失败次数
+	WindowStart int64  `json:"window_start"` // 当前统计窗口的开始时间
+	OpenedAt    int64  `json:"opened_at"`    // 最近一次熔断的时间
+	Probes      int    `json:"probes"`       // 半开状态下正在进行的试探请求数
+	Successes   int    `json:"successes"`    // 半开状态下成功的试探请求数
+}
+
+type circuitBreakerEntry struct {
+	state    CircuitBreakerState
+	syncedAt time.Time
+}
+
+var (
+	circuitBreakerLock sync.Mutex
+	circuitBreakerMap  = make(map[string]*circuitBreakerEntry)
+)
+
+// circuitBreakerKey 渠道级熔断器 modelName 为空
+func circuitBreakerKey(channelId int, modelName string) string {
+	if modelName == "" {
+		return strconv.Itoa(channelId)
+	}
+	return fmt.Sprintf("%d:%s", channelId, modelName)
+}
+
+// circuitBreakerKeys 请求需要经过的熔断器：渠道级和模型级
+func circuitBreakerKeys(channelId int, modelName string) []string {
+	keys := []string{circuitBreakerKey(channelId, "")}
+	if modelName != "" {
+		keys = append(keys, circuitBreakerKey(channelId, modelName))
+	}
+	return keys
+}
+
+func circuitBreakerRedisKey(key string) string {
+	return "circuit_breaker:" + key
+}
+
+// current 返回当前实际所处的状态，熔断冷却结束后即为半开
+func (s *CircuitBreakerState) current(now int64) string {
+	cooldown := int64(operation_setting.GetCircuitBreakerSetting().CooldownSeconds)
+	if s.State == CircuitBreakerOpen && now >= s.OpenedAt+cooldown {
+		return CircuitBreakerHalfOpen
+	}
+	if s.State == "" {
+		return CircuitBreakerClosed
+	}
+	return s.State
+}
+
+// available 熔断器是否允许新的请求通过
+func (s *CircuitBreakerState) available(now int64) bool {
+	switch s.current(now) {
+	case CircuitBreakerOpen:
+		return false
+	case CircuitBreakerHalfOpen:
+		return s.Probes < operation_setting.GetCircuitBreakerSetting().HalfOpenRequests
+	}
+	return true
+}
+
+func (s *CircuitBreakerState) open(now int64) {
+	*s = CircuitBreakerState{
+		State:    CircuitBreakerOpen,
+		OpenedAt: now,
+	}
+}
+
+func (s *CircuitBreakerState) onStart(now int64) bool {
+	if s.current(now) == CircuitBreakerHalfOpen {
+		s.State = CircuitBreakerHalfOpen
+		s.Probes++
+		return true
+	}
+	return false
+}
+
+// onProbeFinished 释放试探名额，名额属于已经结束的半开状态时不做修改，success 为 true 时记为一次成功的试探
+func (s *CircuitBreakerState) onProbeFinished(openedAt int64, success bool) {
+	if s.State != CircuitBreakerHalfOpen || s.OpenedAt != openedAt {
+		return
+	}
+	if s.Probes > 0 {
+		s.Probes--
+	}
+	if !success {
+		return
+	}
+	s.Successes++
+	if s.Successes >= operation_setting.GetCircuitBreakerSetting().HalfOpenRequests {
+		*s = CircuitBreakerState{State: CircuitBreakerClosed}
+	}
+}
+
+func (s *CircuitBreakerState) onFailure(now int64) {
+	setting := operation_setting.GetCircuitBreakerSetting()
+	switch s.current(now) {
+	case CircuitBreakerHalfOpen:
+		// 试探请求失败，重新熔断
+		s.open(now)
+	case CircuitBreakerClosed:
+		if now-s.WindowStart >= int64(setting.WindowSeconds) {
+			s.WindowStart = now
+			s.Failures = 0
+		}
+		s.State = CircuitBreakerClosed
+		s.Failures++
+		if s.Failures >= setting.FailureThreshold {
+			s.open(now)
+		}
+	}
+}
+
+func (s *CircuitBreakerState) toRedisHash() map[string]interface{} {
+	return map[string]interface{}{
+		"state":        s.State,
+		"failures":     s.Failures,
+		"window_start": s.WindowStart,
+		"opened_at":    s.OpenedAt,
+		"probes":       s.Probes,
+		"successes":    s.Successes,
+	}
+}
+
+func circuitBreakerStateFromRedisHash(values map[string]string) CircuitBreakerState {
+	var s CircuitBreakerState
+	s.State = values["state"]
+	s.Failures, _ = strconv.Atoi(values["failures"])
+	s.WindowStart, _ = strconv.ParseInt(values["window_start"], 10, 64)
+	s.OpenedAt, _ = strconv.ParseInt(values["opened_at"], 10, 64)
+	s.Probes, _ = strconv.Atoi(values["probes"])
+	s.Successes, _ = strconv.Atoi(values["successes"])
+	return s
+}
+
+func getCircuitBreakerEntry(key string) *circuitBreakerEntry {
+	entry, ok := circuitBreakerMap[key]
+	if !ok {
+		entry = &circuitBreakerEntry{}
+		circuitBreakerMap[key] = entry
+	}
+	return entry
+}
+
+// updateCircuitBreaker 修改熔断器状态，启用 redis 时使用乐观锁在 redis 中修改，保证多个节点共享同一个状态
+func updateCircuitBreaker(key string, update func(s *CircuitBreakerState)) CircuitBreakerState {
+	if !common.RedisEnabled {
+		circuitBreakerLock.Lock()
+		defer circuitBreakerLock.Unlock()
+		entry := getCircuitBreakerEntry(key)
+		update(&entry.state)
+		return entry.state
+	}
+
+	ctx := context.Background()
+	redisKey := circuitBreakerRedisKey(key)
+	var state CircuitBreakerState
+	var err error
+	for i := 0; i < 5; i++ {
+		err = common.RDB.Watch(ctx, func(tx *redis.Tx) error {
+			values, err := tx.HGetAll(ctx, redisKey).Result()
+			if err != nil {
+				return err
+			}
+			state = circuitBreakerStateFromRedisHash(values)
+			update(&state)
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.HSet(ctx, redisKey, state.toRedisHash())
+				pipe.Expire(ctx, redisKey, circuitBreakerRedisTTL)
+				return nil
+			})
+			return err
+		}, redisKey)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		common.SysError("failed to update circuit breaker: " + err.Error())
+		return state
+	}
+	circuitBreakerLock.Lock()
+	entry := getCircuitBreakerEntry(key)
+	entry.state = state
+	entry.syncedAt = time.Now()
+	circuitBreakerLock.Unlock()
+	return state
+}
+
+// getCircuitBreakerState 获取熔断器状态，启用 redis 时定期从 redis 同步其他节点的修改
+func getCircuitBreakerState(key string) CircuitBreakerState {
+	circuitBreakerLock.Lock()
+	entry := getCircuitBreakerEntry(key)
+	state := entry.state
+	shouldSync := common.RedisEnabled && time.Since(entry.syncedAt) > circuitBreakerRedisSyncTime
+	if shouldSync {
+		entry.syncedAt = time.Now()
+	}
+	circuitBreakerLock.Unlock()
+	if !shouldSync {
+		return state
+	}
+
+	values, err := common.RDB.HGetAll(context.Background(), circuitBreakerRedisKey(key)).Result()
+	if err != nil {
+		common.SysError("failed to get circuit breaker: " + err.Error())
+		return state
+	}
+	state = circuitBreakerStateFromRedisHash(values)
+	circuitBreakerLock.Lock()
+	entry.state = state
+	circuitBreakerLock.Unlock()
+	return state
+}
+
+// GetCircuitBreakerState 获取渠道（modelName 为空）或渠道上某个模型的熔断器状态
+func GetCircuitBreakerState(channelId int, modelName string) CircuitBreakerState {
+	state := getCircuitBreakerState(circuitBreakerKey(channelId, modelName))
+	state.State = state.current(common.GetTimestamp())
+	return state
+}
+
+// IsChannelCircuitAvailable 渠道及其模型的熔断器是否都允许请求通过
+func IsChannelCircuitAvailable(channelId int, modelName string) bool {
+	if !operation_setting.GetCircuitBreakerSetting().Enabled {
+		return true
+	}
+	now := common.GetTimestamp()
+	for _, key := range circuitBreakerKeys(channelId, modelName) {
+		state := getCircuitBreakerState(key)
+		if !state.available(now) {
+			return false
+		}
+	}
+	return true
+}
+
+// CircuitBreakerProbe 请求在半开状态下占用的试探名额，openedAt 标识名额所属的半开状态
+type CircuitBreakerProbe struct {
+	key      string
+	openedAt int64
+}
+
+// CircuitBreakerRequestStarted 请求开始时调用，半开状态下记为一次试探请求，返回的试探名额需要传给 CircuitBreakerRequestFinished
+func CircuitBreakerRequestStarted(channelId int, modelName string) []CircuitBreakerProbe {
+	if !operation_setting.GetCircuitBreakerSetting().Enabled {
+		return nil
+	}
+	now := common.GetTimestamp()
+	var probes []CircuitBreakerProbe
+	for _, key := range circuitBreakerKeys(channelId, modelName) {
+		// 只有半开状态需要修改，避免每个请求都写 redis
+		state := getCircuitBreakerState(key)
+		if state.current(now) != CircuitBreakerHalfOpen {
+			continue
+		}
+		var isProbe bool
+		state = updateCircuitBreaker(key, func(s *CircuitBreakerState) {
+			isProbe = s.onStart(now)
+		})
+		if isProbe {
+			probes = append(probes, CircuitBreakerProbe{key: key, openedAt: state.OpenedAt})
+		}
+	}
+	return probes
+}
+
+// CircuitBreakerRequestFinished 释放请求占用的试探名额并记录请求结果，counted 为 false 时只释放名额。
+// 失败达到阈值时熔断，半开状态下试探请求全部成功后恢复
+func CircuitBreakerRequestFinished(channelId int, modelName string, probes []CircuitBreakerProbe, success bool, counted bool) {
+	if !operation_setting.GetCircuitBreakerSetting().Enabled && len(probes) == 0 {
+		return
+	}
+	now := common.GetTimestamp()
+	for _, key := range circuitBreakerKeys(channelId, modelName) {
+		if counted && !success {
+			var before string
+			state := updateCircuitBreaker(key, func(s *CircuitBreakerState) {
+				before = s.current(now)
+				s.onFailure(now)
+			})
+			if before != CircuitBreakerOpen && state.State == CircuitBreakerOpen {
+				common.SysLog(fmt.Sprintf("circuit breaker %s opened", key))
+			}
+			continue
+		}
+		// 不是试探请求的成功不改变状态
+		for _, probe := range probes {
+			if probe.key != key {
+				continue
+			}
+			var closed bool
+			updateCircuitBreaker(key, func(s *CircuitBreakerState) {
+				before := s.State
+				s.onProbeFinished(probe.openedAt, counted && success)
+				closed = before == CircuitBreakerHalfOpen && s.State == CircuitBreakerClosed
+			})
+			if closed {
+				common.SysLog(fmt.Sprintf("circuit breaker %s closed", key))
+			}
+		}
+	}
+}
+
+// ResetChannelCircuitBreakers 重置渠道及其所有模型的熔断器
+func ResetChannelCircuitBreakers(channel *Channel) {
+	keys := []string{circuitBreakerKey(channel.Id, "")}
+	for _, modelName := range channel.GetModels() {
+		keys = append(keys, circuitBreakerKey(channel.Id, modelName))
+	}
+	circuitBreakerLock.Lock()
+	for _, key := range keys {
+		delete(circuitBreakerMap, key)
+	}
+	circuitBreakerLock.Unlock()
+	if common.RedisEnabled {
+		redisKeys := make([]string, len(keys))
+		for i, key := range keys {
+			redisKeys[i] = circuitBreakerRedisKey(key)
+		}
+		if err := common.RDB.Del(context.Background(), redisKeys...).Err(); err != nil {
+			common.SysError("failed to reset circuit breaker: " + err.Error())
+		}
+	}
+}
+
+// filterCircuitAvailableChannels 过滤掉熔断中的渠道，全部熔断时不做过滤，避免请求全部失败
+func filterCircuitAvailableChannels(channels []*Channel, modelName string) []*Channel {
+	if !operation_setting.GetCircuitBreakerSetting().Enabled {
+		return channels
+	}
+	available := make([]*Channel, 0, len(channels))
+	for _, channel := range channels {
+		if IsChannelCircuitAvailable(channel.Id, modelName) {
+			available = append(available, channel)
+		}
+	}
+	if len(available) == 0 {
+		return channels
+	}
+	return available
+}
+
+// filterCircuitAvailableAbilities 与 filterCircuitAvailableChannels 相同，用于未启用内存缓存时
+func filterCircuitAvailableAbilities(abilities []Ability, modelName string) []Ability {
+	if !operation_setting.GetCircuitBreakerSetting().Enabled {
+		return abilities
+	}
+	available := make([]Ability, 0, len(abilities))
+	for _, ability := range abilities {
+		if IsChannelCircuitAvailable(ability.ChannelId, modelName) {
+			available = append(available, ability)
+		}
+	}
+	if len(available) == 0 {
+		return abilities
+	}
+	return available
+}
@@ -0,0 +1,120 @@
+package model
+
+import (
+	"sync"
+	"time"
+	"veloera/common"
+
+	"gorm.io/gorm"
+)
+
+// ExperimentAssignment 请求分配到的实验变体，RecordConsumeLog 把请求各次计费的消耗累计到这里
+type ExperimentAssignment struct {
+	Experiment       string
+	Variant          string
+	Model            string
+	StartTime        time.Time
+	mu               sync.Mutex
+	Quota            int
+	PromptTokens     int
+	CompletionTokens int
+}
+
+func (a *ExperimentAssignment) add(promptTokens int, completionTokens int, quota int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.Quota += quota
+	a.PromptTokens += promptTokens
+	a.CompletionTokens += completionTokens
+}
+
+// Usage 返回请求累计的消耗
+func (a *ExperimentAssignment) Usage() (promptTokens int, completionTokens int, quota int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.PromptTokens, a.CompletionTokens, a.Quota
+}
+
+// ExperimentRequest 实验中的一次请求，用于按变体比较消耗、延迟、错误率和客户端反馈
+type ExperimentRequest struct {
+	Id               int      `json:"id"`
+	CreatedAt        int64    `json:"created_at" gorm:"bigint;index"`
+	Experiment       string   `json:"experiment" gorm:"type:varchar(64);index"`
+	Variant          string   `json:"variant" gorm:"type:varchar(64)"`
+	Model            string   `json:"model"`
+	RequestId        string   `json:"request_id" gorm:"type:varchar(64);index"`
+	UserId           int      `json:"user_id" gorm:"index"`
+	TokenId          int      `json:"token_id"`
+	Success          bool     `json:"success"`
+	Latency          int64    `json:"latency"` // 毫秒
+	Quota            int      `json:"quota"`
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+	FeedbackScore    *float64 `json:"feedback_score"` // 客户端反馈的评分，没有反馈时为空
+}
+
+// ExperimentVariantStat 实验请求按变体汇总的结果
+type ExperimentVariantStat struct {
+	Experiment       string   `json:"experiment"`
+	Variant          string   `json:"variant"`
+	Requests         int      `json:"requests"`
+	Errors           int      `json:"errors"`
+	ErrorRate        float64  `json:"error_rate" gorm:"-"`
+	AvgLatency       float64  `json:"avg_latency"`
+	Quota            int      `json:"quota"`
+	AvgQuota         float64  `json:"avg_quota"`
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+	FeedbackCount    int      `json:"feedback_count"`
+	AvgFeedbackScore *float64 `json:"avg_feedback_score"`
+}
+
+func RecordExperimentRequest(request *ExperimentRequest) {
+	request.CreatedAt = common.GetTimestamp()
+	if err := LOG_DB.Create(request).Error; err != nil {
+		common.SysError("failed to record experiment request: " + err.Error())
+	}
+}
+
+// UpdateExperimentFeedback 记录客户端对自己的请求的反馈评分，请求不属于该用户或不在实验中时返回 gorm.ErrRecordNotFound
+func UpdateExperimentFeedback(userId int, requestId string, score float64) error {
+	result := LOG_DB.Model(&ExperimentRequest{}).
+		Where("request_id = ? and user_id = ?", requestId, userId).
+		Update("feedback_score", score)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetExperimentVariantStats 按实验和变体汇总请求的消耗、延迟、错误率和反馈评分
+func GetExperimentVariantStats(experiment string, startTimestamp int64, endTimestamp int64) (stats []*ExperimentVariantStat, err error) {
+	tx := LOG_DB.Model(&ExperimentRequest{})
+	if experiment != "" {
+		tx = tx.Where("experiment = ?", experiment)
+	}
+	if startTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", startTimestamp)
+	}
+	if endTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", endTimestamp)
+	}
+	err = tx.Select("experiment, variant, count(*) as requests, " +
+		"sum(case when success then 0 else 1 end) as errors, " +
+		"avg(latency) as avg_latency, sum(quota) as quota, avg(quota) as avg_quota, " +
+		"sum(prompt_tokens) as prompt_tokens, sum(completion_tokens) as completion_tokens, " +
+		"count(feedback_score) as feedback_count, avg(feedback_score) as avg_feedback_score").
+		Group("experiment, variant").Order("experiment, variant").Scan(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, stat := range stats {
+		if stat.Requests > 0 {
+			stat.ErrorRate = float64(stat.Errors) / float64(stat.Requests)
+		}
+	}
+	return stats, nil
+}
@@ -0,0 +1,81 @@
+package model
+
+import (
+	"veloera/common"
+
+	"gorm.io/gorm"
+)
+
+const (
+	FilePurposeBatch       = "batch"
+	FilePurposeBatchOutput = "batch_output"
+)
+
+// File /v1/files 上传的文件，内容保存在 FILE_STORAGE_DIR 目录下，以 FileId 命名
+type File struct {
+	Id        int    `json:"id"`
+	FileId    string `json:"file_id" gorm:"type:varchar(64);uniqueIndex"`
+	UserId    int    `json:"user_id" gorm:"index"`
+	Filename  string `json:"filename" gorm:"type:varchar(255)"`
+	Purpose   string `json:"purpose" gorm:"type:varchar(32);index"`
+	Bytes     int64  `json:"bytes" gorm:"bigint"`
+	CreatedAt int64  `json:"created_at" gorm:"bigint;index"`
+}
+
+func (f *File) Insert() error {
+	if f.CreatedAt == 0 {
+		f.CreatedAt = common.GetTimestamp()
+	}
+	return DB.Create(f).Error
+}
+
+// GetUserFile 获取用户的文件，不存在时返回 gorm.ErrRecordNotFound
+func GetUserFile(userId int, fileId string) (*File, error) {
+	if fileId == "" {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var f File
+	err := DB.Where("file_id = ? AND user_id = ?", fileId, userId).First(&f).Error
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// GetUserFiles 按创建时间列出用户的文件，after 为上一页最后一个文件的 id
+func GetUserFiles(userId int, purpose string, after string, limit int, desc bool) ([]*File, error) {
+	tx := DB.Where("user_id = ?", userId)
+	if purpose != "" {
+		tx = tx.Where("purpose = ?", purpose)
+	}
+	order := "id asc"
+	if desc {
+		order = "id desc"
+	}
+	if after != "" {
+		afterFile, err := GetUserFile(userId, after)
+		if err != nil {
+			return nil, err
+		}
+		if desc {
+			tx = tx.Where("id < ?", afterFile.Id)
+		} else {
+			tx = tx.Where("id > ?", afterFile.Id)
+		}
+	}
+	var files []*File
+	err := tx.Order(order).Limit(limit).Find(&files).Error
+	return files, err
+}
+
+// DeleteUserFile 删除用户的文件记录，不存在时返回 gorm.ErrRecordNotFound
+func DeleteUserFile(userId int, fileId string) error {
+	result := DB.Where("file_id = ? AND user_id = ?", fileId, userId).Delete(&File{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
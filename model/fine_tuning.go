@@ -0,0 +1,231 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"veloera/common"
+
+	"gorm.io/gorm"
+)
+
+const (
+	FineTuningStatusValidatingFiles = "validating_files"
+	FineTuningStatusQueued          = "queued"
+	FineTuningStatusRunning         = "running"
+	FineTuningStatusSucceeded       = "succeeded"
+	FineTuningStatusFailed          = "failed"
+	FineTuningStatusCancelled       = "cancelled"
+)
+
+// FineTuningJob /v1/fine_tuning/jobs 创建的微调任务，任务及其微调模型只能通过创建时的渠道和 key 访问
+type FineTuningJob struct {
+	Id             int             `json:"id"`
+	JobId          string          `json:"job_id" gorm:"type:varchar(128);uniqueIndex"`
+	UserId         int             `json:"user_id" gorm:"index"`
+	TokenId        int             `json:"token_id" gorm:"index"`
+	ChannelId      int             `json:"channel_id" gorm:"index"`
+	KeyHash        string          `json:"key_hash" gorm:"type:varchar(64)"` // 上游 key 的 HashChannelKey
+	Model          string          `json:"model" gorm:"type:varchar(255)"`
+	FineTunedModel string          `json:"fine_tuned_model" gorm:"type:varchar(255);index"`
+	TrainingFile   string          `json:"training_file" gorm:"type:varchar(64)"` // 本地文件 id
+	ValidationFile string          `json:"validation_file" gorm:"type:varchar(64)"`
+	Status         string          `json:"status" gorm:"type:varchar(32);index"`
+	Data           json.RawMessage `json:"data" gorm:"type:json"` // 上游返回的最新任务对象
+	CreatedAt      int64           `json:"created_at" gorm:"bigint;index"`
+	UpdatedAt      int64           `json:"updated_at" gorm:"bigint"`
+}
+
+// UpstreamFile 上传到渠道的本地文件，同一个文件在同一个渠道 key 下只上传一次
+type UpstreamFile struct {
+	Id             int    `json:"id"`
+	FileId         string `json:"file_id" gorm:"type:varchar(64);index"`
+	ChannelId      int    `json:"channel_id" gorm:"index"`
+	KeyHash        string `json:"key_hash" gorm:"type:varchar(64)"`
+	UpstreamFileId string `json:"upstream_file_id" gorm:"type:varchar(128)"`
+	CreatedAt      int64  `json:"created_at" gorm:"bigint"`
+}
+
+func (j *FineTuningJob) Insert() error {
+	now := common.GetTimestamp()
+	if j.CreatedAt == 0 {
+		j.CreatedAt = now
+	}
+	j.UpdatedAt = now
+	return DB.Create(j).Error
+}
+
+// Update 只更新指定的字段
+func (j *FineTuningJob) Update(fields map[string]any) error {
+	fields["updated_at"] = common.GetTimestamp()
+	return DB.Model(j).Updates(fields).Error
+}
+
+// IsFinished 任务已结束，不需要再轮询状态
+func (j *FineTuningJob) IsFinished() bool {
+	switch j.Status {
+	case FineTuningStatusSucceeded, FineTuningStatusFailed, FineTuningStatusCancelled:
+		return true
+	}
+	return false
+}
+
+// GetUserFineTuningJob 获取用户的微调任务，不存在时返回 gorm.ErrRecordNotFound
+func GetUserFineTuningJob(userId int, jobId string) (*FineTuningJob, error) {
+	if jobId == "" {
+		return nil, gorm.ErrRecordNotFound
+	}
+	var j FineTuningJob
+	err := DB.Where("job_id = ? AND user_id = ?", jobId, userId).First(&j).Error
+	if err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// GetUserFineTuningJobs 按创建时间倒序列出用户的微调任务，after 为上一页最后一个任务的 id
+func GetUserFineTuningJobs(userId int, after string, limit int) ([]*FineTuningJob, error) {
+	tx := DB.Where("user_id = ?", userId)
+	if after != "" {
+		afterJob, err := GetUserFineTuningJob(userId, after)
+		if err != nil {
+			return nil, err
+		}
+		tx = tx.Where("id < ?", afterJob.Id)
+	}
+	var jobs []*FineTuningJob
+	err := tx.Order("id desc").Limit(limit).Find(&jobs).Error
+	return jobs, err
+}
+
+// GetUnfinishedFineTuningJobs 获取需要轮询状态的微调任务
+func GetUnfinishedFineTuningJobs() ([]*FineTuningJob, error) {
+	var jobs []*FineTuningJob
+	err := DB.Where("status NOT IN ?", []string{FineTuningStatusSucceeded, FineTuningStatusFailed, FineTuningStatusCancelled}).
+		Order("id asc").Find(&jobs).Error
+	return jobs, err
+}
+
+// GetFineTunedModelKeyHash 返回渠道下微调模型所属的 key，非微调模型或找不到时返回空
+func GetFineTunedModelKeyHash(channelId int, fineTunedModel string) string {
+	if !strings.HasPrefix(fineTunedModel, "ft:") {
+		return ""
+	}
+	var j FineTuningJob
+	err := DB.Select("key_hash").Where("channel_id = ? AND fine_tuned_model = ?", channelId, fineTunedModel).First(&j).Error
+	if err != nil {
+		return ""
+	}
+	return j.KeyHash
+}
+
+// IsFineTunedModelOwner 微调模型是否属于该用户，不是通过微调任务创建的模型不限制
+func IsFineTunedModelOwner(userId int, fineTunedModel string) (bool, error) {
+	if !strings.HasPrefix(fineTunedModel, "ft:") {
+		return true, nil
+	}
+	var jobs []*FineTuningJob
+	err := DB.Select("user_id").Where("fine_tuned_model = ?", fineTunedModel).Find(&jobs).Error
+	if err != nil {
+		return false, err
+	}
+	if len(jobs) == 0 {
+		return true, nil
+	}
+	for _, job := range jobs {
+		if job.UserId == userId {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *UpstreamFile) Insert() error {
+	if f.CreatedAt == 0 {
+		f.CreatedAt = common.GetTimestamp()
+	}
+	return DB.Create(f).Error
+}
+
+// GetUpstreamFile 获取本地文件在渠道 key 下对应的上游文件，不存在时返回 gorm.ErrRecordNotFound
+func GetUpstreamFile(fileId string, channelId int, keyHash string) (*UpstreamFile, error) {
+	var f UpstreamFile
+	err := DB.Where("file_id = ? AND channel_id = ? AND key_hash = ?", fileId, channelId, keyHash).First(&f).Error
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// GetFineTuningChannel 选择支持微调的渠道，只考虑 channelTypes 中的渠道类型，优先级最高的渠道中按权重随机
+func GetFineTuningChannel(group string, modelName string, channelTypes []int) (*Channel, error) {
+	var abilities []Ability
+	err := DB.Where(groupCol+" = ? AND model = ? AND enabled = ?", group, modelName, true).Find(&abilities).Error
+	if err != nil {
+		return nil, err
+	}
+	channelIds := make([]int, 0, len(abilities))
+	for _, ability := range abilities {
+		channelIds = append(channelIds, ability.ChannelId)
+	}
+	if len(channelIds) == 0 {
+		return nil, errors.New("channel not found")
+	}
+	var channels []*Channel
+	err = DB.Where("id IN ? AND type IN ? AND status = ?", channelIds, channelTypes, common.ChannelStatusEnabled).
+		Order("priority desc").Find(&channels).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(channels) == 0 {
+		return nil, errors.New("channel not found")
+	}
+	var candidates []*Channel
+	for _, channel := range channels {
+		if channel.GetPriority() == channels[0].GetPriority() {
+			candidates = append(candidates, channel)
+		}
+	}
+	totalWeight := 0
+	for _, channel := range candidates {
+		totalWeight += channel.GetWeight() + 10
+	}
+	weight := common.GetRandomInt(totalWeight)
+	for _, channel := range candidates {
+		weight -= channel.GetWeight() + 10
+		if weight < 0 {
+			return channel, nil
+		}
+	}
+	return candidates[0], nil
+}
+
+// AddChannelModel 将模型加入渠道的模型列表并更新能力，模型已存在时不做修改
+func AddChannelModel(channelId int, modelName string) error {
+	channel, err := GetChannelById(channelId, true)
+	if err != nil {
+		return err
+	}
+	for _, m := range channel.GetModels() {
+		if m == modelName {
+			return nil
+		}
+	}
+	models := modelName
+	if channel.Models != "" {
+		models = channel.Models + "," + modelName
+	}
+	err = DB.Model(channel).Update("models", models).Error
+	if err != nil {
+		return err
+	}
+	channel.Models = models
+	err = channel.UpdateAbilities(nil)
+	if err != nil {
+		return err
+	}
+	if common.MemoryCacheEnabled {
+		InitChannelCache()
+	}
+	return nil
+}
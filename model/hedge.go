@@ -0,0 +1,132 @@
+package model
+
+import (
+	"sync"
+	"veloera/common"
+
+	"gorm.io/gorm"
+)
+
+// HedgeAttempt 对冲请求中的一次尝试，落败的尝试不向用户计费，其消耗由 RecordConsumeLog 转交到这里
+type HedgeAttempt struct {
+	mu               sync.Mutex
+	lost             bool
+	billed           bool
+	Quota            int
+	PromptTokens     int
+	CompletionTokens int
+}
+
+// Lose 标记为落败，之后的消耗不再计入用户的消费日志
+func (a *HedgeAttempt) Lose() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.lost = true
+}
+
+func (a *HedgeAttempt) Lost() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.lost
+}
+
+func (a *HedgeAttempt) add(promptTokens int, completionTokens int, quota int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.billed = true
+	a.Quota += quota
+	a.PromptTokens += promptTokens
+	a.CompletionTokens += completionTokens
+}
+
+// Usage 返回落败后产生的消耗，billed 为 false 表示请求在计费前就被取消
+func (a *HedgeAttempt) Usage() (promptTokens int, completionTokens int, quota int, billed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.PromptTokens, a.CompletionTokens, a.Quota, a.billed
+}
+
+// HedgeCost 对冲请求中落败一方的上游消耗，只向管理员展示，不向用户计费
+type HedgeCost struct {
+	Id               int    `json:"id"`
+	CreatedAt        int64  `json:"created_at" gorm:"bigint;index"`
+	RequestId        string `json:"request_id" gorm:"type:varchar(64)"`
+	UserId           int    `json:"user_id" gorm:"index"`
+	TokenId          int    `json:"token_id"`
+	ChannelId        int    `json:"channel_id" gorm:"index"`
+	WinnerChannelId  int    `json:"winner_channel_id"`
+	ModelName        string `json:"model_name"`
+	PromptTokens     int    `json:"prompt_tokens"`
+	CompletionTokens int    `json:"completion_tokens"`
+	Quota            int    `json:"quota"`
+	Cancelled        bool   `json:"cancelled"` // 在计费前被取消，token 数为预估的输入 token 数
+}
+
+// HedgeCostStat 对冲成本按渠道汇总
+type HedgeCostStat struct {
+	ChannelId        int `json:"channel_id"`
+	Count            int `json:"count"`
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	Quota            int `json:"quota"`
+}
+
+func RecordHedgeCost(cost *HedgeCost) {
+	cost.CreatedAt = common.GetTimestamp()
+	if err := LOG_DB.Create(cost).Error; err != nil {
+		common.SysError("failed to record hedge cost: " + err.Error())
+	}
+}
+
+// RefundHedgeQuota 退还落败的对冲请求已扣除的额度，并撤销计入的用户用量和请求次数
+func RefundHedgeQuota(userId int, tokenId int, tokenKeyHash string, quota int, refundToken bool) error {
+	if quota <= 0 {
+		return nil
+	}
+	if err := IncreaseUserQuota(userId, quota, false); err != nil {
+		return err
+	}
+	if refundToken {
+		if err := IncreaseTokenQuota(tokenId, tokenKeyHash, quota); err != nil {
+			return err
+		}
+	}
+	if common.BatchUpdateEnabled {
+		addNewRecord(BatchUpdateTypeUsedQuota, userId, -quota)
+		addNewRecord(BatchUpdateTypeRequestCount, userId, -1)
+		return nil
+	}
+	updateUserUsedQuotaAndRequestCount(userId, -quota, -1)
+	return nil
+}
+
+func hedgeCostQuery(startTimestamp int64, endTimestamp int64, channelId int) *gorm.DB {
+	tx := LOG_DB.Model(&HedgeCost{})
+	if startTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", startTimestamp)
+	}
+	if endTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", endTimestamp)
+	}
+	if channelId != 0 {
+		tx = tx.Where("channel_id = ?", channelId)
+	}
+	return tx
+}
+
+func GetHedgeCosts(startTimestamp int64, endTimestamp int64, channelId int, startIdx int, num int) (costs []*HedgeCost, total int64, err error) {
+	tx := hedgeCostQuery(startTimestamp, endTimestamp, channelId)
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&costs).Error
+	return costs, total, err
+}
+
+// GetHedgeCostStats 按渠道汇总对冲成本
+func GetHedgeCostStats(startTimestamp int64, endTimestamp int64) (stats []*HedgeCostStat, err error) {
+	err = hedgeCostQuery(startTimestamp, endTimestamp, 0).
+		Select("channel_id, count(*) as count, sum(prompt_tokens) as prompt_tokens, sum(completion_tokens) as completion_tokens, sum(quota) as quota").
+		Group("channel_id").Order("quota desc").Scan(&stats).Error
+	return stats, err
+}
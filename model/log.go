@@ -6,6 +6,7 @@ import (
 	"strings"
 	"time"
 	"veloera/common"
+	"veloera/constant"
 
 	"github.com/gin-gonic/gin"
 
@@ -14,27 +15,29 @@ import (
 )
 
 type Log struct {
-	Id               int    `json:"id" gorm:"index:idx_created_at_id,priority:1"`
-	UserId           int    `json:"user_id" gorm:"index"`
-	CreatedAt        int64  `json:"created_at" gorm:"bigint;index:idx_created_at_id,priority:2;index:idx_created_at_type"`
-	Type             int    `json:"type" gorm:"index:idx_created_at_type"`
-	Content          string `json:"content"`
-	Username         string `json:"username" gorm:"index;index:index_username_model_name,priority:2;default:''"`
-	TokenName        string `json:"token_name" gorm:"index;default:''"`
-	ModelName        string `json:"model_name" gorm:"index;index:index_username_model_name,priority:1;default:''"`
-	Quota            int    `json:"quota" gorm:"default:0"`
-	PromptTokens     int    `json:"prompt_tokens" gorm:"default:0"`
-	CompletionTokens int    `json:"completion_tokens" gorm:"default:0"`
-	UseTime          int    `json:"use_time" gorm:"default:0"`
-	IsStream         bool   `json:"is_stream" gorm:"default:false"`
-	ChannelId        int     `json:"channel" gorm:"index"`
-	ChannelName      string  `json:"channel_name" gorm:"->"`
-	TokenId          int     `json:"token_id" gorm:"default:0;index"`
-	Group            string  `json:"group" gorm:"index"`
-	Other            string  `json:"other"`
-	FileSize         *int64  `json:"file_size,omitempty" gorm:"default:null"`
-	Duration         *int    `json:"duration,omitempty" gorm:"default:null"`
-	TaskType         *string `json:"task_type,omitempty" gorm:"default:null"`
+	Id                   int     `json:"id" gorm:"index:idx_created_at_id,priority:1"`
+	UserId               int     `json:"user_id" gorm:"index"`
+	CreatedAt            int64   `json:"created_at" gorm:"bigint;index:idx_created_at_id,priority:2;index:idx_created_at_type"`
+	Type                 int     `json:"type" gorm:"index:idx_created_at_type"`
+	Content              string  `json:"content"`
+	Username             string  `json:"username" gorm:"index;index:index_username_model_name,priority:2;default:''"`
+	TokenName            string  `json:"token_name" gorm:"index;default:''"`
+	ModelName            string  `json:"model_name" gorm:"index;index:index_username_model_name,priority:1;default:''"`
+	Quota                int     `json:"quota" gorm:"default:0"`
+	PromptTokens         int     `json:"prompt_tokens" gorm:"default:0"`
+	CompletionTokens     int     `json:"completion_tokens" gorm:"default:0"`
+	UseTime              int     `json:"use_time" gorm:"default:0"`
+	IsStream             bool    `json:"is_stream" gorm:"default:false"`
+	ChannelId            int     `json:"channel" gorm:"index"`
+	ChannelName          string  `json:"channel_name" gorm:"->"`
+	TokenId              int     `json:"token_id" gorm:"default:0;index"`
+	Group                string  `json:"group" gorm:"index"`
+	Other                string  `json:"other"`
+	UpstreamCost         int     `json:"upstream_cost,omitempty" gorm:"default:0"` // 支付给上游的额度，只对管理员展示
+	UpstreamCostRecorded bool    `json:"-" gorm:"default:false"`                   // 是否记录了上游成本，旧版本的日志没有上游成本，不参与毛利统计
+	FileSize             *int64  `json:"file_size,omitempty" gorm:"default:null"`
+	Duration             *int    `json:"duration,omitempty" gorm:"default:null"`
+	TaskType             *string `json:"task_type,omitempty" gorm:"default:null"`
 }
 
 const (
@@ -56,6 +59,7 @@ func formatUserLogs(logs []*Log) {
 			delete(otherMap, "admin_info")
 		}
 		logs[i].Other = common.MapToJsonStr(otherMap)
+		logs[i].UpstreamCost = 0
 		logs[i].Id = logs[i].Id % 1024
 	}
 }
@@ -63,7 +67,7 @@ func formatUserLogs(logs []*Log) {
 func GetLogByKey(key string, userId int) (logs []*Log, err error) {
 	if os.Getenv("LOG_SQL_DSN") != "" {
 		var tk Token
-		if err = DB.Model(&Token{}).Where(keyCol+"=?", strings.TrimPrefix(key, "sk-")).First(&tk).Error; err != nil {
+		if err = DB.Model(&Token{}).Where("key_hash = ?", HashTokenKey(strings.TrimPrefix(key, "sk-"))).First(&tk).Error; err != nil {
 			return nil, err
 		}
 		if tk.UserId != userId { // 验证token是否属于当前用户
@@ -71,7 +75,7 @@ func GetLogByKey(key string, userId int) (logs []*Log, err error) {
 		}
 		err = LOG_DB.Model(&Log{}).Where("token_id=?", tk.Id).Find(&logs).Error
 	} else {
-		err = LOG_DB.Joins("left join tokens on tokens.id = logs.token_id").Where("tokens.key = ? AND tokens.user_id = ?", strings.TrimPrefix(key, "sk-"), userId).Find(&logs).Error
+		err = LOG_DB.Joins("left join tokens on tokens.id = logs.token_id").Where("tokens.key_hash = ? AND tokens.user_id = ?", HashTokenKey(strings.TrimPrefix(key, "sk-")), userId).Find(&logs).Error
 	}
 	formatUserLogs(logs)
 	return logs, err
@@ -99,28 +103,63 @@ func RecordConsumeLog(c *gin.Context, userId int, channelId int, promptTokens in
 	modelName string, tokenName string, quota int, content string, tokenId int, userQuota int, useTimeSeconds int,
 	isStream bool, group string, other map[string]interface{}) {
 	common.LogInfo(c, fmt.Sprintf("record consume log: userId=%d, 用户调用前余额=%d, channelId=%d, promptTokens=%d, completionTokens=%d, modelName=%s, tokenName=%s, quota=%d, content=%s", userId, userQuota, channelId, promptTokens, completionTokens, modelName, tokenName, quota, content))
+	// 上游成本按渠道实际使用的模型计算，虚拟模型在下面才替换为请求的模型名
+	upstreamCost := computeUpstreamCost(channelId, modelName, promptTokens, completionTokens, quota, other)
+	if value, ok := c.Get(constant.ContextKeyUpstreamCost); ok {
+		upstreamCost = value.(int)
+	}
+	if batchUsage, ok := c.Get(constant.ContextKeyBatchUsage); ok {
+		// 批处理请求汇总到批处理的消费日志中
+		batchUsage.(*BatchUsage).add(promptTokens, completionTokens, quota, upstreamCost)
+		return
+	}
+	if hedgeAttempt, ok := c.Get(constant.ContextKeyHedgeAttempt); ok && hedgeAttempt.(*HedgeAttempt).Lost() {
+		// 落败的对冲请求不向用户计费，消耗记录为对冲成本
+		hedgeAttempt.(*HedgeAttempt).add(promptTokens, completionTokens, quota)
+		return
+	}
+	if value, ok := c.Get(constant.ContextKeyExperiment); ok {
+		// 实验中的请求按变体累计消耗，并在日志中记录分配的变体
+		assignment := value.(*ExperimentAssignment)
+		assignment.add(promptTokens, completionTokens, quota)
+		if other == nil {
+			other = make(map[string]interface{})
+		}
+		other["experiment"] = assignment.Experiment
+		other["experiment_variant"] = assignment.Variant
+	}
 	if !common.LogConsumeEnabled {
 		return
 	}
+	if virtualModel := c.GetString(constant.ContextKeyVirtualModel); virtualModel != "" {
+		// 虚拟模型记录请求的模型名，实际使用的模型记录在 other 中
+		if other == nil {
+			other = make(map[string]interface{})
+		}
+		other["served_model"] = modelName
+		modelName = virtualModel
+	}
 	username := c.GetString("username")
 	otherStr := common.MapToJsonStr(other)
 	log := &Log{
-		UserId:           userId,
-		Username:         username,
-		CreatedAt:        common.GetTimestamp(),
-		Type:             LogTypeConsume,
-		Content:          content,
-		PromptTokens:     promptTokens,
-		CompletionTokens: completionTokens,
-		TokenName:        tokenName,
-		ModelName:        modelName,
-		Quota:            quota,
-		ChannelId:        channelId,
-		TokenId:          tokenId,
-		UseTime:          useTimeSeconds,
-		IsStream:         isStream,
-		Group:            group,
-		Other:            otherStr,
+		UserId:               userId,
+		Username:             username,
+		CreatedAt:            common.GetTimestamp(),
+		Type:                 LogTypeConsume,
+		Content:              content,
+		PromptTokens:         promptTokens,
+		CompletionTokens:     completionTokens,
+		TokenName:            tokenName,
+		ModelName:            modelName,
+		Quota:                quota,
+		ChannelId:            channelId,
+		TokenId:              tokenId,
+		UseTime:              useTimeSeconds,
+		IsStream:             isStream,
+		Group:                group,
+		Other:                otherStr,
+		UpstreamCost:         upstreamCost,
+		UpstreamCostRecorded: true,
 	}
 	err := LOG_DB.Create(log).Error
 	if err != nil {
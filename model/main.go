@@ -186,7 +186,10 @@ func InitDB() (err error) {
 		sqlDB.SetConnMaxLifetime(time.Second * time.Duration(common.GetEnvOrDefault("SQL_MAX_LIFETIME", 60)))
 
 		if !common.IsMasterNode {
-			return nil
+			if err := initTokenHashSecret(); err != nil {
+				return err
+			}
+			return initChannelKeyHashSecret()
 		}
 		if common.UsingMySQL {
 			_, _ = sqlDB.Exec("ALTER TABLE channels MODIFY model_mapping TEXT;") // TODO: delete this line when most users have upgraded
@@ -256,6 +259,17 @@ func migrateDB() error {
 		&Setup{},
 		&TranscriptionTask{},
 		&FileStorage{},
+		&StoredResponse{},
+		&File{},
+		&Batch{},
+		&FineTuningJob{},
+		&UpstreamFile{},
+		&ChannelKey{},
+		&HedgeCost{},
+		&ShadowComparison{},
+		&ExperimentRequest{},
+		&ChannelHealthSample{},
+		&ModelDiscoveryDiff{},
 	}
 
 	for _, model := range modelsToMigrate {
@@ -270,6 +284,15 @@ func migrateDB() error {
 		}
 	}
 
+	if err := initTokenHashSecret(); err != nil {
+		return err
+	}
+	if err := migrateTokenKeys(); err != nil {
+		return err
+	}
+	if err := initChannelKeyHashSecret(); err != nil {
+		return err
+	}
 	common.SysLog("database migrated")
 	return nil
 }
@@ -279,6 +302,18 @@ func migrateLOGDB() error {
 	if err = LOG_DB.AutoMigrate(&Log{}); err != nil {
 		return err
 	}
+	if err = LOG_DB.AutoMigrate(&HedgeCost{}); err != nil {
+		return err
+	}
+	if err = LOG_DB.AutoMigrate(&ShadowComparison{}); err != nil {
+		return err
+	}
+	if err = LOG_DB.AutoMigrate(&ExperimentRequest{}); err != nil {
+		return err
+	}
+	if err = LOG_DB.AutoMigrate(&ChannelHealthSample{}); err != nil {
+		return err
+	}
 	return nil
 }
 
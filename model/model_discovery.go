@@ -0,0 +1,255 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"veloera/common"
+	"veloera/constant"
+	"veloera/setting/operation_setting"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ModelDiscoveryDiffPending    = "pending"    // 等待管理员审核
+	ModelDiscoveryDiffApplied    = "applied"    // 已更新渠道的模型列表
+	ModelDiscoveryDiffRejected   = "rejected"   // 管理员拒绝
+	ModelDiscoveryDiffSuperseded = "superseded" // 审核前上游再次变化，被新的记录取代
+)
+
+// ModelDiscoveryPolicy 渠道对上游新增和下线模型的处理策略，为空时使用全局配置
+type ModelDiscoveryPolicy struct {
+	Add    string `json:"add"`
+	Remove string `json:"remove"`
+}
+
+// ModelDiscoveryDiff 一次检查发现的上游模型变化，模型列表以逗号分隔
+type ModelDiscoveryDiff struct {
+	Id          int    `json:"id"`
+	CreatedAt   int64  `json:"created_at" gorm:"bigint;index"`
+	ChannelId   int    `json:"channel_id" gorm:"index"`
+	ChannelName string `json:"channel_name"`
+	Added       string `json:"added" gorm:"type:text"`        // 等待审核的新增模型
+	Removed     string `json:"removed" gorm:"type:text"`      // 等待审核的下线模型
+	AutoAdded   string `json:"auto_added" gorm:"type:text"`   // 已自动添加的模型
+	AutoRemoved string `json:"auto_removed" gorm:"type:text"` // 已自动移除的模型
+	Status      string `json:"status" gorm:"type:varchar(16);index"`
+	ReviewedAt  int64  `json:"reviewed_at" gorm:"bigint"`
+}
+
+// GetModelDiscoveryPolicy 返回渠道设置中的处理策略，未设置的部分使用全局配置
+func (channel *Channel) GetModelDiscoveryPolicy() ModelDiscoveryPolicy {
+	setting := operation_setting.GetModelDiscoverySetting()
+	policy := ModelDiscoveryPolicy{
+		Add:    setting.AddPolicy,
+		Remove: setting.RemovePolicy,
+	}
+	value, ok := channel.GetSetting()[constant.ChannelSettingModelDiscovery]
+	if !ok {
+		return policy
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return policy
+	}
+	var channelPolicy ModelDiscoveryPolicy
+	if err := json.Unmarshal(data, &channelPolicy); err != nil {
+		common.SysError("failed to unmarshal channel model discovery policy: " + err.Error())
+		return policy
+	}
+	if channelPolicy.Add != "" {
+		policy.Add = channelPolicy.Add
+	}
+	if channelPolicy.Remove != "" {
+		policy.Remove = channelPolicy.Remove
+	}
+	return policy
+}
+
+func splitModels(models string) []string {
+	if models == "" {
+		return []string{}
+	}
+	return strings.Split(models, ",")
+}
+
+func joinModels(models []string) string {
+	sorted := append([]string(nil), models...)
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
+
+func (diff *ModelDiscoveryDiff) GetAdded() []string {
+	return splitModels(diff.Added)
+}
+
+func (diff *ModelDiscoveryDiff) GetRemoved() []string {
+	return splitModels(diff.Removed)
+}
+
+func (diff *ModelDiscoveryDiff) GetAutoAdded() []string {
+	return splitModels(diff.AutoAdded)
+}
+
+func (diff *ModelDiscoveryDiff) GetAutoRemoved() []string {
+	return splitModels(diff.AutoRemoved)
+}
+
+// SetChanges 设置等待审核和自动处理的模型，模型按名称排序以便与之前的记录比较
+func (diff *ModelDiscoveryDiff) SetChanges(added, removed, autoAdded, autoRemoved []string) {
+	diff.Added = joinModels(added)
+	diff.Removed = joinModels(removed)
+	diff.AutoAdded = joinModels(autoAdded)
+	diff.AutoRemoved = joinModels(autoRemoved)
+}
+
+func (diff *ModelDiscoveryDiff) hasPendingChanges() bool {
+	return diff.Added != "" || diff.Removed != ""
+}
+
+func (diff *ModelDiscoveryDiff) hasAutoChanges() bool {
+	return diff.AutoAdded != "" || diff.AutoRemoved != ""
+}
+
+// applyChannelModels 在事务中给渠道添加和移除模型，并更新渠道的 abilities
+func applyChannelModels(tx *gorm.DB, channelId int, added []string, removed []string) error {
+	var channel Channel
+	if err := tx.First(&channel, "id = ?", channelId).Error; err != nil {
+		return err
+	}
+	removedSet := make(map[string]bool, len(removed))
+	for _, name := range removed {
+		removedSet[name] = true
+	}
+	models := make([]string, 0)
+	existing := make(map[string]bool)
+	for _, name := range channel.GetModels() {
+		if name == "" || removedSet[name] || existing[name] {
+			continue
+		}
+		existing[name] = true
+		models = append(models, name)
+	}
+	for _, name := range added {
+		if !existing[name] {
+			existing[name] = true
+			models = append(models, name)
+		}
+	}
+	channel.Models = strings.Join(models, ",")
+	if err := tx.Model(&Channel{}).Where("id = ?", channelId).Update("models", channel.Models).Error; err != nil {
+		return err
+	}
+	return channel.UpdateAbilities(tx)
+}
+
+// SaveModelDiscoveryDiff 保存一次检查的结果：自动处理的模型直接更新渠道，等待审核的模型取代该渠道之前未审核的记录。
+// 与上一次被拒绝的内容相同时不再重复提交审核。返回是否产生了新的记录
+func SaveModelDiscoveryDiff(diff *ModelDiscoveryDiff) (bool, error) {
+	saved := false
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		var pending ModelDiscoveryDiff
+		result := tx.Where("channel_id = ? and status = ?", diff.ChannelId, ModelDiscoveryDiffPending).
+			Order("id desc").Limit(1).Find(&pending)
+		if result.Error != nil {
+			return result.Error
+		}
+		hasPending := result.RowsAffected > 0
+		if diff.hasPendingChanges() {
+			var rejected ModelDiscoveryDiff
+			result := tx.Where("channel_id = ? and status = ?", diff.ChannelId, ModelDiscoveryDiffRejected).
+				Order("id desc").Limit(1).Find(&rejected)
+			if result.Error != nil {
+				return result.Error
+			}
+			if result.RowsAffected > 0 && rejected.Added == diff.Added && rejected.Removed == diff.Removed {
+				diff.Added = ""
+				diff.Removed = ""
+			}
+		}
+		if hasPending && pending.Added == diff.Added && pending.Removed == diff.Removed {
+			// 等待审核的内容没有变化
+			if !diff.hasAutoChanges() {
+				return nil
+			}
+			diff.Added = ""
+			diff.Removed = ""
+		} else if hasPending {
+			err := tx.Model(&ModelDiscoveryDiff{}).Where("id = ?", pending.Id).
+				Update("status", ModelDiscoveryDiffSuperseded).Error
+			if err != nil {
+				return err
+			}
+		}
+		if !diff.hasPendingChanges() && !diff.hasAutoChanges() {
+			return nil
+		}
+		if diff.hasAutoChanges() {
+			if err := applyChannelModels(tx, diff.ChannelId, diff.GetAutoAdded(), diff.GetAutoRemoved()); err != nil {
+				return err
+			}
+		}
+		diff.CreatedAt = common.GetTimestamp()
+		diff.Status = ModelDiscoveryDiffApplied
+		if diff.hasPendingChanges() {
+			diff.Status = ModelDiscoveryDiffPending
+		}
+		if err := tx.Create(diff).Error; err != nil {
+			return err
+		}
+		saved = true
+		return nil
+	})
+	if err == nil && saved && diff.hasAutoChanges() && common.MemoryCacheEnabled {
+		InitChannelCache()
+	}
+	return saved, err
+}
+
+// ReviewModelDiscoveryDiff 审核等待中的记录，通过时在同一事务中更新渠道的模型列表和 abilities
+func ReviewModelDiscoveryDiff(id int, approve bool) (*ModelDiscoveryDiff, error) {
+	var diff ModelDiscoveryDiff
+	err := DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.First(&diff, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if diff.Status != ModelDiscoveryDiffPending {
+			return errors.New("该记录已处理")
+		}
+		status := ModelDiscoveryDiffRejected
+		if approve {
+			status = ModelDiscoveryDiffApplied
+			if err := applyChannelModels(tx, diff.ChannelId, diff.GetAdded(), diff.GetRemoved()); err != nil {
+				return err
+			}
+		}
+		diff.Status = status
+		diff.ReviewedAt = common.GetTimestamp()
+		return tx.Model(&ModelDiscoveryDiff{}).Where("id = ? and status = ?", id, ModelDiscoveryDiffPending).
+			Updates(map[string]any{"status": diff.Status, "reviewed_at": diff.ReviewedAt}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	if approve && common.MemoryCacheEnabled {
+		InitChannelCache()
+	}
+	return &diff, nil
+}
+
+func GetModelDiscoveryDiffs(status string, channelId int, startIdx int, num int) (diffs []*ModelDiscoveryDiff, total int64, err error) {
+	tx := DB.Model(&ModelDiscoveryDiff{})
+	if status != "" {
+		tx = tx.Where("status = ?", status)
+	}
+	if channelId != 0 {
+		tx = tx.Where("channel_id = ?", channelId)
+	}
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&diffs).Error
+	return diffs, total, err
+}
@@ -1,6 +1,8 @@
 package model
 
 import (
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 	"time"
@@ -8,6 +10,7 @@ import (
 	"veloera/setting"
 	"veloera/setting/config"
 	"veloera/setting/operation_setting"
+	"veloera/setting/system_setting"
 )
 
 type Option struct {
@@ -139,7 +142,15 @@ func InitOptionMap() {
 func loadOptionsFromDatabase() {
 	options, _ := AllOption()
 	for _, option := range options {
-		err := updateOptionMap(option.Key, option.Value)
+		if isGeneratedSecretOption(option.Key) {
+			continue
+		}
+		value, err := decryptOptionValue(option.Key, option.Value)
+		if err != nil {
+			common.SysError(fmt.Sprintf("failed to decrypt option %s: %s", option.Key, err.Error()))
+			continue
+		}
+		err = updateOptionMap(option.Key, value)
 		if err != nil {
 			common.SysError("failed to update option map: " + err.Error())
 		}
@@ -155,13 +166,20 @@ func SyncOptions(frequency int) {
 }
 
 func UpdateOption(key string, value string) error {
+	if isGeneratedSecretOption(key) {
+		return errors.New(key + " 由系统生成，不能修改")
+	}
 	// Save to database first
 	option := Option{
 		Key: key,
 	}
 	// https://gorm.io/docs/update.html#Save-All-Fields
 	DB.FirstOrCreate(&option, Option{Key: key})
-	option.Value = value
+	storedValue, err := encryptOptionValue(key, value)
+	if err != nil {
+		return err
+	}
+	option.Value = storedValue
 	// Save is a combination function.
 	// If save value does not contain primary key, it will execute Create,
 	// otherwise it will execute Update (with all fields).
@@ -170,6 +188,57 @@ func UpdateOption(key string, value string) error {
 	return updateOptionMap(key, value)
 }
 
+// ValidateOption 检查选项的值能否保存，启用功能前要求已经填写相关配置。
+// pending 为同一批一起更新的选项，检查依赖的配置时优先使用其中的值
+func ValidateOption(key string, value string, pending map[string]string) error {
+	pendingOr := func(pendingKey string, current string) string {
+		if v, ok := pending[pendingKey]; ok {
+			return v
+		}
+		return current
+	}
+	if isGeneratedSecretOption(key) {
+		return errors.New(key + " 由系统生成，不能修改")
+	}
+	switch key {
+	case "GitHubOAuthEnabled":
+		if value == "true" && pendingOr("GitHubClientId", common.GitHubClientId) == "" {
+			return errors.New("无法启用 GitHub OAuth，请先填入 GitHub Client Id 以及 GitHub Client Secret！")
+		}
+	case "oidc.enabled":
+		if value == "true" && pendingOr("oidc.client_id", system_setting.GetOIDCSettings().ClientId) == "" {
+			return errors.New("无法启用 OIDC 登录，请先填入 OIDC Client Id 以及 OIDC Client Secret！")
+		}
+	case "LinuxDOOAuthEnabled":
+		if value == "true" && pendingOr("LinuxDOClientId", common.LinuxDOClientId) == "" {
+			return errors.New("无法启用 LinuxDO OAuth，请先填入 LinuxDO Client Id 以及 LinuxDO Client Secret！")
+		}
+	case "EmailDomainRestrictionEnabled":
+		whitelistEmpty := len(common.EmailDomainWhitelist) == 0
+		if whitelist, ok := pending["EmailDomainWhitelist"]; ok {
+			whitelistEmpty = whitelist == ""
+		}
+		if value == "true" && whitelistEmpty {
+			return errors.New("无法启用邮箱域名限制，请先填入限制的邮箱域名！")
+		}
+	case "WeChatAuthEnabled":
+		if value == "true" && pendingOr("WeChatServerAddress", common.WeChatServerAddress) == "" {
+			return errors.New("无法启用微信登录，请先填入微信登录相关配置信息！")
+		}
+	case "TurnstileCheckEnabled":
+		if value == "true" && pendingOr("TurnstileSiteKey", common.TurnstileSiteKey) == "" {
+			return errors.New("无法启用 Turnstile 校验，请先填入 Turnstile 校验相关配置信息！")
+		}
+	case "TelegramOAuthEnabled":
+		if value == "true" && pendingOr("TelegramBotToken", common.TelegramBotToken) == "" {
+			return errors.New("无法启用 Telegram OAuth，请先填入 Telegram Bot Token！")
+		}
+	case "GroupRatio":
+		return setting.CheckGroupRatio(value)
+	}
+	return nil
+}
+
 func updateOptionMap(key string, value string) (err error) {
 	common.OptionMapRWMutex.Lock()
 	defer common.OptionMapRWMutex.Unlock()
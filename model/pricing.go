@@ -4,6 +4,7 @@ import (
 	"sync"
 	"time"
 	"veloera/common"
+	"veloera/setting/model_setting"
 	"veloera/setting/operation_setting"
 )
 
@@ -59,20 +60,51 @@ func updatePricing() {
 		modelGroupsMap[ability.Model] = groups
 	}
 
+	// 虚拟模型和实验模型在链上任一模型可用的分组中可用，按链上第一个可用的模型展示价格
+	virtualModelPriceModel := make(map[string]string)
+	for name, chain := range model_setting.GetVirtualModelChains(common.GetTimestamp()) {
+		if _, ok := modelGroupsMap[name]; ok {
+			continue
+		}
+		groups := make([]string, 0)
+		for _, model := range chain {
+			modelGroups, ok := modelGroupsMap[model]
+			if !ok {
+				continue
+			}
+			if _, ok := virtualModelPriceModel[name]; !ok {
+				virtualModelPriceModel[name] = model
+			}
+			for _, group := range modelGroups {
+				if !common.StringsContains(groups, group) {
+					groups = append(groups, group)
+				}
+			}
+		}
+		if len(groups) > 0 {
+			modelGroupsMap[name] = groups
+		}
+	}
+
 	pricingMap = make([]Pricing, 0)
 	for model, groups := range modelGroupsMap {
 		pricing := Pricing{
 			ModelName:   model,
 			EnableGroup: groups,
 		}
-		modelPrice, findPrice := operation_setting.GetModelPrice(model, false)
+		priceModel := model
+		if name, ok := virtualModelPriceModel[model]; ok {
+			priceModel = name
+			pricing.OwnerBy = "virtual"
+		}
+		modelPrice, findPrice := operation_setting.GetModelPrice(priceModel, false)
 		if findPrice {
 			pricing.ModelPrice = modelPrice
 			pricing.QuotaType = 1
 		} else {
-			modelRatio, _ := operation_setting.GetModelRatio(model)
+			modelRatio, _ := operation_setting.GetModelRatio(priceModel)
 			pricing.ModelRatio = modelRatio
-			pricing.CompletionRatio = operation_setting.GetCompletionRatio(model)
+			pricing.CompletionRatio = operation_setting.GetCompletionRatio(priceModel)
 			pricing.QuotaType = 0
 		}
 		pricingMap = append(pricingMap, pricing)
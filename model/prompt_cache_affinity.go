@@ -0,0 +1,224 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"veloera/common"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const channelCacheStatsRedisTTL = 7 * 24 * time.Hour
+
+// PromptCacheAffinity 前缀相同的请求绑定的渠道和 key，单 key 渠道的 KeyHash 为空
+type PromptCacheAffinity struct {
+	ChannelId int
+	KeyHash   string
+	expiresAt time.Time
+}
+
+// ChannelCacheStats 渠道的提示词缓存命中统计，来自计费时上游返回的缓存 token 数
+type ChannelCacheStats struct {
+	Requests         int64   `json:"requests"`
+	CacheHitRequests int64   `json:"cache_hit_requests"`
+	AffinityRequests int64   `json:"affinity_requests"` // 按前缀绑定选择渠道的请求数
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CachedTokens     int64   `json:"cached_tokens"`
+	HitRate          float64 `json:"hit_rate"` // 缓存 token 占输入 token 的比例
+}
+
+var (
+	promptCacheAffinityLock      sync.Mutex
+	promptCacheAffinityMap       = make(map[string]*PromptCacheAffinity)
+	promptCacheAffinitySweptTime time.Time
+
+	channelCacheStatsLock sync.Mutex
+	channelCacheStatsMap  = make(map[int]*ChannelCacheStats)
+)
+
+func promptCacheAffinityRedisKey(hash string) string {
+	return "prompt_cache_affinity:" + hash
+}
+
+func channelCacheStatsRedisKey(channelId int) string {
+	return fmt.Sprintf("channel_cache_stats:%d", channelId)
+}
+
+// GetPromptCacheAffinity 获取前缀绑定的渠道和 key
+func GetPromptCacheAffinity(hash string) (PromptCacheAffinity, bool) {
+	if common.RedisEnabled {
+		value, err := common.RDB.Get(context.Background(), promptCacheAffinityRedisKey(hash)).Result()
+		if err != nil {
+			if err != redis.Nil {
+				common.SysError("failed to get prompt cache affinity: " + err.Error())
+			}
+			return PromptCacheAffinity{}, false
+		}
+		idStr, keyHash, _ := strings.Cut(value, ":")
+		channelId, err := strconv.Atoi(idStr)
+		if err != nil {
+			return PromptCacheAffinity{}, false
+		}
+		return PromptCacheAffinity{ChannelId: channelId, KeyHash: keyHash}, true
+	}
+	promptCacheAffinityLock.Lock()
+	defer promptCacheAffinityLock.Unlock()
+	affinity, ok := promptCacheAffinityMap[hash]
+	if !ok || time.Now().After(affinity.expiresAt) {
+		return PromptCacheAffinity{}, false
+	}
+	return *affinity, true
+}
+
+// SetPromptCacheAffinity 将前缀绑定到渠道和 key，每次成功请求后刷新有效期
+func SetPromptCacheAffinity(hash string, channelId int, keyHash string, ttl time.Duration) {
+	if common.RedisEnabled {
+		value := fmt.Sprintf("%d:%s", channelId, keyHash)
+		if err := common.RDB.Set(context.Background(), promptCacheAffinityRedisKey(hash), value, ttl).Err(); err != nil {
+			common.SysError("failed to set prompt cache affinity: " + err.Error())
+		}
+		return
+	}
+	now := time.Now()
+	promptCacheAffinityLock.Lock()
+	defer promptCacheAffinityLock.Unlock()
+	promptCacheAffinityMap[hash] = &PromptCacheAffinity{ChannelId: channelId, KeyHash: keyHash, expiresAt: now.Add(ttl)}
+	// 定期清理过期的绑定
+	if now.Sub(promptCacheAffinitySweptTime) > ttl {
+		for h, affinity := range promptCacheAffinityMap {
+			if now.After(affinity.expiresAt) {
+				delete(promptCacheAffinityMap, h)
+			}
+		}
+		promptCacheAffinitySweptTime = now
+	}
+}
+
+// channelServesModel 渠道是否在分组下提供该模型
+func channelServesModel(channelId int, group string, modelName string) bool {
+	if common.MemoryCacheEnabled {
+		channelSyncLock.RLock()
+		defer channelSyncLock.RUnlock()
+		for _, channel := range group2model2channels[group][modelName] {
+			if channel.Id == channelId {
+				return true
+			}
+		}
+		return false
+	}
+	trueVal := "1"
+	if common.UsingPostgreSQL {
+		trueVal = "true"
+	}
+	var count int64
+	err := DB.Model(&Ability{}).Where(groupCol+" = ? and model = ? and channel_id = ? and enabled = "+trueVal, group, modelName, channelId).Count(&count).Error
+	return err == nil && count > 0
+}
+
+// GetPromptCacheAffinityChannel 返回前缀绑定的渠道，渠道已禁用、熔断、被上游限流、并发已满或没有可用 key 时返回 false
+func GetPromptCacheAffinityChannel(group string, modelName string, channelId int) (*Channel, bool) {
+	if strings.HasPrefix(modelName, "gpt-4-gizmo") {
+		modelName = "gpt-4-gizmo-*"
+	}
+	if strings.HasPrefix(modelName, "gpt-4o-gizmo") {
+		modelName = "gpt-4o-gizmo-*"
+	}
+	channel, err := CacheGetChannel(channelId)
+	if err != nil || channel.Status != common.ChannelStatusEnabled {
+		return nil, false
+	}
+	if !channelServesModel(channelId, group, modelName) {
+		return nil, false
+	}
+	if !IsChannelCircuitAvailable(channelId, modelName) || IsChannelSaturated(channel) {
+		return nil, false
+	}
+	if limited, _ := channelRateLimitState(channel); limited {
+		return nil, false
+	}
+	if len(channel.GetKeys()) > 1 && !ChannelHasAvailableKey(channel) {
+		return nil, false
+	}
+	return channel, true
+}
+
+// RecordChannelCacheUsage 记录渠道一次请求的输入 token 数和命中缓存的 token 数
+func RecordChannelCacheUsage(channelId int, promptTokens int, cachedTokens int, affinity bool) {
+	var cacheHit, affinityRequest int64
+	if cachedTokens > 0 {
+		cacheHit = 1
+	}
+	if affinity {
+		affinityRequest = 1
+	}
+	if common.RedisEnabled {
+		key := channelCacheStatsRedisKey(channelId)
+		ctx := context.Background()
+		pipe := common.RDB.TxPipeline()
+		pipe.HIncrBy(ctx, key, "requests", 1)
+		pipe.HIncrBy(ctx, key, "cache_hit_requests", cacheHit)
+		pipe.HIncrBy(ctx, key, "affinity_requests", affinityRequest)
+		pipe.HIncrBy(ctx, key, "prompt_tokens", int64(promptTokens))
+		pipe.HIncrBy(ctx, key, "cached_tokens", int64(cachedTokens))
+		pipe.Expire(ctx, key, channelCacheStatsRedisTTL)
+		if _, err := pipe.Exec(ctx); err != nil {
+			common.SysError("failed to update channel cache stats: " + err.Error())
+		}
+		return
+	}
+	channelCacheStatsLock.Lock()
+	defer channelCacheStatsLock.Unlock()
+	stats, ok := channelCacheStatsMap[channelId]
+	if !ok {
+		stats = &ChannelCacheStats{}
+		channelCacheStatsMap[channelId] = stats
+	}
+	stats.Requests++
+	stats.CacheHitRequests += cacheHit
+	stats.AffinityRequests += affinityRequest
+	stats.PromptTokens += int64(promptTokens)
+	stats.CachedTokens += int64(cachedTokens)
+}
+
+// GetChannelCacheStats 获取渠道的提示词缓存命中统计
+func GetChannelCacheStats(channelId int) ChannelCacheStats {
+	var stats ChannelCacheStats
+	if common.RedisEnabled {
+		values, err := common.RDB.HGetAll(context.Background(), channelCacheStatsRedisKey(channelId)).Result()
+		if err != nil {
+			common.SysError("failed to get channel cache stats: " + err.Error())
+		}
+		stats.Requests, _ = strconv.ParseInt(values["requests"], 10, 64)
+		stats.CacheHitRequests, _ = strconv.ParseInt(values["cache_hit_requests"], 10, 64)
+		stats.AffinityRequests, _ = strconv.ParseInt(values["affinity_requests"], 10, 64)
+		stats.PromptTokens, _ = strconv.ParseInt(values["prompt_tokens"], 10, 64)
+		stats.CachedTokens, _ = strconv.ParseInt(values["cached_tokens"], 10, 64)
+	} else {
+		channelCacheStatsLock.Lock()
+		if s, ok := channelCacheStatsMap[channelId]; ok {
+			stats = *s
+		}
+		channelCacheStatsLock.Unlock()
+	}
+	if stats.PromptTokens > 0 {
+		stats.HitRate = float64(stats.CachedTokens) / float64(stats.PromptTokens)
+	}
+	return stats
+}
+
+// ResetChannelCacheStats 清空渠道的提示词缓存命中统计
+func ResetChannelCacheStats(channelId int) {
+	if common.RedisEnabled {
+		if err := common.RDB.Del(context.Background(), channelCacheStatsRedisKey(channelId)).Err(); err != nil {
+			common.SysError("failed to reset channel cache stats: " + err.Error())
+		}
+		return
+	}
+	channelCacheStatsLock.Lock()
+	delete(channelCacheStatsMap, channelId)
+	channelCacheStatsLock.Unlock()
+}
@@ -0,0 +1,336 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"veloera/common"
+	"veloera/constant"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/schema"
+)
+
+func init() {
+	schema.RegisterSerializer("encrypted", EncryptedSerializer{})
+}
+
+// EncryptedSerializer 字符串字段写入数据库前使用主密钥加密，读取时解密，兼容未加密的旧数据
+type EncryptedSerializer struct{}
+
+func (EncryptedSerializer) Scan(ctx context.Context, field *schema.Field, dst reflect.Value, dbValue interface{}) error {
+	var value string
+	switch v := dbValue.(type) {
+	case nil:
+	case string:
+		value = v
+	case []byte:
+		value = string(v)
+	default:
+		return fmt.Errorf("failed to decrypt %s: unsupported value %T", field.Name, dbValue)
+	}
+	plaintext, err := common.DecryptSecret(value)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %s", field.Name, err.Error())
+	}
+	field.ReflectValueOf(ctx, dst).SetString(plaintext)
+	return nil
+}
+
+func (EncryptedSerializer) Value(ctx context.Context, field *schema.Field, dst reflect.Value, fieldValue interface{}) (interface{}, error) {
+	plaintext, _ := fieldValue.(string)
+	return common.EncryptSecret(plaintext)
+}
+
+// HashChannelKey 渠道 key 的 HMAC-SHA256，用于按 key 搜索以及持久化与某个 key 相关的状态。
+// 密钥保存在数据库中并由主密钥加密，只有哈希泄露时无法离线穷举较短的 key；不依赖 CryptoSecret，重启和多节点之间保持一致
+func HashChannelKey(key string) string {
+	return common.GenerateHMACWithKey(channelKeyHashSecret, key)
+}
+
+func (channel *Channel) syncKeyHash() {
+	if channel.Key != "" {
+		channel.KeyHash = HashChannelKey(channel.Key)
+	}
+}
+
+// secretOptions 加密保存且不对外导出的选项，新增密钥类选项时需要加入这里
+var secretOptions = map[string]bool{
+	"SMTPToken":                true,
+	"WorkerValidKey":           true,
+	"EpayKey":                  true,
+	"GitHubClientSecret":       true,
+	"LinuxDOClientSecret":      true,
+	"WeChatServerToken":        true,
+	"TelegramBotToken":         true,
+	"TurnstileSecretKey":       true,
+	"oidc.client_secret":       true,
+	tokenHashSecretOption:      true,
+	channelKeyHashSecretOption: true,
+}
+
+// IsSecretOption 选项是否为密钥，密钥类选项加密保存且不对外导出
+func IsSecretOption(key string) bool {
+	return secretOptions[key]
+}
+
+func encryptOptionValue(key string, value string) (string, error) {
+	if !IsSecretOption(key) {
+		return value, nil
+	}
+	return common.EncryptSecret(value)
+}
+
+// decryptOptionValue 非密钥类选项同样识别密文，兼容按旧规则加密保存的选项
+func decryptOptionValue(key string, value string) (string, error) {
+	return common.DecryptSecret(value)
+}
+
+// reencryptSecret 解密后按当前主密钥重新加密，未配置主密钥时还原为明文
+func reencryptSecret(value string) (string, error) {
+	plaintext, err := common.DecryptSecret(value)
+	if err != nil {
+		return "", err
+	}
+	return common.EncryptSecret(plaintext)
+}
+
+// errSecretsEncrypted 未配置主密钥时数据库中仍有密文，通常是漏配了 ENCRYPTION_MASTER_KEY，不能自动还原为明文
+var errSecretsEncrypted = errors.New("stored secrets are encrypted but ENCRYPTION_MASTER_KEY is not set, set it or run with --decrypt-secrets to store them as plaintext")
+
+// checkSecretDecrypt 未配置主密钥时，只有指定了 decrypt 才允许把密文还原为明文
+func checkSecretDecrypt(value string, decrypt bool) error {
+	if !decrypt && !common.SecretEncryptionEnabled() && common.IsEncryptedSecret(value) {
+		return errSecretsEncrypted
+	}
+	return nil
+}
+
+// MigrateSecrets 把渠道 key、密钥类选项和用户的 webhook 密钥改为当前主密钥加密：
+// 加密未加密的旧数据，轮换主密钥后重新加密旧主密钥加密的数据；未配置主密钥时，decrypt 为 true 才还原为明文，
+// 否则数据库中有密文时返回错误。返回处理的记录数
+func MigrateSecrets(decrypt bool) (int, error) {
+	count := 0
+
+	var channels []struct {
+		Id       int
+		KeyValue string
+		KeyHash  string
+	}
+	err := DB.Table("channels").Select("id, " + keyCol + " as key_value, key_hash").Find(&channels).Error
+	if err != nil {
+		return count, err
+	}
+	for _, channel := range channels {
+		if common.IsSecretUpToDate(channel.KeyValue) && channel.KeyHash != "" {
+			continue
+		}
+		if err := checkSecretDecrypt(channel.KeyValue, decrypt); err != nil {
+			return count, err
+		}
+		plaintext, err := common.DecryptSecret(channel.KeyValue)
+		if err != nil {
+			return count, fmt.Errorf("channel #%d: %s", channel.Id, err.Error())
+		}
+		stored, err := common.EncryptSecret(plaintext)
+		if err != nil {
+			return count, err
+		}
+		err = DB.Table("channels").Where("id = ?", channel.Id).Updates(map[string]any{
+			"key":      stored,
+			"key_hash": HashChannelKey(plaintext),
+		}).Error
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	options, err := AllOption()
+	if err != nil {
+		return count, err
+	}
+	for _, option := range options {
+		if IsSecretOption(option.Key) {
+			if common.IsSecretUpToDate(option.Value) {
+				continue
+			}
+			if err := checkSecretDecrypt(option.Value, decrypt); err != nil {
+				return count, err
+			}
+			option.Value, err = reencryptSecret(option.Value)
+		} else {
+			// 不在密钥列表中的选项保存为明文
+			if !common.IsEncryptedSecret(option.Value) {
+				continue
+			}
+			option.Value, err = common.DecryptSecret(option.Value)
+		}
+		if err != nil {
+			return count, fmt.Errorf("option %s: %s", option.Key, err.Error())
+		}
+		if err := DB.Save(option).Error; err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	var users []*User
+	err = DB.Select("id, setting").Where("setting LIKE ?", "%"+constant.UserSettingWebhookSecret+"%").Find(&users).Error
+	if err != nil {
+		return count, err
+	}
+	for _, user := range users {
+		setting := user.GetSetting()
+		secret, ok := setting[constant.UserSettingWebhookSecret].(string)
+		if !ok || common.IsSecretUpToDate(secret) {
+			continue
+		}
+		if err := checkSecretDecrypt(secret, decrypt); err != nil {
+			return count, err
+		}
+		setting[constant.UserSettingWebhookSecret], err = reencryptSecret(secret)
+		if err != nil {
+			return count, fmt.Errorf("webhook secret of user #%d: %s", user.Id, err.Error())
+		}
+		user.SetSetting(setting)
+		if err := DB.Model(&User{}).Where("id = ?", user.Id).Update("setting", user.Setting).Error; err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// 自动生成的哈希密钥保存在选项中，与其他密钥一样由主密钥加密，不加载到 OptionMap，也不允许通过接口修改
+const (
+	tokenHashSecretOption      = "TokenHashSecret"
+	channelKeyHashSecretOption = "ChannelKeyHashSecret"
+)
+
+// channelKeyHashSecret HashChannelKey 使用的 HMAC 密钥，启动时从数据库读取，没有则由主节点随机生成
+var channelKeyHashSecret []byte
+
+func isGeneratedSecretOption(key string) bool {
+	return key == tokenHashSecretOption || key == channelKeyHashSecretOption
+}
+
+// initTokenHashSecret 确定令牌哈希密钥：优先使用 TOKEN_HASH_SECRET，其次使用数据库中保存的密钥，
+// 主节点在两者都没有时随机生成一个并保存，保证重启和多节点之间一致
+func initTokenHashSecret() error {
+	if common.TokenHashSecret != "" {
+		return nil
+	}
+	secret, _, err := initGeneratedSecret(tokenHashSecretOption)
+	if err != nil {
+		return err
+	}
+	common.TokenHashSecret = secret
+	if !common.SecretEncryptionEnabled() {
+		common.SysError("未设置 TOKEN_HASH_SECRET，令牌哈希密钥以明文保存在数据库中，建议设置 TOKEN_HASH_SECRET 或 ENCRYPTION_MASTER_KEY")
+	} else {
+		common.SysLog("未设置 TOKEN_HASH_SECRET，使用数据库中保存的令牌哈希密钥")
+	}
+	return nil
+}
+
+// initChannelKeyHashSecret 读取或生成渠道 key 的哈希密钥。首次生成时把旧版本按 SHA-256 保存的 key 哈希改为新的 HMAC
+func initChannelKeyHashSecret() error {
+	secret, created, err := initGeneratedSecret(channelKeyHashSecretOption)
+	if err != nil {
+		return err
+	}
+	channelKeyHashSecret = []byte(secret)
+	if created {
+		return rehashChannelKeys()
+	}
+	return nil
+}
+
+// initGeneratedSecret 读取数据库中保存的密钥，主节点在没有时随机生成并保存，created 表示本次新生成
+func initGeneratedSecret(option string) (secret string, created bool, err error) {
+	secret, found, err := loadGeneratedSecret(option)
+	if err != nil || found {
+		return secret, false, err
+	}
+	if !common.IsMasterNode {
+		return "", false, fmt.Errorf("数据库中没有 %s，请先启动主节点", option)
+	}
+	secret, err = common.GenerateRandomCharsKey(64)
+	if err != nil {
+		return "", false, err
+	}
+	value, err := encryptOptionValue(option, secret)
+	if err != nil {
+		return "", false, err
+	}
+	if err := DB.Create(&Option{Key: option, Value: value}).Error; err != nil {
+		// 其他主节点可能同时完成了生成，以数据库中的为准
+		stored, found, loadErr := loadGeneratedSecret(option)
+		if loadErr != nil || !found {
+			return "", false, err
+		}
+		return stored, false, nil
+	}
+	return secret, true, nil
+}
+
+func loadGeneratedSecret(option string) (string, bool, error) {
+	var options []Option
+	if err := DB.Where(keyCol+" = ?", option).Limit(1).Find(&options).Error; err != nil {
+		return "", false, err
+	}
+	if len(options) == 0 || options[0].Value == "" {
+		return "", false, nil
+	}
+	secret, err := decryptOptionValue(option, options[0].Value)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to decrypt %s: %s", option, err.Error())
+	}
+	return secret, true, nil
+}
+
+// rehashChannelKeys 把渠道以及与 key 相关的状态中旧的 SHA-256 key 哈希替换为 HashChannelKey
+func rehashChannelKeys() error {
+	var channels []struct {
+		Id       int
+		Type     int
+		KeyValue string
+	}
+	if err := DB.Table("channels").Select("id, type, " + keyCol + " as key_value").Find(&channels).Error; err != nil {
+		return err
+	}
+	keyHashTables := []string{"channel_keys", "fine_tuning_jobs", "upstream_files", "stored_responses"}
+	for _, row := range channels {
+		plaintext, err := common.DecryptSecret(row.KeyValue)
+		if err != nil {
+			common.SysError(fmt.Sprintf("failed to rehash keys of channel #%d: %s", row.Id, err.Error()))
+			continue
+		}
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Table("channels").Where("id = ?", row.Id).Update("key_hash", HashChannelKey(plaintext)).Error; err != nil {
+				return err
+			}
+			channel := Channel{Type: row.Type, Key: plaintext}
+			for _, key := range channel.GetKeys() {
+				sum := sha256.Sum256([]byte(key))
+				oldHash := hex.EncodeToString(sum[:])
+				for _, table := range keyHashTables {
+					err := tx.Table(table).Where("channel_id = ? AND key_hash = ?", row.Id, oldHash).
+						Update("key_hash", HashChannelKey(key)).Error
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package model
+
+import (
+	"veloera/common"
+
+	"gorm.io/gorm"
+)
+
+// ShadowComparison 一次影子请求与原请求的对比结果，影子请求不向用户计费
+type ShadowComparison struct {
+	Id                      int      `json:"id"`
+	CreatedAt               int64    `json:"created_at" gorm:"bigint;index"`
+	RequestId               string   `json:"request_id" gorm:"type:varchar(64)"`
+	RuleName                string   `json:"rule_name" gorm:"type:varchar(64);index"`
+	UserId                  int      `json:"user_id"`
+	Group                   string   `json:"group" gorm:"type:varchar(64)"`
+	ModelName               string   `json:"model_name"`
+	IsStream                bool     `json:"is_stream"`
+	PrimaryChannelId        int      `json:"primary_channel_id"`
+	PrimaryLatency          int64    `json:"primary_latency"` // 毫秒
+	PrimaryPromptTokens     int      `json:"primary_prompt_tokens"`
+	PrimaryCompletionTokens int      `json:"primary_completion_tokens"`
+	PrimaryError            bool     `json:"primary_error"`
+	ShadowChannelId         int      `json:"shadow_channel_id" gorm:"index"`
+	ShadowModel             string   `json:"shadow_model"`
+	ShadowLatency           int64    `json:"shadow_latency"` // 毫秒
+	ShadowPromptTokens      int      `json:"shadow_prompt_tokens"`
+	ShadowCompletionTokens  int      `json:"shadow_completion_tokens"`
+	ShadowError             bool     `json:"shadow_error"`
+	ShadowErrorMessage      string   `json:"shadow_error_message"`
+	Similarity              *float64 `json:"similarity"` // 规则未开启比较或任一方失败时为空
+}
+
+// ShadowComparisonStat 影子请求按规则、影子渠道和模型汇总的对比结果
+type ShadowComparisonStat struct {
+	RuleName                   string   `json:"rule_name"`
+	ShadowChannelId            int      `json:"shadow_channel_id"`
+	ShadowModel                string   `json:"shadow_model"`
+	Count                      int      `json:"count"`
+	PrimaryErrors              int      `json:"primary_errors"`
+	ShadowErrors               int      `json:"shadow_errors"`
+	PrimaryErrorRate           float64  `json:"primary_error_rate" gorm:"-"`
+	ShadowErrorRate            float64  `json:"shadow_error_rate" gorm:"-"`
+	AvgPrimaryLatency          float64  `json:"avg_primary_latency"`
+	AvgShadowLatency           float64  `json:"avg_shadow_latency"`
+	AvgPrimaryPromptTokens     float64  `json:"avg_primary_prompt_tokens"`
+	AvgPrimaryCompletionTokens float64  `json:"avg_primary_completion_tokens"`
+	AvgShadowPromptTokens      float64  `json:"avg_shadow_prompt_tokens"`
+	AvgShadowCompletionTokens  float64  `json:"avg_shadow_completion_tokens"`
+	AvgSimilarity              *float64 `json:"avg_similarity"`
+}
+
+func RecordShadowComparison(comparison *ShadowComparison) {
+	comparison.CreatedAt = common.GetTimestamp()
+	if err := LOG_DB.Create(comparison).Error; err != nil {
+		common.SysError("failed to record shadow comparison: " + err.Error())
+	}
+}
+
+func shadowComparisonQuery(startTimestamp int64, endTimestamp int64, ruleName string, channelId int) *gorm.DB {
+	tx := LOG_DB.Model(&ShadowComparison{})
+	if startTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", startTimestamp)
+	}
+	if endTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", endTimestamp)
+	}
+	if ruleName != "" {
+		tx = tx.Where("rule_name = ?", ruleName)
+	}
+	if channelId != 0 {
+		tx = tx.Where("shadow_channel_id = ?", channelId)
+	}
+	return tx
+}
+
+func GetShadowComparisons(startTimestamp int64, endTimestamp int64, ruleName string, channelId int, startIdx int, num int) (comparisons []*ShadowComparison, total int64, err error) {
+	tx := shadowComparisonQuery(startTimestamp, endTimestamp, ruleName, channelId)
+	if err = tx.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	err = tx.Order("id desc").Limit(num).Offset(startIdx).Find(&comparisons).Error
+	return comparisons, total, err
+}
+
+// GetShadowComparisonStats 按规则、影子渠道和模型汇总影子请求的延迟、用量、错误率和相似度
+func GetShadowComparisonStats(startTimestamp int64, endTimestamp int64, ruleName string, channelId int) (stats []*ShadowComparisonStat, err error) {
+	err = shadowComparisonQuery(startTimestamp, endTimestamp, ruleName, channelId).
+		Select("rule_name, shadow_channel_id, shadow_model, count(*) as count, " +
+			"sum(case when primary_error then 1 else 0 end) as primary_errors, " +
+			"sum(case when shadow_error then 1 else 0 end) as shadow_errors, " +
+			"avg(primary_latency) as avg_primary_latency, avg(shadow_latency) as avg_shadow_latency, " +
+			"avg(primary_prompt_tokens) as avg_primary_prompt_tokens, avg(primary_completion_tokens) as avg_primary_completion_tokens, " +
+			"avg(shadow_prompt_tokens) as avg_shadow_prompt_tokens, avg(shadow_completion_tokens) as avg_shadow_completion_tokens, " +
+			"avg(similarity) as avg_similarity").
+		Group("rule_name, shadow_channel_id, shadow_model").Order("rule_name").Scan(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+	for _, stat := range stats {
+		if stat.Count > 0 {
+			stat.PrimaryErrorRate = float64(stat.PrimaryErrors) / float64(stat.Count)
+			stat.ShadowErrorRate = float64(stat.ShadowErrors) / float64(stat.Count)
+		}
+	}
+	return stats, nil
+}
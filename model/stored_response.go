@@ -0,0 +1,153 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+	"veloera/common"
+	"veloera/setting/operation_setting"
+
+	"gorm.io/gorm"
+)
+
+const storedResponseCacheSeconds = 3600
+
+// StoredResponse 保存 /v1/responses 的请求输入和响应，用于 previous_response_id 续接对话以及 GET/DELETE /v1/responses/{id}
+type StoredResponse struct {
+	Id                 int             `json:"id"`
+	ResponseId         string          `json:"response_id" gorm:"type:varchar(128);uniqueIndex"`
+	UserId             int             `json:"user_id" gorm:"index"`
+	TokenId            int             `json:"token_id" gorm:"index"`
+	ChannelId          int             `json:"channel_id"`
+	KeyHash            string          `json:"key_hash" gorm:"type:varchar(64)"` // 上游 key 的 HashChannelKey，上游状态只在同一个 key 下可用
+	Upstream           bool            `json:"upstream"`                         // 上游同样保存了该响应
+	PreviousResponseId string          `json:"previous_response_id" gorm:"type:varchar(128)"`
+	Model              string          `json:"model" gorm:"type:varchar(255)"`
+	Input              json.RawMessage `json:"input" gorm:"type:json"`    // 本次请求的 input items
+	Response           json.RawMessage `json:"response" gorm:"type:json"` // 完整的 response 对象
+	CreatedAt          int64           `json:"created_at" gorm:"bigint;index"`
+}
+
+func (r *StoredResponse) Insert() error {
+	if r.CreatedAt == 0 {
+		r.CreatedAt = common.GetTimestamp()
+	}
+	err := DB.Create(r).Error
+	if err != nil {
+		return err
+	}
+	if common.RedisEnabled {
+		if err := cacheSetStoredResponse(r); err != nil {
+			common.SysError("failed to cache stored response: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// canAccess 按令牌隔离时只有创建响应的令牌可以访问，tokenId 为 0 表示不是令牌发起的请求
+func (r *StoredResponse) canAccess(userId int, tokenId int) bool {
+	if r.UserId != userId {
+		return false
+	}
+	return !operation_setting.GetResponsesSetting().TokenScoped || tokenId == 0 || r.TokenId == tokenId
+}
+
+// GetStoredResponse 获取用户保存的响应，不存在或不属于该令牌时返回 gorm.ErrRecordNotFound
+func GetStoredResponse(userId int, tokenId int, responseId string) (*StoredResponse, error) {
+	if responseId == "" {
+		return nil, gorm.ErrRecordNotFound
+	}
+	// 已过期但尚未清理的响应视为不存在
+	var expiredBefore int64
+	if retentionDays := operation_setting.GetResponsesSetting().RetentionDays; retentionDays > 0 {
+		expiredBefore = time.Now().AddDate(0, 0, -retentionDays).Unix()
+	}
+	if common.RedisEnabled {
+		if r, err := cacheGetStoredResponse(responseId); err == nil {
+			if !r.canAccess(userId, tokenId) || r.CreatedAt < expiredBefore {
+				return nil, gorm.ErrRecordNotFound
+			}
+			return r, nil
+		}
+	}
+	var r StoredResponse
+	err := DB.Where("response_id = ? AND user_id = ? AND created_at >= ?", responseId, userId, expiredBefore).First(&r).Error
+	if err != nil {
+		return nil, err
+	}
+	if common.RedisEnabled {
+		if err := cacheSetStoredResponse(&r); err != nil {
+			common.SysError("failed to cache stored response: " + err.Error())
+		}
+	}
+	if !r.canAccess(userId, tokenId) {
+		return nil, gorm.ErrRecordNotFound
+	}
+	return &r, nil
+}
+
+// DeleteStoredResponse 删除用户保存的响应，不存在或不属于该令牌时返回 gorm.ErrRecordNotFound
+func DeleteStoredResponse(userId int, tokenId int, responseId string) error {
+	tx := DB.Where("response_id = ? AND user_id = ?", responseId, userId)
+	if operation_setting.GetResponsesSetting().TokenScoped && tokenId != 0 {
+		tx = tx.Where("token_id = ?", tokenId)
+	}
+	result := tx.Delete(&StoredResponse{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if common.RedisEnabled {
+		_ = common.RedisDel(fmt.Sprintf("response:%s", responseId))
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// DeleteStoredResponsesBefore 删除 timestamp 之前保存的响应，缓存会自行过期
+func DeleteStoredResponsesBefore(timestamp int64) (int64, error) {
+	result := DB.Where("created_at < ?", timestamp).Delete(&StoredResponse{})
+	return result.RowsAffected, result.Error
+}
+
+// CleanupStoredResponses 定期删除超过保存天数的响应
+func CleanupStoredResponses() {
+	defer func() {
+		if r := recover(); r != nil {
+			common.SysLog(fmt.Sprintf("CleanupStoredResponses panic: %s", r))
+		}
+	}()
+	for {
+		retentionDays := operation_setting.GetResponsesSetting().RetentionDays
+		if retentionDays > 0 {
+			deleted, err := DeleteStoredResponsesBefore(time.Now().AddDate(0, 0, -retentionDays).Unix())
+			if err != nil {
+				common.SysError("failed to cleanup stored responses: " + err.Error())
+			} else if deleted > 0 {
+				common.SysLog(fmt.Sprintf("deleted %d expired stored responses", deleted))
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func cacheSetStoredResponse(r *StoredResponse) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return common.RedisSet(fmt.Sprintf("response:%s", r.ResponseId), string(data), time.Duration(storedResponseCacheSeconds)*time.Second)
+}
+
+func cacheGetStoredResponse(responseId string) (*StoredResponse, error) {
+	data, err := common.RedisGet(fmt.Sprintf("response:%s", responseId))
+	if err != nil {
+		return nil, err
+	}
+	var r StoredResponse
+	if err := json.Unmarshal([]byte(data), &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
@@ -13,7 +13,9 @@ import (
 type Token struct {
 	Id                 int            `json:"id"`
 	UserId             int            `json:"user_id" gorm:"index"`
-	Key                string         `json:"key" gorm:"type:char(48);uniqueIndex"`
+	Key                string         `json:"key,omitempty" gorm:"-"`             // 明文只在创建时返回一次，不保存到数据库
+	KeyHash            string         `json:"-" gorm:"type:char(64);uniqueIndex"` // 令牌的 HMAC-SHA256
+	KeyPrefix          string         `json:"key_prefix" gorm:"type:varchar(16)"` // 令牌的前几位，用于识别令牌
 	Status             int            `json:"status" gorm:"default:1"`
 	Name               string         `json:"name" gorm:"index" `
 	CreatedTime        int64          `json:"created_time" gorm:"bigint"`
@@ -26,13 +28,34 @@ type Token struct {
 	AllowIps           *string        `json:"allow_ips" gorm:"default:''"`
 	UsedQuota          int            `json:"used_quota" gorm:"default:0"` // used quota
 	Group              string         `json:"group" gorm:"default:''"`
+	HedgingEnabled     bool           `json:"hedging_enabled" gorm:"default:false"` // 首字过慢时在另一个渠道上发起对冲请求
 	DeletedAt          gorm.DeletedAt `gorm:"index"`
 }
 
+// tokenKeyPrefixLength 保存到数据库的令牌前缀长度
+const tokenKeyPrefixLength = 8
+
+// HashTokenKey 计算令牌的 HMAC-SHA256，数据库和缓存都以它查找令牌
+func HashTokenKey(key string) string {
+	return common.GenerateHMACWithKey([]byte(common.TokenHashSecret), key)
+}
+
+func tokenKeyPrefix(key string) string {
+	if len(key) > tokenKeyPrefixLength {
+		return key[:tokenKeyPrefixLength]
+	}
+	return key
+}
+
 func (token *Token) Clean() {
 	token.Key = ""
 }
 
+// MaskedKey 返回只包含前缀的令牌，用于日志和错误信息
+func (token *Token) MaskedKey() string {
+	return "sk-" + token.KeyPrefix + "***"
+}
+
 func (token *Token) GetIpLimitsMap() map[string]any {
 	// delete empty spaces
 	//split with \n
@@ -63,10 +86,15 @@ func GetAllUserTokens(userId int, startIdx int, num int) ([]*Token, error) {
 }
 
 func SearchUserTokens(userId int, keyword string, token string) (tokens []*Token, err error) {
-	if token != "" {
-		token = strings.Trim(token, "sk-")
+	tx := DB.Where("user_id = ?", userId).Where("name LIKE ?", "%"+keyword+"%")
+	// 数据库只保存令牌的前缀，完整的令牌按哈希查找
+	token = strings.TrimPrefix(token, "sk-")
+	if len(token) > tokenKeyPrefixLength {
+		tx = tx.Where("key_hash = ?", HashTokenKey(token))
+	} else if token != "" {
+		tx = tx.Where("key_prefix LIKE ?", token+"%")
 	}
-	err = DB.Where("user_id = ?", userId).Where("name LIKE ?", "%"+keyword+"%").Where(keyCol+" LIKE ?", "%"+token+"%").Find(&tokens).Error
+	err = tx.Find(&tokens).Error
 	return tokens, err
 }
 
@@ -74,12 +102,15 @@ func ValidateUserToken(key string) (token *Token, err error) {
 	if key == "" {
 		return nil, errors.New("未提供令牌")
 	}
-	token, err = GetTokenByKey(key, false)
+	return ValidateUserTokenHash(HashTokenKey(key))
+}
+
+// ValidateUserTokenHash 按令牌哈希校验令牌，用于批处理等没有令牌明文的内部请求
+func ValidateUserTokenHash(keyHash string) (token *Token, err error) {
+	token, err = GetTokenByKeyHash(keyHash, false)
 	if err == nil {
 		if token.Status == common.TokenStatusExhausted {
-			keyPrefix := key[:3]
-			keySuffix := key[len(key)-3:]
-			return token, errors.New("该令牌额度已用尽 TokenStatusExhausted[sk-" + keyPrefix + "***" + keySuffix + "]")
+			return token, errors.New("该令牌额度已用尽 TokenStatusExhausted[" + token.MaskedKey() + "]")
 		} else if token.Status == common.TokenStatusExpired {
 			return token, errors.New("该令牌已过期")
 		}
@@ -105,9 +136,7 @@ func ValidateUserToken(key string) (token *Token, err error) {
 					common.SysError("failed to update token status" + err.Error())
 				}
 			}
-			keyPrefix := key[:3]
-			keySuffix := key[len(key)-3:]
-			return token, errors.New(fmt.Sprintf("[sk-%s***%s] 该令牌额度已用尽 !token.UnlimitedQuota && token.RemainQuota = %d", keyPrefix, keySuffix, token.RemainQuota))
+			return token, errors.New(fmt.Sprintf("[%s] 该令牌额度已用尽 !token.UnlimitedQuota && token.RemainQuota = %d", token.MaskedKey(), token.RemainQuota))
 		}
 		return token, nil
 	}
@@ -142,6 +171,10 @@ func GetTokenById(id int) (*Token, error) {
 }
 
 func GetTokenByKey(key string, fromDB bool) (token *Token, err error) {
+	return GetTokenByKeyHash(HashTokenKey(key), fromDB)
+}
+
+func GetTokenByKeyHash(keyHash string, fromDB bool) (token *Token, err error) {
 	defer func() {
 		// Update Redis cache asynchronously on successful DB read
 		if shouldUpdateRedis(fromDB, err) && token != nil {
@@ -154,18 +187,23 @@ func GetTokenByKey(key string, fromDB bool) (token *Token, err error) {
 	}()
 	if !fromDB && common.RedisEnabled {
 		// Try Redis first
-		token, err := cacheGetTokenByKey(key)
+		token, err := cacheGetTokenByKeyHash(keyHash)
 		if err == nil {
 			return token, nil
 		}
 		// Don't return error - fall through to DB
 	}
 	fromDB = true
-	err = DB.Where(keyCol+" = ?", key).First(&token).Error
+	err = DB.Where("key_hash = ?", keyHash).First(&token).Error
 	return token, err
 }
 
 func (token *Token) Insert() error {
+	if token.Key == "" {
+		return errors.New("令牌为空")
+	}
+	token.KeyHash = HashTokenKey(token.Key)
+	token.KeyPrefix = tokenKeyPrefix(token.Key)
 	var err error
 	err = DB.Create(token).Error
 	return err
@@ -184,7 +222,7 @@ func (token *Token) Update() (err error) {
 		}
 	}()
 	err = DB.Model(token).Select("name", "status", "expired_time", "remain_quota", "unlimited_quota",
-		"model_limits_enabled", "model_limits", "allow_ips", "group").Updates(token).Error
+		"model_limits_enabled", "model_limits", "allow_ips", "group", "hedging_enabled").Updates(token).Error
 	return err
 }
 
@@ -207,7 +245,7 @@ func (token *Token) Delete() (err error) {
 	defer func() {
 		if shouldUpdateRedis(true, err) {
 			gopool.Go(func() {
-				err := cacheDeleteToken(token.Key)
+				err := cacheDeleteToken(token.KeyHash)
 				if err != nil {
 					common.SysError("failed to delete token cache: " + err.Error())
 				}
@@ -261,13 +299,13 @@ func DeleteTokenById(id int, userId int) (err error) {
 	return token.Delete()
 }
 
-func IncreaseTokenQuota(id int, key string, quota int) (err error) {
+func IncreaseTokenQuota(id int, keyHash string, quota int) (err error) {
 	if quota < 0 {
 		return errors.New("quota 不能为负数！")
 	}
 	if common.RedisEnabled {
 		gopool.Go(func() {
-			err := cacheIncrTokenQuota(key, int64(quota))
+			err := cacheIncrTokenQuota(keyHash, int64(quota))
 			if err != nil {
 				common.SysError("failed to increase token quota: " + err.Error())
 			}
@@ -291,13 +329,13 @@ func increaseTokenQuota(id int, quota int) (err error) {
 	return err
 }
 
-func DecreaseTokenQuota(id int, key string, quota int) (err error) {
+func DecreaseTokenQuota(id int, keyHash string, quota int) (err error) {
 	if quota < 0 {
 		return errors.New("quota 不能为负数！")
 	}
 	if common.RedisEnabled {
 		gopool.Go(func() {
-			err := cacheDecrTokenQuota(key, int64(quota))
+			err := cacheDecrTokenQuota(keyHash, int64(quota))
 			if err != nil {
 				common.SysError("failed to decrease token quota: " + err.Error())
 			}
@@ -320,3 +358,58 @@ func decreaseTokenQuota(id int, quota int) (err error) {
 	).Error
 	return err
 }
+
+// migrateTokenKeys 把旧版本以明文保存在 key 列的令牌改为保存哈希和前缀，并清空明文
+func migrateTokenKeys() error {
+	// sqlite 的 HasColumn 会把 key_hash 等列误判为 key 列，这里按列名精确比较
+	columnTypes, err := DB.Migrator().ColumnTypes(&Token{})
+	if err != nil {
+		return err
+	}
+	hasKeyColumn := false
+	for _, columnType := range columnTypes {
+		if columnType.Name() == "key" {
+			hasKeyColumn = true
+			break
+		}
+	}
+	if !hasKeyColumn {
+		return nil
+	}
+	count := 0
+	for {
+		var rows []struct {
+			Id       int
+			KeyValue string
+		}
+		err := DB.Table("tokens").Select("id, " + keyCol + " as key_value").
+			Where(keyCol + " IS NOT NULL AND " + keyCol + " <> ''").Limit(500).Scan(&rows).Error
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+		err = DB.Transaction(func(tx *gorm.DB) error {
+			for _, row := range rows {
+				err := tx.Table("tokens").Where("id = ?", row.Id).Updates(map[string]any{
+					"key_hash":   HashTokenKey(row.KeyValue),
+					"key_prefix": tokenKeyPrefix(row.KeyValue),
+					"key":        nil,
+				}).Error
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		count += len(rows)
+	}
+	if count > 0 {
+		common.SysLog(fmt.Sprintf("hashed %d plaintext tokens", count))
+	}
+	return nil
+}
@@ -8,57 +8,52 @@ import (
 )
 
 func cacheSetToken(token Token) error {
-	key := common.GenerateHMAC(token.Key)
 	token.Clean()
-	err := common.RedisHSetObj(fmt.Sprintf("token:%s", key), &token, time.Duration(constant.TokenCacheSeconds)*time.Second)
+	err := common.RedisHSetObj(fmt.Sprintf("token:%s", token.KeyHash), &token, time.Duration(constant.TokenCacheSeconds)*time.Second)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func cacheDeleteToken(key string) error {
-	key = common.GenerateHMAC(key)
-	err := common.RedisHDelObj(fmt.Sprintf("token:%s", key))
+func cacheDeleteToken(keyHash string) error {
+	err := common.RedisHDelObj(fmt.Sprintf("token:%s", keyHash))
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func cacheIncrTokenQuota(key string, increment int64) error {
-	key = common.GenerateHMAC(key)
-	err := common.RedisHIncrBy(fmt.Sprintf("token:%s", key), constant.TokenFiledRemainQuota, increment)
+func cacheIncrTokenQuota(keyHash string, increment int64) error {
+	err := common.RedisHIncrBy(fmt.Sprintf("token:%s", keyHash), constant.TokenFiledRemainQuota, increment)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func cacheDecrTokenQuota(key string, decrement int64) error {
-	return cacheIncrTokenQuota(key, -decrement)
+func cacheDecrTokenQuota(keyHash string, decrement int64) error {
+	return cacheIncrTokenQuota(keyHash, -decrement)
 }
 
-func cacheSetTokenField(key string, field string, value string) error {
-	key = common.GenerateHMAC(key)
-	err := common.RedisHSetField(fmt.Sprintf("token:%s", key), field, value)
+func cacheSetTokenField(keyHash string, field string, value string) error {
+	err := common.RedisHSetField(fmt.Sprintf("token:%s", keyHash), field, value)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// CacheGetTokenByKey 从缓存中获取 token，如果缓存中不存在，则从数据库中获取
-func cacheGetTokenByKey(key string) (*Token, error) {
-	hmacKey := common.GenerateHMAC(key)
+// cacheGetTokenByKeyHash 按令牌哈希从缓存中获取 token
+func cacheGetTokenByKeyHash(keyHash string) (*Token, error) {
 	if !common.RedisEnabled {
 		return nil, fmt.Errorf("redis is not enabled")
 	}
 	var token Token
-	err := common.RedisHGetObj(fmt.Sprintf("token:%s", hmacKey), &token)
+	err := common.RedisHGetObj(fmt.Sprintf("token:%s", keyHash), &token)
 	if err != nil {
 		return nil, err
 	}
-	token.Key = key
+	token.KeyHash = keyHash
 	return &token, nil
 }
@@ -0,0 +1,213 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"veloera/common"
+	"veloera/constant"
+	"veloera/setting/operation_setting"
+
+	"gorm.io/gorm"
+)
+
+// 毛利统计的分组方式
+const (
+	MarginGroupByChannel = "channel"
+	MarginGroupByModel   = "model"
+	MarginGroupByGroup   = "group"
+	MarginGroupByDay     = "day"
+)
+
+// UpstreamModelPrice 渠道上游的模型价格，单位为美元，按 token 计费的价格为每百万 token 的价格
+type UpstreamModelPrice struct {
+	Input   float64 `json:"input"`
+	Output  float64 `json:"output"`
+	Request float64 `json:"request"` // 按次计费的价格
+}
+
+// ChannelUpstreamCost 渠道的上游成本设置，设置了模型价格的模型按价格计算，其余模型按倍率计算
+type ChannelUpstreamCost struct {
+	Multiplier  *float64                      `json:"multiplier"` // 上游成本为按模型倍率计算的额度乘以该值，为空时使用全局配置
+	ModelPrices map[string]UpstreamModelPrice `json:"model_prices"`
+}
+
+// MarginStat 一段时间内的收入、上游成本和毛利，单位均为额度
+type MarginStat struct {
+	ChannelId   int     `json:"channel_id,omitempty"`
+	ChannelName string  `json:"channel_name,omitempty"`
+	ModelName   string  `json:"model_name,omitempty"`
+	GroupName   string  `json:"group,omitempty"`
+	Day         int64   `json:"day,omitempty"`
+	Count       int     `json:"count"`
+	Revenue     int     `json:"revenue"`
+	Cost        int     `json:"cost"`
+	Margin      int     `json:"margin"`
+	MarginRate  float64 `json:"margin_rate"` // 毛利占收入的比例，收入为 0 时为 0
+}
+
+// GetUpstreamCost 返回渠道的上游成本设置，未设置时返回 nil
+func (channel *Channel) GetUpstreamCost() *ChannelUpstreamCost {
+	value, ok := channel.GetSetting()[constant.ChannelSettingUpstreamCost]
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var cost ChannelUpstreamCost
+	if err := json.Unmarshal(data, &cost); err != nil {
+		common.SysError("failed to unmarshal channel upstream cost: " + err.Error())
+		return nil
+	}
+	return &cost
+}
+
+func getChannelUpstreamCost(channelId int) *ChannelUpstreamCost {
+	if common.MemoryCacheEnabled {
+		channel, err := CacheGetChannel(channelId)
+		if err != nil {
+			return nil
+		}
+		return channel.GetUpstreamCost()
+	}
+	var channel Channel
+	if err := DB.Select("id", "setting").First(&channel, "id = ?", channelId).Error; err != nil {
+		return nil
+	}
+	return channel.GetUpstreamCost()
+}
+
+func otherFloat(other map[string]interface{}, key string) (float64, bool) {
+	value, ok := other[key]
+	if !ok {
+		return 0, false
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// baseQuota 去掉分组倍率后的额度，即按模型倍率或模型价格计算的额度
+func baseQuota(promptTokens int, completionTokens int, quota int, other map[string]interface{}) float64 {
+	if groupRatio, ok := otherFloat(other, "group_ratio"); ok {
+		if groupRatio > 0 {
+			return float64(quota) / groupRatio
+		}
+		// 分组倍率为 0 时用户不扣费，按模型倍率或价格重新计算
+		if modelPrice, ok := otherFloat(other, "model_price"); ok && modelPrice >= 0 {
+			return modelPrice * common.QuotaPerUnit
+		}
+		modelRatio, _ := otherFloat(other, "model_ratio")
+		completionRatio, ok := otherFloat(other, "completion_ratio")
+		if !ok {
+			completionRatio = 1
+		}
+		return (float64(promptTokens) + float64(completionTokens)*completionRatio) * modelRatio
+	}
+	return float64(quota)
+}
+
+// computeUpstreamCost 计算一次请求支付给上游的额度
+func computeUpstreamCost(channelId int, modelName string, promptTokens int, completionTokens int, quota int, other map[string]interface{}) int {
+	if channelId == 0 {
+		return 0
+	}
+	multiplier := operation_setting.GetUpstreamCostSetting().DefaultMultiplier
+	if cost := getChannelUpstreamCost(channelId); cost != nil {
+		if price, ok := cost.ModelPrices[modelName]; ok {
+			usd := (float64(promptTokens)*price.Input+float64(completionTokens)*price.Output)/1000000 + price.Request
+			return int(math.Round(usd * common.QuotaPerUnit))
+		}
+		if cost.Multiplier != nil {
+			multiplier = *cost.Multiplier
+		}
+	}
+	return int(math.Round(baseQuota(promptTokens, completionTokens, quota, other) * multiplier))
+}
+
+// marginQuery 只统计记录了上游成本的消费日志，记录上游成本之前的日志成本为 0，会虚增毛利
+func marginQuery(startTimestamp int64, endTimestamp int64, channelId int, modelName string, group string) *gorm.DB {
+	tx := LOG_DB.Model(&Log{}).Where("type = ? AND upstream_cost_recorded = ?", LogTypeConsume, true)
+	if startTimestamp != 0 {
+		tx = tx.Where("created_at >= ?", startTimestamp)
+	}
+	if endTimestamp != 0 {
+		tx = tx.Where("created_at <= ?", endTimestamp)
+	}
+	if channelId != 0 {
+		tx = tx.Where("channel_id = ?", channelId)
+	}
+	if modelName != "" {
+		tx = tx.Where("model_name = ?", modelName)
+	}
+	if group != "" {
+		tx = tx.Where(groupCol+" = ?", group)
+	}
+	return tx
+}
+
+// GetMarginStats 按渠道、模型、分组或天汇总收入、上游成本和毛利，按毛利从低到高排序，按天汇总时按日期从新到旧排序
+func GetMarginStats(startTimestamp int64, endTimestamp int64, groupBy string, channelId int, modelName string, group string) (stats []*MarginStat, err error) {
+	// selectColumn 为查询的列，groupColumn 为分组的表达式
+	var selectColumn, groupColumn string
+	switch groupBy {
+	case MarginGroupByChannel:
+		selectColumn, groupColumn = "channel_id", "channel_id"
+	case MarginGroupByModel:
+		selectColumn, groupColumn = "model_name", "model_name"
+	case MarginGroupByGroup:
+		selectColumn, groupColumn = groupCol+" as group_name", "group_name"
+	case MarginGroupByDay:
+		selectColumn, groupColumn = "(created_at - created_at % 86400) as day", "(created_at - created_at % 86400)"
+	default:
+		return nil, errors.New("不支持的分组方式：" + groupBy)
+	}
+	err = marginQuery(startTimestamp, endTimestamp, channelId, modelName, group).
+		Select(selectColumn + ", count(*) as count, sum(quota) as revenue, sum(upstream_cost) as cost").
+		Group(groupColumn).Scan(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+	if groupBy == MarginGroupByChannel {
+		fillMarginChannelNames(stats)
+	}
+	for _, stat := range stats {
+		stat.Margin = stat.Revenue - stat.Cost
+		if stat.Revenue != 0 {
+			stat.MarginRate = float64(stat.Margin) / float64(stat.Revenue)
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if groupBy == MarginGroupByDay {
+			return stats[i].Day > stats[j].Day
+		}
+		return stats[i].Margin < stats[j].Margin
+	})
+	return stats, nil
+}
+
+func fillMarginChannelNames(stats []*MarginStat) {
+	ids := make([]int, 0, len(stats))
+	for _, stat := range stats {
+		ids = append(ids, stat.ChannelId)
+	}
+	var channels []*Channel
+	if err := DB.Select("id", "name").Where("id IN ?", ids).Find(&channels).Error; err != nil {
+		common.SysError("failed to get channel names: " + err.Error())
+		return
+	}
+	names := make(map[int]string, len(channels))
+	for _, channel := range channels {
+		names[channel.Id] = channel.Name
+	}
+	for _, stat := range stats {
+		stat.ChannelName = names[stat.ChannelId]
+	}
+}
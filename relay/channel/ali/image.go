@@ -26,6 +26,41 @@ func oaiImage2Ali(request dto.ImageRequest) *AliImageRequest {
 	return &imageRequest
 }
 
+// oaiImageEdit2Ali 将图片编辑请求转换为通义万相图像编辑请求，图片以 data url 传递，
+// 编辑功能默认为指令编辑，有遮罩时为局部重绘，也可以通过表单字段 function 指定
+func oaiImageEdit2Ali(c *gin.Context, request dto.ImageRequest) (*AliImageEditRequest, error) {
+	images, mask, err := service.GetImageEditFiles(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(images) != 1 {
+		return nil, errors.New("only one image is supported")
+	}
+	var imageRequest AliImageEditRequest
+	imageRequest.Model = request.Model
+	imageRequest.Input.Prompt = request.Prompt
+	imageRequest.Input.Function = "description_edit"
+	imageRequest.Parameters.N = request.N
+
+	mimeType, data, err := service.ReadImageFile(images[0])
+	if err != nil {
+		return nil, fmt.Errorf("read image failed: %w", err)
+	}
+	imageRequest.Input.BaseImageUrl = fmt.Sprintf("data:%s;base64,%s", mimeType, data)
+	if mask != nil {
+		mimeType, data, err := service.ReadImageFile(mask)
+		if err != nil {
+			return nil, fmt.Errorf("read mask failed: %w", err)
+		}
+		imageRequest.Input.MaskImageUrl = fmt.Sprintf("data:%s;base64,%s", mimeType, data)
+		imageRequest.Input.Function = "description_edit_with_mask"
+	}
+	if function := c.PostForm("function"); function != "" {
+		imageRequest.Input.Function = function
+	}
+	return &imageRequest, nil
+}
+
 func updateTask(info *relaycommon.RelayInfo, taskID string) (*AliResponse, error, []byte) {
 	url := fmt.Sprintf("%s/api/v1/tasks/%s", info.BaseUrl, taskID)
 
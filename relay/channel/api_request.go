@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	common2 "veloera/common"
+	constant2 "veloera/constant"
 	"veloera/relay/common"
 	"veloera/relay/constant"
 	"veloera/service"
@@ -105,6 +106,10 @@ func doRequest(c *gin.Context, req *http.Request, info *common.RelayInfo) (*http
 	} else {
 		client = service.GetHttpClient()
 	}
+	if _, ok := c.Get(constant2.ContextKeyHedgeAttempt); ok {
+		// 对冲请求落败时取消上游请求
+		req = req.WithContext(c.Request.Context())
+	}
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
@@ -112,6 +117,8 @@ func doRequest(c *gin.Context, req *http.Request, info *common.RelayInfo) (*http
 	if resp == nil {
 		return nil, errors.New("resp is nil")
 	}
+	// 记录上游返回的限流额度，用于渠道选择
+	service.RecordUpstreamRateLimit(info.ChannelId, c.GetString(constant2.ContextKeyChannelKeyHash), resp)
 	_ = req.Body.Close()
 	_ = c.Request.Body.Close()
 	return resp, nil
@@ -10,6 +10,7 @@ import (
 	"veloera/dto"
 	"veloera/relay/channel"
 	relaycommon "veloera/relay/common"
+	"veloera/relay/constant"
 	"veloera/service"
 	"veloera/setting/model_setting"
 
@@ -22,9 +23,7 @@ type Adaptor struct {
 }
 
 func (a *Adaptor) ConvertClaudeRequest(*gin.Context, *relaycommon.RelayInfo, *dto.ClaudeRequest) (any, error) {
-	//TODO implement me
-	panic("implement me")
-	return nil, nil
+	return nil, errors.New("not implemented")
 }
 
 func (a *Adaptor) ConvertAudioRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.AudioRequest) (io.Reader, error) {
@@ -33,6 +32,9 @@ func (a *Adaptor) ConvertAudioRequest(c *gin.Context, info *relaycommon.RelayInf
 }
 
 func (a *Adaptor) ConvertImageRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.ImageRequest) (any, error) {
+	if info.RelayMode == constant.RelayModeImagesEdits {
+		return convertImageEditRequest(c, request)
+	}
 	if !strings.HasPrefix(info.UpstreamModelName, "imagen") {
 		return nil, errors.New("not supported model for image generation")
 	}
@@ -81,6 +83,10 @@ func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
 
 	version := model_setting.GetGeminiVersionSetting(info.UpstreamModelName)
 
+	if info.RelayFormat == relaycommon.RelayFormatGemini {
+		return fmt.Sprintf("%s/%s/models/%s:%s", info.BaseUrl, version, info.UpstreamModelName, NativeAction(info)), nil
+	}
+
 	if strings.HasPrefix(info.UpstreamModelName, "imagen") {
 		return fmt.Sprintf("%s/%s/models/%s:predict", info.BaseUrl, version, info.UpstreamModelName), nil
 	}
@@ -101,6 +107,10 @@ func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
 func (a *Adaptor) SetupRequestHeader(c *gin.Context, req *http.Header, info *relaycommon.RelayInfo) error {
 	channel.SetupApiRequestHeader(info, c, req)
 	req.Set("x-goog-api-key", info.ApiKey)
+	if info.RelayMode == constant.RelayModeImagesEdits {
+		// 客户端以 multipart/form-data 上传图片，转换后的请求体为 JSON
+		req.Set("Content-Type", "application/json")
+	}
 	return nil
 }
 
@@ -165,6 +175,14 @@ func (a *Adaptor) DoRequest(c *gin.Context, info *relaycommon.RelayInfo, request
 }
 
 func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (usage any, err *dto.OpenAIErrorWithStatusCode) {
+	if info.RelayFormat == relaycommon.RelayFormatGemini {
+		return GeminiNativeHandler(c, resp, info)
+	}
+
+	if info.RelayMode == constant.RelayModeImagesEdits {
+		return GeminiImageEditHandler(c, resp, info)
+	}
+
 	if strings.HasPrefix(info.UpstreamModelName, "imagen") {
 		return GeminiImageHandler(c, resp, info)
 	}
@@ -250,6 +268,99 @@ func GeminiImageHandler(c *gin.Context, resp *http.Response, info *relaycommon.R
 	return usage, nil
 }
 
+// convertImageEditRequest 将图片编辑请求转换为带图片输入的 generateContent 请求，由支持图片输出的 gemini 模型完成编辑
+func convertImageEditRequest(c *gin.Context, request dto.ImageRequest) (*GeminiChatRequest, error) {
+	images, _, err := service.GetImageEditFiles(c)
+	if err != nil {
+		return nil, err
+	}
+	parts := []GeminiPart{
+		{
+			Text: request.Prompt,
+		},
+	}
+	for _, image := range images {
+		mimeType, data, err := service.ReadImageFile(image)
+		if err != nil {
+			return nil, fmt.Errorf("read image failed: %w", err)
+		}
+		parts = append(parts, GeminiPart{
+			InlineData: &GeminiInlineData{
+				MimeType: mimeType,
+				Data:     data,
+			},
+		})
+	}
+	geminiRequest := &GeminiChatRequest{
+		Contents: []GeminiChatContent{
+			{
+				Role:  "user",
+				Parts: parts,
+			},
+		},
+		GenerationConfig: GeminiChatGenerationConfig{
+			ResponseModalities: []string{"TEXT", "IMAGE"},
+		},
+	}
+	if request.N > 1 {
+		geminiRequest.GenerationConfig.CandidateCount = request.N
+	}
+	return geminiRequest, nil
+}
+
+// GeminiImageEditHandler 将 generateContent 响应中的图片转换为 OpenAI 图片响应，文本内容作为 revised_prompt
+func GeminiImageEditHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (usage any, err *dto.OpenAIErrorWithStatusCode) {
+	responseBody, readErr := io.ReadAll(resp.Body)
+	if readErr != nil {
+		return nil, service.OpenAIErrorWrapper(readErr, "read_response_body_failed", http.StatusInternalServerError)
+	}
+	_ = resp.Body.Close()
+
+	var geminiResponse GeminiChatResponse
+	if jsonErr := json.Unmarshal(responseBody, &geminiResponse); jsonErr != nil {
+		return nil, service.OpenAIErrorWrapper(jsonErr, "unmarshal_response_body_failed", http.StatusInternalServerError)
+	}
+
+	openAIResponse := dto.ImageResponse{
+		Created: common.GetTimestamp(),
+		Data:    make([]dto.ImageData, 0, len(geminiResponse.Candidates)),
+	}
+	for _, candidate := range geminiResponse.Candidates {
+		var texts []string
+		for _, part := range candidate.Content.Parts {
+			if part.InlineData != nil && strings.HasPrefix(part.InlineData.MimeType, "image/") {
+				openAIResponse.Data = append(openAIResponse.Data, dto.ImageData{
+					B64Json: part.InlineData.Data,
+				})
+			} else if part.Text != "" && !part.Thought {
+				texts = append(texts, part.Text)
+			}
+		}
+		if len(texts) > 0 && len(openAIResponse.Data) > 0 {
+			openAIResponse.Data[len(openAIResponse.Data)-1].RevisedPrompt = strings.Join(texts, "\n")
+		}
+	}
+	if len(openAIResponse.Data) == 0 {
+		return nil, service.OpenAIErrorWrapper(errors.New("no images generated"), "no_images", http.StatusBadRequest)
+	}
+
+	jsonResponse, jsonErr := json.Marshal(openAIResponse)
+	if jsonErr != nil {
+		return nil, service.OpenAIErrorWrapper(jsonErr, "marshal_response_failed", http.StatusInternalServerError)
+	}
+
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, _ = c.Writer.Write(jsonResponse)
+
+	usage = &dto.Usage{
+		PromptTokens:     geminiResponse.UsageMetadata.PromptTokenCount,
+		CompletionTokens: geminiResponse.UsageMetadata.CandidatesTokenCount,
+		TotalTokens:      geminiResponse.UsageMetadata.TotalTokenCount,
+	}
+	return usage, nil
+}
+
 func (a *Adaptor) GetModelList() []string {
 	return ModelList
 }
@@ -1,13 +1,55 @@
 package gemini
 
+import "encoding/json"
+
 type GeminiChatRequest struct {
 	Contents           []GeminiChatContent        `json:"contents"`
 	SafetySettings     []GeminiChatSafetySettings `json:"safety_settings,omitempty"`
 	GenerationConfig   GeminiChatGenerationConfig `json:"generation_config,omitempty"`
 	Tools              []GeminiChatTool           `json:"tools,omitempty"`
+	ToolConfig         *GeminiToolConfig          `json:"toolConfig,omitempty"`
 	SystemInstructions *GeminiChatContent         `json:"system_instruction,omitempty"`
 }
 
+// UnmarshalJSON accepts both the snake_case and the camelCase field names,
+// the official SDKs send camelCase while the REST examples mostly use snake_case
+func (r *GeminiChatRequest) UnmarshalJSON(data []byte) error {
+	type alias GeminiChatRequest
+	var aux struct {
+		alias
+		SafetySettings     []GeminiChatSafetySettings  `json:"safetySettings"`
+		GenerationConfig   *GeminiChatGenerationConfig `json:"generationConfig"`
+		SystemInstructions *GeminiChatContent          `json:"systemInstruction"`
+		ToolConfig         *GeminiToolConfig           `json:"tool_config"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*r = GeminiChatRequest(aux.alias)
+	if aux.SafetySettings != nil {
+		r.SafetySettings = aux.SafetySettings
+	}
+	if aux.GenerationConfig != nil {
+		r.GenerationConfig = *aux.GenerationConfig
+	}
+	if aux.SystemInstructions != nil {
+		r.SystemInstructions = aux.SystemInstructions
+	}
+	if aux.ToolConfig != nil {
+		r.ToolConfig = aux.ToolConfig
+	}
+	return nil
+}
+
+type GeminiToolConfig struct {
+	FunctionCallingConfig *GeminiFunctionCallingConfig `json:"functionCallingConfig,omitempty"`
+}
+
+type GeminiFunctionCallingConfig struct {
+	Mode                 string   `json:"mode,omitempty"`
+	AllowedFunctionNames []string `json:"allowedFunctionNames,omitempty"`
+}
+
 type GeminiThinkingConfig struct {
 	IncludeThoughts bool `json:"includeThoughts,omitempty"`
 	ThinkingBudget  *int `json:"thinkingBudget,omitempty"`
@@ -22,6 +64,22 @@ type GeminiInlineData struct {
 	Data     string `json:"data"`
 }
 
+func (d *GeminiInlineData) UnmarshalJSON(data []byte) error {
+	type alias GeminiInlineData
+	var aux struct {
+		alias
+		MimeType string `json:"mime_type"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*d = GeminiInlineData(aux.alias)
+	if aux.MimeType != "" {
+		d.MimeType = aux.MimeType
+	}
+	return nil
+}
+
 type FunctionCall struct {
 	FunctionName string `json:"name"`
 	Arguments    any    `json:"args"`
@@ -33,8 +91,8 @@ type GeminiFunctionResponseContent struct {
 }
 
 type FunctionResponse struct {
-	Name     string                        `json:"name"`
-	Response GeminiFunctionResponseContent `json:"response"`
+	Name     string `json:"name"`
+	Response any    `json:"response"`
 }
 
 type GeminiPartExecutableCode struct {
@@ -52,8 +110,29 @@ type GeminiFileData struct {
 	FileUri  string `json:"fileUri,omitempty"`
 }
 
+func (d *GeminiFileData) UnmarshalJSON(data []byte) error {
+	type alias GeminiFileData
+	var aux struct {
+		alias
+		MimeType string `json:"mime_type"`
+		FileUri  string `json:"file_uri"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*d = GeminiFileData(aux.alias)
+	if aux.MimeType != "" {
+		d.MimeType = aux.MimeType
+	}
+	if aux.FileUri != "" {
+		d.FileUri = aux.FileUri
+	}
+	return nil
+}
+
 type GeminiPart struct {
 	Text                string                         `json:"text,omitempty"`
+	Thought             bool                           `json:"thought,omitempty"`
 	InlineData          *GeminiInlineData              `json:"inlineData,omitempty"`
 	FunctionCall        *FunctionCall                  `json:"functionCall,omitempty"`
 	FunctionResponse    *FunctionResponse              `json:"functionResponse,omitempty"`
@@ -62,6 +141,34 @@ type GeminiPart struct {
 	CodeExecutionResult *GeminiPartCodeExecutionResult `json:"codeExecutionResult,omitempty"`
 }
 
+func (p *GeminiPart) UnmarshalJSON(data []byte) error {
+	type alias GeminiPart
+	var aux struct {
+		alias
+		InlineData       *GeminiInlineData `json:"inline_data"`
+		FunctionCall     *FunctionCall     `json:"function_call"`
+		FunctionResponse *FunctionResponse `json:"function_response"`
+		FileData         *GeminiFileData   `json:"file_data"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	*p = GeminiPart(aux.alias)
+	if aux.InlineData != nil {
+		p.InlineData = aux.InlineData
+	}
+	if aux.FunctionCall != nil {
+		p.FunctionCall = aux.FunctionCall
+	}
+	if aux.FunctionResponse != nil {
+		p.FunctionResponse = aux.FunctionResponse
+	}
+	if aux.FileData != nil {
+		p.FileData = aux.FileData
+	}
+	return nil
+}
+
 type GeminiChatContent struct {
 	Role  string       `json:"role,omitempty"`
 	Parts []GeminiPart `json:"parts"`
@@ -116,10 +223,15 @@ type GeminiChatResponse struct {
 }
 
 type GeminiUsageMetadata struct {
-	PromptTokenCount     int `json:"promptTokenCount"`
-	CandidatesTokenCount int `json:"candidatesTokenCount"`
-	TotalTokenCount      int `json:"totalTokenCount"`
-	ThoughtsTokenCount   int `json:"thoughtsTokenCount"`
+	PromptTokenCount        int `json:"promptTokenCount"`
+	CandidatesTokenCount    int `json:"candidatesTokenCount"`
+	TotalTokenCount         int `json:"totalTokenCount"`
+	ThoughtsTokenCount      int `json:"thoughtsTokenCount"`
+	CachedContentTokenCount int `json:"cachedContentTokenCount,omitempty"`
+}
+
+type GeminiCountTokensResponse struct {
+	TotalTokens int `json:"totalTokens"`
 }
 
 // Imagen related structs
@@ -0,0 +1,441 @@
+package gemini
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"veloera/common"
+	"veloera/constant"
+	"veloera/dto"
+	relaycommon "veloera/relay/common"
+	relayconstant "veloera/relay/constant"
+	"veloera/relay/helper"
+	"veloera/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// NativeAction 返回 gemini 原生格式请求对应的上游 action
+func NativeAction(info *relaycommon.RelayInfo) string {
+	switch info.RelayMode {
+	case relayconstant.RelayModeGeminiCountTokens:
+		return "countTokens"
+	case relayconstant.RelayModeGeminiEmbedContent:
+		return "embedContent"
+	}
+	if info.IsStream {
+		return "streamGenerateContent?alt=sse"
+	}
+	return "generateContent"
+}
+
+// GeminiNativeHandler 透传 gemini 原生格式的响应，并从 usageMetadata 中获取用量
+func GeminiNativeHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (usage any, err *dto.OpenAIErrorWithStatusCode) {
+	switch info.RelayMode {
+	case relayconstant.RelayModeGeminiCountTokens, relayconstant.RelayModeGeminiEmbedContent:
+		return geminiNativePassthroughHandler(c, resp, info)
+	}
+	if info.IsStream {
+		return geminiNativeStreamHandler(c, resp, info)
+	}
+	return geminiNativeChatHandler(c, resp, info)
+}
+
+func geminiNativeChatHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (any, *dto.OpenAIErrorWithStatusCode) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, service.OpenAIErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
+	}
+	_ = resp.Body.Close()
+	var geminiResponse GeminiChatResponse
+	if err = json.Unmarshal(responseBody, &geminiResponse); err != nil {
+		return nil, service.OpenAIErrorWrapper(err, "unmarshal_response_body_failed", http.StatusInternalServerError)
+	}
+	usage := &dto.Usage{
+		PromptTokens:     geminiResponse.UsageMetadata.PromptTokenCount,
+		CompletionTokens: geminiResponse.UsageMetadata.CandidatesTokenCount,
+		TotalTokens:      geminiResponse.UsageMetadata.TotalTokenCount,
+	}
+	// Only process ReasoningTokens for gemini-2.5- models
+	if strings.HasPrefix(info.UpstreamModelName, "gemini-2.5-") {
+		usage.CompletionTokenDetails.ReasoningTokens = geminiResponse.UsageMetadata.ThoughtsTokenCount
+	}
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, _ = c.Writer.Write(responseBody)
+	return usage, nil
+}
+
+func geminiNativeStreamHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (any, *dto.OpenAIErrorWithStatusCode) {
+	var usage = &dto.Usage{}
+	var imageCount int
+
+	helper.StreamScannerHandler(c, resp, info, func(data string) bool {
+		var geminiResponse GeminiChatResponse
+		err := common.DecodeJsonStr(data, &geminiResponse)
+		if err != nil {
+			common.LogError(c, "error unmarshalling stream response: "+err.Error())
+			return false
+		}
+		for _, candidate := range geminiResponse.Candidates {
+			for _, part := range candidate.Content.Parts {
+				if part.InlineData != nil && strings.HasPrefix(part.InlineData.MimeType, "image") {
+					imageCount++
+				}
+			}
+		}
+		if geminiResponse.UsageMetadata.TotalTokenCount != 0 {
+			usage.PromptTokens = geminiResponse.UsageMetadata.PromptTokenCount
+			usage.CompletionTokens = geminiResponse.UsageMetadata.CandidatesTokenCount
+			usage.CompletionTokenDetails.ReasoningTokens = geminiResponse.UsageMetadata.ThoughtsTokenCount
+		}
+		info.SendResponseCount++
+		err = helper.StringData(c, data)
+		if err != nil {
+			common.LogError(c, err.Error())
+		}
+		return true
+	})
+
+	if imageCount != 0 {
+		if usage.CompletionTokens == 0 {
+			usage.CompletionTokens = imageCount * 258
+		}
+	}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+	usage.PromptTokensDetails.TextTokens = usage.PromptTokens
+	return usage, nil
+}
+
+// geminiNativePassthroughHandler 透传 countTokens 和 embedContent 的响应，用量按输入计算
+func geminiNativePassthroughHandler(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (any, *dto.OpenAIErrorWithStatusCode) {
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, service.OpenAIErrorWrapper(err, "read_response_body_failed", http.StatusInternalServerError)
+	}
+	_ = resp.Body.Close()
+	c.Writer.Header().Set("Content-Type", "application/json")
+	c.Writer.WriteHeader(resp.StatusCode)
+	_, _ = c.Writer.Write(responseBody)
+	usage := &dto.Usage{
+		PromptTokens: info.PromptTokens,
+		TotalTokens:  info.PromptTokens,
+	}
+	return usage, nil
+}
+
+// RequestGemini2OpenAI 将 gemini 原生格式的请求转换为 OpenAI 格式，用于非 gemini 渠道
+func RequestGemini2OpenAI(geminiRequest *GeminiChatRequest, model string, stream bool) (*dto.GeneralOpenAIRequest, error) {
+	openAIRequest := dto.GeneralOpenAIRequest{
+		Model:       model,
+		Stream:      stream,
+		Temperature: geminiRequest.GenerationConfig.Temperature,
+		TopP:        geminiRequest.GenerationConfig.TopP,
+		TopK:        int(geminiRequest.GenerationConfig.TopK),
+		MaxTokens:   geminiRequest.GenerationConfig.MaxOutputTokens,
+		Seed:        float64(geminiRequest.GenerationConfig.Seed),
+	}
+	if geminiRequest.GenerationConfig.CandidateCount > 1 {
+		openAIRequest.N = geminiRequest.GenerationConfig.CandidateCount
+	}
+	if len(geminiRequest.GenerationConfig.StopSequences) > 0 {
+		openAIRequest.Stop = geminiRequest.GenerationConfig.StopSequences
+	}
+	if geminiRequest.GenerationConfig.ResponseMimeType == "application/json" {
+		if geminiRequest.GenerationConfig.ResponseSchema != nil {
+			openAIRequest.ResponseFormat = &dto.ResponseFormat{
+				Type: "json_schema",
+				JsonSchema: &dto.FormatJsonSchema{
+					Name:   "response",
+					Schema: normalizeGeminiSchema(geminiRequest.GenerationConfig.ResponseSchema),
+				},
+			}
+		} else {
+			openAIRequest.ResponseFormat = &dto.ResponseFormat{Type: "json_object"}
+		}
+	}
+
+	// Convert tools
+	for _, tool := range geminiRequest.Tools {
+		if tool.FunctionDeclarations == nil {
+			continue
+		}
+		declarations, err := common.Any2Type[[]dto.FunctionRequest](tool.FunctionDeclarations)
+		if err != nil {
+			return nil, fmt.Errorf("invalid function declarations: %w", err)
+		}
+		for _, declaration := range declarations {
+			declaration.Parameters = normalizeGeminiSchema(declaration.Parameters)
+			openAIRequest.Tools = append(openAIRequest.Tools, dto.ToolCallRequest{
+				Type:     "function",
+				Function: declaration,
+			})
+		}
+	}
+	if len(openAIRequest.Tools) > 0 && geminiRequest.ToolConfig != nil && geminiRequest.ToolConfig.FunctionCallingConfig != nil {
+		config := geminiRequest.ToolConfig.FunctionCallingConfig
+		switch config.Mode {
+		case "AUTO":
+			openAIRequest.ToolChoice = "auto"
+		case "NONE":
+			openAIRequest.ToolChoice = "none"
+		case "ANY":
+			openAIRequest.ToolChoice = "required"
+			if len(config.AllowedFunctionNames) == 1 {
+				openAIRequest.ToolChoice = map[string]any{
+					"type": "function",
+					"function": map[string]any{
+						"name": config.AllowedFunctionNames[0],
+					},
+				}
+			}
+		}
+	}
+
+	// Convert messages
+	messages := make([]dto.Message, 0, len(geminiRequest.Contents)+1)
+	if geminiRequest.SystemInstructions != nil {
+		texts := make([]string, 0, len(geminiRequest.SystemInstructions.Parts))
+		for _, part := range geminiRequest.SystemInstructions.Parts {
+			if part.Text != "" {
+				texts = append(texts, part.Text)
+			}
+		}
+		if len(texts) > 0 {
+			message := dto.Message{Role: "system"}
+			message.SetStringContent(strings.Join(texts, "\n"))
+			messages = append(messages, message)
+		}
+	}
+
+	// gemini 通过函数名关联调用和结果，这里为每次调用生成 id 并按顺序匹配
+	pendingCallIds := make(map[string][]string)
+	for _, content := range geminiRequest.Contents {
+		role := "user"
+		if content.Role == "model" {
+			role = "assistant"
+		}
+		message := dto.Message{Role: role}
+		mediaContents := make([]dto.MediaContent, 0, len(content.Parts))
+		var toolCalls []dto.ToolCallRequest
+		for _, part := range content.Parts {
+			switch {
+			case part.Thought:
+				// previous thoughts are not accepted as input by openai compatible upstreams
+			case part.FunctionCall != nil:
+				id := fmt.Sprintf("call_%s", common.GetUUID())
+				pendingCallIds[part.FunctionCall.FunctionName] = append(pendingCallIds[part.FunctionCall.FunctionName], id)
+				arguments, _ := json.Marshal(part.FunctionCall.Arguments)
+				toolCalls = append(toolCalls, dto.ToolCallRequest{
+					ID:   id,
+					Type: "function",
+					Function: dto.FunctionRequest{
+						Name:      part.FunctionCall.FunctionName,
+						Arguments: string(arguments),
+					},
+				})
+			case part.FunctionResponse != nil:
+				name := part.FunctionResponse.Name
+				id := fmt.Sprintf("call_%s", common.GetUUID())
+				if ids := pendingCallIds[name]; len(ids) > 0 {
+					id = ids[0]
+					pendingCallIds[name] = ids[1:]
+				}
+				result, _ := json.Marshal(part.FunctionResponse.Response)
+				toolMessage := dto.Message{
+					Role:       "tool",
+					Name:       &name,
+					ToolCallId: id,
+				}
+				toolMessage.SetStringContent(string(result))
+				messages = append(messages, toolMessage)
+			case part.InlineData != nil:
+				if strings.HasPrefix(part.InlineData.MimeType, "image") {
+					mediaContents = append(mediaContents, dto.MediaContent{
+						Type: dto.ContentTypeImageURL,
+						ImageUrl: &dto.MessageImageUrl{
+							Url: fmt.Sprintf("data:%s;base64,%s", part.InlineData.MimeType, part.InlineData.Data),
+						},
+					})
+				} else if strings.HasPrefix(part.InlineData.MimeType, "audio") {
+					mediaContents = append(mediaContents, dto.MediaContent{
+						Type: dto.ContentTypeInputAudio,
+						InputAudio: &dto.MessageInputAudio{
+							Data:   part.InlineData.Data,
+							Format: strings.TrimPrefix(part.InlineData.MimeType, "audio/"),
+						},
+					})
+				} else {
+					mediaContents = append(mediaContents, dto.MediaContent{
+						Type: dto.ContentTypeFile,
+						File: &dto.MessageFile{
+							FileData: fmt.Sprintf("data:%s;base64,%s", part.InlineData.MimeType, part.InlineData.Data),
+						},
+					})
+				}
+			case part.FileData != nil:
+				mediaContents = append(mediaContents, dto.MediaContent{
+					Type:     dto.ContentTypeImageURL,
+					ImageUrl: &dto.MessageImageUrl{Url: part.FileData.FileUri},
+				})
+			case part.ExecutableCode != nil:
+				mediaContents = append(mediaContents, dto.MediaContent{
+					Type: dto.ContentTypeText,
+					Text: "```" + part.ExecutableCode.Language + "\n" + part.ExecutableCode.Code + "\n```",
+				})
+			case part.CodeExecutionResult != nil:
+				mediaContents = append(mediaContents, dto.MediaContent{
+					Type: dto.ContentTypeText,
+					Text: "```output\n" + part.CodeExecutionResult.Output + "\n```",
+				})
+			default:
+				mediaContents = append(mediaContents, dto.MediaContent{
+					Type: dto.ContentTypeText,
+					Text: part.Text,
+				})
+			}
+		}
+		if len(toolCalls) > 0 {
+			message.SetToolCalls(toolCalls)
+		}
+		if len(mediaContents) == 1 && mediaContents[0].Type == dto.ContentTypeText {
+			message.SetStringContent(mediaContents[0].Text)
+		} else if len(mediaContents) > 0 {
+			message.SetMediaContent(mediaContents)
+		}
+		if len(mediaContents) > 0 || len(toolCalls) > 0 {
+			messages = append(messages, message)
+		}
+	}
+	openAIRequest.Messages = messages
+	return &openAIRequest, nil
+}
+
+// normalizeGeminiSchema 将 gemini schema 中的大写类型 (OBJECT, STRING ...) 转换为 json schema 的小写类型
+func normalizeGeminiSchema(schema any) any {
+	switch v := schema.(type) {
+	case map[string]any:
+		normalized := make(map[string]any, len(v))
+		for key, value := range v {
+			if key == "type" {
+				if typ, ok := value.(string); ok {
+					normalized[key] = strings.ToLower(typ)
+					continue
+				}
+			}
+			normalized[key] = normalizeGeminiSchema(value)
+		}
+		return normalized
+	case []any:
+		normalized := make([]any, len(v))
+		for i, value := range v {
+			normalized[i] = normalizeGeminiSchema(value)
+		}
+		return normalized
+	}
+	return schema
+}
+
+// EmbeddingRequestGemini2OpenAI 将 gemini embedContent 请求转换为 OpenAI embeddings 请求
+func EmbeddingRequestGemini2OpenAI(geminiRequest *GeminiEmbeddingRequest, model string) *dto.EmbeddingRequest {
+	texts := make([]string, 0, len(geminiRequest.Content.Parts))
+	for _, part := range geminiRequest.Content.Parts {
+		texts = append(texts, part.Text)
+	}
+	return &dto.EmbeddingRequest{
+		Model:      model,
+		Input:      strings.Join(texts, "\n"),
+		Dimensions: geminiRequest.OutputDimensionality,
+	}
+}
+
+// EmbeddingResponseOpenAI2Gemini 将 OpenAI embeddings 响应转换为 gemini embedContent 响应
+func EmbeddingResponseOpenAI2Gemini(openAIResponse *dto.OpenAIEmbeddingResponse) *GeminiEmbeddingResponse {
+	geminiResponse := &GeminiEmbeddingResponse{
+		Embedding: ContentEmbedding{
+			Values: make([]float64, 0),
+		},
+	}
+	if len(openAIResponse.Data) > 0 {
+		geminiResponse.Embedding.Values = openAIResponse.Data[0].Embedding
+	}
+	return geminiResponse
+}
+
+// FinishReasonOpenAI2Gemini 将 OpenAI 的结束原因转换为 gemini 的 finishReason
+func FinishReasonOpenAI2Gemini(reason string) string {
+	switch reason {
+	case constant.FinishReasonLength:
+		return "MAX_TOKENS"
+	case constant.FinishReasonContentFilter:
+		return "SAFETY"
+	}
+	return "STOP"
+}
+
+// UsageOpenAI2Gemini 将 OpenAI 格式的用量转换为 gemini 的 usageMetadata
+func UsageOpenAI2Gemini(usage *dto.Usage) GeminiUsageMetadata {
+	if usage == nil {
+		return GeminiUsageMetadata{}
+	}
+	return GeminiUsageMetadata{
+		PromptTokenCount:        usage.PromptTokens,
+		CandidatesTokenCount:    usage.CompletionTokens - usage.CompletionTokenDetails.ReasoningTokens,
+		ThoughtsTokenCount:      usage.CompletionTokenDetails.ReasoningTokens,
+		TotalTokenCount:         usage.PromptTokens + usage.CompletionTokens,
+		CachedContentTokenCount: usage.PromptTokensDetails.CachedTokens,
+	}
+}
+
+// FunctionCallOpenAI2Gemini 将 OpenAI 的工具调用转换为 gemini 的 functionCall
+func FunctionCallOpenAI2Gemini(name string, arguments string) *FunctionCall {
+	var args any = map[string]any{}
+	if arguments != "" {
+		if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+			args = map[string]any{}
+		}
+	}
+	return &FunctionCall{
+		FunctionName: name,
+		Arguments:    args,
+	}
+}
+
+// ResponseOpenAI2Gemini 将 OpenAI 非流式响应转换为 gemini generateContent 响应
+func ResponseOpenAI2Gemini(openAIResponse *dto.OpenAITextResponse) *GeminiChatResponse {
+	geminiResponse := &GeminiChatResponse{
+		Candidates:    make([]GeminiChatCandidate, 0, len(openAIResponse.Choices)),
+		UsageMetadata: UsageOpenAI2Gemini(&openAIResponse.Usage),
+	}
+	for _, choice := range openAIResponse.Choices {
+		parts := make([]GeminiPart, 0)
+		if choice.Message.ReasoningContent != "" {
+			parts = append(parts, GeminiPart{Text: choice.Message.ReasoningContent, Thought: true})
+		} else if choice.Message.Reasoning != "" {
+			parts = append(parts, GeminiPart{Text: choice.Message.Reasoning, Thought: true})
+		}
+		if text := choice.Message.StringContent(); text != "" {
+			parts = append(parts, GeminiPart{Text: text})
+		}
+		for _, toolCall := range choice.Message.ParseToolCalls() {
+			parts = append(parts, GeminiPart{
+				FunctionCall: FunctionCallOpenAI2Gemini(toolCall.Function.Name, toolCall.Function.Arguments),
+			})
+		}
+		if len(parts) == 0 {
+			parts = append(parts, GeminiPart{Text: ""})
+		}
+		finishReason := FinishReasonOpenAI2Gemini(choice.FinishReason)
+		geminiResponse.Candidates = append(geminiResponse.Candidates, GeminiChatCandidate{
+			Content: GeminiChatContent{
+				Role:  "model",
+				Parts: parts,
+			},
+			FinishReason: &finishReason,
+			Index:        int64(choice.Index),
+		})
+	}
+	return geminiResponse
+}
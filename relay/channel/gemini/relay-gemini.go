@@ -152,15 +152,16 @@ func CovertGemini2OpenAI(textRequest dto.GeneralOpenAIRequest, info *relaycommon
 				name = val
 			}
 			content := common.StrToMap(message.StringContent())
-			functionResp := &FunctionResponse{
-				Name: name,
-				Response: GeminiFunctionResponseContent{
-					Name:    name,
-					Content: content,
-				},
+			responseContent := GeminiFunctionResponseContent{
+				Name:    name,
+				Content: content,
 			}
 			if content == nil {
-				functionResp.Response.Content = message.StringContent()
+				responseContent.Content = message.StringContent()
+			}
+			functionResp := &FunctionResponse{
+				Name:     name,
+				Response: responseContent,
 			}
 			*parts = append(*parts, GeminiPart{
 				FunctionResponse: functionResp,
@@ -8,6 +8,7 @@ import (
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"strings"
 	"veloera/common"
 	constant2 "veloera/constant"
@@ -33,9 +34,9 @@ type Adaptor struct {
 }
 
 func (a *Adaptor) ConvertClaudeRequest(c *gin.Context, info *relaycommon.RelayInfo, request *dto.ClaudeRequest) (any, error) {
-	if !strings.Contains(request.Model, "claude") {
-		return nil, fmt.Errorf("you are using openai channel type with path /v1/messages, only claude model supported convert, but got %s", request.Model)
-	}
+	// /v1/messages is served by the chat completions endpoint of the channel
+	info.RelayMode = constant.RelayModeChatCompletions
+	info.RequestURLPath = "/v1/chat/completions"
 	aiRequest, err := service.ClaudeToOpenAIRequest(*request, info)
 	if err != nil {
 		return nil, err
@@ -62,9 +63,6 @@ func (a *Adaptor) Init(info *relaycommon.RelayInfo) {
 }
 
 func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
-	if info.RelayFormat == relaycommon.RelayFormatClaude {
-		return fmt.Sprintf("%s/v1/chat/completions", info.BaseUrl), nil
-	}
 	if info.RelayMode == constant.RelayModeResponses {
 		return fmt.Sprintf("%s/v1/responses", info.BaseUrl), nil
 	}
@@ -242,7 +240,53 @@ func (a *Adaptor) ConvertAudioRequest(c *gin.Context, info *relaycommon.RelayInf
 }
 
 func (a *Adaptor) ConvertImageRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.ImageRequest) (any, error) {
-	return request, nil
+	if info.RelayMode != constant.RelayModeImagesEdits && info.RelayMode != constant.RelayModeImagesVariations {
+		return request, nil
+	}
+	// 图片编辑 / 变体使用 multipart 表单，替换模型名后原样转发
+	var requestBody bytes.Buffer
+	writer := multipart.NewWriter(&requestBody)
+
+	writer.WriteField("model", request.Model)
+	for key, values := range c.Request.MultipartForm.Value {
+		if key == "model" {
+			continue
+		}
+		for _, value := range values {
+			writer.WriteField(key, value)
+		}
+	}
+	for _, key := range []string{"image", "image[]", "mask"} {
+		for _, header := range c.Request.MultipartForm.File[key] {
+			if err := copyFormFile(writer, key, header); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	writer.Close()
+	c.Request.Header.Set("Content-Type", writer.FormDataContentType())
+	return &requestBody, nil
+}
+
+func copyFormFile(writer *multipart.Writer, key string, header *multipart.FileHeader) error {
+	file, err := header.Open()
+	if err != nil {
+		return fmt.Errorf("open form file failed: %w", err)
+	}
+	defer file.Close()
+
+	part, err := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {fmt.Sprintf(`form-data; name="%s"; filename="%s"`, key, header.Filename)},
+		"Content-Type":        {common.GetStringIfEmpty(header.Header.Get("Content-Type"), "application/octet-stream")},
+	})
+	if err != nil {
+		return errors.New("create form file failed")
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return errors.New("copy file failed")
+	}
+	return nil
 }
 
 func (a *Adaptor) ConvertOpenAIResponsesRequest(c *gin.Context, info *relaycommon.RelayInfo, request dto.OpenAIResponsesRequest) (any, error) {
@@ -261,7 +305,8 @@ func (a *Adaptor) ConvertOpenAIResponsesRequest(c *gin.Context, info *relaycommo
 }
 
 func (a *Adaptor) DoRequest(c *gin.Context, info *relaycommon.RelayInfo, requestBody io.Reader) (any, error) {
-	if info.RelayMode == constant.RelayModeAudioTranscription || info.RelayMode == constant.RelayModeAudioTranslation {
+	if info.RelayMode == constant.RelayModeAudioTranscription || info.RelayMode == constant.RelayModeAudioTranslation ||
+		info.RelayMode == constant.RelayModeImagesEdits || info.RelayMode == constant.RelayModeImagesVariations {
 		return channel.DoFormRequest(a, c, info, requestBody)
 	} else if info.RelayMode == constant.RelayModeRealtime {
 		return channel.DoWssRequest(a, c, info, requestBody)
@@ -280,7 +325,7 @@ func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, info *relaycom
 		fallthrough
 	case constant.RelayModeAudioTranscription:
 		err, usage = OpenaiSTTHandler(c, resp, info, a.ResponseFormat)
-	case constant.RelayModeImagesGenerations:
+	case constant.RelayModeImagesGenerations, constant.RelayModeImagesEdits, constant.RelayModeImagesVariations:
 		err, usage = OpenaiTTSHandler(c, resp, info)
 	case constant.RelayModeRerank:
 		err, usage = common_handler.RerankHandler(c, info, resp)
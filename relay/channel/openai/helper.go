@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"strings"
 	"veloera/common"
+	"veloera/constant"
 	"veloera/dto"
 	relaycommon "veloera/relay/common"
 	relayconstant "veloera/relay/constant"
 	"veloera/relay/helper"
 	"veloera/service"
+	"veloera/setting/operation_setting"
 
 	"github.com/gin-gonic/gin"
 )
@@ -173,17 +175,118 @@ func handleFinalResponse(c *gin.Context, info *relaycommon.RelayInfo, lastStream
 
 	case relaycommon.RelayFormatClaude:
 		info.ClaudeConvertInfo.Done = true
+		info.ClaudeConvertInfo.Usage = usage
 		var streamResponse dto.ChatCompletionsStreamResponse
-		if err := json.Unmarshal(common.StringToByteSlice(lastStreamData), &streamResponse); err != nil {
-			common.SysError("error unmarshalling stream response: " + err.Error())
-			return
+		if lastStreamData != "" {
+			if err := json.Unmarshal(common.StringToByteSlice(lastStreamData), &streamResponse); err != nil {
+				common.SysError("error unmarshalling stream response: " + err.Error())
+			}
 		}
 
-		info.ClaudeConvertInfo.Usage = usage
-
 		claudeResponses := service.StreamResponseOpenAI2Claude(&streamResponse, info)
 		for _, resp := range claudeResponses {
 			helper.ClaudeData(c, *resp)
 		}
 	}
 }
+
+// streamFinished 流式响应是否给出了结束原因，结束原因在最后一个带 choices 的数据块中
+func streamFinished(streamItems []string) bool {
+	for i := len(streamItems) - 1; i >= 0; i-- {
+		var streamResponse dto.ChatCompletionsStreamResponse
+		if err := common.DecodeJsonStr(streamItems[i], &streamResponse); err != nil {
+			return false
+		}
+		if len(streamResponse.Choices) == 0 {
+			continue
+		}
+		for _, choice := range streamResponse.Choices {
+			if choice.FinishReason != nil && *choice.FinishReason != "" {
+				return true
+			}
+		}
+		return false
+	}
+	return false
+}
+
+// streamContentText 已输出的回复内容，不包含思考内容
+func streamContentText(streamItems []string) string {
+	var builder strings.Builder
+	for _, item := range streamItems {
+		var streamResponse dto.ChatCompletionsStreamResponse
+		if err := common.DecodeJsonStr(item, &streamResponse); err != nil {
+			continue
+		}
+		for _, choice := range streamResponse.Choices {
+			builder.WriteString(choice.Delta.GetContentString())
+		}
+	}
+	return builder.String()
+}
+
+// shouldContinueStream 流式响应超时、读取出错，或者既没有收到 [DONE] 也没有结束原因就断开时，在客户端仍在等待的情况下续写。
+// 收到 [DONE] 的响应即使没有结束原因也视为正常结束，调用工具的响应无法续写
+func shouldContinueStream(c *gin.Context, info *relaycommon.RelayInfo, streamItems []string, toolCount int) bool {
+	setting := operation_setting.GetStreamFailoverSetting()
+	if !setting.Enabled || info.RelayMode != relayconstant.RelayModeChatCompletions || info.RelayFormat != relaycommon.RelayFormatOpenAI {
+		return false
+	}
+	if toolCount > 0 || c.Request.Context().Err() != nil {
+		return false
+	}
+	if continuation := relaycommon.GetStreamContinuation(c); continuation != nil && continuation.Segments >= setting.MaxContinuations {
+		return false
+	}
+	return info.StreamInterrupted || (!info.StreamDone && !streamFinished(streamItems))
+}
+
+// interruptStream 记录中断的一段，第一段中断时用其响应的 id、创建时间和模型名创建续写状态
+func interruptStream(c *gin.Context, info *relaycommon.RelayInfo, streamItems []string, usage *dto.Usage) {
+	continuation := relaycommon.GetStreamContinuation(c)
+	if continuation == nil {
+		continuation = &relaycommon.StreamContinuation{Model: info.UpstreamModelName}
+		for _, item := range streamItems {
+			var streamResponse dto.ChatCompletionsStreamResponse
+			if err := common.DecodeJsonStr(item, &streamResponse); err == nil && streamResponse.Id != "" {
+				continuation.Id = streamResponse.Id
+				continuation.Created = streamResponse.Created
+				continuation.Model = streamResponse.Model
+				break
+			}
+		}
+		if continuation.Id == "" {
+			continuation.Id = helper.GetResponseID(c)
+			continuation.Created = common.GetTimestamp()
+		}
+		c.Set(constant.ContextKeyStreamContinuation, continuation)
+	}
+	continuation.Interrupt(streamContentText(streamItems), usage)
+}
+
+// rewriteContinuationChunk 续写的数据块沿用第一段响应的 id、创建时间和模型名，用量加上之前各段的用量
+func rewriteContinuationChunk(data string, continuation *relaycommon.StreamContinuation) string {
+	var chunk map[string]any
+	if err := common.DecodeJsonStr(data, &chunk); err != nil {
+		return data
+	}
+	chunk["id"] = continuation.Id
+	chunk["created"] = continuation.Created
+	chunk["model"] = continuation.Model
+	if usage, ok := chunk["usage"].(map[string]any); ok {
+		for key, tokens := range map[string]int{
+			"prompt_tokens":     continuation.Usage.PromptTokens,
+			"completion_tokens": continuation.Usage.CompletionTokens,
+			"total_tokens":      continuation.Usage.TotalTokens,
+		} {
+			if value, ok := usage[key].(float64); ok {
+				usage[key] = value + float64(tokens)
+			}
+		}
+	}
+	rewritten, err := json.Marshal(chunk)
+	if err != nil {
+		return data
+	}
+	return string(rewritten)
+}
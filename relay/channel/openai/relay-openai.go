@@ -135,9 +135,18 @@ func OaiStreamHandler(c *gin.Context, resp *http.Response, info *relaycommon.Rel
 		lastStreamData string
 	)
 
+	// 续写中断的流式响应时，新的数据块接在同一个流中
+	continuation := relaycommon.GetStreamContinuation(c)
+	sendStreamItem := func(data string) error {
+		if continuation != nil {
+			data = rewriteContinuationChunk(data, continuation)
+		}
+		return handleStreamFormat(c, info, data, forceFormat, thinkToContent)
+	}
+
 	helper.StreamScannerHandler(c, resp, info, func(data string) bool {
 		if lastStreamData != "" {
-			err := handleStreamFormat(c, info, lastStreamData, forceFormat, thinkToContent)
+			err := sendStreamItem(lastStreamData)
 			if err != nil {
 				common.SysError("error handling stream format: " + err.Error())
 			}
@@ -169,9 +178,11 @@ func OaiStreamHandler(c *gin.Context, resp *http.Response, info *relaycommon.Rel
 		}
 	}
 
-	if shouldSendLastResp {
-		sendStreamData(c, info, lastStreamData, forceFormat, thinkToContent)
-		//err = handleStreamFormat(c, info, lastStreamData, forceFormat, thinkToContent)
+	if shouldSendLastResp && lastStreamData != "" {
+		err = sendStreamItem(lastStreamData)
+		if err != nil {
+			common.SysError("error handling stream format: " + err.Error())
+		}
 	}
 
 	// 处理token计算
@@ -179,6 +190,12 @@ func OaiStreamHandler(c *gin.Context, resp *http.Response, info *relaycommon.Rel
 		common.SysError("error processing tokens: " + err.Error())
 	}
 
+	// 中途中断的响应按已输出的内容计费，不结束客户端的流，由其他渠道续写
+	continueStream := shouldContinueStream(c, info, streamItems, toolCount)
+	if continuation != nil {
+		responseId, createAt, model = continuation.Id, continuation.Created, continuation.Model
+	}
+
 	// 检查是否为空回复或只有空格的回复，如果是则不计费
 	responseText := responseTextBuilder.String()
 	// 保存到 info 中，供日志记录使用
@@ -245,8 +262,14 @@ func OaiStreamHandler(c *gin.Context, resp *http.Response, info *relaycommon.Rel
 	}
 
 	info.Other["output_content"] = responseText // 保存输出内容
+	if continueStream {
+		info.Other["stream_interrupted"] = true
+	}
+	if continuation != nil {
+		info.Other["stream_continuation"] = true
+	}
 
-	if common.IsEmptyOrWhitespace(responseText) && toolCount == 0 {
+	if common.IsEmptyOrWhitespace(responseText) && toolCount == 0 && !continueStream {
 		// 空回复或全是空格不计费，返回零使用量（而不是只设置CompletionTokens为0）
 		zeroUsage := &dto.Usage{
 			PromptTokens:     0,
@@ -254,6 +277,11 @@ func OaiStreamHandler(c *gin.Context, resp *http.Response, info *relaycommon.Rel
 			TotalTokens:      0,
 		}
 		// 直接返回空使用量，结束处理
+		if continuation != nil {
+			totalUsage := continuation.TotalUsage(zeroUsage)
+			handleFinalResponse(c, info, lastStreamData, responseId, createAt, model, systemFingerprint, &totalUsage, false)
+			return nil, zeroUsage
+		}
 		handleFinalResponse(c, info, lastStreamData, responseId, createAt, model, systemFingerprint, zeroUsage, false)
 		return nil, zeroUsage
 	}
@@ -269,6 +297,16 @@ func OaiStreamHandler(c *gin.Context, resp *http.Response, info *relaycommon.Rel
 		}
 	}
 
+	if continueStream {
+		interruptStream(c, info, streamItems, usage)
+		return nil, usage
+	}
+	if continuation != nil {
+		totalUsage := continuation.TotalUsage(usage)
+		handleFinalResponse(c, info, lastStreamData, responseId, createAt, model, systemFingerprint, &totalUsage, containStreamUsage)
+		return nil, usage
+	}
+
 	handleFinalResponse(c, info, lastStreamData, responseId, createAt, model, systemFingerprint, usage, containStreamUsage)
 
 	return nil, usage
@@ -525,6 +563,8 @@ func OpenaiResponsesHandler(c *gin.Context, resp *http.Response, info *relaycomm
 		}, nil
 	}
 
+	c.Set(constant.ContextKeyResponsesResponse, &responsesResponse)
+
 	// reset response body
 	resp.Body = io.NopCloser(bytes.NewBuffer(responseBody))
 	// We shouldn't set the header before we parse the response body, because the parse part may fail.
@@ -543,6 +583,9 @@ func OpenaiResponsesHandler(c *gin.Context, resp *http.Response, info *relaycomm
 	resp.Body.Close()
 	// compute usage
 	usage := dto.Usage{}
+	if responsesResponse.Usage == nil {
+		return nil, &usage
+	}
 	usage.PromptTokens = responsesResponse.Usage.InputTokens
 	usage.CompletionTokens = responsesResponse.Usage.OutputTokens
 	usage.TotalTokens = responsesResponse.Usage.TotalTokens
@@ -565,10 +608,16 @@ func OaiResponsesStreamHandler(c *gin.Context, resp *http.Response, info *relayc
 		if err := common.DecodeJsonStr(data, &streamResponse); err == nil {
 			sendResponsesStreamData(c, streamResponse, data)
 			switch streamResponse.Type {
-			case "response.completed":
-				usage.PromptTokens = streamResponse.Response.Usage.InputTokens
-				usage.CompletionTokens = streamResponse.Response.Usage.OutputTokens
-				usage.TotalTokens = streamResponse.Response.Usage.TotalTokens
+			case dto.ResponsesStreamTypeCompleted, dto.ResponsesStreamTypeIncomplete:
+				if streamResponse.Response == nil {
+					break
+				}
+				c.Set(constant.ContextKeyResponsesResponse, streamResponse.Response)
+				if streamResponse.Response.Usage != nil {
+					usage.PromptTokens = streamResponse.Response.Usage.InputTokens
+					usage.CompletionTokens = streamResponse.Response.Usage.OutputTokens
+					usage.TotalTokens = streamResponse.Response.Usage.TotalTokens
+				}
 			case "response.output_text.delta":
 				// 处理输出文本
 				responseTextBuilder.WriteString(streamResponse.Delta)
@@ -79,7 +79,9 @@ func (a *Adaptor) GetRequestURL(info *relaycommon.RelayInfo) (string, error) {
 	a.AccountCredentials = *adc
 	suffix := ""
 	if a.RequestMode == RequestModeGemini {
-		if info.IsStream {
+		if info.RelayFormat == relaycommon.RelayFormatGemini {
+			suffix = gemini.NativeAction(info)
+		} else if info.IsStream {
 			suffix = "streamGenerateContent?alt=sse"
 		} else {
 			suffix = "generateContent"
@@ -185,6 +187,9 @@ func (a *Adaptor) DoRequest(c *gin.Context, info *relaycommon.RelayInfo, request
 }
 
 func (a *Adaptor) DoResponse(c *gin.Context, resp *http.Response, info *relaycommon.RelayInfo) (usage any, err *dto.OpenAIErrorWithStatusCode) {
+	if a.RequestMode == RequestModeGemini && info.RelayFormat == relaycommon.RelayFormatGemini {
+		return gemini.GeminiNativeHandler(c, resp, info)
+	}
 	if info.IsStream {
 		switch a.RequestMode {
 		case RequestModeClaude:
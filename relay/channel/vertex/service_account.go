@@ -35,7 +35,7 @@ var Cache = asynccache.NewAsyncCache(asynccache.Options{
 })
 
 func getAccessToken(a *Adaptor, info *relaycommon.RelayInfo) (string, error) {
-	cacheKey := fmt.Sprintf("access-token-%d", info.ChannelId)
+	cacheKey := fmt.Sprintf("access-token-%d-%s", info.ChannelId, a.AccountCredentials.ClientEmail)
 	val, err := Cache.Get(cacheKey)
 	if err == nil {
 		return val.(string), nil
@@ -0,0 +1,131 @@
+package relay
+
+import (
+	"encoding/json"
+	"strings"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/relay/channel"
+	relaycommon "veloera/relay/common"
+	"veloera/relay/constant"
+	"veloera/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isClaudeUpstream reports whether the channel speaks the Claude messages API upstream
+func isClaudeUpstream(info *relaycommon.RelayInfo) bool {
+	switch info.ApiType {
+	case constant.APITypeAnthropic, constant.APITypeAws:
+		return true
+	case constant.APITypeVertexAi:
+		return strings.HasPrefix(info.UpstreamModelName, "claude")
+	}
+	return false
+}
+
+// needClaudeCompat reports whether the claude request has to be converted through the OpenAI format
+// and the adaptor's OpenAI output converted back, the openai adaptor handles both directions by itself
+func needClaudeCompat(info *relaycommon.RelayInfo) bool {
+	if isClaudeUpstream(info) {
+		return false
+	}
+	switch info.ApiType {
+	case constant.APITypeOpenAI, constant.APITypeOpenRouter, constant.APITypeXinference:
+		return false
+	}
+	return true
+}
+
+func convertClaudeRequestCompat(c *gin.Context, info *relaycommon.RelayInfo, adaptor channel.Adaptor, request *dto.ClaudeRequest) (any, error) {
+	openAIRequest, err := service.ClaudeToOpenAIRequest(*request, info)
+	if err != nil {
+		return nil, err
+	}
+	if openAIRequest.Stream && info.SupportStreamOptions {
+		openAIRequest.StreamOptions = &dto.StreamOptions{
+			IncludeUsage: true,
+		}
+	}
+	info.PromptMessages = openAIRequest.Messages
+	return adaptor.ConvertOpenAIRequest(c, info, openAIRequest)
+}
+
+// setupClaudeCompat makes the relay info look like a chat completions request,
+// the adaptor then writes OpenAI responses which are converted back by claudeCompatWriter
+func setupClaudeCompat(info *relaycommon.RelayInfo) {
+	info.RelayMode = constant.RelayModeChatCompletions
+	info.RequestURLPath = "/v1/chat/completions"
+	info.RelayFormat = relaycommon.RelayFormatOpenAI
+	info.ShouldIncludeUsage = false
+}
+
+// claudeCompatWriter converts the OpenAI format output written by the adaptor into Claude messages / events
+type claudeCompatWriter struct {
+	*sseCompatWriter
+}
+
+func newClaudeCompatWriter(writer gin.ResponseWriter, info *relaycommon.RelayInfo) *claudeCompatWriter {
+	w := &claudeCompatWriter{}
+	w.sseCompatWriter = newSSECompatWriter(writer, info, w.convertChunk)
+	return w
+}
+
+func (w *claudeCompatWriter) convertChunk(streamResponse *dto.ChatCompletionsStreamResponse) {
+	if service.ValidUsage(streamResponse.Usage) {
+		w.info.ClaudeConvertInfo.Usage = streamResponse.Usage
+	}
+	w.writeClaudeEvents(service.StreamResponseOpenAI2Claude(streamResponse, w.info))
+}
+
+func (w *claudeCompatWriter) writeClaudeEvents(claudeResponses []*dto.ClaudeResponse) {
+	for _, resp := range claudeResponses {
+		w.writeEvent(resp.Type, resp)
+	}
+	w.ResponseWriter.Flush()
+}
+
+// finish sends the closing events of a stream, or the converted message of a non-stream response
+func (w *claudeCompatWriter) finish(usage *dto.Usage) {
+	if w.info.IsStream {
+		if w.info.SendResponseCount == 0 {
+			w.info.SendResponseCount++
+			w.writeClaudeEvents(service.StreamResponseOpenAI2Claude(&dto.ChatCompletionsStreamResponse{}, w.info))
+		}
+		if usage != nil {
+			w.info.ClaudeConvertInfo.Usage = usage
+		}
+		w.info.ClaudeConvertInfo.Done = true
+		w.writeClaudeEvents(service.StreamResponseOpenAI2Claude(&dto.ChatCompletionsStreamResponse{}, w.info))
+		return
+	}
+
+	responseBody := w.buffer.Bytes()
+	var openAIResponse dto.OpenAITextResponse
+	if err := common.DecodeJson(responseBody, &openAIResponse); err == nil && openAIResponse.Error == nil {
+		if usage != nil {
+			openAIResponse.Usage = *usage
+		}
+		claudeResponse := service.ResponseOpenAI2Claude(&openAIResponse, w.info)
+		if claudeBody, err := json.Marshal(claudeResponse); err == nil {
+			responseBody = claudeBody
+		} else {
+			common.SysError("error marshalling claude response: " + err.Error())
+		}
+	}
+	w.writeBody(responseBody)
+}
+
+// claudeCompatUsage turns OpenAI style usage into the claude one expected by PostClaudeConsumeQuota,
+// where prompt tokens do not include cache read tokens
+func claudeCompatUsage(usage *dto.Usage) *dto.Usage {
+	if usage == nil {
+		return &dto.Usage{}
+	}
+	claudeUsage := *usage
+	claudeUsage.PromptTokens -= usage.PromptTokensDetails.CachedTokens
+	if claudeUsage.PromptTokens < 0 {
+		claudeUsage.PromptTokens = 0
+	}
+	return &claudeUsage
+}
@@ -109,7 +109,14 @@ func ClaudeHelper(c *gin.Context) (claudeError *dto.ClaudeErrorWithStatusCode) {
 		relayInfo.UpstreamModelName = textRequest.Model
 	}
 
-	convertedRequest, err := adaptor.ConvertClaudeRequest(c, relayInfo, textRequest)
+	compat := needClaudeCompat(relayInfo)
+	var convertedRequest any
+	if compat {
+		setupClaudeCompat(relayInfo)
+		convertedRequest, err = convertClaudeRequestCompat(c, relayInfo, adaptor, textRequest)
+	} else {
+		convertedRequest, err = adaptor.ConvertClaudeRequest(c, relayInfo, textRequest)
+	}
 	if err != nil {
 		return service.ClaudeErrorWrapperLocal(err, "convert_request_failed", http.StatusInternalServerError)
 	}
@@ -140,14 +147,29 @@ func ClaudeHelper(c *gin.Context) (claudeError *dto.ClaudeErrorWithStatusCode) {
 		}
 	}
 
+	var compatWriter *claudeCompatWriter
+	if compat {
+		compatWriter = newClaudeCompatWriter(c.Writer, relayInfo)
+		c.Writer = compatWriter
+	}
 	usage, openaiErr := adaptor.DoResponse(c, httpResp, relayInfo)
+	if compatWriter != nil {
+		c.Writer = compatWriter.ResponseWriter
+	}
 	//log.Printf("usage: %v", usage)
 	if openaiErr != nil {
 		// reset status code 重置状态码
 		service.ResetStatusCode(openaiErr, statusCodeMappingStr)
 		return service.OpenAIErrorToClaudeError(openaiErr)
 	}
-	service.PostClaudeConsumeQuota(c, relayInfo, usage.(*dto.Usage), preConsumedQuota, userQuota, priceData, "")
+	claudeUsage := usage.(*dto.Usage)
+	if compatWriter != nil {
+		compatWriter.finish(claudeUsage)
+	}
+	if !isClaudeUpstream(relayInfo) {
+		claudeUsage = claudeCompatUsage(claudeUsage)
+	}
+	service.PostClaudeConsumeQuota(c, relayInfo, claudeUsage, preConsumedQuota, userQuota, priceData, "")
 	return nil
 }
 
@@ -28,6 +28,7 @@ const (
 type ClaudeConvertInfo struct {
 	LastMessagesType string
 	Index            int
+	ToolCallId       string
 	Usage            *dto.Usage
 	FinishReason     string
 	Done             bool
@@ -36,6 +37,7 @@ type ClaudeConvertInfo struct {
 const (
 	RelayFormatOpenAI = "openai"
 	RelayFormatClaude = "claude"
+	RelayFormatGemini = "gemini"
 )
 
 type RerankerInfo struct {
@@ -47,7 +49,7 @@ type RelayInfo struct {
 	ChannelType       int
 	ChannelId         int
 	TokenId           int
-	TokenKey          string
+	TokenKeyHash      string
 	UserId            int
 	Group             string
 	TokenUnlimited    bool
@@ -88,6 +90,8 @@ type RelayInfo struct {
 	RelayFormat          string
 	SendResponseCount    int
 	ChannelCreateTime    int64
+	StreamInterrupted    bool                   // 流式响应因超时或读取出错而中断
+	StreamDone           bool                   // 流式响应收到了 [DONE]
 	PromptMessages       interface{}            // 保存请求的消息内容
 	Other                map[string]interface{} // 用于存储额外信息，如输入输出内容
 	ThinkingContentInfo
@@ -108,6 +112,11 @@ var streamSupportedChannels = map[int]bool{
 	common.ChannelTypeXai:        true,
 }
 
+// IsStreamOptionsSupported reports whether the channel type accepts stream_options in chat completions requests
+func IsStreamOptionsSupported(channelType int) bool {
+	return streamSupportedChannels[channelType]
+}
+
 func GenRelayInfoWs(c *gin.Context, ws *websocket.Conn) *RelayInfo {
 	info := GenRelayInfo(c)
 	info.ClientWs = ws
@@ -127,6 +136,17 @@ func GenRelayInfoClaude(c *gin.Context) *RelayInfo {
 	return info
 }
 
+func GenRelayInfoGemini(c *gin.Context) *RelayInfo {
+	info := GenRelayInfo(c)
+	info.RelayFormat = RelayFormatGemini
+	info.ShouldIncludeUsage = false
+	_, action := relayconstant.ParseGeminiModelAction(c.Request.URL.Path)
+	if action == "streamGenerateContent" {
+		info.IsStream = true
+	}
+	return info
+}
+
 func GenRelayInfoRerank(c *gin.Context, req *dto.RerankRequest) *RelayInfo {
 	info := GenRelayInfo(c)
 	info.RelayMode = relayconstant.RelayModeRerank
@@ -144,7 +164,7 @@ func GenRelayInfo(c *gin.Context) *RelayInfo {
 	paramOverride := c.GetStringMap("param_override")
 
 	tokenId := c.GetInt("token_id")
-	tokenKey := c.GetString("token_key")
+	tokenKeyHash := c.GetString("token_key_hash")
 	userId := c.GetInt("id")
 	group := c.GetString("group")
 	tokenUnlimited := c.GetBool("token_unlimited_quota")
@@ -174,7 +194,7 @@ func GenRelayInfo(c *gin.Context) *RelayInfo {
 		ChannelType:       channelType,
 		ChannelId:         channelId,
 		TokenId:           tokenId,
-		TokenKey:          tokenKey,
+		TokenKeyHash:      tokenKeyHash,
 		UserId:            userId,
 		Group:             group,
 		TokenUnlimited:    tokenUnlimited,
@@ -219,6 +239,7 @@ func GenRelayInfo(c *gin.Context) *RelayInfo {
 	if relayconstant.RelayModeResponses == info.RelayMode {
 		info.SupportStreamOptions = false
 	}
+	c.Set(constant.ContextKeyRelayInfo, info)
 	return info
 }
 
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"veloera/constant"
+	"veloera/dto"
+
+	"github.com/gin-gonic/gin"
+)
+
+// StreamContinuation 中途中断的流式响应的续写状态，续写的内容沿用第一段响应的 id、创建时间和模型名
+type StreamContinuation struct {
+	Id          string
+	Created     int64
+	Model       string
+	Text        string    // 已经输出给客户端的内容
+	Segments    int       // 已经中断的段数
+	Usage       dto.Usage // 之前各段已计费的用量
+	Interrupted bool      // 最近一段是否中断，需要在其他渠道上续写
+}
+
+// GetStreamContinuation 获取请求的续写状态，流式响应没有中断过时返回 nil
+func GetStreamContinuation(c *gin.Context) *StreamContinuation {
+	if value, ok := c.Get(constant.ContextKeyStreamContinuation); ok {
+		if continuation, ok := value.(*StreamContinuation); ok {
+			return continuation
+		}
+	}
+	return nil
+}
+
+// Interrupt 记录中断的一段已输出的内容和已计费的用量
+func (s *StreamContinuation) Interrupt(text string, usage *dto.Usage) {
+	s.Text += text
+	s.Segments++
+	s.Interrupted = true
+	if usage != nil {
+		s.Usage.PromptTokens += usage.PromptTokens
+		s.Usage.CompletionTokens += usage.CompletionTokens
+		s.Usage.TotalTokens += usage.TotalTokens
+	}
+}
+
+// TotalUsage 返回加上之前各段用量后的用量，用于返回给客户端
+func (s *StreamContinuation) TotalUsage(usage *dto.Usage) dto.Usage {
+	total := s.Usage
+	if usage != nil {
+		total.PromptTokens += usage.PromptTokens
+		total.CompletionTokens += usage.CompletionTokens
+		total.TotalTokens += usage.TotalTokens
+	}
+	return total
+}
@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"veloera/common"
+	"veloera/dto"
+	relaycommon "veloera/relay/common"
+
+	"github.com/gin-gonic/gin"
+)
+
+// sseCompatWriter buffers the OpenAI format output written by the adaptor. Stream chunks are decoded line by line
+// and handed to onChunk, a non-stream body is kept until the format specific finish converts it as a whole
+type sseCompatWriter struct {
+	gin.ResponseWriter
+	info       *relaycommon.RelayInfo
+	buffer     bytes.Buffer
+	statusCode int
+	onChunk    func(streamResponse *dto.ChatCompletionsStreamResponse)
+}
+
+func newSSECompatWriter(writer gin.ResponseWriter, info *relaycommon.RelayInfo, onChunk func(*dto.ChatCompletionsStreamResponse)) *sseCompatWriter {
+	return &sseCompatWriter{
+		ResponseWriter: writer,
+		info:           info,
+		statusCode:     http.StatusOK,
+		onChunk:        onChunk,
+	}
+}
+
+func (w *sseCompatWriter) WriteHeader(code int) {
+	if w.info.IsStream {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.statusCode = code
+}
+
+func (w *sseCompatWriter) WriteHeaderNow() {
+	if w.info.IsStream {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *sseCompatWriter) Write(data []byte) (int, error) {
+	w.buffer.Write(data)
+	if w.info.IsStream {
+		w.processStreamLines()
+	}
+	return len(data), nil
+}
+
+func (w *sseCompatWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func (w *sseCompatWriter) Flush() {
+	if w.info.IsStream {
+		w.ResponseWriter.Flush()
+	}
+}
+
+func (w *sseCompatWriter) processStreamLines() {
+	for {
+		data := w.buffer.Bytes()
+		idx := bytes.IndexByte(data, '\n')
+		if idx < 0 {
+			return
+		}
+		line := strings.TrimSuffix(string(data[:idx]), "\r")
+		w.buffer.Next(idx + 1)
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		if line == "" || line == "[DONE]" {
+			continue
+		}
+		var streamResponse dto.ChatCompletionsStreamResponse
+		if err := common.DecodeJsonStr(line, &streamResponse); err != nil {
+			common.SysError("error unmarshalling stream response: " + err.Error())
+			continue
+		}
+		w.info.SendResponseCount++
+		w.onChunk(&streamResponse)
+	}
+}
+
+// writeEvent writes one converted stream event, the event line is omitted when event is empty
+func (w *sseCompatWriter) writeEvent(event string, data any) {
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		common.SysError("error marshalling stream response: " + err.Error())
+		return
+	}
+	if event != "" {
+		_, _ = w.ResponseWriter.WriteString(fmt.Sprintf("event: %s\n", event))
+	}
+	_, _ = w.ResponseWriter.WriteString(fmt.Sprintf("data: %s\n\n", jsonData))
+}
+
+// writeBody writes the converted body of a non-stream response with the status code kept by WriteHeader
+func (w *sseCompatWriter) writeBody(responseBody []byte) {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.ResponseWriter.WriteHeader(w.statusCode)
+	_, err := w.ResponseWriter.Write(responseBody)
+	if err != nil {
+		common.SysError("error writing response: " + err.Error())
+	}
+}
@@ -42,6 +42,13 @@ const (
 	RelayModeResponses
 
 	RelayModeRealtime
+
+	RelayModeGemini
+	RelayModeGeminiCountTokens
+	RelayModeGeminiEmbedContent
+
+	RelayModeImagesEdits
+	RelayModeImagesVariations
 )
 
 func Path2RelayMode(path string) int {
@@ -58,6 +65,10 @@ func Path2RelayMode(path string) int {
 		relayMode = RelayModeModerations
 	} else if strings.HasPrefix(path, "/v1/images/generations") {
 		relayMode = RelayModeImagesGenerations
+	} else if strings.HasPrefix(path, "/v1/images/edits") {
+		relayMode = RelayModeImagesEdits
+	} else if strings.HasPrefix(path, "/v1/images/variations") {
+		relayMode = RelayModeImagesVariations
 	} else if strings.HasPrefix(path, "/v1/edits") {
 		relayMode = RelayModeEdits
 	} else if strings.HasPrefix(path, "/v1/responses") {
@@ -72,10 +83,37 @@ func Path2RelayMode(path string) int {
 		relayMode = RelayModeRerank
 	} else if strings.HasPrefix(path, "/v1/realtime") {
 		relayMode = RelayModeRealtime
+	} else if strings.HasPrefix(path, "/v1beta/models/") {
+		relayMode = Path2RelayModeGemini(path)
 	}
 	return relayMode
 }
 
+// Path2RelayModeGemini 根据 gemini 原生接口的 action 获取 relay mode
+// /v1beta/models/{model}:{action}
+func Path2RelayModeGemini(path string) int {
+	_, action := ParseGeminiModelAction(path)
+	switch action {
+	case "generateContent", "streamGenerateContent":
+		return RelayModeGemini
+	case "countTokens":
+		return RelayModeGeminiCountTokens
+	case "embedContent":
+		return RelayModeGeminiEmbedContent
+	}
+	return RelayModeUnknown
+}
+
+// ParseGeminiModelAction 从 gemini 原生接口路径中解析模型名称和 action
+func ParseGeminiModelAction(path string) (string, string) {
+	path = path[strings.LastIndex(path, "/")+1:]
+	idx := strings.LastIndex(path, ":")
+	if idx < 0 {
+		return path, ""
+	}
+	return path[:idx], path[idx+1:]
+}
+
 func Path2RelayModeMidjourney(path string) int {
 	relayMode := RelayModeUnknown
 	if strings.HasSuffix(path, "/mj/submit/action") {
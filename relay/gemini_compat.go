@@ -0,0 +1,199 @@
+package relay
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/relay/channel/gemini"
+	relaycommon "veloera/relay/common"
+	"veloera/relay/constant"
+
+	"github.com/gin-gonic/gin"
+)
+
+// isGeminiUpstream reports whether the channel accepts gemini native requests, these are passed through as is
+func isGeminiUpstream(info *relaycommon.RelayInfo) bool {
+	switch info.ApiType {
+	case constant.APITypeGemini:
+		return true
+	case constant.APITypeVertexAi:
+		return strings.HasPrefix(info.UpstreamModelName, "gemini") && info.RelayMode != constant.RelayModeGeminiEmbedContent
+	}
+	return false
+}
+
+// setupGeminiCompat makes the relay info look like a chat completions or embeddings request,
+// the adaptor then writes OpenAI responses which are converted back by geminiCompatWriter
+func setupGeminiCompat(info *relaycommon.RelayInfo) {
+	if info.RelayMode == constant.RelayModeGeminiEmbedContent {
+		info.RelayMode = constant.RelayModeEmbeddings
+		info.RequestURLPath = "/v1/embeddings"
+	} else {
+		info.RelayMode = constant.RelayModeChatCompletions
+		info.RequestURLPath = "/v1/chat/completions"
+	}
+	info.RelayFormat = relaycommon.RelayFormatOpenAI
+	info.ShouldIncludeUsage = false
+}
+
+type geminiCompatToolCall struct {
+	name      string
+	arguments strings.Builder
+}
+
+// geminiCompatWriter converts the OpenAI format output written by the adaptor into gemini responses
+type geminiCompatWriter struct {
+	*sseCompatWriter
+	embedding     bool
+	toolCalls     map[int][]*geminiCompatToolCall
+	finishReasons map[int]string
+}
+
+func newGeminiCompatWriter(writer gin.ResponseWriter, info *relaycommon.RelayInfo) *geminiCompatWriter {
+	w := &geminiCompatWriter{
+		embedding:     info.RelayMode == constant.RelayModeEmbeddings,
+		toolCalls:     make(map[int][]*geminiCompatToolCall),
+		finishReasons: make(map[int]string),
+	}
+	w.sseCompatWriter = newSSECompatWriter(writer, info, w.convertChunk)
+	return w
+}
+
+func (w *geminiCompatWriter) convertChunk(streamResponse *dto.ChatCompletionsStreamResponse) {
+	if geminiResponse := w.convertStreamResponse(streamResponse); geminiResponse != nil {
+		w.writeGeminiData(geminiResponse)
+	}
+}
+
+// convertStreamResponse turns the text of a chunk into a gemini chunk, tool calls are collected
+// until the end of the stream because gemini sends every function call in one piece
+func (w *geminiCompatWriter) convertStreamResponse(streamResponse *dto.ChatCompletionsStreamResponse) *gemini.GeminiChatResponse {
+	candidates := make([]gemini.GeminiChatCandidate, 0, len(streamResponse.Choices))
+	for _, choice := range streamResponse.Choices {
+		if choice.FinishReason != nil && *choice.FinishReason != "" {
+			w.finishReasons[choice.Index] = *choice.FinishReason
+		}
+		for _, toolCall := range choice.Delta.ToolCalls {
+			toolCalls := w.toolCalls[choice.Index]
+			idx := len(toolCalls) - 1
+			if toolCall.Index != nil {
+				idx = *toolCall.Index
+				for len(toolCalls) <= idx {
+					toolCalls = append(toolCalls, &geminiCompatToolCall{})
+				}
+			} else if toolCall.ID != "" || idx < 0 {
+				toolCalls = append(toolCalls, &geminiCompatToolCall{})
+				idx = len(toolCalls) - 1
+			}
+			if toolCall.Function.Name != "" {
+				toolCalls[idx].name = toolCall.Function.Name
+			}
+			toolCalls[idx].arguments.WriteString(toolCall.Function.Arguments)
+			w.toolCalls[choice.Index] = toolCalls
+		}
+		parts := make([]gemini.GeminiPart, 0, 2)
+		if reasoning := choice.Delta.GetReasoningContent(); reasoning != "" {
+			parts = append(parts, gemini.GeminiPart{Text: reasoning, Thought: true})
+		}
+		if content := choice.Delta.GetContentString(); content != "" {
+			parts = append(parts, gemini.GeminiPart{Text: content})
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		candidates = append(candidates, gemini.GeminiChatCandidate{
+			Content: gemini.GeminiChatContent{
+				Role:  "model",
+				Parts: parts,
+			},
+			Index: int64(choice.Index),
+		})
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	return &gemini.GeminiChatResponse{Candidates: candidates}
+}
+
+func (w *geminiCompatWriter) writeGeminiData(geminiResponse *gemini.GeminiChatResponse) {
+	w.writeEvent("", geminiResponse)
+	w.ResponseWriter.Flush()
+}
+
+// finish sends the last chunk carrying the function calls, finish reason and usage of a stream,
+// or the converted response of a non-stream request
+func (w *geminiCompatWriter) finish(usage *dto.Usage) {
+	if w.info.IsStream {
+		w.writeGeminiData(w.lastStreamResponse(usage))
+		return
+	}
+
+	responseBody := w.buffer.Bytes()
+	var geminiResponse any
+	if w.embedding {
+		var openAIResponse dto.OpenAIEmbeddingResponse
+		if err := common.DecodeJson(responseBody, &openAIResponse); err == nil {
+			geminiResponse = gemini.EmbeddingResponseOpenAI2Gemini(&openAIResponse)
+		}
+	} else {
+		var openAIResponse dto.OpenAITextResponse
+		if err := common.DecodeJson(responseBody, &openAIResponse); err == nil && openAIResponse.Error == nil {
+			if usage != nil {
+				openAIResponse.Usage = *usage
+			}
+			geminiResponse = gemini.ResponseOpenAI2Gemini(&openAIResponse)
+		}
+	}
+	if geminiResponse != nil {
+		if geminiBody, err := json.Marshal(geminiResponse); err == nil {
+			responseBody = geminiBody
+		} else {
+			common.SysError("error marshalling gemini response: " + err.Error())
+		}
+	}
+	w.writeBody(responseBody)
+}
+
+func (w *geminiCompatWriter) lastStreamResponse(usage *dto.Usage) *gemini.GeminiChatResponse {
+	indexes := make([]int, 0, len(w.finishReasons))
+	for index := range w.finishReasons {
+		indexes = append(indexes, index)
+	}
+	for index := range w.toolCalls {
+		if _, ok := w.finishReasons[index]; !ok {
+			indexes = append(indexes, index)
+		}
+	}
+	if len(indexes) == 0 {
+		indexes = append(indexes, 0)
+	}
+	sort.Ints(indexes)
+
+	candidates := make([]gemini.GeminiChatCandidate, 0, len(indexes))
+	for _, index := range indexes {
+		parts := make([]gemini.GeminiPart, 0, len(w.toolCalls[index]))
+		for _, toolCall := range w.toolCalls[index] {
+			parts = append(parts, gemini.GeminiPart{
+				FunctionCall: gemini.FunctionCallOpenAI2Gemini(toolCall.name, toolCall.arguments.String()),
+			})
+		}
+		if len(parts) == 0 {
+			parts = append(parts, gemini.GeminiPart{Text: ""})
+		}
+		finishReason := gemini.FinishReasonOpenAI2Gemini(w.finishReasons[index])
+		candidates = append(candidates, gemini.GeminiChatCandidate{
+			Content: gemini.GeminiChatContent{
+				Role:  "model",
+				Parts: parts,
+			},
+			FinishReason: &finishReason,
+			Index:        int64(index),
+		})
+	}
+	return &gemini.GeminiChatResponse{
+		Candidates:    candidates,
+		UsageMetadata: gemini.UsageOpenAI2Gemini(usage),
+	}
+}
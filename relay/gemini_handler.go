@@ -0,0 +1,173 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/relay/channel/gemini"
+	relaycommon "veloera/relay/common"
+	relayconstant "veloera/relay/constant"
+	"veloera/relay/helper"
+	"veloera/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+func GeminiHelper(c *gin.Context) (openaiErr *dto.OpenAIErrorWithStatusCode) {
+	relayInfo := relaycommon.GenRelayInfoGemini(c)
+	if relayInfo.RelayMode == relayconstant.RelayModeUnknown {
+		return service.OpenAIErrorWrapperLocal(errors.New("unsupported gemini action"), "invalid_gemini_request", http.StatusNotFound)
+	}
+
+	body, err := common.GetRequestBody(c)
+	if err != nil {
+		return service.OpenAIErrorWrapperLocal(err, "get_request_body_failed", http.StatusInternalServerError)
+	}
+
+	err = helper.ModelMappedHelper(c, relayInfo)
+	if err != nil {
+		return service.OpenAIErrorWrapperLocal(err, "model_mapped_error", http.StatusInternalServerError)
+	}
+
+	// 非 gemini 渠道使用转换后的 OpenAI 请求，同时用于计算 promptTokens
+	var textRequest *dto.GeneralOpenAIRequest
+	var embeddingRequest *dto.EmbeddingRequest
+	var maxTokens int
+	if relayInfo.RelayMode == relayconstant.RelayModeGeminiEmbedContent {
+		geminiRequest := &gemini.GeminiEmbeddingRequest{}
+		if err = json.Unmarshal(body, geminiRequest); err != nil {
+			return service.OpenAIErrorWrapperLocal(err, "invalid_gemini_request", http.StatusBadRequest)
+		}
+		embeddingRequest = gemini.EmbeddingRequestGemini2OpenAI(geminiRequest, relayInfo.UpstreamModelName)
+		relayInfo.PromptTokens = getEmbeddingPromptToken(*embeddingRequest)
+	} else {
+		geminiRequest := &gemini.GeminiChatRequest{}
+		if err = json.Unmarshal(body, geminiRequest); err != nil {
+			return service.OpenAIErrorWrapperLocal(err, "invalid_gemini_request", http.StatusBadRequest)
+		}
+		if len(geminiRequest.Contents) == 0 {
+			return service.OpenAIErrorWrapperLocal(errors.New("field contents is required"), "invalid_gemini_request", http.StatusBadRequest)
+		}
+		textRequest, err = gemini.RequestGemini2OpenAI(geminiRequest, relayInfo.UpstreamModelName, relayInfo.IsStream)
+		if err != nil {
+			return service.OpenAIErrorWrapperLocal(err, "invalid_gemini_request", http.StatusBadRequest)
+		}
+		relayInfo.PromptTokens, err = service.CountTokenChatRequest(relayInfo, *textRequest)
+		if err != nil {
+			return service.OpenAIErrorWrapperLocal(err, "count_token_messages_failed", http.StatusInternalServerError)
+		}
+		maxTokens = int(textRequest.MaxTokens)
+	}
+
+	native := isGeminiUpstream(relayInfo)
+
+	// countTokens 不计费，非 gemini 渠道直接返回本地计算结果
+	billing := relayInfo.RelayMode != relayconstant.RelayModeGeminiCountTokens
+	if !billing && !native {
+		c.JSON(http.StatusOK, gemini.GeminiCountTokensResponse{TotalTokens: relayInfo.PromptTokens})
+		return nil
+	}
+
+	var priceData helper.PriceData
+	var preConsumedQuota, userQuota int
+	if billing {
+		priceData, err = helper.ModelPriceHelper(c, relayInfo, relayInfo.PromptTokens, maxTokens)
+		if err != nil {
+			return service.OpenAIErrorWrapperLocal(err, "model_price_error", http.StatusInternalServerError)
+		}
+
+		// pre-consume quota 预消耗配额
+		preConsumedQuota, userQuota, openaiErr = preConsumeQuota(c, priceData.ShouldPreConsumedQuota, relayInfo)
+		if openaiErr != nil {
+			return openaiErr
+		}
+		defer func() {
+			if openaiErr != nil {
+				returnPreConsumedQuota(c, relayInfo, userQuota, preConsumedQuota)
+			}
+		}()
+	}
+
+	adaptor := GetAdaptor(relayInfo.ApiType)
+	if adaptor == nil {
+		return service.OpenAIErrorWrapperLocal(fmt.Errorf("invalid api type: %d", relayInfo.ApiType), "invalid_api_type", http.StatusBadRequest)
+	}
+	adaptor.Init(relayInfo)
+
+	var requestBody io.Reader
+	if native {
+		requestBody = bytes.NewBuffer(body)
+	} else {
+		setupGeminiCompat(relayInfo)
+		var convertedRequest any
+		if embeddingRequest != nil {
+			convertedRequest, err = adaptor.ConvertEmbeddingRequest(c, relayInfo, *embeddingRequest)
+		} else {
+			if textRequest.Stream && relayInfo.SupportStreamOptions {
+				textRequest.StreamOptions = &dto.StreamOptions{
+					IncludeUsage: true,
+				}
+			}
+			relayInfo.PromptMessages = textRequest.Messages
+			convertedRequest, err = adaptor.ConvertOpenAIRequest(c, relayInfo, textRequest)
+		}
+		if err != nil {
+			return service.OpenAIErrorWrapperLocal(err, "convert_request_failed", http.StatusInternalServerError)
+		}
+		jsonData, err := json.Marshal(convertedRequest)
+		if err != nil {
+			return service.OpenAIErrorWrapperLocal(err, "json_marshal_failed", http.StatusInternalServerError)
+		}
+		if common.DebugEnabled {
+			println("requestBody: ", string(jsonData))
+		}
+		requestBody = bytes.NewBuffer(jsonData)
+	}
+
+	var httpResp *http.Response
+	resp, err := adaptor.DoRequest(c, relayInfo, requestBody)
+	if err != nil {
+		return service.OpenAIErrorWrapper(err, "do_request_failed", http.StatusInternalServerError)
+	}
+
+	statusCodeMappingStr := c.GetString("status_code_mapping")
+
+	if resp != nil {
+		httpResp = resp.(*http.Response)
+		relayInfo.IsStream = relayInfo.IsStream || strings.HasPrefix(httpResp.Header.Get("Content-Type"), "text/event-stream")
+		if httpResp.StatusCode != http.StatusOK {
+			openaiErr = service.RelayErrorHandler(httpResp, false)
+			// reset status code 重置状态码
+			service.ResetStatusCode(openaiErr, statusCodeMappingStr)
+			return openaiErr
+		}
+	}
+
+	var compatWriter *geminiCompatWriter
+	if !native {
+		compatWriter = newGeminiCompatWriter(c.Writer, relayInfo)
+		c.Writer = compatWriter
+	}
+	usage, openaiErr := adaptor.DoResponse(c, httpResp, relayInfo)
+	if compatWriter != nil {
+		c.Writer = compatWriter.ResponseWriter
+	}
+	if openaiErr != nil {
+		// reset status code 重置状态码
+		service.ResetStatusCode(openaiErr, statusCodeMappingStr)
+		return openaiErr
+	}
+	if compatWriter != nil {
+		compatWriter.finish(usage.(*dto.Usage))
+	}
+	if billing {
+		postConsumeQuota(c, relayInfo, usage.(*dto.Usage), preConsumedQuota, userQuota, priceData, "")
+	}
+	return nil
+}
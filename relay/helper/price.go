@@ -37,8 +37,23 @@ func ModelPriceHelper(c *gin.Context, info *relaycommon.RelayInfo, promptTokens
 		modelNameForRatio = info.UpstreamModelName
 	}
 
+	// 微调模型没有单独设置时，按基础模型计费并乘以微调倍率
+	fineTunedRatio := 1.0
+	if baseModel, ratio, ok := operation_setting.GetFineTunedModelRatio(modelNameForRatio); ok {
+		modelNameForPrice = baseModel
+		modelNameForRatio = baseModel
+		fineTunedRatio = ratio
+	}
+
 	modelPrice, usePrice := operation_setting.GetModelPrice(modelNameForPrice, false)
+	if usePrice {
+		modelPrice *= fineTunedRatio
+	}
 	groupRatio := setting.GetGroupRatio(info.Group)
+	if _, ok := c.Get(constant2.ContextKeyBatchUsage); ok {
+		// 批处理请求按折扣计费
+		groupRatio *= operation_setting.GetBatchSetting().DiscountRatio
+	}
 	var preConsumedQuota int
 	var modelRatio float64
 	var completionRatio float64
@@ -63,6 +78,7 @@ func ModelPriceHelper(c *gin.Context, info *relaycommon.RelayInfo, promptTokens
 				return PriceData{}, fmt.Errorf("模型 %s 倍率或价格未配置，请联系管理员设置或开始自用模式；Model %s ratio or price not set, please set or start self-use mode", info.OriginModelName, info.OriginModelName)
 			}
 		}
+		modelRatio *= fineTunedRatio
 		completionRatio = operation_setting.GetCompletionRatio(modelNameForRatio)
 		cacheRatio, _ = operation_setting.GetCacheRatio(modelNameForRatio)
 		cacheCreationRatio, _ = operation_setting.GetCreateCacheRatio(modelNameForRatio)
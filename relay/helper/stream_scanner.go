@@ -43,6 +43,7 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 		ticker     = time.NewTicker(streamingTimeout)
 		pingTicker *time.Ticker
 		writeMutex sync.Mutex // Mutex to protect concurrent writes
+		stopped    bool       // 超时后不再处理数据，避免与后续的续写请求同时写入
 	)
 
 	generalSettings := operation_setting.GetGeneralSetting()
@@ -119,17 +120,30 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 			if !strings.HasPrefix(data, "[DONE]") {
 				info.SetFirstResponseTime()
 				writeMutex.Lock() // Lock before writing
+				if stopped {
+					writeMutex.Unlock()
+					break
+				}
 				success := dataHandler(data)
 				writeMutex.Unlock() // Unlock after writing
 				if !success {
 					break
 				}
+			} else {
+				writeMutex.Lock()
+				info.StreamDone = true
+				writeMutex.Unlock()
 			}
 		}
 
 		if err := scanner.Err(); err != nil {
 			if err != io.EOF {
 				common.LogError(c, "scanner error: "+err.Error())
+				writeMutex.Lock()
+				if !stopped {
+					info.StreamInterrupted = true
+				}
+				writeMutex.Unlock()
 			}
 		}
 
@@ -140,6 +154,10 @@ func StreamScannerHandler(c *gin.Context, resp *http.Response, info *relaycommon
 	case <-ticker.C:
 		// 超时处理逻辑
 		common.LogError(c, "streaming timeout")
+		writeMutex.Lock()
+		stopped = true
+		info.StreamInterrupted = true
+		writeMutex.Unlock()
 		common.SafeSendBool(stopChan, true)
 	case <-stopChan:
 		// 正常结束
@@ -8,14 +8,18 @@ import (
 	"github.com/gin-gonic/gin"
 	"io"
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 	"veloera/common"
 	"veloera/dto"
 	"veloera/model"
 	relaycommon "veloera/relay/common"
+	relayconstant "veloera/relay/constant"
 	"veloera/relay/helper"
 	"veloera/service"
 	"veloera/setting"
+	"veloera/setting/model_setting"
 )
 
 func getAndValidImageRequest(c *gin.Context, info *relaycommon.RelayInfo) (*dto.ImageRequest, error) {
@@ -70,34 +74,139 @@ func getAndValidImageRequest(c *gin.Context, info *relaycommon.RelayInfo) (*dto.
 	return imageRequest, nil
 }
 
-func ImageHelper(c *gin.Context) *dto.OpenAIErrorWithStatusCode {
-	relayInfo := relaycommon.GenRelayInfo(c)
+var dallE2ImageSizes = map[string]bool{"256x256": true, "512x512": true, "1024x1024": true}
+var gptImageSizes = map[string]bool{"auto": true, "1024x1024": true, "1536x1024": true, "1024x1536": true}
+var imageSizePattern = regexp.MustCompile(`^\d+x\d+$`)
 
-	imageRequest, err := getAndValidImageRequest(c, relayInfo)
-	if err != nil {
-		common.LogError(c, fmt.Sprintf("getAndValidImageRequest failed: %s", err.Error()))
-		return service.OpenAIErrorWrapper(err, "invalid_image_request", http.StatusBadRequest)
-	}
+const (
+	dallE2MaxImageSize = 4 << 20
+	maxEditImageSize   = 50 << 20
+)
 
-	err = helper.ModelMappedHelper(c, relayInfo)
-	if err != nil {
-		return service.OpenAIErrorWrapperLocal(err, "model_mapped_error", http.StatusInternalServerError)
+// getAndValidImageEditRequest 解析 /v1/images/edits 和 /v1/images/variations 的 multipart 表单，图片文件由适配器从表单中读取
+func getAndValidImageEditRequest(c *gin.Context, info *relaycommon.RelayInfo) (*dto.ImageRequest, error) {
+	imageRequest := &dto.ImageRequest{
+		Model:          info.OriginModelName,
+		Prompt:         c.PostForm("prompt"),
+		Size:           c.PostForm("size"),
+		Quality:        c.PostForm("quality"),
+		ResponseFormat: c.PostForm("response_format"),
+		User:           c.PostForm("user"),
+	}
+	if n := c.PostForm("n"); n != "" {
+		var err error
+		imageRequest.N, err = strconv.Atoi(n)
+		if err != nil {
+			return nil, errors.New("n must be an integer")
+		}
+	}
+	if imageRequest.N == 0 {
+		imageRequest.N = 1
+	}
+	if imageRequest.N < 1 || imageRequest.N > 10 {
+		return nil, errors.New("n must be between 1 and 10")
+	}
+	if info.RelayMode == relayconstant.RelayModeImagesEdits && imageRequest.Prompt == "" {
+		return nil, errors.New("prompt is required")
 	}
 
-	imageRequest.Model = relayInfo.UpstreamModelName
+	isDallE2 := imageRequest.Model == "dall-e-2" || imageRequest.Model == "dall-e"
+	if strings.Contains(imageRequest.Size, "×") {
+		return nil, errors.New("size an unexpected error occurred in the parameter, please use 'x' instead of the multiplication sign '×'")
+	}
+	if imageRequest.Size == "" {
+		imageRequest.Size = "1024x1024"
+	}
+	if isDallE2 {
+		if !dallE2ImageSizes[imageRequest.Size] {
+			return nil, errors.New("size must be one of 256x256, 512x512, or 1024x1024")
+		}
+	} else if strings.HasPrefix(imageRequest.Model, "gpt-image") {
+		if !gptImageSizes[imageRequest.Size] {
+			return nil, errors.New("size must be one of 1024x1024, 1536x1024, 1024x1536, or auto")
+		}
+	} else if imageRequest.Size != "auto" && !imageSizePattern.MatchString(imageRequest.Size) {
+		return nil, errors.New("size must be in the format of {width}x{height}")
+	}
 
-	priceData, err := helper.ModelPriceHelper(c, relayInfo, 0, 0)
+	images, mask, err := service.GetImageEditFiles(c)
 	if err != nil {
-		return service.OpenAIErrorWrapperLocal(err, "model_price_error", http.StatusInternalServerError)
+		return nil, err
 	}
-	if !priceData.UsePrice {
-		// modelRatio 16 = modelPrice $0.04
-		// per 1 modelRatio = $0.04 / 16
-		priceData.ModelPrice = 0.0025 * priceData.ModelRatio
+	if len(images) == 0 {
+		return nil, errors.New("image is required")
+	}
+	if (isDallE2 || info.RelayMode == relayconstant.RelayModeImagesVariations) && len(images) > 1 {
+		return nil, errors.New("only one image is supported")
+	}
+	maxSize := int64(maxEditImageSize)
+	if isDallE2 {
+		maxSize = dallE2MaxImageSize
+	}
+	for _, image := range images {
+		if image.Size > maxSize {
+			return nil, fmt.Errorf("image must be less than %dMB", maxSize>>20)
+		}
+		mimeType, err := service.DetectImageFileType(image)
+		if err != nil {
+			return nil, err
+		}
+		if isDallE2 && mimeType != "image/png" {
+			return nil, errors.New("image must be a png file")
+		}
+		if !strings.HasPrefix(mimeType, "image/") {
+			return nil, fmt.Errorf("unsupported image type: %s", mimeType)
+		}
+	}
+	if mask != nil {
+		if info.RelayMode == relayconstant.RelayModeImagesVariations {
+			return nil, errors.New("mask is not supported for image variations")
+		}
+		if mask.Size > maxSize {
+			return nil, fmt.Errorf("mask must be less than %dMB", maxSize>>20)
+		}
+		mimeType, err := service.DetectImageFileType(mask)
+		if err != nil {
+			return nil, err
+		}
+		if mimeType != "image/png" {
+			return nil, errors.New("mask must be a png file")
+		}
 	}
 
-	userQuota, err := model.GetUserQuota(relayInfo.UserId, false)
+	if setting.ShouldCheckPromptSensitive() && imageRequest.Prompt != "" {
+		words, err := service.CheckSensitiveInput(imageRequest.Prompt)
+		if err != nil {
+			common.LogWarn(c, fmt.Sprintf("user sensitive words detected: %s", strings.Join(words, ",")))
+			return nil, err
+		}
+	}
+	return imageRequest, nil
+}
+
+// checkImageEditSupported 检查渠道是否支持图片编辑 / 变体，OpenAI 兼容渠道直接转发表单，Gemini 和阿里转换为原生接口
+func checkImageEditSupported(info *relaycommon.RelayInfo, hasMask bool) error {
+	switch info.ApiType {
+	case relayconstant.APITypeOpenAI:
+		return nil
+	case relayconstant.APITypeGemini:
+		if info.RelayMode != relayconstant.RelayModeImagesEdits || !model_setting.IsGeminiModelSupportImagine(info.UpstreamModelName) {
+			break
+		}
+		if hasMask {
+			return errors.New("mask is not supported by gemini image models")
+		}
+		return nil
+	case relayconstant.APITypeAli:
+		if info.RelayMode == relayconstant.RelayModeImagesEdits {
+			return nil
+		}
+	}
+	return fmt.Errorf("model %s of this channel does not support %s", info.UpstreamModelName, strings.TrimPrefix(info.RequestURLPath, "/v1/"))
+}
 
+// getImagePriceRatio 按尺寸和品质计算单张图片的价格倍率
+func getImagePriceRatio(imageRequest *dto.ImageRequest) float64 {
 	sizeRatio := 1.0
 	// Size
 	if imageRequest.Size == "256x256" {
@@ -108,6 +217,8 @@ func ImageHelper(c *gin.Context) *dto.OpenAIErrorWithStatusCode {
 		sizeRatio = 1
 	} else if imageRequest.Size == "1024x1792" || imageRequest.Size == "1792x1024" {
 		sizeRatio = 2
+	} else if imageRequest.Size == "1536x1024" || imageRequest.Size == "1024x1536" {
+		sizeRatio = 1.5
 	}
 
 	qualityRatio := 1.0
@@ -117,8 +228,53 @@ func ImageHelper(c *gin.Context) *dto.OpenAIErrorWithStatusCode {
 			qualityRatio = 1.5
 		}
 	}
+	return sizeRatio * qualityRatio
+}
 
-	priceData.ModelPrice *= sizeRatio * qualityRatio * float64(imageRequest.N)
+func ImageHelper(c *gin.Context) *dto.OpenAIErrorWithStatusCode {
+	relayInfo := relaycommon.GenRelayInfo(c)
+
+	var imageRequest *dto.ImageRequest
+	var err error
+	isEdit := relayInfo.RelayMode == relayconstant.RelayModeImagesEdits || relayInfo.RelayMode == relayconstant.RelayModeImagesVariations
+	if isEdit {
+		imageRequest, err = getAndValidImageEditRequest(c, relayInfo)
+	} else {
+		imageRequest, err = getAndValidImageRequest(c, relayInfo)
+	}
+	if err != nil {
+		common.LogError(c, fmt.Sprintf("getAndValidImageRequest failed: %s", err.Error()))
+		return service.OpenAIErrorWrapper(err, "invalid_image_request", http.StatusBadRequest)
+	}
+
+	err = helper.ModelMappedHelper(c, relayInfo)
+	if err != nil {
+		return service.OpenAIErrorWrapperLocal(err, "model_mapped_error", http.StatusInternalServerError)
+	}
+
+	imageRequest.Model = relayInfo.UpstreamModelName
+
+	if isEdit {
+		_, mask, _ := service.GetImageEditFiles(c)
+		if err = checkImageEditSupported(relayInfo, mask != nil); err != nil {
+			return service.OpenAIErrorWrapperLocal(err, "image_edit_not_supported", http.StatusBadRequest)
+		}
+	}
+	c.Set("response_format", imageRequest.ResponseFormat)
+
+	priceData, err := helper.ModelPriceHelper(c, relayInfo, 0, 0)
+	if err != nil {
+		return service.OpenAIErrorWrapperLocal(err, "model_price_error", http.StatusInternalServerError)
+	}
+	if !priceData.UsePrice {
+		// modelRatio 16 = modelPrice $0.04
+		// per 1 modelRatio = $0.04 / 16
+		priceData.ModelPrice = 0.0025 * priceData.ModelRatio
+	}
+
+	userQuota, err := model.GetUserQuota(relayInfo.UserId, false)
+
+	priceData.ModelPrice *= getImagePriceRatio(imageRequest) * float64(imageRequest.N)
 	quota := int(priceData.ModelPrice * priceData.GroupRatio * common.QuotaPerUnit)
 
 	if userQuota-quota < 0 {
@@ -138,11 +294,16 @@ func ImageHelper(c *gin.Context) *dto.OpenAIErrorWithStatusCode {
 		return service.OpenAIErrorWrapperLocal(err, "convert_request_failed", http.StatusInternalServerError)
 	}
 
-	jsonData, err := json.Marshal(convertedRequest)
-	if err != nil {
-		return service.OpenAIErrorWrapperLocal(err, "json_marshal_failed", http.StatusInternalServerError)
+	if reader, ok := convertedRequest.(io.Reader); ok {
+		// multipart 表单请求
+		requestBody = reader
+	} else {
+		jsonData, err := json.Marshal(convertedRequest)
+		if err != nil {
+			return service.OpenAIErrorWrapperLocal(err, "json_marshal_failed", http.StatusInternalServerError)
+		}
+		requestBody = bytes.NewBuffer(jsonData)
 	}
-	requestBody = bytes.NewBuffer(jsonData)
 
 	statusCodeMappingStr := c.GetString("status_code_mapping")
 
@@ -180,6 +341,11 @@ func ImageHelper(c *gin.Context) *dto.OpenAIErrorWithStatusCode {
 	}
 
 	logContent := fmt.Sprintf("大小 %s, 品质 %s", imageRequest.Size, quality)
+	if relayInfo.RelayMode == relayconstant.RelayModeImagesEdits {
+		logContent = "图片编辑, " + logContent
+	} else if relayInfo.RelayMode == relayconstant.RelayModeImagesVariations {
+		logContent = "图片变体, " + logContent
+	}
 	postConsumeQuota(c, relayInfo, usage, 0, userQuota, priceData, logContent)
 	return nil
 }
@@ -12,14 +12,21 @@ import (
 	"github.com/gin-gonic/gin"
 
 	"veloera/common"
+	"veloera/constant"
 	"veloera/dto"
+	"veloera/model"
+	"veloera/relay/channel"
 	relaycommon "veloera/relay/common"
 	"veloera/relay/helper"
 	"veloera/service"
 	"veloera/setting"
 	"veloera/setting/model_setting"
+	"veloera/setting/operation_setting"
 )
 
+// responsesRestoredKey marks requests whose previous_response_id was replaced by the stored conversation
+const responsesRestoredKey = "responses_restored"
+
 func getAndValidateResponsesRequest(c *gin.Context, relayInfo *relaycommon.RelayInfo) (*dto.OpenAIResponsesRequest, error) {
 	request := &dto.OpenAIResponsesRequest{}
 	err := common.UnmarshalBodyReusable(c, request)
@@ -56,6 +63,19 @@ func ResponsesHelper(c *gin.Context) (openaiErr *dto.OpenAIErrorWithStatusCode)
 		return openaiErr
 	}
 
+	// Keep the input of this turn for the response store before the conversation is restored
+	previousResponseId := req.PreviousResponseID
+	inputItems, err := service.ResponsesInputRaw(req)
+	if err != nil {
+		return service.OpenAIErrorWrapperLocal(err, "invalid_responses_request", http.StatusBadRequest)
+	}
+
+	// Restore the conversation of previous_response_id when the upstream does not hold it
+	openaiErr = restorePreviousResponse(c, relayInfo, req)
+	if openaiErr != nil {
+		return openaiErr
+	}
+
 	// Handle model mapping and token counting
 	openaiErr = handleModelAndTokens(c, relayInfo, req)
 	if openaiErr != nil {
@@ -82,17 +102,114 @@ func ResponsesHelper(c *gin.Context) (openaiErr *dto.OpenAIErrorWithStatusCode)
 	}
 
 	// Process response and handle quota consumption
+	var compatWriter *responsesCompatWriter
+	var compatResponse *dto.OpenAIResponsesResponse
+	if needResponsesCompat(relayInfo) {
+		compatResponse = service.NewResponsesResponse(req)
+		compatResponse.PreviousResponseID = previousResponseId
+		compatWriter = newResponsesCompatWriter(c.Writer, relayInfo, compatResponse)
+		c.Writer = compatWriter
+	}
 	usage, openaiErr := processResponse(c, httpResp, relayInfo)
+	if compatWriter != nil {
+		c.Writer = compatWriter.ResponseWriter
+	}
 	if openaiErr != nil {
 		return openaiErr
 	}
+	if compatWriter != nil {
+		compatWriter.finish(usage)
+	}
 
 	// Post-consume quota
 	postProcessQuota(c, relayInfo, usage, preConsumedQuota, userQuota, priceData)
 
+	if req.ShouldStore() && operation_setting.GetResponsesSetting().StoreEnabled {
+		response := compatResponse
+		if value, ok := c.Get(constant.ContextKeyResponsesResponse); ok && response == nil {
+			response = value.(*dto.OpenAIResponsesResponse)
+		}
+		storeResponsesResponse(relayInfo, previousResponseId, inputItems, response, compatResponse == nil)
+	}
+
 	return nil
 }
 
+// restorePreviousResponse replaces previous_response_id with the stored conversation, unless the request goes to
+// the same openai channel and key which created the previous response and still holds it
+func restorePreviousResponse(c *gin.Context, relayInfo *relaycommon.RelayInfo, req *dto.OpenAIResponsesRequest) *dto.OpenAIErrorWithStatusCode {
+	c.Set(responsesRestoredKey, false)
+	if req.PreviousResponseID == "" || !operation_setting.GetResponsesSetting().StoreEnabled {
+		return nil
+	}
+	compat := needResponsesCompat(relayInfo)
+	stored, err := model.GetStoredResponse(relayInfo.UserId, relayInfo.TokenId, req.PreviousResponseID)
+	if exist, err := model.RecordExist(err); !exist {
+		if err != nil {
+			return service.OpenAIErrorWrapperLocal(err, "get_stored_response_failed", http.StatusInternalServerError)
+		}
+		if !compat {
+			// 可能是上游直接保存的响应，交给上游处理
+			return nil
+		}
+		return service.OpenAIErrorWrapperLocal(fmt.Errorf("previous response with id '%s' not found", req.PreviousResponseID), "previous_response_not_found", http.StatusBadRequest)
+	}
+	if !compat && service.IsUpstreamResponseAvailable(stored, relayInfo.ChannelId, relayInfo.ApiKey) {
+		return nil
+	}
+
+	history, err := service.BuildResponsesHistory(relayInfo.UserId, relayInfo.TokenId, req.PreviousResponseID)
+	if err != nil {
+		if errors.Is(err, service.ErrPreviousResponseNotFound) {
+			return service.OpenAIErrorWrapperLocal(err, "previous_response_not_found", http.StatusBadRequest)
+		}
+		return service.OpenAIErrorWrapperLocal(err, "get_stored_response_failed", http.StatusInternalServerError)
+	}
+	input, err := service.ResponsesInputRaw(req)
+	if err != nil {
+		return service.OpenAIErrorWrapperLocal(err, "invalid_responses_request", http.StatusBadRequest)
+	}
+	req.Input, err = json.Marshal(append(history, input...))
+	if err != nil {
+		return service.OpenAIErrorWrapperLocal(err, "marshal_request_error", http.StatusInternalServerError)
+	}
+	req.PreviousResponseID = ""
+	// 请求已被修改，不能再透传原始请求体
+	c.Set(responsesRestoredKey, true)
+	return nil
+}
+
+func storeResponsesResponse(relayInfo *relaycommon.RelayInfo, previousResponseId string, inputItems []json.RawMessage, response *dto.OpenAIResponsesResponse, upstream bool) {
+	if response == nil || response.ID == "" {
+		return
+	}
+	input, err := json.Marshal(inputItems)
+	if err != nil {
+		common.SysError("error marshalling responses input: " + err.Error())
+		return
+	}
+	responseData, err := json.Marshal(response)
+	if err != nil {
+		common.SysError("error marshalling responses response: " + err.Error())
+		return
+	}
+	stored := &model.StoredResponse{
+		ResponseId:         response.ID,
+		UserId:             relayInfo.UserId,
+		TokenId:            relayInfo.TokenId,
+		ChannelId:          relayInfo.ChannelId,
+		KeyHash:            model.HashChannelKey(relayInfo.ApiKey),
+		Upstream:           upstream,
+		PreviousResponseId: previousResponseId,
+		Model:              relayInfo.OriginModelName,
+		Input:              input,
+		Response:           responseData,
+	}
+	if err := stored.Insert(); err != nil {
+		common.SysError("failed to store response: " + err.Error())
+	}
+}
+
 func validateAndPrepareRequest(c *gin.Context, relayInfo *relaycommon.RelayInfo) (*dto.OpenAIResponsesRequest, *dto.OpenAIErrorWithStatusCode) {
 	req, err := getAndValidateResponsesRequest(c, relayInfo)
 	if err != nil {
@@ -180,8 +297,9 @@ func prepareAndSendRequest(c *gin.Context, relayInfo *relaycommon.RelayInfo, req
 	return httpResp, nil
 }
 
-func prepareRequestBody(c *gin.Context, relayInfo *relaycommon.RelayInfo, req *dto.OpenAIResponsesRequest, adaptor interface{}) (io.Reader, *dto.OpenAIErrorWithStatusCode) {
-	if model_setting.GetGlobalSettings().PassThroughRequestEnabled {
+func prepareRequestBody(c *gin.Context, relayInfo *relaycommon.RelayInfo, req *dto.OpenAIResponsesRequest, adaptor channel.Adaptor) (io.Reader, *dto.OpenAIErrorWithStatusCode) {
+	compat := needResponsesCompat(relayInfo)
+	if !compat && !c.GetBool(responsesRestoredKey) && model_setting.GetGlobalSettings().PassThroughRequestEnabled {
 		body, err := common.GetRequestBody(c)
 		if err != nil {
 			return nil, service.OpenAIErrorWrapperLocal(err, "get_request_body_error", http.StatusInternalServerError)
@@ -189,9 +307,15 @@ func prepareRequestBody(c *gin.Context, relayInfo *relaycommon.RelayInfo, req *d
 		return bytes.NewBuffer(body), nil
 	}
 
-	convertedRequest, err := adaptor.(interface {
-		ConvertOpenAIResponsesRequest(*gin.Context, *relaycommon.RelayInfo, dto.OpenAIResponsesRequest) (interface{}, error)
-	}).ConvertOpenAIResponsesRequest(c, relayInfo, *req)
+	var convertedRequest any
+	var err error
+	if compat {
+		// 非 OpenAI 渠道转换为 chat completions 请求
+		setupResponsesCompat(relayInfo)
+		convertedRequest, err = convertResponsesRequestCompat(c, relayInfo, adaptor, req)
+	} else {
+		convertedRequest, err = adaptor.ConvertOpenAIResponsesRequest(c, relayInfo, *req)
+	}
 	if err != nil {
 		return nil, service.OpenAIErrorWrapperLocal(err, "convert_request_error", http.StatusBadRequest)
 	}
@@ -232,6 +356,7 @@ func applyParamOverride(jsonData []byte, paramOverride map[string]interface{}) (
 
 func processResponse(c *gin.Context, httpResp *http.Response, relayInfo *relaycommon.RelayInfo) (*dto.Usage, *dto.OpenAIErrorWithStatusCode) {
 	adaptor := GetAdaptor(relayInfo.ApiType)
+	adaptor.Init(relayInfo)
 	usage, openaiErr := adaptor.DoResponse(c, httpResp, relayInfo)
 
 	if openaiErr != nil {
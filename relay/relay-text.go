@@ -400,6 +400,7 @@ func postConsumeQuota(ctx *gin.Context, relayInfo *relaycommon.RelayInfo,
 	} else {
 		model.UpdateUserUsedQuotaAndRequestCount(relayInfo.UserId, quota)
 		model.UpdateChannelUsedQuota(relayInfo.ChannelId, quota)
+		model.RecordChannelCacheUsage(relayInfo.ChannelId, promptTokens, cacheTokens, ctx.GetBool(constant.ContextKeyPromptCacheAffinityRouted))
 	}
 
 	quotaDelta := quota - preConsumedQuota
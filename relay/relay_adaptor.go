@@ -92,6 +92,29 @@ func GetAdaptor(apiType int) channel.Adaptor {
 	return nil
 }
 
+// streamContinuationAPITypes 聊天补全的流式响应由 openai.OaiStreamHandler 处理的 API 类型，
+// 只有它会改写续写数据块的 id、创建时间和模型名并累加之前各段的用量
+var streamContinuationAPITypes = map[int]bool{
+	constant.APITypeOpenAI:      true,
+	constant.APITypeAli:         true,
+	constant.APITypeBaiduV2:     true,
+	constant.APITypeDeepSeek:    true,
+	constant.APITypeMistral:     true,
+	constant.APITypeOllama:      true,
+	constant.APITypePerplexity:  true,
+	constant.APITypeSiliconFlow: true,
+	constant.APITypeVolcEngine:  true,
+	constant.APITypeZhipuV4:     true,
+	constant.APITypeOpenRouter:  true,
+	constant.APITypeXinference:  true,
+}
+
+// SupportsStreamContinuation 渠道能否续写其他渠道中断的聊天补全流式响应
+func SupportsStreamContinuation(channelType int) bool {
+	apiType, _ := constant.ChannelType2APIType(channelType)
+	return streamContinuationAPITypes[apiType]
+}
+
 func GetTaskAdaptor(platform commonconstant.TaskPlatform) channel.TaskAdaptor {
 	switch platform {
 	//case constant.APITypeAIProxyLibrary:
@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"encoding/json"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/relay/channel"
+	relaycommon "veloera/relay/common"
+	"veloera/relay/constant"
+	"veloera/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// needResponsesCompat reports whether the responses request has to be converted into a chat completions
+// request and the adaptor's OpenAI output converted back, only the openai adaptor supports /v1/responses upstream
+func needResponsesCompat(info *relaycommon.RelayInfo) bool {
+	switch info.ApiType {
+	case constant.APITypeOpenAI, constant.APITypeOpenRouter:
+		return false
+	}
+	return true
+}
+
+func convertResponsesRequestCompat(c *gin.Context, info *relaycommon.RelayInfo, adaptor channel.Adaptor, request *dto.OpenAIResponsesRequest) (any, error) {
+	openAIRequest, err := service.ResponsesToOpenAIRequest(*request)
+	if err != nil {
+		return nil, err
+	}
+	if openAIRequest.Stream && info.SupportStreamOptions {
+		openAIRequest.StreamOptions = &dto.StreamOptions{
+			IncludeUsage: true,
+		}
+	}
+	info.PromptMessages = openAIRequest.Messages
+	return adaptor.ConvertOpenAIRequest(c, info, openAIRequest)
+}
+
+// setupResponsesCompat makes the relay info look like a chat completions request,
+// the adaptor then writes OpenAI responses which are converted back by responsesCompatWriter
+func setupResponsesCompat(info *relaycommon.RelayInfo) {
+	info.RelayMode = constant.RelayModeChatCompletions
+	info.RequestURLPath = "/v1/chat/completions"
+	info.RelayFormat = relaycommon.RelayFormatOpenAI
+	info.ShouldIncludeUsage = false
+	info.SupportStreamOptions = relaycommon.IsStreamOptionsSupported(info.ChannelType)
+}
+
+// responsesCompatWriter converts the OpenAI format output written by the adaptor into responses objects / events
+type responsesCompatWriter struct {
+	*sseCompatWriter
+	converter *service.ResponsesStreamConverter
+}
+
+func newResponsesCompatWriter(writer gin.ResponseWriter, info *relaycommon.RelayInfo, response *dto.OpenAIResponsesResponse) *responsesCompatWriter {
+	w := &responsesCompatWriter{
+		converter: service.NewResponsesStreamConverter(response),
+	}
+	w.sseCompatWriter = newSSECompatWriter(writer, info, w.convertChunk)
+	return w
+}
+
+func (w *responsesCompatWriter) convertChunk(streamResponse *dto.ChatCompletionsStreamResponse) {
+	w.writeResponsesEvents(w.converter.Convert(streamResponse))
+}
+
+func (w *responsesCompatWriter) writeResponsesEvents(events []*dto.ResponsesStreamResponse) {
+	if len(events) == 0 {
+		return
+	}
+	for _, event := range events {
+		w.writeEvent(event.Type, event)
+	}
+	w.ResponseWriter.Flush()
+}
+
+// finish sends the closing events of a stream, or the converted response object of a non-stream response
+func (w *responsesCompatWriter) finish(usage *dto.Usage) {
+	if w.info.IsStream {
+		w.writeResponsesEvents(w.converter.Finish(usage))
+		return
+	}
+
+	responseBody := w.buffer.Bytes()
+	var openAIResponse dto.OpenAITextResponse
+	if err := common.DecodeJson(responseBody, &openAIResponse); err == nil && openAIResponse.Error == nil {
+		if usage != nil {
+			openAIResponse.Usage = *usage
+		}
+		responsesResponse := service.ResponseOpenAI2Responses(&openAIResponse, w.converter.Response())
+		if responsesBody, err := json.Marshal(responsesResponse); err == nil {
+			responseBody = responsesBody
+		} else {
+			common.SysError("error marshalling responses response: " + err.Error())
+		}
+	}
+	w.writeBody(responseBody)
+}
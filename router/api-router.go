@@ -18,6 +18,7 @@ func SetApiRouter(router *gin.Engine) {
 		apiRouter.GET("/status", controller.GetStatus)
 		apiRouter.GET("/models", middleware.UserAuth(), controller.DashboardListModels)
 		apiRouter.GET("/status/test", middleware.AdminAuth(), controller.TestStatus)
+		apiRouter.GET("/status/models", controller.GetModelStatus)
 		apiRouter.GET("/notice", controller.GetNotice)
 		apiRouter.GET("/about", controller.GetAbout)
 		//apiRouter.GET("/midjourney", controller.GetMidjourney)
@@ -97,6 +98,12 @@ func SetApiRouter(router *gin.Engine) {
 			optionRoute.PUT("/", controller.UpdateOption)
 			optionRoute.POST("/rest_model_ratio", controller.ResetModelRatio)
 		}
+		configRoute := apiRouter.Group("/config")
+		configRoute.Use(middleware.RootAuth())
+		{
+			configRoute.GET("/export", controller.ExportGatewayConfig)
+			configRoute.POST("/import", controller.ImportGatewayConfig)
+		}
 		channelRoute := apiRouter.Group("/channel")
 		channelRoute.Use(middleware.AdminAuth())
 		{
@@ -104,7 +111,20 @@ func SetApiRouter(router *gin.Engine) {
 			channelRoute.GET("/search", controller.SearchChannels)
 			channelRoute.GET("/models", controller.ChannelListModels)
 			channelRoute.GET("/models_enabled", controller.EnabledListModels)
+			channelRoute.GET("/concurrency", controller.GetChannelConcurrency)
+			channelRoute.GET("/cache_stats", controller.GetChannelCacheStats)
+			channelRoute.GET("/health", controller.GetChannelHealthSamples)
+			channelRoute.GET("/health/stats", controller.GetChannelHealthStats)
+			channelRoute.GET("/model_discovery", controller.GetModelDiscoveryDiffs)
+			channelRoute.POST("/model_discovery/:id/approve", controller.ApproveModelDiscoveryDiff)
+			channelRoute.POST("/model_discovery/:id/reject", controller.RejectModelDiscoveryDiff)
 			channelRoute.GET("/:id", controller.GetChannel)
+			channelRoute.GET("/:id/circuit_breaker", controller.GetChannelCircuitBreaker)
+			channelRoute.DELETE("/:id/circuit_breaker", controller.ResetChannelCircuitBreaker)
+			channelRoute.GET("/:id/keys", controller.GetChannelKeys)
+			channelRoute.POST("/:id/keys/enabled", controller.EnableChannelKey)
+			channelRoute.POST("/:id/keys/disabled", controller.DisableChannelKey)
+			channelRoute.DELETE("/:id/cache_stats", controller.ResetChannelCacheStats)
 			channelRoute.GET("/test", controller.TestAllChannels)
 			channelRoute.GET("/test/:id", controller.TestChannel)
 			channelRoute.GET("/update_balance", controller.UpdateAllChannelsBalance)
@@ -120,6 +140,7 @@ func SetApiRouter(router *gin.Engine) {
 			channelRoute.POST("/fix", controller.FixChannelsAbilities)
 			channelRoute.GET("/fetch_models/:id", controller.FetchUpstreamModels)
 			channelRoute.POST("/fetch_models", controller.FetchModels)
+			channelRoute.POST("/:id/model_discovery", controller.DiscoverChannelModels)
 			channelRoute.POST("/batch/tag", controller.BatchSetChannelTag)
 		}
 
@@ -165,6 +186,8 @@ func SetApiRouter(router *gin.Engine) {
 		logRoute.GET("/", middleware.AdminAuth(), controller.GetAllLogs)
 		logRoute.DELETE("/", middleware.AdminAuth(), controller.DeleteHistoryLogs)
 		logRoute.GET("/stat", middleware.AdminAuth(), controller.GetLogsStat)
+		logRoute.GET("/hedge", middleware.AdminAuth(), controller.GetHedgeCosts)
+		logRoute.GET("/margin", middleware.AdminAuth(), controller.GetMarginStats)
 		logRoute.GET("/self/stat", middleware.UserAuth(), controller.GetLogsSelfStat)
 		logRoute.GET("/search", middleware.AdminAuth(), controller.SearchAllLogs)
 		logRoute.GET("/self", middleware.UserAuth(), controller.GetUserLogs)
@@ -179,6 +202,17 @@ func SetApiRouter(router *gin.Engine) {
 			logRoute.GET("/token", middleware.UserAuth(), controller.GetLogByKey)
 
 		}
+		shadowRoute := apiRouter.Group("/shadow")
+		shadowRoute.Use(middleware.AdminAuth())
+		{
+			shadowRoute.GET("/", controller.GetShadowComparisons)
+			shadowRoute.GET("/stats", controller.GetShadowComparisonStats)
+		}
+		experimentRoute := apiRouter.Group("/experiment")
+		experimentRoute.Use(middleware.AdminAuth())
+		{
+			experimentRoute.GET("/stats", controller.GetExperimentStats)
+		}
 		groupRoute := apiRouter.Group("/group")
 		groupRoute.Use(middleware.AdminAuth())
 		{
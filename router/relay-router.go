@@ -32,19 +32,14 @@ func SetRelayRouter(router *gin.Engine) {
 		httpRouter.POST("/chat/completions", controller.Relay)
 		httpRouter.POST("/edits", controller.Relay)
 		httpRouter.POST("/images/generations", controller.Relay)
-		httpRouter.POST("/images/edits", controller.RelayNotImplemented)
-		httpRouter.POST("/images/variations", controller.RelayNotImplemented)
+		httpRouter.POST("/images/edits", controller.Relay)
+		httpRouter.POST("/images/variations", controller.Relay)
 		httpRouter.POST("/embeddings", controller.Relay)
 		httpRouter.POST("/engines/:model/embeddings", controller.Relay)
 		httpRouter.POST("/audio/transcriptions", controller.Relay)
 		httpRouter.POST("/audio/translations", controller.Relay)
 		httpRouter.POST("/audio/speech", controller.Relay)
 		httpRouter.POST("/responses", controller.Relay)
-		httpRouter.GET("/files", controller.RelayNotImplemented)
-		httpRouter.POST("/files", controller.RelayNotImplemented)
-		httpRouter.DELETE("/files/:id", controller.RelayNotImplemented)
-		httpRouter.GET("/files/:id", controller.RelayNotImplemented)
-		httpRouter.GET("/files/:id/content", controller.RelayNotImplemented)
 		httpRouter.POST("/fine-tunes", controller.RelayNotImplemented)
 		httpRouter.GET("/fine-tunes", controller.RelayNotImplemented)
 		httpRouter.GET("/fine-tunes/:id", controller.RelayNotImplemented)
@@ -53,6 +48,38 @@ func SetRelayRouter(router *gin.Engine) {
 		httpRouter.DELETE("/models/:model", controller.RelayNotImplemented)
 		httpRouter.POST("/moderations", controller.Relay)
 		httpRouter.POST("/rerank", controller.Relay)
+
+		// 本地保存的 responses，不需要选择渠道
+		responsesRouter := v1Router.Group("/responses")
+		responsesRouter.GET("/:id", controller.GetResponse)
+		responsesRouter.DELETE("/:id", controller.DeleteResponse)
+		responsesRouter.GET("/:id/input_items", controller.ListResponseInputItems)
+
+		// 本地保存的文件和批处理，批处理中的请求由调度器执行
+		filesRouter := v1Router.Group("/files")
+		filesRouter.GET("", controller.ListFiles)
+		filesRouter.POST("", controller.UploadFile)
+		filesRouter.GET("/:id", controller.GetFile)
+		filesRouter.DELETE("/:id", controller.DeleteFile)
+		filesRouter.GET("/:id/content", controller.GetFileContent)
+
+		batchesRouter := v1Router.Group("/batches")
+		batchesRouter.GET("", controller.ListBatches)
+		batchesRouter.POST("", controller.CreateBatch)
+		batchesRouter.GET("/:id", controller.GetBatch)
+		batchesRouter.POST("/:id/cancel", controller.CancelBatch)
+
+		// 客户端对实验请求的反馈评分
+		v1Router.POST("/experiments/feedback", controller.SubmitExperimentFeedback)
+
+		// 微调任务透传到创建任务的渠道
+		fineTuningRouter := v1Router.Group("/fine_tuning/jobs")
+		fineTuningRouter.GET("", controller.ListFineTuningJobs)
+		fineTuningRouter.POST("", controller.CreateFineTuningJob)
+		fineTuningRouter.GET("/:id", controller.GetFineTuningJob)
+		fineTuningRouter.POST("/:id/cancel", controller.CancelFineTuningJob)
+		fineTuningRouter.GET("/:id/events", controller.ListFineTuningJobEvents)
+		fineTuningRouter.GET("/:id/checkpoints", controller.ListFineTuningJobCheckpoints)
 	}
 
 	// 设置 /v1/models 路由
@@ -77,6 +104,16 @@ func SetRelayRouter(router *gin.Engine) {
 	relayHfV1Router.Use(middleware.ModelRequestRateLimit())
 	setupV1Router(relayHfV1Router)
 
+	// 设置 /v1beta gemini 原生路由组
+	relayGeminiRouter := router.Group("/v1beta")
+	relayGeminiRouter.Use(middleware.TokenAuth())
+	relayGeminiRouter.Use(middleware.ModelRequestRateLimit())
+	relayGeminiRouter.Use(middleware.Distribute())
+	{
+		// /v1beta/models/{model}:generateContent, :streamGenerateContent, :countTokens, :embedContent
+		relayGeminiRouter.POST("/models/:model", controller.RelayGemini)
+	}
+
 	playgroundRouter := router.Group("/pg")
 	playgroundRouter.Use(middleware.UserAuth())
 	{
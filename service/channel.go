@@ -27,6 +27,9 @@ func DisableChannel(channelId int, channelName string, reason string) {
 func EnableChannel(channelId int, channelName string) {
 	success := model.UpdateChannelStatusById(channelId, common.ChannelStatusEnabled, "")
 	if success {
+		if channel, err := model.GetChannelById(channelId, false); err == nil {
+			model.ResetChannelCircuitBreakers(channel)
+		}
 		subject := fmt.Sprintf("通道「%s」（#%d）已被启用", channelName, channelId)
 		content := fmt.Sprintf("通道「%s」（#%d）已被启用", channelName, channelId)
 		NotifyRootUser(formatNotifyType(channelId, common.ChannelStatusEnabled), subject, content)
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"fmt"
+	"net/http"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/model"
+	"veloera/setting/operation_setting"
+)
+
+// ProcessChannelKeyError 处理多 key 渠道中单个 key 的错误：限流的 key 暂停使用，无效或余额不足的 key 被禁用，
+// 返回渠道中是否还有可用的 key，没有可用 key 时由调用方按原有逻辑禁用整个渠道
+func ProcessChannelKeyError(channelId int, channelType int, keyHash string, autoBan bool, err *dto.OpenAIErrorWithStatusCode) bool {
+	key, found := model.GetChannelKeyByHash(channelId, keyHash)
+	status := model.ChannelKeyStatusEnabled
+	cooldownUntil := int64(0)
+	if found {
+		status = key.Status
+		cooldownUntil = key.CooldownUntil
+	}
+	switch {
+	case autoBan && ShouldDisableChannel(channelType, err):
+		status = model.ChannelKeyStatusDisabled
+		cooldownUntil = 0
+	case err.StatusCode == http.StatusTooManyRequests:
+		status = model.ChannelKeyStatusCoolingDown
+		cooldownUntil = common.GetTimestamp() + int64(operation_setting.GetChannelKeySetting().CooldownSeconds)
+		// 上游返回了 retry-after 时按上游要求的时间冷却
+		if retryAt := model.GetChannelRateLimit(channelId, keyHash).CooldownUntil / 1000; retryAt > common.GetTimestamp() {
+			cooldownUntil = retryAt
+		}
+	}
+	if updateErr := model.UpdateChannelKeyStatus(channelId, keyHash, status, cooldownUntil, err.Error.Message); updateErr != nil {
+		common.SysError(fmt.Sprintf("failed to update key status of channel #%d: %s", channelId, updateErr.Error()))
+	}
+	if status == model.ChannelKeyStatusDisabled {
+		common.SysLog(fmt.Sprintf("key %s of channel #%d disabled: %s", keyHash, channelId, err.Error.Message))
+	}
+
+	channel, getErr := model.CacheGetChannel(channelId)
+	if getErr != nil {
+		return false
+	}
+	return model.ChannelHasAvailableKey(channel)
+}
@@ -9,6 +9,36 @@ import (
 	relaycommon "veloera/relay/common"
 )
 
+// 按思考预算映射到 reasoning_effort 的分档
+const (
+	claudeThinkingBudgetLow    = 4096
+	claudeThinkingBudgetMedium = 16384
+)
+
+// claudeThinkingToReasoningEffort 将 Claude 的思考预算映射为 OpenAI 的 reasoning_effort，未启用思考时返回空
+func claudeThinkingToReasoningEffort(thinking *dto.Thinking) string {
+	if thinking == nil || thinking.Type != "enabled" {
+		return ""
+	}
+	switch {
+	case thinking.BudgetTokens < claudeThinkingBudgetLow:
+		return "low"
+	case thinking.BudgetTokens < claudeThinkingBudgetMedium:
+		return "medium"
+	}
+	return "high"
+}
+
+// acceptsReasoningContent 上游是否接受历史消息中的 reasoning_content，
+// OpenAI 和 Azure 会校验消息字段，DeepSeek 收到 reasoning_content 时返回 400
+func acceptsReasoningContent(channelType int) bool {
+	switch channelType {
+	case common.ChannelTypeOpenAI, common.ChannelTypeAzure, common.ChannelTypeDeepSeek:
+		return false
+	}
+	return true
+}
+
 func ClaudeToOpenAIRequest(claudeRequest dto.ClaudeRequest, info *relaycommon.RelayInfo) (*dto.GeneralOpenAIRequest, error) {
 	openAIRequest := dto.GeneralOpenAIRequest{
 		Model:       claudeRequest.Model,
@@ -23,6 +53,10 @@ func ClaudeToOpenAIRequest(claudeRequest dto.ClaudeRequest, info *relaycommon.Re
 			!strings.HasSuffix(claudeRequest.Model, "-thinking") {
 			openAIRequest.Model = openAIRequest.Model + "-thinking"
 		}
+		if effort := claudeThinkingToReasoningEffort(claudeRequest.Thinking); effort != "" {
+			openAIRequest.ReasoningEffort = effort
+			info.ReasoningEffort = effort
+		}
 	}
 
 	// Convert stop sequences
@@ -47,6 +81,9 @@ func ClaudeToOpenAIRequest(claudeRequest dto.ClaudeRequest, info *relaycommon.Re
 		openAITools = append(openAITools, openAITool)
 	}
 	openAIRequest.Tools = openAITools
+	if len(openAITools) > 0 && claudeRequest.ToolChoice != nil {
+		openAIRequest.ToolChoice = toolChoiceClaude2OpenAI(claudeRequest.ToolChoice)
+	}
 
 	// Convert messages
 	openAIMessages := make([]dto.Message, 0)
@@ -103,7 +140,13 @@ func ClaudeToOpenAIRequest(claudeRequest dto.ClaudeRequest, info *relaycommon.Re
 					mediaMessages = append(mediaMessages, message)
 				case "image":
 					// Handle image conversion (base64 to URL or keep as is)
-					imageData := fmt.Sprintf("data:%s;base64,%s", mediaMsg.Source.MediaType, mediaMsg.Source.Data)
+					if mediaMsg.Source == nil {
+						continue
+					}
+					imageData := mediaMsg.Source.Url
+					if mediaMsg.Source.Type != "url" {
+						imageData = fmt.Sprintf("data:%s;base64,%s", mediaMsg.Source.MediaType, mediaMsg.Source.Data)
+					}
 					//textContent += fmt.Sprintf("[Image: %s]", imageData)
 					mediaMessage := dto.MediaContent{
 						Type:     "image_url",
@@ -136,6 +179,13 @@ func ClaudeToOpenAIRequest(claudeRequest dto.ClaudeRequest, info *relaycommon.Re
 						oaiToolMessage.SetStringContent(string(encodeJson))
 					}
 					openAIMessages = append(openAIMessages, oaiToolMessage)
+				case "thinking":
+					// 之前轮次的思考内容作为 reasoning_content 传给接受它的上游
+					if acceptsReasoningContent(info.ChannelType) {
+						openAIMessage.ReasoningContent += mediaMsg.Thinking
+					}
+				case "redacted_thinking":
+					// 加密的思考内容只有 Claude 能解读，不传给其他上游
 				}
 			}
 
@@ -157,6 +207,29 @@ func ClaudeToOpenAIRequest(claudeRequest dto.ClaudeRequest, info *relaycommon.Re
 	return &openAIRequest, nil
 }
 
+func toolChoiceClaude2OpenAI(toolChoice any) any {
+	choice, ok := toolChoice.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	switch choice["type"] {
+	case "auto":
+		return "auto"
+	case "any":
+		return "required"
+	case "none":
+		return "none"
+	case "tool":
+		return map[string]interface{}{
+			"type": "function",
+			"function": map[string]interface{}{
+				"name": choice["name"],
+			},
+		}
+	}
+	return nil
+}
+
 func OpenAIErrorToClaudeError(openAIError *dto.OpenAIErrorWithStatusCode) *dto.ClaudeErrorWithStatusCode {
 	claudeError := dto.ClaudeError{
 		Type:    "veloera_error",
@@ -186,9 +259,39 @@ func generateStopBlock(index int) *dto.ClaudeResponse {
 	}
 }
 
+// startContentBlock closes the current content block (if any) and opens a new one at the next index
+func startContentBlock(info *relaycommon.RelayInfo, messageType string, contentBlock *dto.ClaudeMediaMessage) []*dto.ClaudeResponse {
+	var claudeResponses []*dto.ClaudeResponse
+	if info.ClaudeConvertInfo.LastMessagesType != relaycommon.LastMessageTypeNone {
+		claudeResponses = append(claudeResponses, generateStopBlock(info.ClaudeConvertInfo.Index))
+		info.ClaudeConvertInfo.Index++
+	}
+	info.ClaudeConvertInfo.LastMessagesType = messageType
+	claudeResponses = append(claudeResponses, &dto.ClaudeResponse{
+		Index:        common.GetPointer[int](info.ClaudeConvertInfo.Index),
+		Type:         "content_block_start",
+		ContentBlock: contentBlock,
+	})
+	return claudeResponses
+}
+
+func usageOpenAI2Claude(usage *dto.Usage) *dto.ClaudeUsage {
+	if usage == nil {
+		return &dto.ClaudeUsage{}
+	}
+	// claude input_tokens do not include cache read tokens
+	cachedTokens := usage.PromptTokensDetails.CachedTokens
+	return &dto.ClaudeUsage{
+		InputTokens:              usage.PromptTokens - cachedTokens,
+		CacheReadInputTokens:     cachedTokens,
+		CacheCreationInputTokens: usage.PromptTokensDetails.CachedCreationTokens,
+		OutputTokens:             usage.CompletionTokens,
+	}
+}
+
 func StreamResponseOpenAI2Claude(openAIResponse *dto.ChatCompletionsStreamResponse, info *relaycommon.RelayInfo) []*dto.ClaudeResponse {
 	var claudeResponses []*dto.ClaudeResponse
-	if info.SendResponseCount == 1 {
+	if info.SendResponseCount == 1 && !info.Done {
 		msg := &dto.ClaudeMediaMessage{
 			Id:    openAIResponse.Id,
 			Model: openAIResponse.Model,
@@ -204,141 +307,100 @@ func StreamResponseOpenAI2Claude(openAIResponse *dto.ChatCompletionsStreamRespon
 			Type:    "message_start",
 			Message: msg,
 		})
-		claudeResponses = append(claudeResponses)
-		//claudeResponses = append(claudeResponses, &dto.ClaudeResponse{
-		//	Type: "ping",
-		//})
-		if openAIResponse.IsToolCall() {
-			resp := &dto.ClaudeResponse{
-				Type: "content_block_start",
-				ContentBlock: &dto.ClaudeMediaMessage{
-					Id:   openAIResponse.GetFirstToolCall().ID,
-					Type: "tool_use",
-					Name: openAIResponse.GetFirstToolCall().Function.Name,
-				},
-			}
-			resp.SetIndex(0)
-			claudeResponses = append(claudeResponses, resp)
-		} else {
-			//resp := &dto.ClaudeResponse{
-			//	Type: "content_block_start",
-			//	ContentBlock: &dto.ClaudeMediaMessage{
-			//		Type: "text",
-			//		Text: common.GetPointer[string](""),
-			//	},
-			//}
-			//resp.SetIndex(0)
-			//claudeResponses = append(claudeResponses, resp)
+	}
+
+	if info.Done {
+		if info.ClaudeConvertInfo.LastMessagesType != relaycommon.LastMessageTypeNone {
+			claudeResponses = append(claudeResponses, generateStopBlock(info.ClaudeConvertInfo.Index))
+		}
+		stopReason := stopReasonOpenAI2Claude(info.FinishReason)
+		if stopReason == "" {
+			stopReason = "end_turn"
 		}
+		claudeResponses = append(claudeResponses, &dto.ClaudeResponse{
+			Type:  "message_delta",
+			Usage: usageOpenAI2Claude(info.ClaudeConvertInfo.Usage),
+			Delta: &dto.ClaudeMediaMessage{
+				StopReason: common.GetPointer[string](stopReason),
+			},
+		})
+		claudeResponses = append(claudeResponses, &dto.ClaudeResponse{
+			Type: "message_stop",
+		})
 		return claudeResponses
 	}
 
 	if len(openAIResponse.Choices) == 0 {
-		// no choices
-		// TODO: handle this case
 		return claudeResponses
-	} else {
-		chosenChoice := openAIResponse.Choices[0]
-		if chosenChoice.FinishReason != nil && *chosenChoice.FinishReason != "" {
-			// should be done
-			info.FinishReason = *chosenChoice.FinishReason
-			return claudeResponses
-		}
-		if info.Done {
-			claudeResponses = append(claudeResponses, generateStopBlock(info.ClaudeConvertInfo.Index))
-			if info.ClaudeConvertInfo.Usage != nil {
-				claudeResponses = append(claudeResponses, &dto.ClaudeResponse{
-					Type: "message_delta",
-					Usage: &dto.ClaudeUsage{
-						InputTokens:  info.ClaudeConvertInfo.Usage.PromptTokens,
-						OutputTokens: info.ClaudeConvertInfo.Usage.CompletionTokens,
-					},
-					Delta: &dto.ClaudeMediaMessage{
-						StopReason: common.GetPointer[string](stopReasonOpenAI2Claude(info.FinishReason)),
-					},
-				})
+	}
+	chosenChoice := openAIResponse.Choices[0]
+	if chosenChoice.FinishReason != nil && *chosenChoice.FinishReason != "" {
+		// the stop events are sent once the stream is done, but the same chunk may still carry content
+		info.FinishReason = *chosenChoice.FinishReason
+	}
+
+	if len(chosenChoice.Delta.ToolCalls) > 0 {
+		for _, toolCall := range chosenChoice.Delta.ToolCalls {
+			if info.ClaudeConvertInfo.LastMessagesType != relaycommon.LastMessageTypeTools ||
+				(toolCall.ID != "" && toolCall.ID != info.ClaudeConvertInfo.ToolCallId) {
+				info.ClaudeConvertInfo.ToolCallId = toolCall.ID
+				claudeResponses = append(claudeResponses, startContentBlock(info, relaycommon.LastMessageTypeTools, &dto.ClaudeMediaMessage{
+					Id:    toolCall.ID,
+					Type:  "tool_use",
+					Name:  toolCall.Function.Name,
+					Input: map[string]interface{}{},
+				})...)
 			}
+			if toolCall.Function.Arguments == "" {
+				continue
+			}
+			// tools delta
 			claudeResponses = append(claudeResponses, &dto.ClaudeResponse{
-				Type: "message_stop",
-			})
-		} else {
-			var claudeResponse dto.ClaudeResponse
-			var isEmpty bool
-			claudeResponse.Type = "content_block_delta"
-			if len(chosenChoice.Delta.ToolCalls) > 0 {
-				if info.ClaudeConvertInfo.LastMessagesType != relaycommon.LastMessageTypeTools {
-					claudeResponses = append(claudeResponses, generateStopBlock(info.ClaudeConvertInfo.Index))
-					info.ClaudeConvertInfo.Index++
-					claudeResponses = append(claudeResponses, &dto.ClaudeResponse{
-						Index: &info.ClaudeConvertInfo.Index,
-						Type:  "content_block_start",
-						ContentBlock: &dto.ClaudeMediaMessage{
-							Id:    openAIResponse.GetFirstToolCall().ID,
-							Type:  "tool_use",
-							Name:  openAIResponse.GetFirstToolCall().Function.Name,
-							Input: map[string]interface{}{},
-						},
-					})
-				}
-				info.ClaudeConvertInfo.LastMessagesType = relaycommon.LastMessageTypeTools
-				// tools delta
-				claudeResponse.Delta = &dto.ClaudeMediaMessage{
+				Index: common.GetPointer[int](info.ClaudeConvertInfo.Index),
+				Type:  "content_block_delta",
+				Delta: &dto.ClaudeMediaMessage{
 					Type:        "input_json_delta",
-					PartialJson: &chosenChoice.Delta.ToolCalls[0].Function.Arguments,
-				}
-			} else {
-				reasoning := chosenChoice.Delta.GetReasoningContent()
-				textContent := chosenChoice.Delta.GetContentString()
-				if reasoning != "" || textContent != "" {
-					if reasoning != "" {
-						if info.ClaudeConvertInfo.LastMessagesType != relaycommon.LastMessageTypeThinking {
-							//info.ClaudeConvertInfo.Index++
-							claudeResponses = append(claudeResponses, &dto.ClaudeResponse{
-								Index: &info.ClaudeConvertInfo.Index,
-								Type:  "content_block_start",
-								ContentBlock: &dto.ClaudeMediaMessage{
-									Type:     "thinking",
-									Thinking: "",
-								},
-							})
-						}
-						info.ClaudeConvertInfo.LastMessagesType = relaycommon.LastMessageTypeThinking
-						// text delta
-						claudeResponse.Delta = &dto.ClaudeMediaMessage{
-							Type:     "thinking_delta",
-							Thinking: reasoning,
-						}
-					} else {
-						if info.ClaudeConvertInfo.LastMessagesType != relaycommon.LastMessageTypeText {
-							if info.LastMessagesType == relaycommon.LastMessageTypeThinking || info.LastMessagesType == relaycommon.LastMessageTypeTools {
-								claudeResponses = append(claudeResponses, generateStopBlock(info.ClaudeConvertInfo.Index))
-								info.ClaudeConvertInfo.Index++
-							}
-							claudeResponses = append(claudeResponses, &dto.ClaudeResponse{
-								Index: &info.ClaudeConvertInfo.Index,
-								Type:  "content_block_start",
-								ContentBlock: &dto.ClaudeMediaMessage{
-									Type: "text",
-									Text: common.GetPointer[string](""),
-								},
-							})
-						}
-						info.ClaudeConvertInfo.LastMessagesType = relaycommon.LastMessageTypeText
-						// text delta
-						claudeResponse.Delta = &dto.ClaudeMediaMessage{
-							Type: "text_delta",
-							Text: common.GetPointer[string](textContent),
-						}
-					}
-				} else {
-					isEmpty = true
-				}
-			}
-			claudeResponse.Index = &info.ClaudeConvertInfo.Index
-			if !isEmpty {
-				claudeResponses = append(claudeResponses, &claudeResponse)
-			}
+					PartialJson: common.GetPointer[string](toolCall.Function.Arguments),
+				},
+			})
+		}
+		return claudeResponses
+	}
+
+	if reasoning := chosenChoice.Delta.GetReasoningContent(); reasoning != "" {
+		if info.ClaudeConvertInfo.LastMessagesType != relaycommon.LastMessageTypeThinking {
+			claudeResponses = append(claudeResponses, startContentBlock(info, relaycommon.LastMessageTypeThinking, &dto.ClaudeMediaMessage{
+				Type:     "thinking",
+				Thinking: "",
+			})...)
+		}
+		// thinking delta
+		claudeResponses = append(claudeResponses, &dto.ClaudeResponse{
+			Index: common.GetPointer[int](info.ClaudeConvertInfo.Index),
+			Type:  "content_block_delta",
+			Delta: &dto.ClaudeMediaMessage{
+				Type:     "thinking_delta",
+				Thinking: reasoning,
+			},
+		})
+	}
+
+	if textContent := chosenChoice.Delta.GetContentString(); textContent != "" {
+		if info.ClaudeConvertInfo.LastMessagesType != relaycommon.LastMessageTypeText {
+			claudeResponses = append(claudeResponses, startContentBlock(info, relaycommon.LastMessageTypeText, &dto.ClaudeMediaMessage{
+				Type: "text",
+				Text: common.GetPointer[string](""),
+			})...)
 		}
+		// text delta
+		claudeResponses = append(claudeResponses, &dto.ClaudeResponse{
+			Index: common.GetPointer[int](info.ClaudeConvertInfo.Index),
+			Type:  "content_block_delta",
+			Delta: &dto.ClaudeMediaMessage{
+				Type: "text_delta",
+				Text: common.GetPointer[string](textContent),
+			},
+		})
 	}
 
 	return claudeResponses
@@ -355,29 +417,44 @@ func ResponseOpenAI2Claude(openAIResponse *dto.OpenAITextResponse, info *relayco
 	}
 	for _, choice := range openAIResponse.Choices {
 		stopReason = stopReasonOpenAI2Claude(choice.FinishReason)
-		claudeContent := dto.ClaudeMediaMessage{}
-		if choice.FinishReason == "tool_calls" {
-			claudeContent.Type = "tool_use"
-			claudeContent.Id = choice.Message.ToolCallId
-			claudeContent.Name = choice.Message.ParseToolCalls()[0].Function.Name
+		reasoning := choice.Message.ReasoningContent
+		if reasoning == "" {
+			reasoning = choice.Message.Reasoning
+		}
+		if reasoning != "" {
+			contents = append(contents, dto.ClaudeMediaMessage{
+				Type:     "thinking",
+				Thinking: reasoning,
+			})
+		}
+		if text := choice.Message.StringContent(); text != "" {
+			claudeContent := dto.ClaudeMediaMessage{Type: "text"}
+			claudeContent.SetText(text)
+			contents = append(contents, claudeContent)
+		}
+		for _, toolCall := range choice.Message.ParseToolCalls() {
+			claudeContent := dto.ClaudeMediaMessage{
+				Type: "tool_use",
+				Id:   toolCall.ID,
+				Name: toolCall.Function.Name,
+			}
 			var mapParams map[string]interface{}
-			if err := json.Unmarshal([]byte(choice.Message.ParseToolCalls()[0].Function.Arguments), &mapParams); err == nil {
+			if err := json.Unmarshal([]byte(toolCall.Function.Arguments), &mapParams); err == nil {
 				claudeContent.Input = mapParams
 			} else {
-				claudeContent.Input = choice.Message.ParseToolCalls()[0].Function.Arguments
+				claudeContent.Input = toolCall.Function.Arguments
 			}
-		} else {
-			claudeContent.Type = "text"
-			claudeContent.SetText(choice.Message.StringContent())
+			contents = append(contents, claudeContent)
 		}
+	}
+	if len(contents) == 0 {
+		claudeContent := dto.ClaudeMediaMessage{Type: "text"}
+		claudeContent.SetText("")
 		contents = append(contents, claudeContent)
 	}
 	claudeResponse.Content = contents
 	claudeResponse.StopReason = stopReason
-	claudeResponse.Usage = &dto.ClaudeUsage{
-		InputTokens:  openAIResponse.PromptTokens,
-		OutputTokens: openAIResponse.CompletionTokens,
-	}
+	claudeResponse.Usage = usageOpenAI2Claude(&openAIResponse.Usage)
 
 	return claudeResponse
 }
@@ -388,9 +465,9 @@ func stopReasonOpenAI2Claude(reason string) string {
 		return "end_turn"
 	case "stop_sequence":
 		return "stop_sequence"
-	case "max_tokens":
+	case "length", "max_tokens":
 		return "max_tokens"
-	case "tool_calls":
+	case "tool_calls", "function_call":
 		return "tool_use"
 	default:
 		return reason
@@ -0,0 +1,565 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"veloera/common"
+	"veloera/constant"
+	"veloera/dto"
+)
+
+// ResponsesToOpenAIRequest converts a /v1/responses request into a chat completions request
+func ResponsesToOpenAIRequest(request dto.OpenAIResponsesRequest) (*dto.GeneralOpenAIRequest, error) {
+	openAIRequest := dto.GeneralOpenAIRequest{
+		Model:     request.Model,
+		MaxTokens: request.MaxOutputTokens,
+		TopP:      request.TopP,
+		Stream:    request.Stream,
+		User:      request.User,
+	}
+	if request.Temperature != 0 {
+		openAIRequest.Temperature = common.GetPointer(request.Temperature)
+	}
+	if request.Reasoning != nil && request.Reasoning.Effort != "" {
+		openAIRequest.ReasoningEffort = request.Reasoning.Effort
+	}
+
+	// Convert text format
+	if len(request.Text) > 0 {
+		var text struct {
+			Format *struct {
+				Type        string `json:"type"`
+				Name        string `json:"name"`
+				Description string `json:"description"`
+				Schema      any    `json:"schema"`
+				Strict      any    `json:"strict"`
+			} `json:"format"`
+		}
+		if err := json.Unmarshal(request.Text, &text); err == nil && text.Format != nil {
+			switch text.Format.Type {
+			case "json_schema":
+				openAIRequest.ResponseFormat = &dto.ResponseFormat{
+					Type: "json_schema",
+					JsonSchema: &dto.FormatJsonSchema{
+						Name:        text.Format.Name,
+						Description: text.Format.Description,
+						Schema:      text.Format.Schema,
+						Strict:      text.Format.Strict,
+					},
+				}
+			case "json_object":
+				openAIRequest.ResponseFormat = &dto.ResponseFormat{Type: "json_object"}
+			}
+		}
+	}
+
+	// Convert tools, built-in tools are not supported by chat completions upstreams
+	for _, tool := range request.Tools {
+		if tool.Type != "function" {
+			continue
+		}
+		var parameters any
+		if len(tool.Parameters) > 0 {
+			_ = json.Unmarshal(tool.Parameters, &parameters)
+		}
+		openAIRequest.Tools = append(openAIRequest.Tools, dto.ToolCallRequest{
+			Type: "function",
+			Function: dto.FunctionRequest{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  parameters,
+			},
+		})
+	}
+	if len(openAIRequest.Tools) > 0 && len(request.ToolChoice) > 0 {
+		openAIRequest.ToolChoice = toolChoiceResponses2OpenAI(request.ToolChoice)
+	}
+
+	// Convert messages
+	messages := make([]dto.Message, 0)
+	if instructions := request.GetInstructions(); instructions != "" {
+		message := dto.Message{Role: "system"}
+		message.SetStringContent(instructions)
+		messages = append(messages, message)
+	}
+	items, err := request.ParseInput()
+	if err != nil {
+		return nil, fmt.Errorf("invalid input: %w", err)
+	}
+	// function calls following each other belong to the same assistant message
+	toolCalls := make(map[int][]dto.ToolCallRequest)
+	for _, item := range items {
+		switch item.Type {
+		case "function_call":
+			last := len(messages) - 1
+			if last < 0 || messages[last].Role != "assistant" {
+				messages = append(messages, dto.Message{Role: "assistant"})
+				last = len(messages) - 1
+			}
+			toolCalls[last] = append(toolCalls[last], dto.ToolCallRequest{
+				ID:   item.CallId,
+				Type: "function",
+				Function: dto.FunctionRequest{
+					Name:      item.Name,
+					Arguments: item.Arguments,
+				},
+			})
+		case "function_call_output":
+			message := dto.Message{
+				Role:       "tool",
+				ToolCallId: item.CallId,
+			}
+			var output string
+			if err := json.Unmarshal(item.Output, &output); err != nil {
+				output = string(item.Output)
+			}
+			message.SetStringContent(output)
+			messages = append(messages, message)
+		case "", "message":
+			role := item.Role
+			if role == "developer" {
+				role = "system"
+			}
+			message := dto.Message{Role: role}
+			mediaContents := responsesContent2OpenAI(item.ParseContent())
+			if len(mediaContents) == 1 && mediaContents[0].Type == dto.ContentTypeText {
+				message.SetStringContent(mediaContents[0].Text)
+			} else {
+				message.SetMediaContent(mediaContents)
+			}
+			messages = append(messages, message)
+		default:
+			// reasoning and built-in tool items are not accepted as input by chat completions upstreams
+		}
+	}
+	for index, calls := range toolCalls {
+		messages[index].SetToolCalls(calls)
+	}
+	openAIRequest.Messages = messages
+	return &openAIRequest, nil
+}
+
+func responsesContent2OpenAI(contents []dto.ResponsesInputContent) []dto.MediaContent {
+	mediaContents := make([]dto.MediaContent, 0, len(contents))
+	for _, content := range contents {
+		switch content.Type {
+		case "input_text", "output_text":
+			mediaContents = append(mediaContents, dto.MediaContent{
+				Type: dto.ContentTypeText,
+				Text: content.Text,
+			})
+		case "input_image":
+			mediaContents = append(mediaContents, dto.MediaContent{
+				Type: dto.ContentTypeImageURL,
+				ImageUrl: &dto.MessageImageUrl{
+					Url:    content.ImageUrl,
+					Detail: content.Detail,
+				},
+			})
+		case "input_file":
+			mediaContents = append(mediaContents, dto.MediaContent{
+				Type: dto.ContentTypeFile,
+				File: &dto.MessageFile{
+					FileName: content.FileName,
+					FileData: content.FileData,
+					FileId:   content.FileId,
+				},
+			})
+		}
+	}
+	return mediaContents
+}
+
+func toolChoiceResponses2OpenAI(toolChoice json.RawMessage) any {
+	var choice string
+	if err := json.Unmarshal(toolChoice, &choice); err == nil {
+		return choice
+	}
+	var function struct {
+		Type string `json:"type"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal(toolChoice, &function); err == nil && function.Type == "function" {
+		return map[string]any{
+			"type": "function",
+			"function": map[string]any{
+				"name": function.Name,
+			},
+		}
+	}
+	return "auto"
+}
+
+// UsageOpenAI2Responses converts chat completions usage into /v1/responses usage
+func UsageOpenAI2Responses(usage *dto.Usage) *dto.ResponsesUsage {
+	if usage == nil {
+		return &dto.ResponsesUsage{}
+	}
+	return &dto.ResponsesUsage{
+		InputTokens: usage.PromptTokens,
+		InputTokensDetails: &dto.ResponsesInputTokensDetails{
+			CachedTokens: usage.PromptTokensDetails.CachedTokens,
+		},
+		OutputTokens: usage.CompletionTokens,
+		OutputTokensDetails: &dto.ResponsesOutputTokensDetails{
+			ReasoningTokens: usage.CompletionTokenDetails.ReasoningTokens,
+		},
+		TotalTokens: usage.PromptTokens + usage.CompletionTokens,
+	}
+}
+
+// NewResponsesResponse creates an in progress response object which echoes the request parameters
+func NewResponsesResponse(request *dto.OpenAIResponsesRequest) *dto.OpenAIResponsesResponse {
+	response := &dto.OpenAIResponsesResponse{
+		ID:                 fmt.Sprintf("resp_%s", common.GetUUID()),
+		Object:             "response",
+		CreatedAt:          int(common.GetTimestamp()),
+		Status:             "in_progress",
+		Instructions:       request.GetInstructions(),
+		MaxOutputTokens:    int(request.MaxOutputTokens),
+		Model:              request.Model,
+		Output:             make([]dto.ResponsesOutput, 0),
+		ParallelToolCalls:  request.ParallelToolCalls,
+		PreviousResponseID: request.PreviousResponseID,
+		Reasoning:          request.Reasoning,
+		Store:              request.ShouldStore(),
+		Temperature:        request.Temperature,
+		ToolChoice:         "auto",
+		Tools:              make([]interface{}, 0, len(request.Tools)),
+		TopP:               request.TopP,
+		Truncation:         common.GetStringIfEmpty(request.Truncation, "disabled"),
+		User:               json.RawMessage("null"),
+		Metadata:           request.Metadata,
+	}
+	if request.User != "" {
+		response.User, _ = json.Marshal(request.User)
+	}
+	if len(response.Metadata) == 0 {
+		response.Metadata = json.RawMessage("{}")
+	}
+	var toolChoice string
+	if err := json.Unmarshal(request.ToolChoice, &toolChoice); err == nil {
+		response.ToolChoice = toolChoice
+	}
+	for _, tool := range request.Tools {
+		response.Tools = append(response.Tools, tool)
+	}
+	return response
+}
+
+// finishResponsesResponse sets the final status of the response from the chat completions finish reason
+func finishResponsesResponse(response *dto.OpenAIResponsesResponse, finishReason string, usage *dto.Usage) {
+	response.Status = "completed"
+	if finishReason == constant.FinishReasonLength {
+		response.Status = "incomplete"
+		response.IncompleteDetails = &dto.IncompleteDetails{Reason: "max_output_tokens"}
+	} else if finishReason == constant.FinishReasonContentFilter {
+		response.Status = "incomplete"
+		response.IncompleteDetails = &dto.IncompleteDetails{Reason: "content_filter"}
+	}
+	response.Usage = UsageOpenAI2Responses(usage)
+}
+
+func newResponsesTextContent(text string) dto.ResponsesOutputContent {
+	return dto.ResponsesOutputContent{
+		Type:        "output_text",
+		Text:        text,
+		Annotations: make([]interface{}, 0),
+	}
+}
+
+// ResponseOpenAI2Responses converts a chat completions response into a /v1/responses response object
+func ResponseOpenAI2Responses(openAIResponse *dto.OpenAITextResponse, response *dto.OpenAIResponsesResponse) *dto.OpenAIResponsesResponse {
+	finishReason := ""
+	if len(openAIResponse.Choices) > 0 {
+		choice := openAIResponse.Choices[0]
+		finishReason = choice.FinishReason
+		reasoning := choice.Message.ReasoningContent
+		if reasoning == "" {
+			reasoning = choice.Message.Reasoning
+		}
+		if reasoning != "" {
+			response.Output = append(response.Output, dto.ResponsesOutput{
+				Type: "reasoning",
+				ID:   fmt.Sprintf("rs_%s", common.GetUUID()),
+				Summary: []dto.ResponsesOutputContent{
+					{Type: "summary_text", Text: reasoning},
+				},
+			})
+		}
+		if text := choice.Message.StringContent(); text != "" {
+			response.Output = append(response.Output, dto.ResponsesOutput{
+				Type:    "message",
+				ID:      fmt.Sprintf("msg_%s", common.GetUUID()),
+				Status:  "completed",
+				Role:    "assistant",
+				Content: []dto.ResponsesOutputContent{newResponsesTextContent(text)},
+			})
+		}
+		for _, toolCall := range choice.Message.ParseToolCalls() {
+			arguments := toolCall.Function.Arguments
+			response.Output = append(response.Output, dto.ResponsesOutput{
+				Type:      "function_call",
+				ID:        fmt.Sprintf("fc_%s", common.GetUUID()),
+				Status:    "completed",
+				CallId:    toolCall.ID,
+				Name:      toolCall.Function.Name,
+				Arguments: &arguments,
+			})
+		}
+	}
+	finishResponsesResponse(response, finishReason, &openAIResponse.Usage)
+	return response
+}
+
+// ResponsesStreamConverter converts chat completions chunks into /v1/responses stream events
+type ResponsesStreamConverter struct {
+	response       *dto.OpenAIResponsesResponse
+	sequenceNumber int
+	started        bool
+	finishReason   string
+	// the output item which is receiving deltas
+	current     *dto.ResponsesOutput
+	currentText strings.Builder
+	// the index of the upstream tool call of the current function call item
+	currentToolIndex int
+}
+
+func NewResponsesStreamConverter(response *dto.OpenAIResponsesResponse) *ResponsesStreamConverter {
+	return &ResponsesStreamConverter{
+		response:         response,
+		currentToolIndex: -1,
+	}
+}
+
+func (s *ResponsesStreamConverter) event(event dto.ResponsesStreamResponse) *dto.ResponsesStreamResponse {
+	event.SequenceNumber = s.sequenceNumber
+	s.sequenceNumber++
+	return &event
+}
+
+func (s *ResponsesStreamConverter) start() []*dto.ResponsesStreamResponse {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	response := *s.response
+	return []*dto.ResponsesStreamResponse{
+		s.event(dto.ResponsesStreamResponse{Type: dto.ResponsesStreamTypeCreated, Response: &response}),
+		s.event(dto.ResponsesStreamResponse{Type: dto.ResponsesStreamTypeInProgress, Response: &response}),
+	}
+}
+
+// open closes the current output item and starts a new one
+func (s *ResponsesStreamConverter) open(item dto.ResponsesOutput) []*dto.ResponsesStreamResponse {
+	events := s.close()
+	s.current = &item
+	s.currentText.Reset()
+	outputIndex := len(s.response.Output)
+	added := item
+	events = append(events, s.event(dto.ResponsesStreamResponse{
+		Type:        dto.ResponsesOutputTypeItemAdded,
+		OutputIndex: &outputIndex,
+		Item:        &added,
+	}))
+	zero := 0
+	switch item.Type {
+	case "message":
+		part := newResponsesTextContent("")
+		events = append(events, s.event(dto.ResponsesStreamResponse{
+			Type:         dto.ResponsesStreamTypeContentPartAdded,
+			ItemId:       item.ID,
+			OutputIndex:  &outputIndex,
+			ContentIndex: &zero,
+			Part:         &part,
+		}))
+	case "reasoning":
+		part := dto.ResponsesOutputContent{Type: "summary_text"}
+		events = append(events, s.event(dto.ResponsesStreamResponse{
+			Type:         dto.ResponsesStreamTypeReasoningSummaryAdded,
+			ItemId:       item.ID,
+			OutputIndex:  &outputIndex,
+			SummaryIndex: &zero,
+			Part:         &part,
+		}))
+	}
+	return events
+}
+
+// close finishes the current output item and appends it to the response output
+func (s *ResponsesStreamConverter) close() []*dto.ResponsesStreamResponse {
+	if s.current == nil {
+		return nil
+	}
+	item := *s.current
+	s.current = nil
+	s.currentToolIndex = -1
+	text := s.currentText.String()
+	outputIndex := len(s.response.Output)
+	zero := 0
+	events := make([]*dto.ResponsesStreamResponse, 0, 3)
+	switch item.Type {
+	case "message":
+		part := newResponsesTextContent(text)
+		item.Status = "completed"
+		item.Content = []dto.ResponsesOutputContent{part}
+		events = append(events,
+			s.event(dto.ResponsesStreamResponse{
+				Type:         dto.ResponsesStreamTypeOutputTextDone,
+				ItemId:       item.ID,
+				OutputIndex:  &outputIndex,
+				ContentIndex: &zero,
+				Text:         &text,
+			}),
+			s.event(dto.ResponsesStreamResponse{
+				Type:         dto.ResponsesStreamTypeContentPartDone,
+				ItemId:       item.ID,
+				OutputIndex:  &outputIndex,
+				ContentIndex: &zero,
+				Part:         &part,
+			}),
+		)
+	case "reasoning":
+		part := dto.ResponsesOutputContent{Type: "summary_text", Text: text}
+		item.Summary = []dto.ResponsesOutputContent{part}
+		events = append(events,
+			s.event(dto.ResponsesStreamResponse{
+				Type:         dto.ResponsesStreamTypeReasoningSummaryTextDone,
+				ItemId:       item.ID,
+				OutputIndex:  &outputIndex,
+				SummaryIndex: &zero,
+				Text:         &text,
+			}),
+			s.event(dto.ResponsesStreamResponse{
+				Type:         dto.ResponsesStreamTypeReasoningSummaryDone,
+				ItemId:       item.ID,
+				OutputIndex:  &outputIndex,
+				SummaryIndex: &zero,
+				Part:         &part,
+			}),
+		)
+	case "function_call":
+		item.Status = "completed"
+		item.Arguments = &text
+		events = append(events, s.event(dto.ResponsesStreamResponse{
+			Type:        dto.ResponsesStreamTypeFunctionCallArgsDone,
+			ItemId:      item.ID,
+			OutputIndex: &outputIndex,
+			Arguments:   &text,
+		}))
+	}
+	s.response.Output = append(s.response.Output, item)
+	events = append(events, s.event(dto.ResponsesStreamResponse{
+		Type:        dto.ResponsesOutputTypeItemDone,
+		OutputIndex: &outputIndex,
+		Item:        &item,
+	}))
+	return events
+}
+
+// Convert turns one chat completions chunk into stream events, only the first choice is used
+func (s *ResponsesStreamConverter) Convert(chunk *dto.ChatCompletionsStreamResponse) []*dto.ResponsesStreamResponse {
+	events := s.start()
+	if len(chunk.Choices) == 0 {
+		return events
+	}
+	choice := chunk.Choices[0]
+	if choice.FinishReason != nil && *choice.FinishReason != "" {
+		s.finishReason = *choice.FinishReason
+	}
+	outputIndex := len(s.response.Output)
+	if reasoning := choice.Delta.GetReasoningContent(); reasoning != "" {
+		if s.current == nil || s.current.Type != "reasoning" {
+			events = append(events, s.open(dto.ResponsesOutput{
+				Type:    "reasoning",
+				ID:      fmt.Sprintf("rs_%s", common.GetUUID()),
+				Summary: make([]dto.ResponsesOutputContent, 0),
+			})...)
+			outputIndex = len(s.response.Output)
+		}
+		s.currentText.WriteString(reasoning)
+		zero := 0
+		events = append(events, s.event(dto.ResponsesStreamResponse{
+			Type:         dto.ResponsesStreamTypeReasoningSummaryDelta,
+			ItemId:       s.current.ID,
+			OutputIndex:  &outputIndex,
+			SummaryIndex: &zero,
+			Delta:        reasoning,
+		}))
+	}
+	if content := choice.Delta.GetContentString(); content != "" {
+		if s.current == nil || s.current.Type != "message" {
+			events = append(events, s.open(dto.ResponsesOutput{
+				Type:    "message",
+				ID:      fmt.Sprintf("msg_%s", common.GetUUID()),
+				Status:  "in_progress",
+				Role:    "assistant",
+				Content: make([]dto.ResponsesOutputContent, 0),
+			})...)
+			outputIndex = len(s.response.Output)
+		}
+		s.currentText.WriteString(content)
+		zero := 0
+		events = append(events, s.event(dto.ResponsesStreamResponse{
+			Type:         dto.ResponsesStreamTypeOutputTextDelta,
+			ItemId:       s.current.ID,
+			OutputIndex:  &outputIndex,
+			ContentIndex: &zero,
+			Delta:        content,
+		}))
+	}
+	for _, toolCall := range choice.Delta.ToolCalls {
+		toolIndex := s.currentToolIndex
+		if toolCall.Index != nil {
+			toolIndex = *toolCall.Index
+		} else if toolCall.ID != "" {
+			toolIndex++
+		}
+		if s.current == nil || s.current.Type != "function_call" || toolIndex != s.currentToolIndex {
+			empty := ""
+			events = append(events, s.open(dto.ResponsesOutput{
+				Type:      "function_call",
+				ID:        fmt.Sprintf("fc_%s", common.GetUUID()),
+				Status:    "in_progress",
+				CallId:    common.GetStringIfEmpty(toolCall.ID, fmt.Sprintf("call_%s", common.GetUUID())),
+				Name:      toolCall.Function.Name,
+				Arguments: &empty,
+			})...)
+			s.currentToolIndex = toolIndex
+			outputIndex = len(s.response.Output)
+		}
+		if toolCall.Function.Arguments == "" {
+			continue
+		}
+		s.currentText.WriteString(toolCall.Function.Arguments)
+		events = append(events, s.event(dto.ResponsesStreamResponse{
+			Type:        dto.ResponsesStreamTypeFunctionCallArgsDelta,
+			ItemId:      s.current.ID,
+			OutputIndex: &outputIndex,
+			Delta:       toolCall.Function.Arguments,
+		}))
+	}
+	return events
+}
+
+// Finish closes the open output item and sends the final response with usage
+func (s *ResponsesStreamConverter) Finish(usage *dto.Usage) []*dto.ResponsesStreamResponse {
+	events := s.start()
+	events = append(events, s.close()...)
+	finishResponsesResponse(s.response, s.finishReason, usage)
+	eventType := dto.ResponsesStreamTypeCompleted
+	if s.response.Status == "incomplete" {
+		eventType = dto.ResponsesStreamTypeIncomplete
+	}
+	events = append(events, s.event(dto.ResponsesStreamResponse{
+		Type:     eventType,
+		Response: s.response,
+	}))
+	return events
+}
+
+// Response returns the response object built from the stream
+func (s *ResponsesStreamConverter) Response() *dto.OpenAIResponsesResponse {
+	return s.response
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"veloera/common"
+	"veloera/constant"
+)
+
+// NewFileId 生成 /v1/files 的文件 id
+func NewFileId() string {
+	return fmt.Sprintf("file-%s", common.GetUUID())
+}
+
+// FileStorageAvailable 当前节点能否读写文件内容，批处理只在主节点执行，存储未共享时文件只能保存在主节点
+func FileStorageAvailable() bool {
+	return common.IsMasterNode || constant.FileStorageShared
+}
+
+// TruncateFileContent 将文件截断到 size 字节，文件不存在时不返回错误，用于丢弃中断时写入一半的批处理结果
+func TruncateFileContent(fileId string, size int64) error {
+	err := os.Truncate(FileStoragePath(fileId), size)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// FileStoragePath 返回文件内容在本地的保存路径
+func FileStoragePath(fileId string) string {
+	return filepath.Join(constant.FileStorageDir, filepath.Base(fileId))
+}
+
+// SaveFileContent 将文件内容写入本地存储，超过 maxBytes 时返回错误并删除已写入的内容
+func SaveFileContent(fileId string, reader io.Reader, maxBytes int64) (int64, error) {
+	if err := os.MkdirAll(constant.FileStorageDir, 0755); err != nil {
+		return 0, fmt.Errorf("create file storage dir failed: %w", err)
+	}
+	path := FileStoragePath(fileId)
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	written, err := io.Copy(file, io.LimitReader(reader, maxBytes+1))
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil && written > maxBytes {
+		err = fmt.Errorf("file size exceeds the limit of %d bytes", maxBytes)
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return 0, err
+	}
+	return written, nil
+}
+
+// OpenFileContent 打开本地保存的文件内容
+func OpenFileContent(fileId string) (*os.File, error) {
+	return os.Open(FileStoragePath(fileId))
+}
+
+// AppendFileContent 以追加方式打开文件，不存在时创建，用于逐行写入批处理结果
+func AppendFileContent(fileId string) (*os.File, error) {
+	if err := os.MkdirAll(constant.FileStorageDir, 0755); err != nil {
+		return nil, fmt.Errorf("create file storage dir failed: %w", err)
+	}
+	return os.OpenFile(FileStoragePath(fileId), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+}
+
+// DeleteFileContent 删除本地保存的文件内容，文件不存在时不返回错误
+func DeleteFileContent(fileId string) error {
+	err := os.Remove(FileStoragePath(fileId))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
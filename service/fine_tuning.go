@@ -0,0 +1,171 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"veloera/common"
+	"veloera/constant"
+	"veloera/model"
+	relaycommon "veloera/relay/common"
+)
+
+// FineTuningUpstream 微调任务所属的渠道和 key，任务、文件和微调模型只在同一个 key 下可见
+type FineTuningUpstream struct {
+	Channel *model.Channel
+	Key     string
+}
+
+// NewFineTuningUpstream 按 keyHash 找到渠道中对应的 key，keyHash 为空时随机选择一个 key
+func NewFineTuningUpstream(channel *model.Channel, keyHash string) (*FineTuningUpstream, error) {
+	keys := make([]string, 0)
+	for _, key := range strings.Split(channel.Key, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("channel has no key")
+	}
+	if keyHash == "" {
+		return &FineTuningUpstream{Channel: channel, Key: keys[common.GetRandomInt(len(keys))]}, nil
+	}
+	for _, key := range keys {
+		if model.HashChannelKey(key) == keyHash {
+			return &FineTuningUpstream{Channel: channel, Key: key}, nil
+		}
+	}
+	return nil, errors.New("the channel key that owns this fine-tuning job is no longer available")
+}
+
+func (u *FineTuningUpstream) KeyHash() string {
+	return model.HashChannelKey(u.Key)
+}
+
+func (u *FineTuningUpstream) requestURL(path string, query url.Values) string {
+	if query == nil {
+		query = url.Values{}
+	}
+	var requestURL string
+	if u.Channel.Type == common.ChannelTypeAzure {
+		apiVersion := u.Channel.Other
+		if apiVersion == "" {
+			apiVersion = constant.AzureDefaultAPIVersion
+		}
+		query.Set("api-version", apiVersion)
+		requestURL = relaycommon.GetFullRequestURL(u.Channel.GetBaseURL(), "/openai"+path, u.Channel.Type)
+	} else {
+		requestURL = relaycommon.GetFullRequestURL(u.Channel.GetBaseURL(), "/v1"+path, u.Channel.Type)
+	}
+	if len(query) > 0 {
+		requestURL += "?" + query.Encode()
+	}
+	return requestURL
+}
+
+// Do 向渠道发送请求，path 为 /fine_tuning/jobs 这类不带版本前缀的路径
+func (u *FineTuningUpstream) Do(method string, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u.requestURL(path, query), body)
+	if err != nil {
+		return nil, fmt.Errorf("new request failed: %w", err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if u.Channel.Type == common.ChannelTypeAzure {
+		req.Header.Set("api-key", u.Key)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+u.Key)
+		if u.Channel.OpenAIOrganization != nil && *u.Channel.OpenAIOrganization != "" {
+			req.Header.Set("OpenAI-Organization", *u.Channel.OpenAIOrganization)
+		}
+	}
+	client := GetHttpClient()
+	if proxyURL, ok := u.Channel.GetSetting()["proxy"].(string); ok && proxyURL != "" {
+		client, err = NewProxyHttpClient(proxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("new proxy http client failed: %w", err)
+		}
+	}
+	return client.Do(req)
+}
+
+// UploadFile 将本地文件上传到渠道，返回上游文件 id
+func (u *FineTuningUpstream) UploadFile(file *model.File) (string, error) {
+	content, err := OpenFileContent(file.FileId)
+	if err != nil {
+		return "", err
+	}
+	defer content.Close()
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		err := writer.WriteField("purpose", file.Purpose)
+		if err == nil {
+			var part io.Writer
+			part, err = writer.CreateFormFile("file", file.Filename)
+			if err == nil {
+				_, err = io.Copy(part, content)
+			}
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		_ = pw.CloseWithError(err)
+	}()
+
+	resp, err := u.Do(http.MethodPost, "/files", nil, pr, writer.FormDataContentType())
+	if err != nil {
+		_ = pr.Close()
+		return "", err
+	}
+	defer resp.Body.Close()
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("upload file to upstream failed: status code %d, body: %s", resp.StatusCode, string(responseBody))
+	}
+	var uploaded struct {
+		Id string `json:"id"`
+	}
+	if err := json.Unmarshal(responseBody, &uploaded); err != nil {
+		return "", fmt.Errorf("unmarshal upload response failed: %w", err)
+	}
+	if uploaded.Id == "" {
+		return "", errors.New("upstream returned empty file id")
+	}
+	return uploaded.Id, nil
+}
+
+// GetUpstreamFileId 返回本地文件在该渠道 key 下的上游文件 id，尚未上传时先上传
+func (u *FineTuningUpstream) GetUpstreamFileId(file *model.File) (string, error) {
+	keyHash := u.KeyHash()
+	upstreamFile, err := model.GetUpstreamFile(file.FileId, u.Channel.Id, keyHash)
+	if exist, err := model.RecordExist(err); exist {
+		return upstreamFile.UpstreamFileId, nil
+	} else if err != nil {
+		return "", err
+	}
+	upstreamFileId, err := u.UploadFile(file)
+	if err != nil {
+		return "", err
+	}
+	upstreamFile = &model.UpstreamFile{
+		FileId:         file.FileId,
+		ChannelId:      u.Channel.Id,
+		KeyHash:        keyHash,
+		UpstreamFileId: upstreamFileId,
+	}
+	if err := upstreamFile.Insert(); err != nil {
+		return "", err
+	}
+	return upstreamFileId, nil
+}
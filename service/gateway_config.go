@@ -0,0 +1,507 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"veloera/common"
+	"veloera/model"
+
+	"gopkg.in/yaml.v3"
+)
+
+const gatewayConfigVersion = 1
+
+// 导出渠道 key 的方式
+const (
+	GatewayConfigKeysRedact  = "redact"  // 不导出 key，导入时保留数据库中的 key
+	GatewayConfigKeysEncrypt = "encrypt" // 使用 ENCRYPTION_MASTER_KEY 加密，只能导入到配置了相同主密钥的实例
+)
+
+const RedactedChannelKey = "<redacted>"
+
+// 以 JSON 字符串保存的渠道字段，导出时展开为结构
+var channelJSONFields = []string{"model_mapping", "status_code_mapping", "setting", "param_override"}
+
+// GatewayConfig 网关的声明式配置。Options 包含 OptionMap 中除密钥以外的所有选项，
+// 即模型倍率、分组倍率、限流等系统选项，以及以「模块名.字段」保存的配置模块；
+// Channels 中每个渠道的字段与渠道接口一致，未列出的字段在导入时保持不变
+type GatewayConfig struct {
+	Version  int              `yaml:"version" json:"version"`
+	Options  map[string]any   `yaml:"options" json:"options"`
+	Channels []map[string]any `yaml:"channels" json:"channels"`
+}
+
+// GatewayConfigChange 配置与数据库之间的一处差异
+type GatewayConfigChange struct {
+	Kind   string   `json:"kind"`             // option 或 channel
+	Action string   `json:"action"`           // create、update、delete，或 unmanaged 表示渠道不在配置中但未删除
+	Key    string   `json:"key"`              // 选项名，或渠道的「#id 名称」
+	Fields []string `json:"fields,omitempty"` // 渠道发生变化的字段
+	Old    any      `json:"old,omitempty"`    // 选项在数据库中的值
+	New    any      `json:"new,omitempty"`    // 选项在配置中的值
+}
+
+// GatewayConfigPlan 导入配置需要执行的变更
+type GatewayConfigPlan struct {
+	Changes []*GatewayConfigChange `json:"changes"`
+
+	options   map[string]string
+	creates   []*model.Channel
+	updates   []*model.Channel
+	deleteIds []int
+}
+
+// decodeConfigJSON 解析 JSON，整数保持为整数，避免导出为科学计数法
+func decodeConfigJSON(data []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v any
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	return convertConfigNumbers(v), nil
+}
+
+func convertConfigNumbers(v any) any {
+	switch val := v.(type) {
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return i
+		}
+		f, _ := val.Float64()
+		return f
+	case map[string]any:
+		for k, item := range val {
+			val[k] = convertConfigNumbers(item)
+		}
+	case []any:
+		for i, item := range val {
+			val[i] = convertConfigNumbers(item)
+		}
+	}
+	return v
+}
+
+// exportOptionValue JSON 对象和数组形式的选项展开为结构，便于阅读和比较
+func exportOptionValue(value string) any {
+	trimmed := strings.TrimSpace(value)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		if v, err := decodeConfigJSON([]byte(trimmed)); err == nil {
+			return v
+		}
+	}
+	return value
+}
+
+func optionValueToString(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func optionValuesEqual(a string, b string) bool {
+	if a == b {
+		return true
+	}
+	va, vb := exportOptionValue(a), exportOptionValue(b)
+	if _, ok := va.(string); ok {
+		return false
+	}
+	return reflect.DeepEqual(va, vb)
+}
+
+// channelToConfig 把渠道转换为配置中的字段，不包含 key 和运行时的状态
+func channelToConfig(channel *model.Channel) (map[string]any, error) {
+	data, err := json.Marshal(channel)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := decodeConfigJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	m := decoded.(map[string]any)
+	delete(m, "key")
+	for _, field := range model.ChannelRuntimeColumns {
+		delete(m, field)
+	}
+	for _, field := range channelJSONFields {
+		if s, ok := m[field].(string); ok && s != "" {
+			if v, err := decodeConfigJSON([]byte(s)); err == nil {
+				m[field] = v
+			}
+		}
+	}
+	models := make([]any, 0)
+	for _, name := range channel.GetModels() {
+		models = append(models, name)
+	}
+	m["models"] = models
+	return m, nil
+}
+
+// configToChannel 把配置中的字段覆盖到数据库中的渠道上，base 为空时新建渠道
+func configToChannel(entry map[string]any, base *model.Channel) (*model.Channel, error) {
+	m := make(map[string]any)
+	if base != nil {
+		baseConfig, err := channelToConfig(base)
+		if err != nil {
+			return nil, err
+		}
+		m = baseConfig
+	}
+	for k, v := range entry {
+		if k != "key" {
+			m[k] = v
+		}
+	}
+	for _, field := range channelJSONFields {
+		if v, ok := m[field]; ok && v != nil {
+			if _, isString := v.(string); !isString {
+				data, err := json.Marshal(v)
+				if err != nil {
+					return nil, fmt.Errorf("字段 %s 无效: %s", field, err.Error())
+				}
+				m[field] = string(data)
+			}
+		}
+	}
+	if models, ok := m["models"].([]any); ok {
+		names := make([]string, 0, len(models))
+		for _, name := range models {
+			names = append(names, fmt.Sprint(name))
+		}
+		m["models"] = strings.Join(names, ",")
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	channel := &model.Channel{}
+	if err := json.Unmarshal(data, channel); err != nil {
+		return nil, err
+	}
+	if base != nil {
+		channel.Id = base.Id
+		channel.Key = base.Key
+		// 自动禁用是运行时的状态，配置为启用时不重新启用
+		if base.Status == common.ChannelStatusAutoDisabled && channel.Status == common.ChannelStatusEnabled {
+			channel.Status = base.Status
+		}
+	} else {
+		channel.CreatedTime = common.GetTimestamp()
+	}
+	if key, ok := entry["key"].(string); ok && key != "" && key != RedactedChannelKey {
+		if common.IsEncryptedSecret(key) {
+			key, err = common.DecryptSecret(key)
+			if err != nil {
+				return nil, fmt.Errorf("解密 key 失败：%s", err.Error())
+			}
+		}
+		channel.Key = key
+	}
+	if channel.Key == "" {
+		return nil, errors.New("新建的渠道缺少 key")
+	}
+	return channel, nil
+}
+
+func configValuesEqual(a any, b any) bool {
+	isEmpty := func(v any) bool {
+		return v == nil || v == ""
+	}
+	if isEmpty(a) && isEmpty(b) {
+		return true
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func channelLabel(id int, name string) string {
+	if id == 0 {
+		return name
+	}
+	return fmt.Sprintf("#%d %s", id, name)
+}
+
+// ExportGatewayConfig 导出所有渠道和选项
+func ExportGatewayConfig(keyMode string) (*GatewayConfig, error) {
+	// 未配置主密钥时 EncryptSecret 返回明文
+	if keyMode == GatewayConfigKeysEncrypt && !common.SecretEncryptionEnabled() {
+		return nil, errors.New("导出加密的 key 需要配置 ENCRYPTION_MASTER_KEY")
+	}
+	cfg := &GatewayConfig{
+		Version:  gatewayConfigVersion,
+		Options:  make(map[string]any),
+		Channels: make([]map[string]any, 0),
+	}
+	common.OptionMapRWMutex.RLock()
+	for key, value := range common.OptionMap {
+		if !model.IsSecretOption(key) {
+			cfg.Options[key] = exportOptionValue(value)
+		}
+	}
+	common.OptionMapRWMutex.RUnlock()
+
+	channels, err := model.GetAllChannels(0, 0, true, true)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Id < channels[j].Id })
+	for _, channel := range channels {
+		entry, err := channelToConfig(channel)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range entry {
+			if v == nil || v == "" {
+				delete(entry, k)
+			}
+		}
+		entry["key"] = RedactedChannelKey
+		if keyMode == GatewayConfigKeysEncrypt {
+			encrypted, err := common.EncryptSecret(channel.Key)
+			if err != nil {
+				return nil, err
+			}
+			entry["key"] = encrypted
+		}
+		cfg.Channels = append(cfg.Channels, entry)
+	}
+	return cfg, nil
+}
+
+func MarshalGatewayConfig(cfg *GatewayConfig) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ParseGatewayConfig 解析 YAML 或 JSON 格式的配置
+func ParseGatewayConfig(data []byte) (*GatewayConfig, error) {
+	cfg := &GatewayConfig{}
+	if err := yaml.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("解析配置失败: %s", err.Error())
+	}
+	if cfg.Version != gatewayConfigVersion {
+		return nil, fmt.Errorf("不支持的配置版本 %d", cfg.Version)
+	}
+	return cfg, nil
+}
+
+func planOptions(cfg *GatewayConfig, plan *GatewayConfigPlan) error {
+	keys := make([]string, 0, len(cfg.Options))
+	for key := range cfg.Options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := optionValueToString(cfg.Options[key])
+		if err != nil {
+			return fmt.Errorf("选项 %s 无效: %s", key, err.Error())
+		}
+		values[key] = value
+	}
+	common.OptionMapRWMutex.RLock()
+	defer common.OptionMapRWMutex.RUnlock()
+	for _, key := range keys {
+		current, ok := common.OptionMap[key]
+		if !ok {
+			return fmt.Errorf("未知的选项 %s", key)
+		}
+		value := values[key]
+		if optionValuesEqual(current, value) {
+			continue
+		}
+		// 与管理后台修改选项时的校验一致，依赖的配置以同一份配置中的值为准
+		if err := model.ValidateOption(key, value, values); err != nil {
+			return fmt.Errorf("选项 %s 无效: %s", key, err.Error())
+		}
+		change := &GatewayConfigChange{Kind: "option", Action: "update", Key: key}
+		if !model.IsSecretOption(key) {
+			change.Old = exportOptionValue(current)
+			change.New = exportOptionValue(value)
+		}
+		plan.Changes = append(plan.Changes, change)
+		plan.options[key] = value
+	}
+	return nil
+}
+
+func planChannels(cfg *GatewayConfig, prune bool, plan *GatewayConfigPlan) error {
+	channels, err := model.GetAllChannels(0, 0, true, true)
+	if err != nil {
+		return err
+	}
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Id < channels[j].Id })
+	byId := make(map[int]*model.Channel, len(channels))
+	byName := make(map[string][]*model.Channel)
+	for _, channel := range channels {
+		byId[channel.Id] = channel
+		byName[channel.Name] = append(byName[channel.Name], channel)
+	}
+	matched := make(map[int]bool)
+	for i, entry := range cfg.Channels {
+		// 按 id 匹配，没有 id 时按唯一的名称匹配
+		var base *model.Channel
+		id, _ := entry["id"].(int)
+		name, _ := entry["name"].(string)
+		if id != 0 {
+			base = byId[id]
+		} else if sameName := byName[name]; name != "" && len(sameName) == 1 {
+			base = sameName[0]
+		}
+		if base != nil && matched[base.Id] {
+			return fmt.Errorf("第 %d 个渠道与其他渠道重复", i+1)
+		}
+		channel, err := configToChannel(entry, base)
+		if err != nil {
+			return fmt.Errorf("第 %d 个渠道 %s: %s", i+1, name, err.Error())
+		}
+		if base == nil {
+			plan.creates = append(plan.creates, channel)
+			plan.Changes = append(plan.Changes, &GatewayConfigChange{Kind: "channel", Action: "create", Key: channelLabel(channel.Id, channel.Name)})
+			continue
+		}
+		matched[base.Id] = true
+		current, err := channelToConfig(base)
+		if err != nil {
+			return err
+		}
+		target, err := channelToConfig(channel)
+		if err != nil {
+			return err
+		}
+		var fields []string
+		for field := range entry {
+			if field != "key" && field != "id" && !configValuesEqual(current[field], target[field]) {
+				fields = append(fields, field)
+			}
+		}
+		if channel.Key != base.Key {
+			fields = append(fields, "key")
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		sort.Strings(fields)
+		plan.updates = append(plan.updates, channel)
+		plan.Changes = append(plan.Changes, &GatewayConfigChange{Kind: "channel", Action: "update", Key: channelLabel(base.Id, base.Name), Fields: fields})
+	}
+	for _, channel := range channels {
+		if matched[channel.Id] {
+			continue
+		}
+		// 数据库中有而配置中没有的渠道，只有 prune 时才删除
+		action := "unmanaged"
+		if prune {
+			action = "delete"
+			plan.deleteIds = append(plan.deleteIds, channel.Id)
+		}
+		plan.Changes = append(plan.Changes, &GatewayConfigChange{Kind: "channel", Action: action, Key: channelLabel(channel.Id, channel.Name)})
+	}
+	return nil
+}
+
+// PlanGatewayConfig 比较配置与数据库，返回导入需要执行的变更。配置中没有的选项保持不变，
+// 配置中没有的渠道只有 prune 为 true 时才会被删除
+func PlanGatewayConfig(cfg *GatewayConfig, prune bool) (*GatewayConfigPlan, error) {
+	plan := &GatewayConfigPlan{
+		Changes: make([]*GatewayConfigChange, 0),
+		options: make(map[string]string),
+	}
+	if err := planOptions(cfg, plan); err != nil {
+		return nil, err
+	}
+	if err := planChannels(cfg, prune, plan); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// ApplyGatewayConfigPlan 执行导入：渠道和 abilities 在一个事务中更新，之后逐个更新选项
+func ApplyGatewayConfigPlan(plan *GatewayConfigPlan) error {
+	if len(plan.creates) > 0 || len(plan.updates) > 0 || len(plan.deleteIds) > 0 {
+		if err := model.ReconcileChannels(plan.creates, plan.updates, plan.deleteIds); err != nil {
+			return err
+		}
+		if common.MemoryCacheEnabled {
+			model.InitChannelCache()
+		}
+	}
+	keys := make([]string, 0, len(plan.options))
+	for key := range plan.options {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := model.UpdateOption(key, plan.options[key]); err != nil {
+			return fmt.Errorf("更新选项 %s 失败: %s", key, err.Error())
+		}
+	}
+	return nil
+}
+
+// ReconcileGatewayConfigFile 启动时比较挂载的配置文件与数据库并输出差异，apply 为 true 时同步到数据库
+func ReconcileGatewayConfigFile(path string, apply bool, prune bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg, err := ParseGatewayConfig(data)
+	if err != nil {
+		return err
+	}
+	plan, err := PlanGatewayConfig(cfg, prune)
+	if err != nil {
+		return err
+	}
+	if len(plan.Changes) == 0 {
+		common.SysLog("gateway config is in sync with " + path)
+		return nil
+	}
+	for _, change := range plan.Changes {
+		detail := ""
+		if len(change.Fields) > 0 {
+			detail = " fields: " + strings.Join(change.Fields, ", ")
+		}
+		common.SysLog(fmt.Sprintf("gateway config drift: %s %s %s%s", change.Action, change.Kind, change.Key, detail))
+	}
+	if !apply {
+		common.SysLog(fmt.Sprintf("gateway config has %d drift(s) from %s, not applied", len(plan.Changes), path))
+		return nil
+	}
+	if err := ApplyGatewayConfigPlan(plan); err != nil {
+		return err
+	}
+	common.SysLog(fmt.Sprintf("applied %d gateway config change(s) from %s", len(plan.Changes), path))
+	return nil
+}
@@ -7,11 +7,13 @@ import (
 	"fmt"
 	"image"
 	"io"
+	"mime/multipart"
 	"net/http"
 	"strings"
 	"veloera/common"
 	"veloera/constant"
 
+	"github.com/gin-gonic/gin"
 	"golang.org/x/image/webp"
 )
 
@@ -170,3 +172,49 @@ func getImageConfig(reader io.Reader) (image.Config, string, error) {
 	}
 	return config, format, nil
 }
+
+// GetImageEditFiles 获取 /v1/images/edits 和 /v1/images/variations 表单中的图片和遮罩，图片支持 image 和 image[] 两种字段名
+func GetImageEditFiles(c *gin.Context) ([]*multipart.FileHeader, *multipart.FileHeader, error) {
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid multipart form: %w", err)
+	}
+	images := form.File["image"]
+	if len(images) == 0 {
+		images = form.File["image[]"]
+	}
+	var mask *multipart.FileHeader
+	if masks := form.File["mask"]; len(masks) > 0 {
+		mask = masks[0]
+	}
+	return images, mask, nil
+}
+
+// ReadImageFile 读取上传的图片，返回 mime 类型和 base64 编码的数据
+func ReadImageFile(header *multipart.FileHeader) (mimeType string, data string, err error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+	fileData, err := io.ReadAll(file)
+	if err != nil {
+		return "", "", err
+	}
+	return http.DetectContentType(fileData), base64.StdEncoding.EncodeToString(fileData), nil
+}
+
+// DetectImageFileType 根据文件头判断上传图片的 mime 类型
+func DetectImageFileType(header *multipart.FileHeader) (string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
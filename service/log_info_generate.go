@@ -36,6 +36,13 @@ func GenerateTextOtherInfo(ctx *gin.Context, relayInfo *relaycommon.RelayInfo, m
 		if context, exists := relayInfo.Other["context"]; exists {
 			other["context"] = context
 		}
+		// 中途中断后续写的流式响应，每一段单独计费
+		if _, exists := relayInfo.Other["stream_interrupted"]; exists {
+			other["stream_interrupted"] = true
+		}
+		if _, exists := relayInfo.Other["stream_continuation"]; exists {
+			other["stream_continuation"] = true
+		}
 	}
 
 	adminInfo := make(map[string]interface{})
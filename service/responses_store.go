@@ -0,0 +1,152 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"veloera/common"
+	"veloera/dto"
+	"veloera/model"
+)
+
+// maxResponsesHistoryDepth limits how many previous responses are followed when rebuilding a conversation
+const maxResponsesHistoryDepth = 256
+
+var ErrPreviousResponseNotFound = errors.New("previous response not found")
+
+// ResponsesInputRaw returns the input items of the request as they were sent, a plain string input becomes one user message
+func ResponsesInputRaw(request *dto.OpenAIResponsesRequest) ([]json.RawMessage, error) {
+	if len(request.Input) == 0 {
+		return nil, nil
+	}
+	var text string
+	if err := json.Unmarshal(request.Input, &text); err == nil {
+		item, err := json.Marshal(dto.ResponsesInputItem{Type: "message", Role: "user", Content: request.Input})
+		if err != nil {
+			return nil, err
+		}
+		return []json.RawMessage{item}, nil
+	}
+	var items []json.RawMessage
+	if err := json.Unmarshal(request.Input, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// responsesOutput2Input turns the output items of a stored response into input items of the next turn.
+// Reasoning and built-in tool items are dropped and item ids are removed, another upstream can not resolve them
+func responsesOutput2Input(response json.RawMessage) ([]json.RawMessage, error) {
+	var responsesResponse dto.OpenAIResponsesResponse
+	if err := json.Unmarshal(response, &responsesResponse); err != nil {
+		return nil, err
+	}
+	items := make([]json.RawMessage, 0, len(responsesResponse.Output))
+	for _, output := range responsesResponse.Output {
+		var item dto.ResponsesInputItem
+		switch output.Type {
+		case "message":
+			contents := make([]dto.ResponsesInputContent, 0, len(output.Content))
+			for _, outputContent := range output.Content {
+				contents = append(contents, dto.ResponsesInputContent{Type: outputContent.Type, Text: outputContent.Text})
+			}
+			content, err := json.Marshal(contents)
+			if err != nil {
+				return nil, err
+			}
+			item = dto.ResponsesInputItem{Type: "message", Role: common.GetStringIfEmpty(output.Role, "assistant"), Content: content}
+		case "function_call":
+			item = dto.ResponsesInputItem{Type: "function_call", CallId: output.CallId, Name: output.Name}
+			if output.Arguments != nil {
+				item.Arguments = *output.Arguments
+			}
+		default:
+			continue
+		}
+		data, err := json.Marshal(item)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, data)
+	}
+	return items, nil
+}
+
+// BuildResponsesHistory rebuilds the conversation ending with previousResponseId from the response store,
+// the returned items are the inputs and outputs of every stored turn in order
+func BuildResponsesHistory(userId int, tokenId int, previousResponseId string) ([]json.RawMessage, error) {
+	turns := make([][]json.RawMessage, 0)
+	responseId := previousResponseId
+	for depth := 0; responseId != "" && depth < maxResponsesHistoryDepth; depth++ {
+		stored, err := model.GetStoredResponse(userId, tokenId, responseId)
+		if exist, _ := model.RecordExist(err); !exist {
+			return nil, fmt.Errorf("%w: %s", ErrPreviousResponseNotFound, responseId)
+		}
+		if err != nil {
+			return nil, err
+		}
+		var input []json.RawMessage
+		if len(stored.Input) > 0 {
+			if err := json.Unmarshal(stored.Input, &input); err != nil {
+				return nil, err
+			}
+		}
+		output, err := responsesOutput2Input(stored.Response)
+		if err != nil {
+			return nil, err
+		}
+		turns = append(turns, append(input, output...))
+		responseId = stored.PreviousResponseId
+	}
+	history := make([]json.RawMessage, 0)
+	for i := len(turns) - 1; i >= 0; i-- {
+		history = append(history, turns[i]...)
+	}
+	return history, nil
+}
+
+// IsUpstreamResponseAvailable reports whether the stored response can still be referenced by previous_response_id
+// upstream, that is only the case for the same channel and key which created it
+func IsUpstreamResponseAvailable(stored *model.StoredResponse, channelId int, apiKey string) bool {
+	return stored.Upstream && stored.ChannelId == channelId && stored.KeyHash == model.HashChannelKey(apiKey)
+}
+
+// ResponsesInputItems returns the stored input items in the format of GET /v1/responses/{id}/input_items,
+// items without id get a stable one derived from the sha256 of the response id
+func ResponsesInputItems(stored *model.StoredResponse) ([]map[string]any, error) {
+	var input []json.RawMessage
+	if len(stored.Input) > 0 {
+		if err := json.Unmarshal(stored.Input, &input); err != nil {
+			return nil, err
+		}
+	}
+	items := make([]map[string]any, 0, len(input))
+	for index, raw := range input {
+		item := make(map[string]any)
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return nil, err
+		}
+		itemType, _ := item["type"].(string)
+		if itemType == "" {
+			itemType = "message"
+			item["type"] = itemType
+		}
+		if text, ok := item["content"].(string); ok {
+			item["content"] = []dto.ResponsesInputContent{{Type: "input_text", Text: text}}
+		}
+		if id, _ := item["id"].(string); id == "" {
+			prefix := "item"
+			switch itemType {
+			case "message":
+				prefix = "msg"
+			case "function_call":
+				prefix = "fc"
+			case "function_call_output":
+				prefix = "fco"
+			}
+			item["id"] = fmt.Sprintf("%s_%s_%d", prefix, model.HashChannelKey(stored.ResponseId)[:24], index)
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
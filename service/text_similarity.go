@@ -0,0 +1,46 @@
+package service
+
+import (
+	"strings"
+	"unicode"
+)
+
+// similarityTokens 把文本切分为小写的词，中日韩文字按单字切分
+func similarityTokens(text string) map[string]bool {
+	tokens := make(map[string]bool)
+	var word strings.Builder
+	flush := func() {
+		if word.Len() > 0 {
+			tokens[strings.ToLower(word.String())] = true
+			word.Reset()
+		}
+	}
+	for _, r := range text {
+		switch {
+		case unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul):
+			flush()
+			tokens[string(r)] = true
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word.WriteRune(r)
+		default:
+			flush()
+		}
+	}
+	flush()
+	return tokens
+}
+
+// TextSimilarity 计算两段文本的词集合 Jaccard 相似度，返回 0 到 1 之间的值
+func TextSimilarity(a string, b string) float64 {
+	tokensA, tokensB := similarityTokens(a), similarityTokens(b)
+	if len(tokensA) == 0 && len(tokensB) == 0 {
+		return 1
+	}
+	intersection := 0
+	for token := range tokensA {
+		if tokensB[token] {
+			intersection++
+		}
+	}
+	return float64(intersection) / float64(len(tokensA)+len(tokensB)-intersection)
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"veloera/model"
+	"veloera/setting/operation_setting"
+)
+
+// 不同上游的限流响应头：OpenAI 及兼容接口使用 x-ratelimit-*，Anthropic 使用 anthropic-ratelimit-*
+var (
+	limitRequestsHeaders     = []string{"x-ratelimit-limit-requests", "anthropic-ratelimit-requests-limit"}
+	remainingRequestsHeaders = []string{"x-ratelimit-remaining-requests", "anthropic-ratelimit-requests-remaining"}
+	resetRequestsHeaders     = []string{"x-ratelimit-reset-requests", "anthropic-ratelimit-requests-reset"}
+	limitTokensHeaders       = []string{"x-ratelimit-limit-tokens", "anthropic-ratelimit-tokens-limit"}
+	remainingTokensHeaders   = []string{"x-ratelimit-remaining-tokens", "anthropic-ratelimit-tokens-remaining"}
+	resetTokensHeaders       = []string{"x-ratelimit-reset-tokens", "anthropic-ratelimit-tokens-reset"}
+)
+
+func firstHeader(header http.Header, names []string) string {
+	for _, name := range names {
+		if value := strings.TrimSpace(header.Get(name)); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func headerInt(header http.Header, names []string) (int64, bool) {
+	value, err := strconv.ParseInt(firstHeader(header, names), 10, 64)
+	return value, err == nil
+}
+
+// parseResetTime 解析额度恢复时间，支持 1s、6m0s 这样的时长，秒数，以及 RFC 3339 时间
+func parseResetTime(value string, now time.Time) int64 {
+	if value == "" {
+		return 0
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return now.Add(duration).UnixMilli()
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return now.Add(time.Duration(seconds * float64(time.Second))).UnixMilli()
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UnixMilli()
+	}
+	return 0
+}
+
+// parseRetryAfter 解析 retry-after-ms 和 retry-after（秒数或 HTTP 日期）
+func parseRetryAfter(header http.Header, now time.Time) int64 {
+	if ms, err := strconv.ParseFloat(header.Get("retry-after-ms"), 64); err == nil {
+		return now.Add(time.Duration(ms * float64(time.Millisecond))).UnixMilli()
+	}
+	value := strings.TrimSpace(header.Get("retry-after"))
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return now.Add(time.Duration(seconds * float64(time.Second))).UnixMilli()
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t.UnixMilli()
+	}
+	return 0
+}
+
+// ParseUpstreamRateLimit 从上游响应头解析限流额度，429 时按 retry-after 或额度恢复时间计算冷却时间，
+// 没有任何限流响应头时返回 false
+func ParseUpstreamRateLimit(header http.Header, statusCode int, now time.Time) (model.ChannelRateLimit, bool) {
+	var rateLimit model.ChannelRateLimit
+	found := false
+	if limit, ok := headerInt(header, limitRequestsHeaders); ok && limit > 0 {
+		if remaining, ok := headerInt(header, remainingRequestsHeaders); ok {
+			rateLimit.LimitRequests = limit
+			rateLimit.RemainingRequests = remaining
+			rateLimit.ResetRequestsAt = parseResetTime(firstHeader(header, resetRequestsHeaders), now)
+			found = true
+		}
+	}
+	if limit, ok := headerInt(header, limitTokensHeaders); ok && limit > 0 {
+		if remaining, ok := headerInt(header, remainingTokensHeaders); ok {
+			rateLimit.LimitTokens = limit
+			rateLimit.RemainingTokens = remaining
+			rateLimit.ResetTokensAt = parseResetTime(firstHeader(header, resetTokensHeaders), now)
+			found = true
+		}
+	}
+	if statusCode == http.StatusTooManyRequests {
+		cooldownUntil := parseRetryAfter(header, now)
+		if cooldownUntil == 0 {
+			// 没有 retry-after 时等到耗尽的额度恢复
+			if rateLimit.LimitRequests > 0 && rateLimit.RemainingRequests <= 0 {
+				cooldownUntil = rateLimit.ResetRequestsAt
+			}
+			if rateLimit.LimitTokens > 0 && rateLimit.RemainingTokens <= 0 && rateLimit.ResetTokensAt > cooldownUntil {
+				cooldownUntil = rateLimit.ResetTokensAt
+			}
+		}
+		maxCooldownUntil := now.Add(time.Duration(operation_setting.GetUpstreamRateLimitSetting().MaxCooldownSeconds) * time.Second).UnixMilli()
+		if cooldownUntil > maxCooldownUntil {
+			cooldownUntil = maxCooldownUntil
+		}
+		if cooldownUntil > now.UnixMilli() {
+			rateLimit.CooldownUntil = cooldownUntil
+			found = true
+		}
+	}
+	return rateLimit, found
+}
+
+// RecordUpstreamRateLimit 记录上游响应中的限流额度，keyHash 为多 key 渠道中使用的 key
+func RecordUpstreamRateLimit(channelId int, keyHash string, resp *http.Response) {
+	if !operation_setting.GetUpstreamRateLimitSetting().Enabled || resp == nil {
+		return
+	}
+	rateLimit, ok := ParseUpstreamRateLimit(resp.Header, resp.StatusCode, time.Now())
+	if !ok {
+		return
+	}
+	model.UpdateChannelRateLimit(channelId, keyHash, rateLimit)
+}
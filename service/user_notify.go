@@ -60,6 +60,11 @@ func NotifyUser(userId int, userEmail string, userSetting map[string]interface{}
 		var webhookSecret string
 		if secret, ok := userSetting[constant.UserSettingWebhookSecret]; ok {
 			webhookSecret, _ = secret.(string)
+			webhookSecret, err = common.DecryptSecret(webhookSecret)
+			if err != nil {
+				common.SysError(fmt.Sprintf("failed to decrypt webhook secret of user %d: %s", userId, err.Error()))
+				return err
+			}
 		}
 
 		return SendWebhookNotify(webhookURLStr, webhookSecret, data)
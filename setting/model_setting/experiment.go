@@ -0,0 +1,124 @@
+package model_setting
+
+import (
+	"veloera/setting/config"
+)
+
+const (
+	ExperimentStickyByToken = "token"
+	ExperimentStickyByUser  = "user" // 按请求体中的 user 字段分配，没有 user 字段时按令牌分配
+)
+
+// ExperimentVariant 实验的一个变体，按权重分配请求
+type ExperimentVariant struct {
+	Name   string `json:"name"`
+	Model  string `json:"model"` // 变体实际使用的模型，可以是虚拟模型
+	Weight int    `json:"weight"`
+}
+
+// Experiment 按权重把请求某个模型名的流量分配到不同的变体，同一令牌或用户始终分配到同一个变体
+type Experiment struct {
+	Name      string              `json:"name"`
+	Model     string              `json:"model"` // 客户端请求的模型名
+	Variants  []ExperimentVariant `json:"variants"`
+	StickyBy  string              `json:"sticky_by"`
+	StartTime int64               `json:"start_time"` // 开始时间，为 0 时不限制
+	EndTime   int64               `json:"end_time"`   // 结束时间，为 0 时不限制
+}
+
+// ExperimentSettings 模型 A/B 实验
+type ExperimentSettings struct {
+	Experiments []Experiment `json:"experiments"`
+}
+
+// 默认配置
+var defaultExperimentSettings = ExperimentSettings{
+	Experiments: []Experiment{},
+}
+
+// 全局实例
+var experimentSettings = defaultExperimentSettings
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("experiment", &experimentSettings)
+}
+
+// GetExperimentSettings 获取实验配置
+func GetExperimentSettings() *ExperimentSettings {
+	return &experimentSettings
+}
+
+// Active 实验在给定时间是否进行中且有可分配的变体
+func (e *Experiment) Active(now int64) bool {
+	if e.StartTime != 0 && now < e.StartTime {
+		return false
+	}
+	if e.EndTime != 0 && now >= e.EndTime {
+		return false
+	}
+	return e.TotalWeight() > 0
+}
+
+// TotalWeight 返回所有变体的权重之和
+func (e *Experiment) TotalWeight() int {
+	total := 0
+	for _, variant := range e.Variants {
+		if variant.Weight > 0 && variant.Model != "" {
+			total += variant.Weight
+		}
+	}
+	return total
+}
+
+// PickVariant 按 0 到 TotalWeight 之间的值选择变体
+func (e *Experiment) PickVariant(point int) *ExperimentVariant {
+	for i := range e.Variants {
+		variant := &e.Variants[i]
+		if variant.Weight <= 0 || variant.Model == "" {
+			continue
+		}
+		if point < variant.Weight {
+			return variant
+		}
+		point -= variant.Weight
+	}
+	return nil
+}
+
+// GetActiveExperiment 返回请求的模型名在给定时间进行中的实验，没有时返回 nil
+func GetActiveExperiment(modelName string, now int64) *Experiment {
+	for i := range experimentSettings.Experiments {
+		experiment := &experimentSettings.Experiments[i]
+		if experiment.Model == modelName && experiment.Active(now) {
+			return experiment
+		}
+	}
+	return nil
+}
+
+// GetVirtualModelChains 返回虚拟模型和进行中的实验使用的模型，用于展示可用的模型和价格
+func GetVirtualModelChains(now int64) map[string][]string {
+	chains := make(map[string][]string, len(virtualModelSettings.Models))
+	for name, models := range virtualModelSettings.Models {
+		chains[name] = models
+	}
+	for _, experiment := range experimentSettings.Experiments {
+		if _, ok := chains[experiment.Model]; ok || !experiment.Active(now) {
+			continue
+		}
+		models := make([]string, 0, len(experiment.Variants))
+		for _, variant := range experiment.Variants {
+			if variant.Weight <= 0 || variant.Model == "" {
+				continue
+			}
+			if chain, ok := virtualModelSettings.Models[variant.Model]; ok {
+				models = append(models, chain...)
+			} else {
+				models = append(models, variant.Model)
+			}
+		}
+		chains[experiment.Model] = models
+	}
+	return chains
+}
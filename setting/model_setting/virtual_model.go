@@ -0,0 +1,37 @@
+package model_setting
+
+import (
+	"veloera/setting/config"
+)
+
+// VirtualModelSettings 定义虚拟模型，请求虚拟模型时按顺序尝试其中的模型，前一个模型无可用渠道或重试失败时使用下一个
+type VirtualModelSettings struct {
+	Models map[string][]string `json:"models"`
+}
+
+// 默认配置
+var defaultVirtualModelSettings = VirtualModelSettings{
+	Models: map[string][]string{},
+}
+
+// 全局实例
+var virtualModelSettings = defaultVirtualModelSettings
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("virtual_model", &virtualModelSettings)
+}
+
+// GetVirtualModelSettings 获取虚拟模型配置
+func GetVirtualModelSettings() *VirtualModelSettings {
+	return &virtualModelSettings
+}
+
+// GetVirtualModelChain 返回虚拟模型依次尝试的模型，不是虚拟模型时返回 false
+func GetVirtualModelChain(name string) ([]string, bool) {
+	models, ok := virtualModelSettings.Models[name]
+	if !ok || len(models) == 0 {
+		return nil, false
+	}
+	return models, true
+}
@@ -0,0 +1,30 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// BatchSetting 控制 /v1/files 和 /v1/batches 的批处理
+type BatchSetting struct {
+	Enabled       bool    `json:"enabled"`
+	DiscountRatio float64 `json:"discount_ratio"` // 批处理请求的价格倍率，与分组倍率相乘
+	Concurrency   int     `json:"concurrency"`    // 单个批处理同时执行的请求数
+	MaxFileSizeMB int     `json:"max_file_size_mb"`
+	MaxRequests   int     `json:"max_requests"` // 单个批处理的最大请求数
+}
+
+// 默认配置
+var batchSetting = BatchSetting{
+	Enabled:       true,
+	DiscountRatio: 0.5,
+	Concurrency:   4,
+	MaxFileSizeMB: 200,
+	MaxRequests:   50000,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("batch_setting", &batchSetting)
+}
+
+func GetBatchSetting() *BatchSetting {
+	return &batchSetting
+}
@@ -0,0 +1,24 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// ChannelConcurrencySetting 渠道并发已满时的等待队列配置，渠道和 key 的并发上限在渠道设置中配置
+type ChannelConcurrencySetting struct {
+	QueueSize           int `json:"queue_size"`            // 每个节点最多等待的请求数，为 0 时不排队直接返回 429
+	QueueTimeoutSeconds int `json:"queue_timeout_seconds"` // 请求最长等待时间
+}
+
+// 默认配置
+var channelConcurrencySetting = ChannelConcurrencySetting{
+	QueueSize:           100,
+	QueueTimeoutSeconds: 30,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("channel_concurrency_setting", &channelConcurrencySetting)
+}
+
+func GetChannelConcurrencySetting() *ChannelConcurrencySetting {
+	return &channelConcurrencySetting
+}
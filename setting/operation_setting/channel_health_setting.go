@@ -0,0 +1,34 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// ChannelHealthSetting 渠道健康记录和公开的模型状态页
+type ChannelHealthSetting struct {
+	RecordLiveSamples bool     `json:"record_live_samples"` // 记录实际请求的成败和首字时间，关闭时只记录渠道测试
+	RetentionDays     int      `json:"retention_days"`      // 健康记录保存天数，0 表示不清理
+	StatusPageEnabled bool     `json:"status_page_enabled"` // 开启公开的模型状态接口
+	StatusPageModels  []string `json:"status_page_models"`  // 状态页展示的模型，为空时展示所有有记录的模型
+	StatusPageHours   int      `json:"status_page_hours"`   // 状态页统计最近多少小时的记录
+	DegradedThreshold float64  `json:"degraded_threshold"`  // 可用率低于该值时显示为性能下降，0-1
+	DownThreshold     float64  `json:"down_threshold"`      // 可用率低于该值时显示为不可用，0-1
+}
+
+// 默认配置
+var channelHealthSetting = ChannelHealthSetting{
+	RecordLiveSamples: true,
+	RetentionDays:     30,
+	StatusPageEnabled: false,
+	StatusPageModels:  []string{},
+	StatusPageHours:   24,
+	DegradedThreshold: 0.95,
+	DownThreshold:     0.5,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("channel_health_setting", &channelHealthSetting)
+}
+
+func GetChannelHealthSetting() *ChannelHealthSetting {
+	return &channelHealthSetting
+}
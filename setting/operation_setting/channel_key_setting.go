@@ -0,0 +1,22 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// ChannelKeySetting 多 key 渠道中单个 key 的健康检查配置
+type ChannelKeySetting struct {
+	CooldownSeconds int `json:"cooldown_seconds"` // key 被限流（429）后暂停使用的时间
+}
+
+// 默认配置
+var channelKeySetting = ChannelKeySetting{
+	CooldownSeconds: 60,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("channel_key_setting", &channelKeySetting)
+}
+
+func GetChannelKeySetting() *ChannelKeySetting {
+	return &channelKeySetting
+}
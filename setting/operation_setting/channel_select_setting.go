@@ -0,0 +1,49 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+const (
+	ChannelSelectWeighted     = "weighted"      // 按权重随机
+	ChannelSelectLeastLatency = "least_latency" // 选择首字时间和成功率综合最优的渠道
+	ChannelSelectPowerOfTwo   = "p2c"           // 按权重随机抽取两个渠道，选择负载更低的一个
+)
+
+// ChannelSelectSetting 控制同一优先级内的渠道选择策略
+type ChannelSelectSetting struct {
+	DefaultStrategy string            `json:"default_strategy"`
+	GroupStrategies map[string]string `json:"group_strategies"` // 分组 -> 策略，未配置的分组使用默认策略
+	EwmaAlpha       float64           `json:"ewma_alpha"`       // 首字时间和成功率的指数加权平滑系数
+	ExploreRatio    float64           `json:"explore_ratio"`    // least_latency 策略按权重随机选择的比例，让其他渠道的统计保持更新
+	MinSamples      int               `json:"min_samples"`      // 样本数不足的渠道优先被选择以积累统计
+}
+
+// 默认配置
+var channelSelectSetting = ChannelSelectSetting{
+	DefaultStrategy: ChannelSelectWeighted,
+	GroupStrategies: map[string]string{},
+	EwmaAlpha:       0.2,
+	ExploreRatio:    0.05,
+	MinSamples:      5,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("channel_select_setting", &channelSelectSetting)
+}
+
+func GetChannelSelectSetting() *ChannelSelectSetting {
+	return &channelSelectSetting
+}
+
+// GetGroupChannelSelectStrategy 返回分组使用的渠道选择策略
+func GetGroupChannelSelectStrategy(group string) string {
+	strategy, ok := channelSelectSetting.GroupStrategies[group]
+	if !ok || strategy == "" {
+		strategy = channelSelectSetting.DefaultStrategy
+	}
+	switch strategy {
+	case ChannelSelectLeastLatency, ChannelSelectPowerOfTwo:
+		return strategy
+	}
+	return ChannelSelectWeighted
+}
@@ -0,0 +1,32 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// CircuitBreakerSetting 渠道熔断配置，渠道和渠道上的每个模型各有一个熔断器。
+// 默认关闭，升级后路由行为不变，需要在运营设置中开启。开启后请求失败和测速超时只触发熔断，
+// 熔断器在冷却后自动半开试探并恢复，不再禁用渠道；密钥无效、余额不足等永久错误仍然直接禁用渠道
+type CircuitBreakerSetting struct {
+	Enabled          bool `json:"enabled"`
+	FailureThreshold int  `json:"failure_threshold"`  // 统计窗口内失败达到该次数后熔断
+	WindowSeconds    int  `json:"window_seconds"`     // 失败次数的统计窗口
+	CooldownSeconds  int  `json:"cooldown_seconds"`   // 熔断后经过该时间进入半开状态
+	HalfOpenRequests int  `json:"half_open_requests"` // 半开状态下放行的试探请求数，全部成功后恢复
+}
+
+// 默认配置
+var circuitBreakerSetting = CircuitBreakerSetting{
+	Enabled:          false,
+	FailureThreshold: 5,
+	WindowSeconds:    60,
+	CooldownSeconds:  30,
+	HalfOpenRequests: 3,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("circuit_breaker_setting", &circuitBreakerSetting)
+}
+
+func GetCircuitBreakerSetting() *CircuitBreakerSetting {
+	return &circuitBreakerSetting
+}
@@ -0,0 +1,59 @@
+package operation_setting
+
+import (
+	"strings"
+	"veloera/setting/config"
+)
+
+// FineTuningSetting 控制 /v1/fine_tuning/jobs 的透传以及微调模型的计费
+type FineTuningSetting struct {
+	Enabled             bool    `json:"enabled"`
+	FineTunedModelRatio float64 `json:"fine_tuned_model_ratio"` // 微调模型未单独设置倍率或价格时，按基础模型的倍率或价格乘以该倍率计费
+	PollIntervalSeconds int     `json:"poll_interval_seconds"`  // 轮询未结束任务状态的间隔
+}
+
+// 默认配置
+var fineTuningSetting = FineTuningSetting{
+	Enabled:             true,
+	FineTunedModelRatio: 2,
+	PollIntervalSeconds: 60,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("fine_tuning_setting", &fineTuningSetting)
+}
+
+func GetFineTuningSetting() *FineTuningSetting {
+	return &fineTuningSetting
+}
+
+// GetFineTunedBaseModel 解析微调模型 ft:{base}:{org}:{suffix}:{id} 的基础模型
+func GetFineTunedBaseModel(name string) (string, bool) {
+	if !strings.HasPrefix(name, "ft:") {
+		return "", false
+	}
+	parts := strings.Split(name, ":")
+	if len(parts) < 2 || parts[1] == "" {
+		return "", false
+	}
+	return parts[1], true
+}
+
+// GetFineTunedModelRatio 微调模型没有单独设置倍率或价格时，返回用于计费的基础模型和微调倍率
+func GetFineTunedModelRatio(name string) (string, float64, bool) {
+	baseModel, ok := GetFineTunedBaseModel(name)
+	if !ok {
+		return "", 0, false
+	}
+	if _, ok := GetModelPrice(name, false); ok {
+		return "", 0, false
+	}
+	modelRatioMapMutex.RLock()
+	_, ok = modelRatioMap[name]
+	modelRatioMapMutex.RUnlock()
+	if ok {
+		return "", 0, false
+	}
+	return baseModel, fineTuningSetting.FineTunedModelRatio, true
+}
@@ -0,0 +1,34 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// HedgingSetting 对冲请求：首个渠道超过阈值仍未返回首字时，在另一个渠道上同时发起请求，先返回的一方获胜
+type HedgingSetting struct {
+	Groups  []string `json:"groups"`   // 启用对冲的分组，令牌也可以单独启用
+	DelayMs int      `json:"delay_ms"` // 首个渠道等待首字的阈值
+}
+
+// 默认配置
+var hedgingSetting = HedgingSetting{
+	Groups:  []string{},
+	DelayMs: 2000,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("hedging_setting", &hedgingSetting)
+}
+
+func GetHedgingSetting() *HedgingSetting {
+	return &hedgingSetting
+}
+
+// IsHedgingGroup 分组是否启用了对冲请求
+func IsHedgingGroup(group string) bool {
+	for _, g := range hedgingSetting.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
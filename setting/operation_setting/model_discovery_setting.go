@@ -0,0 +1,35 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// 上游模型变化的处理策略
+const (
+	ModelDiscoveryPolicyAuto    = "auto"    // 自动更新渠道的模型列表
+	ModelDiscoveryPolicyApprove = "approve" // 等待管理员审核
+	ModelDiscoveryPolicyIgnore  = "ignore"  // 忽略
+)
+
+// ModelDiscoverySetting 定期获取渠道上游的模型列表，与渠道的模型列表比较新增和下线的模型
+type ModelDiscoverySetting struct {
+	Enabled         bool   `json:"enabled"`
+	IntervalMinutes int    `json:"interval_minutes"` // 两次检查之间的间隔
+	AddPolicy       string `json:"add_policy"`       // 渠道未单独设置时，上游新增模型的处理策略
+	RemovePolicy    string `json:"remove_policy"`    // 渠道未单独设置时，上游下线模型的处理策略
+}
+
+// 默认配置
+var modelDiscoverySetting = ModelDiscoverySetting{
+	Enabled:         false,
+	IntervalMinutes: 360,
+	AddPolicy:       ModelDiscoveryPolicyApprove,
+	RemovePolicy:    ModelDiscoveryPolicyApprove,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("model_discovery_setting", &modelDiscoverySetting)
+}
+
+func GetModelDiscoverySetting() *ModelDiscoverySetting {
+	return &modelDiscoverySetting
+}
@@ -0,0 +1,30 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// PromptCacheAffinitySetting 将前缀相同的请求固定到同一渠道和 key，以命中上游的提示词缓存
+type PromptCacheAffinitySetting struct {
+	Enabled        bool   `json:"enabled"`
+	PrefixMessages int    `json:"prefix_messages"` // 系统提示词之后参与计算的消息数
+	TTLSeconds     int    `json:"ttl_seconds"`     // 绑定关系在最后一次成功请求后保留的时间
+	SessionHeader  string `json:"session_header"`  // 客户端显式指定会话的请求头，优先于前缀计算
+	UseUserField   bool   `json:"use_user_field"`  // 使用请求体中的 user 字段作为会话标识
+}
+
+// 默认配置
+var promptCacheAffinitySetting = PromptCacheAffinitySetting{
+	Enabled:        false,
+	PrefixMessages: 1,
+	TTLSeconds:     300,
+	SessionHeader:  "X-Session-Id",
+	UseUserField:   true,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("prompt_cache_affinity_setting", &promptCacheAffinitySetting)
+}
+
+func GetPromptCacheAffinitySetting() *PromptCacheAffinitySetting {
+	return &promptCacheAffinitySetting
+}
@@ -0,0 +1,26 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// ResponsesSetting 控制 /v1/responses 响应的本地保存
+type ResponsesSetting struct {
+	StoreEnabled  bool `json:"store_enabled"`
+	RetentionDays int  `json:"retention_days"` // 0 表示永久保存
+	TokenScoped   bool `json:"token_scoped"`   // 保存的响应只能通过创建它的令牌访问，关闭时同一用户的令牌之间共享
+}
+
+// 默认配置
+var responsesSetting = ResponsesSetting{
+	StoreEnabled:  true,
+	RetentionDays: 30,
+	TokenScoped:   true,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("responses_setting", &responsesSetting)
+}
+
+func GetResponsesSetting() *ResponsesSetting {
+	return &responsesSetting
+}
@@ -0,0 +1,66 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// ShadowTrafficRule 影子流量规则，按比例把匹配的请求复制一份发给影子渠道，影子请求不影响客户端也不向用户计费
+type ShadowTrafficRule struct {
+	Name            string   `json:"name"`
+	ChannelId       int      `json:"channel_id"`       // 接收影子请求的渠道
+	Model           string   `json:"model"`            // 影子请求使用的模型，为空时与原请求相同
+	Percentage      float64  `json:"percentage"`       // 复制的请求比例，0-100
+	Groups          []string `json:"groups"`           // 匹配的分组，为空时匹配所有分组
+	Models          []string `json:"models"`           // 匹配的模型，为空时匹配所有模型
+	CompareResponse bool     `json:"compare_response"` // 计算影子响应与原响应的相似度
+}
+
+// ShadowTrafficSetting 影子流量，用于在切换流量前评估新的渠道和模型
+type ShadowTrafficSetting struct {
+	Enabled        bool                `json:"enabled"`
+	MaxConcurrency int                 `json:"max_concurrency"` // 同时进行的影子请求数上限，超过时不再复制
+	Rules          []ShadowTrafficRule `json:"rules"`
+}
+
+// 默认配置
+var shadowTrafficSetting = ShadowTrafficSetting{
+	Enabled:        false,
+	MaxConcurrency: 10,
+	Rules:          []ShadowTrafficRule{},
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("shadow_traffic_setting", &shadowTrafficSetting)
+}
+
+func GetShadowTrafficSetting() *ShadowTrafficSetting {
+	return &shadowTrafficSetting
+}
+
+func matchShadowTrafficValue(values []string, value string) bool {
+	if len(values) == 0 {
+		return true
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// MatchShadowTrafficRules 返回匹配分组和模型的影子流量规则，比例抽样由调用方进行
+func MatchShadowTrafficRules(group string, model string) []ShadowTrafficRule {
+	if !shadowTrafficSetting.Enabled {
+		return nil
+	}
+	var rules []ShadowTrafficRule
+	for _, rule := range shadowTrafficSetting.Rules {
+		if rule.ChannelId == 0 || rule.Percentage <= 0 {
+			continue
+		}
+		if matchShadowTrafficValue(rule.Groups, group) && matchShadowTrafficValue(rule.Models, model) {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
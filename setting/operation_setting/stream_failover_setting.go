@@ -0,0 +1,26 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// StreamFailoverSetting 流式响应中途中断时，把已输出的内容作为续写请求发给另一个渠道，并把新的内容接在同一个流中
+type StreamFailoverSetting struct {
+	Enabled            bool   `json:"enabled"`
+	MaxContinuations   int    `json:"max_continuations"`   // 一个请求最多续写的次数
+	ContinuationPrompt string `json:"continuation_prompt"` // 附在已输出内容之后的续写指令，为空时只附加已输出的内容
+}
+
+// 默认配置
+var streamFailoverSetting = StreamFailoverSetting{
+	Enabled:            false,
+	MaxContinuations:   1,
+	ContinuationPrompt: "Your previous response was interrupted. Continue it exactly from where it stopped, without repeating any of it or adding any preface.",
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("stream_failover_setting", &streamFailoverSetting)
+}
+
+func GetStreamFailoverSetting() *StreamFailoverSetting {
+	return &streamFailoverSetting
+}
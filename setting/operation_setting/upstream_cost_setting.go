@@ -0,0 +1,28 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// UpstreamCostSetting 上游成本和毛利告警
+type UpstreamCostSetting struct {
+	DefaultMultiplier          float64 `json:"default_multiplier"`            // 渠道未设置成本时，上游成本为按模型倍率计算的额度乘以该值
+	MarginAlertEnabled         bool    `json:"margin_alert_enabled"`          // 模型毛利为负时通知管理员
+	MarginAlertWindowHours     int     `json:"margin_alert_window_hours"`     // 统计最近多少小时的毛利
+	MarginAlertIntervalMinutes int     `json:"margin_alert_interval_minutes"` // 两次检查之间的间隔
+}
+
+// 默认配置
+var upstreamCostSetting = UpstreamCostSetting{
+	DefaultMultiplier:          1,
+	MarginAlertEnabled:         false,
+	MarginAlertWindowHours:     24,
+	MarginAlertIntervalMinutes: 60,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("upstream_cost_setting", &upstreamCostSetting)
+}
+
+func GetUpstreamCostSetting() *UpstreamCostSetting {
+	return &upstreamCostSetting
+}
@@ -0,0 +1,26 @@
+package operation_setting
+
+import "veloera/setting/config"
+
+// UpstreamRateLimitSetting 根据上游返回的限流响应头调整渠道选择
+type UpstreamRateLimitSetting struct {
+	Enabled            bool    `json:"enabled"`
+	LowRemainingRatio  float64 `json:"low_remaining_ratio"`  // 剩余请求数或 token 数低于上限的该比例时降低渠道优先级
+	MaxCooldownSeconds int     `json:"max_cooldown_seconds"` // 429 后按 retry-after 暂停使用的最长时间
+}
+
+// 默认配置
+var upstreamRateLimitSetting = UpstreamRateLimitSetting{
+	Enabled:            true,
+	LowRemainingRatio:  0.05,
+	MaxCooldownSeconds: 300,
+}
+
+func init() {
+	// 注册到全局配置管理器
+	config.GlobalConfig.Register("upstream_rate_limit_setting", &upstreamRateLimitSetting)
+}
+
+func GetUpstreamRateLimitSetting() *UpstreamRateLimitSetting {
+	return &upstreamRateLimitSetting
+}